@@ -39,12 +39,52 @@ type ZitadelConfig struct {
 
 // Config represents the overall configuration structure
 type Config struct {
-	Databases   []Database    `mapstructure:"databases"`
-	Zitadel     ZitadelConfig `mapstructure:"zitadel"`
-	Env         string        `mapstructure:"env"`
-	TimeZone    string        `mapstructure:"timezone"`
-	UploadsPath string        `mapstructure:"uploads_path"`
-	Payment     PaymentConfig `mapstructure:"payment"`
+	Databases   []Database      `mapstructure:"databases"`
+	Zitadel     ZitadelConfig   `mapstructure:"zitadel"`
+	Env         string          `mapstructure:"env"`
+	TimeZone    string          `mapstructure:"timezone"`
+	UploadsPath string          `mapstructure:"uploads_path"`
+	Payment     PaymentConfig   `mapstructure:"payment"`
+	Workflows   WorkflowsConfig `mapstructure:"workflows"`
+	Secrets     SecretsConfig   `mapstructure:"secrets"`
+	Smtp        SmtpConfig      `mapstructure:"smtp"`
+}
+
+// WorkflowsConfig holds the configuration of the workflows engine
+type WorkflowsConfig struct {
+	RunsRetentionDays int `mapstructure:"runs_retention_days"` // Runs older than this are deleted, defaults to 30 days
+	Workers           int `mapstructure:"workers"`             // Runs executed at once across tenants, defaults to 8
+	TenantConcurrency int `mapstructure:"tenant_concurrency"`  // Runs executed at once for a tenant, defaults to 2
+	QueueSize         int `mapstructure:"queue_size"`          // Runs waiting across tenants before new ones are rejected, defaults to 1000
+	TenantQueueSize   int `mapstructure:"tenant_queue_size"`   // Runs waiting for a tenant before its new ones are rejected, defaults to 200
+	// DeadLettersRetentionDays is how long the dead letters are kept, they outlive their runs so they can
+	// still be redriven, defaults to 90 days
+	DeadLettersRetentionDays int `mapstructure:"dead_letters_retention_days"`
+	// ApprovalURL is the frontend page approvers decide on, linked from the approval emails. {id} is replaced
+	// by the id of the approval, e.g. https://app.example.com/workflows/approvals/{id}
+	ApprovalURL string `mapstructure:"approval_url"`
+}
+
+// SecretsConfig holds the master keys encrypting the tenants data keys, which encrypt the secret env vars.
+// Keys are base64 encoded 32 bytes, the master key can also be set with the SECRETS_MASTER_KEY env var.
+// A replaced master key is moved to PreviousMasterKeys until the data keys are rotated.
+type SecretsConfig struct {
+	MasterKey          string   `mapstructure:"master_key"`
+	PreviousMasterKeys []string `mapstructure:"previous_master_keys"`
+}
+
+// SmtpConfig holds the SMTP server the send email action delivers through, TLS is either
+// starttls (default), tls for implicit TLS (usually port 465) or none for local test servers.
+// The password can also be set with the SMTP_PASSWORD env var.
+type SmtpConfig struct {
+	Host        string `mapstructure:"host"`
+	Port        int    `mapstructure:"port"`
+	Username    string `mapstructure:"username"`
+	Password    string `mapstructure:"password"`
+	TLS         string `mapstructure:"tls"`
+	FromAddress string `mapstructure:"from_address"` // Sender address of every tenant, tenants set their own sender name and reply-to
+	FromName    string `mapstructure:"from_name"`
+	Timeout     int    `mapstructure:"timeout"` // Seconds, defaults to 30
 }
 
 // PaymentConfig holds the configuration for payment
@@ -88,6 +88,11 @@ func (vc *ViperConfig) GetConfig() (Config, error) {
 	config.Databases = databases
 	config.Zitadel.Domain = zitadel_domain
 	config.Zitadel.Port = zitadel_port
+	config.Secrets.MasterKey = vc.v.GetString("secrets.master_key")
+	config.Secrets.PreviousMasterKeys = vc.v.GetStringSlice("secrets.previous_master_keys")
+	config.Smtp.Host = vc.v.GetString("smtp.host")
+	config.Smtp.Username = vc.v.GetString("smtp.username")
+	config.Smtp.Password = vc.v.GetString("smtp.password")
 
 	return config, nil
 }
@@ -0,0 +1,657 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Expression is a parsed boolean expression evaluated against a json like payload.
+//
+// Expressions compare paths into the payload with literals or other paths, e.g.
+// `order.sale_price > 500`, `label == "branch:downtown" && !(items[0].quantity >= 2)`.
+// Supported operators are == != < <= > >= contains, && (and), || (or) and ! (not).
+// A path segment suffixed with [] iterates over an array, `items[].quantity < 2` is
+// true when any of the items matches, and is used by filters to select the matching items.
+type Expression struct {
+	Source string
+	root   expressionNode
+}
+
+type expressionNode interface {
+	eval(env *expressionEnv) (values []interface{}, err error)
+}
+
+// expressionEnv is the data an expression is evaluated against, when element is bound
+// the paths iterating over bound_path resolve against that element only.
+type expressionEnv struct {
+	data       interface{}
+	bound_path string
+	element    interface{}
+}
+
+type expressionToken struct {
+	kind  string
+	value string
+}
+
+const (
+	tokenPath     = "path"
+	tokenString   = "string"
+	tokenNumber   = "number"
+	tokenOperator = "operator"
+	tokenKeyword  = "keyword"
+)
+
+var expressionTokenRe = regexp.MustCompile(`^(?:(\s+)|("(?:[^"\\]|\\.)*"|'(?:[^'\\]|\\.)*')|(-?\d+(?:\.\d+)?)|(==|!=|<=|>=|&&|\|\||<|>|!|\(|\))|([A-Za-z_][A-Za-z0-9_]*(?:\[\d*\])?(?:\.[A-Za-z_][A-Za-z0-9_]*(?:\[\d*\])?)*))`)
+
+var pathSegmentRe = regexp.MustCompile(`^([A-Za-z_][A-Za-z0-9_]*)(?:\[(\d*)\])?$`)
+
+// ParseExpression parses the expression source.
+func ParseExpression(source string) (expression *Expression, err error) {
+
+	tokens := make([]expressionToken, 0)
+	rest := strings.TrimSpace(source)
+
+	if rest == "" {
+		return nil, fmt.Errorf("expression is empty")
+	}
+
+	for len(rest) > 0 {
+		match := expressionTokenRe.FindStringSubmatch(rest)
+		if match == nil {
+			return nil, fmt.Errorf("unexpected character at %q", rest)
+		}
+
+		switch {
+		case match[1] != "":
+		case match[2] != "":
+			unquoted := match[2][1 : len(match[2])-1]
+			unquoted = strings.ReplaceAll(unquoted, `\"`, `"`)
+			unquoted = strings.ReplaceAll(unquoted, `\'`, `'`)
+			tokens = append(tokens, expressionToken{kind: tokenString, value: unquoted})
+		case match[3] != "":
+			tokens = append(tokens, expressionToken{kind: tokenNumber, value: match[3]})
+		case match[4] != "":
+			tokens = append(tokens, expressionToken{kind: tokenOperator, value: match[4]})
+		case match[5] != "":
+			switch match[5] {
+			case "true", "false", "null", "and", "or", "not", "contains":
+				tokens = append(tokens, expressionToken{kind: tokenKeyword, value: match[5]})
+			default:
+				tokens = append(tokens, expressionToken{kind: tokenPath, value: match[5]})
+			}
+		}
+
+		rest = rest[len(match[0]):]
+	}
+
+	parser := &expressionParser{tokens: tokens}
+
+	root, err := parser.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	if parser.position < len(tokens) {
+		return nil, fmt.Errorf("unexpected %q", tokens[parser.position].value)
+	}
+
+	return &Expression{Source: source, root: root}, nil
+}
+
+// Evaluate reports whether the expression holds for data.
+func (e *Expression) Evaluate(data interface{}) (bool, error) {
+	return e.evaluate(&expressionEnv{data: normalizeExpressionData(data)})
+}
+
+// IterablePath returns the array path the expression iterates over (e.g. "items[]" for `items[].quantity < 2`),
+// it is empty when the expression doesn't iterate over any array.
+func (e *Expression) IterablePath() string {
+	var found string
+	walkExpression(e.root, func(p *pathNode) {
+		if found == "" {
+			found = p.iterablePrefix()
+		}
+	})
+	return found
+}
+
+// Filter returns a copy of data where the array at the iterable path of the expression only keeps
+// the elements the expression holds for, alongside the number of elements before and after filtering.
+func (e *Expression) Filter(data interface{}) (filtered interface{}, total int, kept int, err error) {
+
+	iterable := e.IterablePath()
+	if iterable == "" {
+		return nil, 0, 0, fmt.Errorf("expression %s doesn't iterate over an array", e.Source)
+	}
+
+	filtered = normalizeExpressionData(data)
+
+	segments := strings.Split(strings.TrimSuffix(iterable, "[]"), ".")
+
+	var container interface{} = filtered
+	for _, segment := range segments[:len(segments)-1] {
+		p, _ := parsePathSegment(segment)
+		container = p.resolve(container)
+	}
+
+	last, _ := parsePathSegment(segments[len(segments)-1])
+	object, ok := container.(map[string]interface{})
+	if !ok {
+		return nil, 0, 0, fmt.Errorf("%s is not an array", iterable)
+	}
+
+	var elements []interface{}
+	if last.index >= 0 {
+		elements, ok = last.resolve(container).([]interface{})
+	} else {
+		elements, ok = object[last.name].([]interface{})
+	}
+	if !ok {
+		return nil, 0, 0, fmt.Errorf("%s is not an array", iterable)
+	}
+
+	matching := make([]interface{}, 0)
+	for _, element := range elements {
+		holds, err := e.evaluate(&expressionEnv{data: filtered, bound_path: iterable, element: element})
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		if holds {
+			matching = append(matching, element)
+		}
+	}
+
+	if last.index >= 0 {
+		if parent, ok := object[last.name].([]interface{}); ok && last.index < len(parent) {
+			parent[last.index] = matching
+		}
+	} else {
+		object[last.name] = matching
+	}
+
+	return filtered, len(elements), len(matching), nil
+}
+
+func (e *Expression) evaluate(env *expressionEnv) (bool, error) {
+	values, err := e.root.eval(env)
+	if err != nil {
+		return false, err
+	}
+	return anyTruthy(values), nil
+}
+
+// normalizeExpressionData converts data into its generic json representation (maps, slices, float64, string, bool).
+func normalizeExpressionData(data interface{}) interface{} {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return data
+	}
+	var generic interface{}
+	if err := json.Unmarshal(b, &generic); err != nil {
+		return data
+	}
+	return generic
+}
+
+type expressionParser struct {
+	tokens   []expressionToken
+	position int
+}
+
+func (p *expressionParser) peek() *expressionToken {
+	if p.position >= len(p.tokens) {
+		return nil
+	}
+	return &p.tokens[p.position]
+}
+
+func (p *expressionParser) accept(values ...string) bool {
+	token := p.peek()
+	if token == nil || (token.kind != tokenOperator && token.kind != tokenKeyword) {
+		return false
+	}
+	for _, value := range values {
+		if token.value == value {
+			p.position++
+			return true
+		}
+	}
+	return false
+}
+
+func (p *expressionParser) parseOr() (expressionNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("||", "or") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &logicalNode{operator: "||", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *expressionParser) parseAnd() (expressionNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("&&", "and") {
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &logicalNode{operator: "&&", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *expressionParser) parseUnary() (expressionNode, error) {
+	if p.accept("!", "not") {
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{operand: operand}, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *expressionParser) parseComparison() (expressionNode, error) {
+	left, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+
+	token := p.peek()
+	if token != nil && (token.kind == tokenOperator || token.kind == tokenKeyword) {
+		switch token.value {
+		case "==", "!=", "<", "<=", ">", ">=", "contains":
+			p.position++
+			right, err := p.parsePrimary()
+			if err != nil {
+				return nil, err
+			}
+			return &comparisonNode{operator: token.value, left: left, right: right}, nil
+		}
+	}
+
+	return left, nil
+}
+
+func (p *expressionParser) parsePrimary() (expressionNode, error) {
+	token := p.peek()
+	if token == nil {
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+
+	p.position++
+
+	switch token.kind {
+	case tokenString:
+		return &literalNode{value: token.value}, nil
+	case tokenNumber:
+		number, err := strconv.ParseFloat(token.value, 64)
+		if err != nil {
+			return nil, err
+		}
+		return &literalNode{value: number}, nil
+	case tokenPath:
+		return parsePath(token.value)
+	case tokenKeyword:
+		switch token.value {
+		case "true":
+			return &literalNode{value: true}, nil
+		case "false":
+			return &literalNode{value: false}, nil
+		case "null":
+			return &literalNode{value: nil}, nil
+		}
+	case tokenOperator:
+		if token.value == "(" {
+			node, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			if !p.accept(")") {
+				return nil, fmt.Errorf("missing closing parenthesis")
+			}
+			return node, nil
+		}
+	}
+
+	return nil, fmt.Errorf("unexpected %q", token.value)
+}
+
+type literalNode struct {
+	value interface{}
+}
+
+func (n *literalNode) eval(env *expressionEnv) ([]interface{}, error) {
+	return []interface{}{n.value}, nil
+}
+
+type pathSegment struct {
+	name     string
+	index    int
+	iterates bool
+}
+
+func parsePathSegment(segment string) (pathSegment, error) {
+	match := pathSegmentRe.FindStringSubmatch(segment)
+	if match == nil {
+		return pathSegment{}, fmt.Errorf("invalid path segment %s", segment)
+	}
+
+	p := pathSegment{name: match[1], index: -1}
+	if strings.HasSuffix(segment, "[]") {
+		p.iterates = true
+	} else if match[2] != "" {
+		p.index, _ = strconv.Atoi(match[2])
+	}
+
+	return p, nil
+}
+
+// resolve returns the value of the segment in value, arrays are returned as is for iterating segments.
+func (s pathSegment) resolve(value interface{}) interface{} {
+	object, ok := value.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+
+	child := object[s.name]
+	if s.index >= 0 {
+		list, ok := child.([]interface{})
+		if !ok || s.index >= len(list) {
+			return nil
+		}
+		return list[s.index]
+	}
+
+	return child
+}
+
+type pathNode struct {
+	source   string
+	segments []pathSegment
+}
+
+func parsePath(source string) (*pathNode, error) {
+	node := &pathNode{source: source}
+	for _, segment := range strings.Split(source, ".") {
+		p, err := parsePathSegment(segment)
+		if err != nil {
+			return nil, err
+		}
+		node.segments = append(node.segments, p)
+	}
+	return node, nil
+}
+
+// iterablePrefix returns the path up to and including its first iterating segment.
+func (n *pathNode) iterablePrefix() string {
+	parts := make([]string, 0)
+	for _, segment := range n.segments {
+		if segment.iterates {
+			parts = append(parts, segment.name+"[]")
+			return strings.Join(parts, ".")
+		}
+		if segment.index >= 0 {
+			parts = append(parts, fmt.Sprintf("%s[%d]", segment.name, segment.index))
+		} else {
+			parts = append(parts, segment.name)
+		}
+	}
+	return ""
+}
+
+func (n *pathNode) eval(env *expressionEnv) ([]interface{}, error) {
+
+	values := []interface{}{env.data}
+	segments := n.segments
+
+	if env.bound_path != "" && n.iterablePrefix() == env.bound_path {
+		for i, segment := range segments {
+			if segment.iterates {
+				segments = segments[i+1:]
+				break
+			}
+		}
+		values = []interface{}{env.element}
+	}
+
+	for _, segment := range segments {
+		next := make([]interface{}, 0, len(values))
+		for _, value := range values {
+			resolved := segment.resolve(value)
+			if segment.iterates {
+				if list, ok := resolved.([]interface{}); ok {
+					next = append(next, list...)
+				}
+				continue
+			}
+			next = append(next, resolved)
+		}
+		values = next
+	}
+
+	return values, nil
+}
+
+type comparisonNode struct {
+	operator string
+	left     expressionNode
+	right    expressionNode
+}
+
+func (n *comparisonNode) eval(env *expressionEnv) ([]interface{}, error) {
+	lefts, err := n.left.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	rights, err := n.right.eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, left := range lefts {
+		for _, right := range rights {
+			holds, err := compareValues(n.operator, left, right)
+			if err != nil {
+				return nil, err
+			}
+			if holds {
+				return []interface{}{true}, nil
+			}
+		}
+	}
+
+	return []interface{}{false}, nil
+}
+
+type logicalNode struct {
+	operator string
+	left     expressionNode
+	right    expressionNode
+}
+
+func (n *logicalNode) eval(env *expressionEnv) ([]interface{}, error) {
+	lefts, err := n.left.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	left := anyTruthy(lefts)
+
+	if n.operator == "&&" && !left {
+		return []interface{}{false}, nil
+	}
+	if n.operator == "||" && left {
+		return []interface{}{true}, nil
+	}
+
+	rights, err := n.right.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	return []interface{}{anyTruthy(rights)}, nil
+}
+
+type notNode struct {
+	operand expressionNode
+}
+
+func (n *notNode) eval(env *expressionEnv) ([]interface{}, error) {
+	values, err := n.operand.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	return []interface{}{!anyTruthy(values)}, nil
+}
+
+func walkExpression(node expressionNode, visit func(p *pathNode)) {
+	switch n := node.(type) {
+	case *pathNode:
+		visit(n)
+	case *comparisonNode:
+		walkExpression(n.left, visit)
+		walkExpression(n.right, visit)
+	case *logicalNode:
+		walkExpression(n.left, visit)
+		walkExpression(n.right, visit)
+	case *notNode:
+		walkExpression(n.operand, visit)
+	}
+}
+
+func anyTruthy(values []interface{}) bool {
+	for _, value := range values {
+		if truthy(value) {
+			return true
+		}
+	}
+	return false
+}
+
+func truthy(value interface{}) bool {
+	switch v := value.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case float64:
+		return v != 0
+	case string:
+		return v != ""
+	case []interface{}:
+		return len(v) > 0
+	case map[string]interface{}:
+		return len(v) > 0
+	}
+	return true
+}
+
+func toNumber(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+func compareValues(operator string, left interface{}, right interface{}) (bool, error) {
+
+	if operator == "contains" {
+		switch l := left.(type) {
+		case string:
+			return strings.Contains(l, fmt.Sprint(right)), nil
+		case []interface{}:
+			for _, element := range l {
+				if equal, _ := compareValues("==", element, right); equal {
+					return true, nil
+				}
+			}
+		}
+		return false, nil
+	}
+
+	if operator == "==" || operator == "!=" {
+		equal := false
+		_, left_is_string := left.(string)
+		_, right_is_string := right.(string)
+		left_number, left_ok := toNumber(left)
+		right_number, right_ok := toNumber(right)
+
+		switch {
+		case left == nil || right == nil:
+			equal = left == nil && right == nil
+		case left_ok && right_ok && !(left_is_string && right_is_string):
+			equal = left_number == right_number
+		default:
+			equal = fmt.Sprint(left) == fmt.Sprint(right)
+		}
+
+		if operator == "==" {
+			return equal, nil
+		}
+		return !equal, nil
+	}
+
+	if left == nil || right == nil {
+		return false, nil
+	}
+
+	left_number, left_ok := toNumber(left)
+	right_number, right_ok := toNumber(right)
+
+	if left_ok && right_ok {
+		switch operator {
+		case "<":
+			return left_number < right_number, nil
+		case "<=":
+			return left_number <= right_number, nil
+		case ">":
+			return left_number > right_number, nil
+		case ">=":
+			return left_number >= right_number, nil
+		}
+	}
+
+	left_string, left_is_string := left.(string)
+	right_string, right_is_string := right.(string)
+	if left_is_string && right_is_string {
+		switch operator {
+		case "<":
+			return left_string < right_string, nil
+		case "<=":
+			return left_string <= right_string, nil
+		case ">":
+			return left_string > right_string, nil
+		case ">=":
+			return left_string >= right_string, nil
+		}
+	}
+
+	return false, nil
+}
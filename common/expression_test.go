@@ -0,0 +1,281 @@
+package common
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExpressionPrecedence(t *testing.T) {
+
+	data := map[string]interface{}{
+		"yes":   true,
+		"no":    false,
+		"total": 150,
+		"label": "branch:downtown",
+	}
+
+	tests := []struct {
+		name     string
+		source   string
+		expected bool
+	}{
+		{"and before or", "yes || no && no", true},
+		{"and before or on the left", "no && no || yes", true},
+		{"parentheses override", "(yes || no) && no", false},
+		{"not binds tighter than and", "!no && yes", true},
+		{"not binds tighter than or", "!yes || yes", true},
+		{"not applies to the comparison", "!total > 100", false},
+		{"not on parentheses", "!(yes && no)", true},
+		{"double not", "!!yes", true},
+		{"comparison before and", "total > 100 && label == \"branch:downtown\"", true},
+		{"comparison before or", "total < 100 || label contains \"down\"", true},
+		{"keywords", "not no and (no or yes)", true},
+		{"left associative and", "yes && yes && no", false},
+		{"left associative or", "no || no || yes", true},
+		{"nested parentheses", "((yes && (no || yes)) && !(no))", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			expression, err := ParseExpression(test.source)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			holds, err := expression.Evaluate(data)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if holds != test.expected {
+				t.Errorf("expected %v, got %v", test.expected, holds)
+			}
+		})
+	}
+}
+
+func TestExpressionComparisons(t *testing.T) {
+
+	data := map[string]interface{}{
+		"order": map[string]interface{}{
+			"sale_price": 500,
+			"code":       "042",
+			"label":      "branch:downtown",
+			"tags":       []interface{}{"vip", "takeaway"},
+			"discount":   nil,
+		},
+		"items": []interface{}{
+			map[string]interface{}{"name": "Falafel", "quantity": 2},
+			map[string]interface{}{"name": "Tea", "quantity": 1},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		source   string
+		expected bool
+	}{
+		{"equal number", "order.sale_price == 500", true},
+		{"greater or equal", "order.sale_price >= 500", true},
+		{"strictly greater", "order.sale_price > 500", false},
+		{"number and numeric string", "order.sale_price == \"500\"", true},
+		{"strings compared as text", "order.code == \"42\"", false},
+		{"numeric string to number", "order.code == 42", true},
+		{"not equal", "order.label != \"branch:uptown\"", true},
+		{"string contains", "order.label contains \"down\"", true},
+		{"array contains", "order.tags contains \"vip\"", true},
+		{"array doesn't contain", "order.tags contains \"delivery\"", false},
+		{"null equal", "order.discount == null", true},
+		{"missing is null", "order.missing == null", true},
+		{"null isn't ordered", "order.discount < 1", false},
+		{"string ordering", "order.label > \"a\"", true},
+		{"indexed element", "items[1].name == \"Tea\"", true},
+		{"any element matches", "items[].quantity < 2", true},
+		{"no element matches", "items[].quantity > 5", false},
+		{"truthy path", "order.tags", true},
+		{"falsy path", "order.discount", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			expression, err := ParseExpression(test.source)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			holds, err := expression.Evaluate(data)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if holds != test.expected {
+				t.Errorf("expected %v, got %v", test.expected, holds)
+			}
+		})
+	}
+}
+
+func TestExpressionFilter(t *testing.T) {
+
+	order := func() map[string]interface{} {
+		return map[string]interface{}{
+			"order_id": "A1",
+			"items": []interface{}{
+				map[string]interface{}{"name": "Falafel", "quantity": 2, "category": "food"},
+				map[string]interface{}{"name": "Tea", "quantity": 1, "category": "drinks"},
+				map[string]interface{}{"name": "Koshary", "quantity": 3, "category": "food"},
+			},
+			"branches": []interface{}{
+				map[string]interface{}{"items": []interface{}{
+					map[string]interface{}{"name": "Water", "quantity": 5},
+					map[string]interface{}{"name": "Juice", "quantity": 1},
+				}},
+			},
+		}
+	}
+
+	tests := []struct {
+		name     string
+		source   string
+		iterable string
+		path     func(filtered map[string]interface{}) interface{}
+		expected []string
+		total    int
+	}{
+		{
+			name:     "single condition",
+			source:   "items[].quantity >= 2",
+			iterable: "items[]",
+			path:     func(f map[string]interface{}) interface{} { return f["items"] },
+			expected: []string{"Falafel", "Koshary"},
+			total:    3,
+		},
+		{
+			name:     "combined conditions",
+			source:   "items[].category == \"food\" && items[].quantity < 3",
+			iterable: "items[]",
+			path:     func(f map[string]interface{}) interface{} { return f["items"] },
+			expected: []string{"Falafel"},
+			total:    3,
+		},
+		{
+			name:     "condition outside the array applies to every element",
+			source:   "items[].quantity == 1 || order_id == \"B2\"",
+			iterable: "items[]",
+			path:     func(f map[string]interface{}) interface{} { return f["items"] },
+			expected: []string{"Tea"},
+			total:    3,
+		},
+		{
+			name:     "negated",
+			source:   "!(items[].category == \"food\")",
+			iterable: "items[]",
+			path:     func(f map[string]interface{}) interface{} { return f["items"] },
+			expected: []string{"Tea"},
+			total:    3,
+		},
+		{
+			name:     "no match",
+			source:   "items[].quantity > 10",
+			iterable: "items[]",
+			path:     func(f map[string]interface{}) interface{} { return f["items"] },
+			expected: []string{},
+			total:    3,
+		},
+		{
+			name:     "nested array",
+			source:   "branches[0].items[].quantity > 2",
+			iterable: "branches[0].items[]",
+			path: func(f map[string]interface{}) interface{} {
+				return f["branches"].([]interface{})[0].(map[string]interface{})["items"]
+			},
+			expected: []string{"Water"},
+			total:    2,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			expression, err := ParseExpression(test.source)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if iterable := expression.IterablePath(); iterable != test.iterable {
+				t.Errorf("expected the iterable path %q, got %q", test.iterable, iterable)
+			}
+
+			data := order()
+			filtered, total, kept, err := expression.Filter(data)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if total != test.total || kept != len(test.expected) {
+				t.Errorf("expected %d of %d kept, got %d of %d", len(test.expected), test.total, kept, total)
+			}
+
+			names := make([]string, 0)
+			for _, item := range test.path(filtered.(map[string]interface{})).([]interface{}) {
+				names = append(names, item.(map[string]interface{})["name"].(string))
+			}
+			if !reflect.DeepEqual(names, test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, names)
+			}
+
+			// the data given isn't modified
+			if len(data["items"].([]interface{})) != 3 {
+				t.Errorf("the data given was filtered in place")
+			}
+		})
+	}
+}
+
+func TestExpressionFilterErrors(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		source string
+		data   map[string]interface{}
+		err    string
+	}{
+		{"no iterable path", "order_id == \"A1\"", map[string]interface{}{"order_id": "A1"}, "doesn't iterate over an array"},
+		{"not an array", "items[].quantity > 1", map[string]interface{}{"items": "none"}, "items[] is not an array"},
+		{"missing array", "items[].quantity > 1", map[string]interface{}{}, "items[] is not an array"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			expression, err := ParseExpression(test.source)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			_, _, _, err = expression.Filter(test.data)
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("expected an error containing %q, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestParseExpressionErrors(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		source string
+		err    string
+	}{
+		{"empty", "  ", "expression is empty"},
+		{"unexpected character", "total # 2", "unexpected character"},
+		{"missing operand", "total >", "unexpected end of expression"},
+		{"missing closing parenthesis", "(total > 1", "missing closing parenthesis"},
+		{"trailing token", "total > 1 2", "unexpected \"2\""},
+		{"dangling operator", "total > 1 &&", "unexpected end of expression"},
+		{"operator as operand", "== 1", "unexpected \"==\""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := ParseExpression(test.source)
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("expected an error containing %q, got %v", test.err, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,365 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// JSONSchemaError is a value failing its JSON schema, Path locates it (e.g. items[0].quantity), it is empty for the root.
+type JSONSchemaError struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+func (e JSONSchemaError) Error() string {
+	if e.Path == "" {
+		return e.Message
+	}
+	return e.Path + ": " + e.Message
+}
+
+// ValidateJSONSchema validates the value against the JSON schema and returns every error found, the value
+// and schema are compared in their json representation. The validation keywords supported are type, enum, const,
+// required, properties, additionalProperties, items, min/maxItems, min/maxLength, pattern, minimum, maximum,
+// exclusiveMinimum, exclusiveMaximum, allOf, anyOf, oneOf and not, the others (such as format or $ref) are ignored.
+func ValidateJSONSchema(schema map[string]interface{}, value interface{}) []JSONSchemaError {
+
+	generic_schema, _ := normalizeExpressionData(schema).(map[string]interface{})
+
+	errors := make([]JSONSchemaError, 0)
+	validateJSONSchema(generic_schema, normalizeExpressionData(value), "", &errors)
+
+	return errors
+}
+
+// CheckJSONSchema checks the schema can be validated against, its patterns must compile and
+// its nested schemas must be objects.
+func CheckJSONSchema(schema map[string]interface{}) error {
+
+	generic_schema, ok := normalizeExpressionData(schema).(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("schema must be an object")
+	}
+
+	return checkJSONSchema(generic_schema, "")
+}
+
+// ParseJSONSchema decodes a JSON schema kept as json text and checks it.
+func ParseJSONSchema(source string) (schema map[string]interface{}, err error) {
+
+	err = json.Unmarshal([]byte(source), &schema)
+	if err != nil {
+		return nil, fmt.Errorf("schema isn't valid json: %v", err)
+	}
+
+	if schema == nil {
+		return nil, fmt.Errorf("schema must be an object")
+	}
+
+	return schema, CheckJSONSchema(schema)
+}
+
+func checkJSONSchema(schema map[string]interface{}, path string) error {
+
+	at := func(keyword string) string {
+		if path == "" {
+			return keyword
+		}
+		return path + "." + keyword
+	}
+
+	if pattern, ok := schema["pattern"].(string); ok {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("invalid %s: %v", at("pattern"), err)
+		}
+	}
+
+	if properties, ok := schema["properties"]; ok {
+		properties_map, ok := properties.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s must be an object", at("properties"))
+		}
+		for name, property := range properties_map {
+			property_schema, ok := property.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("%s must be an object", at("properties."+name))
+			}
+			if err := checkJSONSchema(property_schema, at("properties."+name)); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, keyword := range []string{"items", "not", "additionalProperties"} {
+		if nested, ok := schema[keyword].(map[string]interface{}); ok {
+			if err := checkJSONSchema(nested, at(keyword)); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, keyword := range []string{"allOf", "anyOf", "oneOf"} {
+		nested, ok := schema[keyword]
+		if !ok {
+			continue
+		}
+		list, ok := nested.([]interface{})
+		if !ok {
+			return fmt.Errorf("%s must be an array", at(keyword))
+		}
+		for i, element := range list {
+			element_schema, ok := element.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("%s[%d] must be an object", at(keyword), i)
+			}
+			if err := checkJSONSchema(element_schema, fmt.Sprintf("%s[%d]", at(keyword), i)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func validateJSONSchema(schema map[string]interface{}, value interface{}, path string, errors *[]JSONSchemaError) {
+
+	if schema == nil {
+		return
+	}
+
+	fail := func(format string, args ...interface{}) {
+		*errors = append(*errors, JSONSchemaError{Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if types, ok := schema["type"]; ok && !jsonSchemaTypeMatches(types, value) {
+		fail("must be %s", jsonSchemaTypeNames(types))
+		// the other keywords would only repeat the type mismatch
+		return
+	}
+
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, allowed := range enum {
+			if reflect.DeepEqual(allowed, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			fail("must be one of %s", jsonSchemaList(enum))
+		}
+	}
+
+	if constant, ok := schema["const"]; ok && !reflect.DeepEqual(constant, value) {
+		fail("must be %s", jsonSchemaList([]interface{}{constant}))
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		validateJSONSchemaObject(schema, v, path, errors)
+	case []interface{}:
+		if minimum, ok := schema["minItems"].(float64); ok && float64(len(v)) < minimum {
+			fail("must have at least %v items", minimum)
+		}
+		if maximum, ok := schema["maxItems"].(float64); ok && float64(len(v)) > maximum {
+			fail("must have at most %v items", maximum)
+		}
+		if items, ok := schema["items"].(map[string]interface{}); ok {
+			for i, element := range v {
+				validateJSONSchema(items, element, fmt.Sprintf("%s[%d]", path, i), errors)
+			}
+		}
+	case string:
+		length := float64(utf8.RuneCountInString(v))
+		if minimum, ok := schema["minLength"].(float64); ok && length < minimum {
+			fail("must be at least %v characters", minimum)
+		}
+		if maximum, ok := schema["maxLength"].(float64); ok && length > maximum {
+			fail("must be at most %v characters", maximum)
+		}
+		if pattern, ok := schema["pattern"].(string); ok {
+			re, err := regexp.Compile(pattern)
+			if err == nil && !re.MatchString(v) {
+				fail("must match %s", pattern)
+			}
+		}
+	case float64:
+		if minimum, ok := schema["minimum"].(float64); ok && v < minimum {
+			fail("must be at least %v", minimum)
+		}
+		if maximum, ok := schema["maximum"].(float64); ok && v > maximum {
+			fail("must be at most %v", maximum)
+		}
+		if minimum, ok := schema["exclusiveMinimum"].(float64); ok && v <= minimum {
+			fail("must be greater than %v", minimum)
+		}
+		if maximum, ok := schema["exclusiveMaximum"].(float64); ok && v >= maximum {
+			fail("must be less than %v", maximum)
+		}
+	}
+
+	if all, ok := schema["allOf"].([]interface{}); ok {
+		for _, element := range all {
+			element_schema, _ := element.(map[string]interface{})
+			validateJSONSchema(element_schema, value, path, errors)
+		}
+	}
+
+	if any, ok := schema["anyOf"].([]interface{}); ok && jsonSchemaMatches(any, value) == 0 {
+		fail("must match at least one of the allowed schemas")
+	}
+
+	if one, ok := schema["oneOf"].([]interface{}); ok && jsonSchemaMatches(one, value) != 1 {
+		fail("must match exactly one of the allowed schemas")
+	}
+
+	if not, ok := schema["not"].(map[string]interface{}); ok {
+		nested := make([]JSONSchemaError, 0)
+		validateJSONSchema(not, value, path, &nested)
+		if len(nested) == 0 {
+			fail("must not match the disallowed schema")
+		}
+	}
+}
+
+func validateJSONSchemaObject(schema map[string]interface{}, value map[string]interface{}, path string, errors *[]JSONSchemaError) {
+
+	field := func(name string) string {
+		if path == "" {
+			return name
+		}
+		return path + "." + name
+	}
+
+	if required, ok := schema["required"].([]interface{}); ok {
+		for _, name := range required {
+			name, _ := name.(string)
+			if _, found := value[name]; !found {
+				*errors = append(*errors, JSONSchemaError{Path: field(name), Message: "is required"})
+			}
+		}
+	}
+
+	properties, _ := schema["properties"].(map[string]interface{})
+
+	// sorted so the errors come in a stable order
+	names := make([]string, 0, len(value))
+	for name := range value {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if property, ok := properties[name].(map[string]interface{}); ok {
+			validateJSONSchema(property, value[name], field(name), errors)
+			continue
+		}
+
+		switch additional := schema["additionalProperties"].(type) {
+		case bool:
+			if !additional {
+				*errors = append(*errors, JSONSchemaError{Path: field(name), Message: "is not allowed"})
+			}
+		case map[string]interface{}:
+			validateJSONSchema(additional, value[name], field(name), errors)
+		}
+	}
+}
+
+// jsonSchemaMatches counts the schemas the value is valid against.
+func jsonSchemaMatches(schemas []interface{}, value interface{}) int {
+
+	matches := 0
+	for _, element := range schemas {
+		element_schema, _ := element.(map[string]interface{})
+		nested := make([]JSONSchemaError, 0)
+		validateJSONSchema(element_schema, value, "", &nested)
+		if len(nested) == 0 {
+			matches++
+		}
+	}
+
+	return matches
+}
+
+func jsonSchemaTypeMatches(types interface{}, value interface{}) bool {
+
+	switch t := types.(type) {
+	case string:
+		return jsonSchemaTypeIs(t, value)
+	case []interface{}:
+		for _, element := range t {
+			if name, ok := element.(string); ok && jsonSchemaTypeIs(name, value) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return true
+}
+
+func jsonSchemaTypeIs(name string, value interface{}) bool {
+
+	switch name {
+	case "object":
+		_, ok := value.(map[string]interface{})
+		return ok
+	case "array":
+		_, ok := value.([]interface{})
+		return ok
+	case "string":
+		_, ok := value.(string)
+		return ok
+	case "number":
+		_, ok := value.(float64)
+		return ok
+	case "integer":
+		number, ok := value.(float64)
+		return ok && number == math.Trunc(number)
+	case "boolean":
+		_, ok := value.(bool)
+		return ok
+	case "null":
+		return value == nil
+	}
+
+	return false
+}
+
+func jsonSchemaTypeNames(types interface{}) string {
+
+	switch t := types.(type) {
+	case string:
+		return "of type " + t
+	case []interface{}:
+		names := make([]string, 0, len(t))
+		for _, element := range t {
+			names = append(names, fmt.Sprint(element))
+		}
+		return "of type " + strings.Join(names, " or ")
+	}
+
+	return "of the schema type"
+}
+
+func jsonSchemaList(values []interface{}) string {
+
+	encoded := make([]string, 0, len(values))
+	for _, value := range values {
+		b, err := json.Marshal(value)
+		if err != nil {
+			encoded = append(encoded, fmt.Sprint(value))
+			continue
+		}
+		encoded = append(encoded, string(b))
+	}
+
+	return strings.Join(encoded, ", ")
+}
@@ -0,0 +1,226 @@
+package common
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestValidateJSONSchemaErrors(t *testing.T) {
+
+	order_schema := map[string]interface{}{
+		"type":     "object",
+		"required": []interface{}{"order_id", "items"},
+		"properties": map[string]interface{}{
+			"order_id": map[string]interface{}{"type": "string", "pattern": "^[A-Z][0-9]+$"},
+			"status":   map[string]interface{}{"enum": []interface{}{"pending", "paid"}},
+			"items": map[string]interface{}{
+				"type":     "array",
+				"minItems": 1,
+				"items": map[string]interface{}{
+					"type":     "object",
+					"required": []interface{}{"quantity"},
+					"properties": map[string]interface{}{
+						"quantity": map[string]interface{}{"type": "integer", "minimum": 1},
+					},
+				},
+			},
+		},
+		"additionalProperties": false,
+	}
+
+	tests := []struct {
+		name     string
+		schema   map[string]interface{}
+		value    interface{}
+		expected []JSONSchemaError
+	}{
+		{
+			name:     "valid",
+			schema:   order_schema,
+			value:    map[string]interface{}{"order_id": "A1", "status": "paid", "items": []interface{}{map[string]interface{}{"quantity": 2}}},
+			expected: []JSONSchemaError{},
+		},
+		{
+			name:     "root type",
+			schema:   order_schema,
+			value:    []interface{}{},
+			expected: []JSONSchemaError{{Path: "", Message: "must be of type object"}},
+		},
+		{
+			name:   "required",
+			schema: order_schema,
+			value:  map[string]interface{}{},
+			expected: []JSONSchemaError{
+				{Path: "order_id", Message: "is required"},
+				{Path: "items", Message: "is required"},
+			},
+		},
+		{
+			name:   "nested paths",
+			schema: order_schema,
+			value: map[string]interface{}{"order_id": "a1", "items": []interface{}{
+				map[string]interface{}{"quantity": 1},
+				map[string]interface{}{"quantity": 0.5},
+				map[string]interface{}{"quantity": 0},
+				map[string]interface{}{},
+			}},
+			expected: []JSONSchemaError{
+				{Path: "items[1].quantity", Message: "must be of type integer"},
+				{Path: "items[2].quantity", Message: "must be at least 1"},
+				{Path: "items[3].quantity", Message: "is required"},
+				{Path: "order_id", Message: "must match ^[A-Z][0-9]+$"},
+			},
+		},
+		{
+			name:   "enum and additional properties",
+			schema: order_schema,
+			value:  map[string]interface{}{"order_id": "A1", "items": []interface{}{map[string]interface{}{"quantity": 1}}, "status": "lost", "note": "x"},
+			expected: []JSONSchemaError{
+				{Path: "note", Message: "is not allowed"},
+				{Path: "status", Message: `must be one of "pending", "paid"`},
+			},
+		},
+		{
+			name:     "min items",
+			schema:   order_schema,
+			value:    map[string]interface{}{"order_id": "A1", "items": []interface{}{}},
+			expected: []JSONSchemaError{{Path: "items", Message: "must have at least 1 items"}},
+		},
+		{
+			name:     "type list",
+			schema:   map[string]interface{}{"type": []interface{}{"string", "null"}},
+			value:    12,
+			expected: []JSONSchemaError{{Path: "", Message: "must be of type string or null"}},
+		},
+		{
+			name:     "string length",
+			schema:   map[string]interface{}{"type": "string", "minLength": 2, "maxLength": 3},
+			value:    "ملخص",
+			expected: []JSONSchemaError{{Path: "", Message: "must be at most 3 characters"}},
+		},
+		{
+			name:     "exclusive bounds",
+			schema:   map[string]interface{}{"exclusiveMinimum": 0, "exclusiveMaximum": 10},
+			value:    10,
+			expected: []JSONSchemaError{{Path: "", Message: "must be less than 10"}},
+		},
+		{
+			name:     "const",
+			schema:   map[string]interface{}{"const": "v1"},
+			value:    "v2",
+			expected: []JSONSchemaError{{Path: "", Message: `must be "v1"`}},
+		},
+		{
+			name:     "additional properties schema",
+			schema:   map[string]interface{}{"additionalProperties": map[string]interface{}{"type": "number"}},
+			value:    map[string]interface{}{"a": 1, "b": "two"},
+			expected: []JSONSchemaError{{Path: "b", Message: "must be of type number"}},
+		},
+		{
+			name: "all of",
+			schema: map[string]interface{}{"allOf": []interface{}{
+				map[string]interface{}{"minimum": 5},
+				map[string]interface{}{"maximum": 1},
+			}},
+			value: 3,
+			expected: []JSONSchemaError{
+				{Path: "", Message: "must be at least 5"},
+				{Path: "", Message: "must be at most 1"},
+			},
+		},
+		{
+			name: "any of",
+			schema: map[string]interface{}{"anyOf": []interface{}{
+				map[string]interface{}{"type": "string"},
+				map[string]interface{}{"type": "boolean"},
+			}},
+			value:    3,
+			expected: []JSONSchemaError{{Path: "", Message: "must match at least one of the allowed schemas"}},
+		},
+		{
+			name: "one of",
+			schema: map[string]interface{}{"oneOf": []interface{}{
+				map[string]interface{}{"type": "number"},
+				map[string]interface{}{"type": "integer"},
+			}},
+			value:    3,
+			expected: []JSONSchemaError{{Path: "", Message: "must match exactly one of the allowed schemas"}},
+		},
+		{
+			name:     "not",
+			schema:   map[string]interface{}{"not": map[string]interface{}{"type": "null"}},
+			value:    nil,
+			expected: []JSONSchemaError{{Path: "", Message: "must not match the disallowed schema"}},
+		},
+		{
+			name:     "unsupported keywords ignored",
+			schema:   map[string]interface{}{"type": "string", "format": "email", "$ref": "#/definitions/x"},
+			value:    "not an email",
+			expected: []JSONSchemaError{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			errors := ValidateJSONSchema(test.schema, test.value)
+			if !reflect.DeepEqual(errors, test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, errors)
+			}
+		})
+	}
+}
+
+func TestJSONSchemaErrorString(t *testing.T) {
+
+	tests := []struct {
+		err      JSONSchemaError
+		expected string
+	}{
+		{JSONSchemaError{Path: "", Message: "must be of type object"}, "must be of type object"},
+		{JSONSchemaError{Path: "items[0].quantity", Message: "is required"}, "items[0].quantity: is required"},
+	}
+
+	for _, test := range tests {
+		if message := test.err.Error(); message != test.expected {
+			t.Errorf("expected %q, got %q", test.expected, message)
+		}
+	}
+}
+
+func TestParseJSONSchemaErrors(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		source string
+		err    string
+	}{
+		{"valid", `{"type": "object", "properties": {"name": {"type": "string", "pattern": "^a"}}}`, ""},
+		{"invalid json", `{"type": `, "schema isn't valid json"},
+		{"not an object", `["string"]`, "schema isn't valid json"},
+		{"null", `null`, "schema must be an object"},
+		{"invalid pattern", `{"pattern": "("}`, "invalid pattern"},
+		{"invalid nested pattern", `{"properties": {"name": {"pattern": "[a-"}}}`, "invalid properties.name.pattern"},
+		{"properties not an object", `{"properties": []}`, "properties must be an object"},
+		{"property not an object", `{"properties": {"name": "string"}}`, "properties.name must be an object"},
+		{"invalid items pattern", `{"items": {"pattern": "("}}`, "invalid items.pattern"},
+		{"any of not an array", `{"anyOf": {"type": "string"}}`, "anyOf must be an array"},
+		{"one of element not an object", `{"oneOf": [{"type": "string"}, 3]}`, "oneOf[1] must be an object"},
+		{"invalid all of pattern", `{"allOf": [{"pattern": "("}]}`, "invalid allOf[0].pattern"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := ParseJSONSchema(test.source)
+			if test.err == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("expected an error containing %q, got %v", test.err, err)
+			}
+		})
+	}
+}
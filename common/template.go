@@ -0,0 +1,764 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"math"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Template is a parsed template of the text sent by the workflow actions (urls, headers, bodies...).
+//
+// {{ path }} outputs the value at a dotted path into the data, e.g. {{ input.items.0.item_name }} or
+// {{ input.items[0].item_name }}, objects and arrays are output as json.
+// Values are piped through functions, {{ input.label | upper }}, {{ input.items | sum "quantity" }},
+// the available functions are listed in templateFunctions.
+// {{ for item in input.items }}...{{ end }} repeats its body for every element of an array, the body sees
+// the element under the given name and loop.index (from 0), loop.number (from 1), loop.first and loop.last.
+// {{ if expression }}...{{ else if expression }}...{{ else }}...{{ end }} renders the first branch whose
+// expression holds, expressions are the ones of conditions and filters (see Expression).
+//
+// A missing value fails the rendering in strict mode and is rendered empty otherwise,
+// the default function replaces a missing or empty value in both modes.
+//
+// RenderHTML escapes the values output into html, such as email bodies, a trusted value is output as is
+// when piped last through raw (or its alias safe), {{ input.signature | raw }}.
+type Template struct {
+	Source string
+	nodes  []templateNode
+}
+
+type templateNode interface {
+	render(r *templateRenderer, scope map[string]interface{}, out *strings.Builder) error
+}
+
+// templateMissing stands for a value missing from the data while the pipes of an output are applied.
+type templateMissing struct {
+	path string
+}
+
+// templateRaw is a value piped through raw, it isn't escaped in html.
+type templateRaw struct {
+	text string
+}
+
+type templateRenderer struct {
+	strict bool
+	html   bool
+}
+
+var templateTokenRe = regexp.MustCompile(`^(?:(\s+)|("(?:[^"\\]|\\.)*"|'(?:[^'\\]|\\.)*')|(-?\d+(?:\.\d+)?)|(\|)|([A-Za-z_][A-Za-z0-9_\-]*(?:\[\d+\])?(?:\.[A-Za-z0-9_\-]+(?:\[\d+\])?)*))`)
+
+var templateForRe = regexp.MustCompile(`^for\s+([A-Za-z_][A-Za-z0-9_]*)\s+in\s+(\S+)$`)
+
+var templatePathSegmentRe = regexp.MustCompile(`^([A-Za-z0-9_\-]+)(?:\[(\d+)\])?$`)
+
+// ParseTemplate parses the template source.
+func ParseTemplate(source string) (template *Template, err error) {
+
+	parser := &templateParser{source: source}
+
+	nodes, closing, err := parser.parseNodes()
+	if err != nil {
+		return nil, err
+	}
+
+	if closing != "" {
+		return nil, fmt.Errorf("unexpected {{ %s }}", closing)
+	}
+
+	return &Template{Source: source, nodes: nodes}, nil
+}
+
+// RenderTemplate parses and renders the template source against data.
+func RenderTemplate(source string, data map[string]interface{}, strict bool) (string, error) {
+
+	template, err := ParseTemplate(source)
+	if err != nil {
+		return "", err
+	}
+
+	return template.Render(data, strict)
+}
+
+// RenderHTMLTemplate parses and renders the html template source against data, see RenderHTML.
+func RenderHTMLTemplate(source string, data map[string]interface{}, strict bool) (string, error) {
+
+	template, err := ParseTemplate(source)
+	if err != nil {
+		return "", err
+	}
+
+	return template.RenderHTML(data, strict)
+}
+
+// Render renders the template against data, strict makes missing values an error.
+func (t *Template) Render(data map[string]interface{}, strict bool) (string, error) {
+	return t.render(&templateRenderer{strict: strict}, data)
+}
+
+// RenderHTML renders the template against data like Render, html escaping the values it outputs
+// except the ones piped through raw.
+func (t *Template) RenderHTML(data map[string]interface{}, strict bool) (string, error) {
+	return t.render(&templateRenderer{strict: strict, html: true}, data)
+}
+
+func (t *Template) render(renderer *templateRenderer, data map[string]interface{}) (string, error) {
+
+	scope, _ := normalizeExpressionData(data).(map[string]interface{})
+	if scope == nil {
+		scope = make(map[string]interface{})
+	}
+
+	var out strings.Builder
+
+	err := renderNodes(renderer, t.nodes, scope, &out)
+	if err != nil {
+		return "", err
+	}
+
+	return out.String(), nil
+}
+
+// Paths returns the paths into the data the template reads, such as OWNER_EMAILS, env.API_KEY or input.items,
+// in the order they appear. The paths into the element of a for loop and into loop are left out.
+func (t *Template) Paths() []string {
+
+	paths := make([]string, 0)
+	seen := make(map[string]bool)
+
+	add := func(path string, locals map[string]bool) {
+		root := strings.SplitN(path, ".", 2)[0]
+		if i := strings.Index(root, "["); i >= 0 {
+			root = root[:i]
+		}
+		if locals[root] || seen[path] {
+			return
+		}
+		seen[path] = true
+		paths = append(paths, path)
+	}
+
+	var walk func(nodes []templateNode, locals map[string]bool)
+	walk = func(nodes []templateNode, locals map[string]bool) {
+		for _, node := range nodes {
+			switch n := node.(type) {
+			case *templateOutputNode:
+				if n.operand.path != "" {
+					add(n.operand.path, locals)
+				}
+				for _, pipe := range n.pipes {
+					for _, arg := range pipe.args {
+						if arg.path != "" {
+							add(arg.path, locals)
+						}
+					}
+				}
+			case *templateForNode:
+				add(n.path, locals)
+				loop_locals := map[string]bool{n.variable: true, "loop": true}
+				for local := range locals {
+					loop_locals[local] = true
+				}
+				walk(n.body, loop_locals)
+			case *templateIfNode:
+				for _, branch := range n.branches {
+					if branch.expression != nil {
+						walkExpression(branch.expression.root, func(p *pathNode) {
+							add(p.source, locals)
+						})
+					}
+					walk(branch.body, locals)
+				}
+			}
+		}
+	}
+
+	walk(t.nodes, map[string]bool{})
+
+	return paths
+}
+
+func renderNodes(r *templateRenderer, nodes []templateNode, scope map[string]interface{}, out *strings.Builder) error {
+	for _, node := range nodes {
+		if err := node.render(r, scope, out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type templateParser struct {
+	source   string
+	position int
+}
+
+// nextTag returns the text up to the next tag and the trimmed content of that tag,
+// found is false when the end of the source is reached.
+func (p *templateParser) nextTag() (text string, tag string, found bool, err error) {
+
+	rest := p.source[p.position:]
+
+	start := strings.Index(rest, "{{")
+	if start < 0 {
+		p.position = len(p.source)
+		return rest, "", false, nil
+	}
+
+	end := strings.Index(rest[start+2:], "}}")
+	if end < 0 {
+		return "", "", false, fmt.Errorf("unclosed {{ at offset %d", p.position+start)
+	}
+
+	text = rest[:start]
+	tag = strings.TrimSpace(rest[start+2 : start+2+end])
+	p.position += start + 2 + end + 2
+
+	return text, tag, true, nil
+}
+
+// parseNodes parses nodes until the end of the source or a closing tag (else, else if or end), which is returned.
+func (p *templateParser) parseNodes() (nodes []templateNode, closing string, err error) {
+
+	nodes = make([]templateNode, 0)
+
+	for {
+		text, tag, found, err := p.nextTag()
+		if err != nil {
+			return nil, "", err
+		}
+
+		if text != "" {
+			nodes = append(nodes, &templateTextNode{text: text})
+		}
+
+		if !found {
+			return nodes, "", nil
+		}
+
+		switch {
+		case tag == "end" || tag == "else" || strings.HasPrefix(tag, "else if "):
+			return nodes, tag, nil
+
+		case strings.HasPrefix(tag, "for "):
+			node, err := p.parseFor(tag)
+			if err != nil {
+				return nil, "", err
+			}
+			nodes = append(nodes, node)
+
+		case strings.HasPrefix(tag, "if "):
+			node, err := p.parseIf(strings.TrimPrefix(tag, "if "))
+			if err != nil {
+				return nil, "", err
+			}
+			nodes = append(nodes, node)
+
+		default:
+			node, err := parseTemplateOutput(tag)
+			if err != nil {
+				return nil, "", fmt.Errorf("invalid {{ %s }}: %v", tag, err)
+			}
+			nodes = append(nodes, node)
+		}
+	}
+}
+
+func (p *templateParser) parseFor(tag string) (templateNode, error) {
+
+	match := templateForRe.FindStringSubmatch(tag)
+	if match == nil {
+		return nil, fmt.Errorf("invalid {{ %s }}, expected {{ for name in path }}", tag)
+	}
+
+	body, closing, err := p.parseNodes()
+	if err != nil {
+		return nil, err
+	}
+
+	if closing != "end" {
+		return nil, fmt.Errorf("{{ %s }} is not closed by {{ end }}", tag)
+	}
+
+	return &templateForNode{variable: match[1], path: match[2], body: body}, nil
+}
+
+func (p *templateParser) parseIf(source string) (templateNode, error) {
+
+	node := &templateIfNode{}
+
+	for {
+		expression, err := ParseExpression(source)
+		if err != nil {
+			return nil, fmt.Errorf("invalid {{ if %s }}: %v", source, err)
+		}
+
+		body, closing, err := p.parseNodes()
+		if err != nil {
+			return nil, err
+		}
+
+		node.branches = append(node.branches, templateIfBranch{expression: expression, body: body})
+
+		switch {
+		case closing == "end":
+			return node, nil
+		case closing == "else":
+			body, closing, err = p.parseNodes()
+			if err != nil {
+				return nil, err
+			}
+			if closing != "end" {
+				return nil, fmt.Errorf("{{ if %s }} is not closed by {{ end }}", source)
+			}
+			node.branches = append(node.branches, templateIfBranch{body: body})
+			return node, nil
+		case strings.HasPrefix(closing, "else if "):
+			source = strings.TrimPrefix(closing, "else if ")
+		default:
+			return nil, fmt.Errorf("{{ if %s }} is not closed by {{ end }}", source)
+		}
+	}
+}
+
+type templateTextNode struct {
+	text string
+}
+
+func (n *templateTextNode) render(r *templateRenderer, scope map[string]interface{}, out *strings.Builder) error {
+	out.WriteString(n.text)
+	return nil
+}
+
+// templateOperand is a literal or a path in an output.
+type templateOperand struct {
+	literal interface{}
+	path    string
+}
+
+func (o templateOperand) value(scope map[string]interface{}) interface{} {
+
+	if o.path == "" {
+		return o.literal
+	}
+
+	value, found := resolveTemplatePath(scope, o.path)
+	if !found {
+		return templateMissing{path: o.path}
+	}
+
+	return value
+}
+
+type templatePipe struct {
+	function string
+	args     []templateOperand
+}
+
+type templateOutputNode struct {
+	source  string
+	operand templateOperand
+	pipes   []templatePipe
+}
+
+func parseTemplateOutput(source string) (*templateOutputNode, error) {
+
+	operands := make([][]templateOperand, 0)
+	functions := make([]string, 0)
+	current := make([]templateOperand, 0)
+	expect_function := false
+	rest := source
+
+	for len(rest) > 0 {
+		match := templateTokenRe.FindStringSubmatch(rest)
+		if match == nil {
+			return nil, fmt.Errorf("unexpected character at %q", rest)
+		}
+		rest = rest[len(match[0]):]
+
+		switch {
+		case match[1] != "":
+		case match[4] != "":
+			// a function without arguments leaves current empty, only the value before the first | is required
+			if expect_function || (len(operands) == 0 && len(current) == 0) {
+				return nil, fmt.Errorf("unexpected |")
+			}
+			operands = append(operands, current)
+			current = make([]templateOperand, 0)
+			expect_function = true
+		case expect_function:
+			if match[5] == "" {
+				return nil, fmt.Errorf("expected a function name after |")
+			}
+			if _, ok := templateFunctions[match[5]]; !ok {
+				return nil, fmt.Errorf("unknown function %s", match[5])
+			}
+			functions = append(functions, match[5])
+			expect_function = false
+		case match[2] != "":
+			unquoted := match[2][1 : len(match[2])-1]
+			unquoted = strings.ReplaceAll(unquoted, `\"`, `"`)
+			unquoted = strings.ReplaceAll(unquoted, `\'`, `'`)
+			current = append(current, templateOperand{literal: unquoted})
+		case match[3] != "":
+			number, _ := strconv.ParseFloat(match[3], 64)
+			current = append(current, templateOperand{literal: number})
+		case match[5] != "":
+			switch match[5] {
+			case "true", "false":
+				current = append(current, templateOperand{literal: match[5] == "true"})
+			case "null":
+				current = append(current, templateOperand{literal: nil})
+			default:
+				current = append(current, templateOperand{path: match[5]})
+			}
+		}
+	}
+
+	if expect_function {
+		return nil, fmt.Errorf("expected a function name after |")
+	}
+	operands = append(operands, current)
+
+	if len(operands[0]) != 1 {
+		return nil, fmt.Errorf("expected a single value before the first |")
+	}
+
+	node := &templateOutputNode{source: source, operand: operands[0][0]}
+	for i, function := range functions {
+		node.pipes = append(node.pipes, templatePipe{function: function, args: operands[i+1]})
+	}
+
+	return node, nil
+}
+
+func (n *templateOutputNode) render(r *templateRenderer, scope map[string]interface{}, out *strings.Builder) error {
+
+	value := n.operand.value(scope)
+
+	for _, pipe := range n.pipes {
+
+		args := make([]interface{}, 0, len(pipe.args))
+		for _, arg := range pipe.args {
+			arg_value, err := r.present(arg.value(scope))
+			if err != nil {
+				return err
+			}
+			args = append(args, arg_value)
+		}
+
+		if pipe.function != "default" {
+			var err error
+			value, err = r.present(value)
+			if err != nil {
+				return err
+			}
+		}
+
+		var err error
+		value, err = templateFunctions[pipe.function](value, args)
+		if err != nil {
+			return fmt.Errorf("{{ %s }}: %s: %v", n.source, pipe.function, err)
+		}
+	}
+
+	value, err := r.present(value)
+	if err != nil {
+		return err
+	}
+
+	if raw, ok := value.(templateRaw); ok {
+		out.WriteString(raw.text)
+		return nil
+	}
+
+	if r.html {
+		out.WriteString(html.EscapeString(templateString(value)))
+		return nil
+	}
+
+	out.WriteString(templateString(value))
+	return nil
+}
+
+// present replaces a missing value by nil, it fails in strict mode.
+func (r *templateRenderer) present(value interface{}) (interface{}, error) {
+
+	missing, ok := value.(templateMissing)
+	if !ok {
+		return value, nil
+	}
+
+	if r.strict {
+		return nil, fmt.Errorf("missing value %s", missing.path)
+	}
+
+	return nil, nil
+}
+
+type templateForNode struct {
+	variable string
+	path     string
+	body     []templateNode
+}
+
+func (n *templateForNode) render(r *templateRenderer, scope map[string]interface{}, out *strings.Builder) error {
+
+	value, found := resolveTemplatePath(scope, n.path)
+	if !found || value == nil {
+		if r.strict {
+			return fmt.Errorf("missing value %s", n.path)
+		}
+		return nil
+	}
+
+	list, ok := value.([]interface{})
+	if !ok {
+		return fmt.Errorf("{{ for %s in %s }}: %s is not an array", n.variable, n.path, n.path)
+	}
+
+	for index, element := range list {
+
+		loop_scope := make(map[string]interface{}, len(scope)+2)
+		for key, value := range scope {
+			loop_scope[key] = value
+		}
+		loop_scope[n.variable] = element
+		loop_scope["loop"] = map[string]interface{}{
+			"index":  float64(index),
+			"number": float64(index + 1),
+			"first":  index == 0,
+			"last":   index == len(list)-1,
+		}
+
+		err := renderNodes(r, n.body, loop_scope, out)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type templateIfBranch struct {
+	// expression is nil for the else branch
+	expression *Expression
+	body       []templateNode
+}
+
+type templateIfNode struct {
+	branches []templateIfBranch
+}
+
+func (n *templateIfNode) render(r *templateRenderer, scope map[string]interface{}, out *strings.Builder) error {
+
+	for _, branch := range n.branches {
+
+		if branch.expression != nil {
+			holds, err := branch.expression.evaluate(&expressionEnv{data: scope})
+			if err != nil {
+				return fmt.Errorf("{{ if %s }}: %v", branch.expression.Source, err)
+			}
+			if !holds {
+				continue
+			}
+		}
+
+		return renderNodes(r, branch.body, scope, out)
+	}
+
+	return nil
+}
+
+// resolveTemplatePath returns the value at the dotted path, numeric segments and [n] suffixes index arrays.
+func resolveTemplatePath(data interface{}, path string) (value interface{}, found bool) {
+
+	value = data
+
+	for _, segment := range strings.Split(path, ".") {
+
+		match := templatePathSegmentRe.FindStringSubmatch(segment)
+		if match == nil {
+			return nil, false
+		}
+
+		switch v := value.(type) {
+		case map[string]interface{}:
+			value, found = v[match[1]]
+			if !found {
+				return nil, false
+			}
+		case []interface{}:
+			index, err := strconv.Atoi(match[1])
+			if err != nil || index < 0 || index >= len(v) {
+				return nil, false
+			}
+			value = v[index]
+		default:
+			return nil, false
+		}
+
+		if match[2] != "" {
+			list, ok := value.([]interface{})
+			index, _ := strconv.Atoi(match[2])
+			if !ok || index >= len(list) {
+				return nil, false
+			}
+			value = list[index]
+		}
+	}
+
+	return value, true
+}
+
+// templateString returns the text a value is rendered as, objects and arrays are rendered as json.
+func templateString(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case templateRaw:
+		return v.text
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	case map[string]interface{}, []interface{}:
+		b, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Sprint(v)
+		}
+		return string(b)
+	}
+	return fmt.Sprint(value)
+}
+
+// templateFunctions are the functions values can be piped through, each receives the piped value and its arguments.
+//
+//	upper, lower, trim            change the text of the value
+//	json                          encodes the value as json
+//	len                           the length of an array, object or text
+//	sum "field"                   the sum of an array of numbers, or of the field of an array of objects
+//	join ", "                     joins the elements of an array
+//	date "2006-01-02 15:04"       formats an RFC 3339 time or unix seconds using a Go layout, defaults to 2006-01-02
+//	round 2                       rounds a number to the given decimals, defaults to 0
+//	urlencode                     escapes the value for a url query
+//	default "none"                replaces a missing, null or empty value
+//	raw, safe                     outputs the value as is in html, it must be the last function
+var templateFunctions = map[string]func(value interface{}, args []interface{}) (interface{}, error){
+	"upper": func(value interface{}, args []interface{}) (interface{}, error) {
+		return strings.ToUpper(templateString(value)), nil
+	},
+	"lower": func(value interface{}, args []interface{}) (interface{}, error) {
+		return strings.ToLower(templateString(value)), nil
+	},
+	"trim": func(value interface{}, args []interface{}) (interface{}, error) {
+		return strings.TrimSpace(templateString(value)), nil
+	},
+	"json": func(value interface{}, args []interface{}) (interface{}, error) {
+		b, err := json.Marshal(value)
+		return string(b), err
+	},
+	"len": func(value interface{}, args []interface{}) (interface{}, error) {
+		switch v := value.(type) {
+		case []interface{}:
+			return float64(len(v)), nil
+		case map[string]interface{}:
+			return float64(len(v)), nil
+		case nil:
+			return float64(0), nil
+		}
+		return float64(len([]rune(templateString(value)))), nil
+	},
+	"sum": func(value interface{}, args []interface{}) (interface{}, error) {
+		list, ok := value.([]interface{})
+		if !ok && value != nil {
+			return nil, fmt.Errorf("expected an array")
+		}
+		field := ""
+		if len(args) > 0 {
+			field = templateString(args[0])
+		}
+		total := 0.0
+		for _, element := range list {
+			if field != "" {
+				element, _ = resolveTemplatePath(element, field)
+			}
+			if number, ok := toNumber(element); ok {
+				total += number
+			}
+		}
+		return total, nil
+	},
+	"join": func(value interface{}, args []interface{}) (interface{}, error) {
+		list, ok := value.([]interface{})
+		if !ok && value != nil {
+			return nil, fmt.Errorf("expected an array")
+		}
+		separator := ", "
+		if len(args) > 0 {
+			separator = templateString(args[0])
+		}
+		parts := make([]string, 0, len(list))
+		for _, element := range list {
+			parts = append(parts, templateString(element))
+		}
+		return strings.Join(parts, separator), nil
+	},
+	"date": func(value interface{}, args []interface{}) (interface{}, error) {
+		layout := "2006-01-02"
+		if len(args) > 0 {
+			layout = templateString(args[0])
+		}
+		switch v := value.(type) {
+		case nil:
+			return nil, nil
+		case float64:
+			return time.Unix(int64(v), 0).UTC().Format(layout), nil
+		case string:
+			t, err := time.Parse(time.RFC3339Nano, v)
+			if err != nil {
+				return nil, fmt.Errorf("%s is not an RFC 3339 time", v)
+			}
+			return t.Format(layout), nil
+		}
+		return nil, fmt.Errorf("expected a time")
+	},
+	"round": func(value interface{}, args []interface{}) (interface{}, error) {
+		number, ok := toNumber(value)
+		if !ok {
+			return nil, fmt.Errorf("expected a number")
+		}
+		decimals := 0.0
+		if len(args) > 0 {
+			decimals, _ = toNumber(args[0])
+		}
+		scale := math.Pow(10, decimals)
+		return math.Round(number*scale) / scale, nil
+	},
+	"urlencode": func(value interface{}, args []interface{}) (interface{}, error) {
+		return url.QueryEscape(templateString(value)), nil
+	},
+	"raw":  templateRawFunction,
+	"safe": templateRawFunction,
+	"default": func(value interface{}, args []interface{}) (interface{}, error) {
+		if len(args) == 0 {
+			return nil, fmt.Errorf("expected the default value")
+		}
+		if _, missing := value.(templateMissing); missing || value == nil || value == "" {
+			return args[0], nil
+		}
+		return value, nil
+	},
+}
+
+// templateRawFunction marks the value as trusted, RenderHTML outputs it without escaping.
+func templateRawFunction(value interface{}, args []interface{}) (interface{}, error) {
+	return templateRaw{text: templateString(value)}, nil
+}
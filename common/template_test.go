@@ -0,0 +1,337 @@
+package common
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func templateTestData() map[string]interface{} {
+	return map[string]interface{}{
+		"API_KEY": "sk-live-123",
+		"env":     map[string]interface{}{"SHOP": "Koshary Corner"},
+		"input": map[string]interface{}{
+			"order_id": 42,
+			"label":    "  Table 7  ",
+			"note":     "",
+			"paid":     true,
+			"customer": map[string]interface{}{"name": "Mona", "email": "mona@example.com"},
+			"items": []interface{}{
+				map[string]interface{}{"item_name": "Falafel", "quantity": 2, "price": 1.5},
+				map[string]interface{}{"item_name": "Tea", "quantity": 1, "price": 0.75},
+			},
+			"tags":       []interface{}{"vip", "takeaway"},
+			"created_at": "2024-03-05T14:30:00Z",
+			"html":       "<b>Tom & Jerry</b>",
+		},
+	}
+}
+
+func TestRenderTemplatePaths(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		source   string
+		expected string
+	}{
+		{"text only", "hello", "hello"},
+		{"top level", "{{ API_KEY }}", "sk-live-123"},
+		{"dotted", "{{ env.SHOP }}", "Koshary Corner"},
+		{"nested", "{{ input.customer.name }}", "Mona"},
+		{"numeric segment", "{{ input.items.1.item_name }}", "Tea"},
+		{"bracket index", "{{ input.items[0].item_name }}", "Falafel"},
+		{"number", "{{ input.order_id }}", "42"},
+		{"bool", "{{ input.paid }}", "true"},
+		{"object as json", "{{ input.customer }}", `{"email":"mona@example.com","name":"Mona"}`},
+		{"array as json", "{{ input.tags }}", `["vip","takeaway"]`},
+		{"no spaces", "{{input.customer.name}}", "Mona"},
+		{"literal", `{{ "plain" }}`, "plain"},
+		{"pipe", "{{ input.customer.name | upper }}", "MONA"},
+		{"chained pipes", "{{ input.label | trim | lower }}", "table 7"},
+		{"pipe with argument", `{{ input.items | sum "quantity" }}`, "3"},
+		{"pipe with arguments and chain", `{{ input.tags | join " / " | upper }}`, "VIP / TAKEAWAY"},
+		{"len", "{{ input.items | len }}", "2"},
+		{"round", "{{ input.items.1.price | round 1 }}", "0.8"},
+		{"date", `{{ input.created_at | date "02/01/2006 15:04" }}`, "05/03/2024 14:30"},
+		{"urlencode", "{{ env.SHOP | urlencode }}", "Koshary+Corner"},
+		{"default on empty", `{{ input.note | default "none" }}`, "none"},
+		{"default on present", `{{ input.customer.name | default "none" }}`, "Mona"},
+		{"default on missing", `{{ input.missing | default "none" }}`, "none"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rendered, err := RenderTemplate(test.source, templateTestData(), true)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if rendered != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, rendered)
+			}
+		})
+	}
+}
+
+func TestRenderTemplateLoops(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		source   string
+		expected string
+	}{
+		{
+			name:     "elements",
+			source:   "{{ for item in input.items }}{{ item.quantity }}x {{ item.item_name }};{{ end }}",
+			expected: "2x Falafel;1x Tea;",
+		},
+		{
+			name:     "loop variables",
+			source:   "{{ for tag in input.tags }}{{ loop.index }}/{{ loop.number }}/{{ loop.first }}/{{ loop.last }} {{ end }}",
+			expected: "0/1/true/false 1/2/false/true ",
+		},
+		{
+			name:     "outer scope",
+			source:   "{{ for tag in input.tags }}{{ env.SHOP }}:{{ tag }} {{ end }}",
+			expected: "Koshary Corner:vip Koshary Corner:takeaway ",
+		},
+		{
+			name:     "nested",
+			source:   "{{ for item in input.items }}{{ for tag in input.tags }}{{ item.item_name }}-{{ tag }} {{ end }}{{ end }}",
+			expected: "Falafel-vip Falafel-takeaway Tea-vip Tea-takeaway ",
+		},
+		{
+			name:     "separator",
+			source:   "{{ for tag in input.tags }}{{ tag }}{{ if !loop.last }}, {{ end }}{{ end }}",
+			expected: "vip, takeaway",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rendered, err := RenderTemplate(test.source, templateTestData(), true)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if rendered != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, rendered)
+			}
+		})
+	}
+}
+
+func TestRenderTemplateConditionals(t *testing.T) {
+
+	source := `{{ if input.total > 100 }}big{{ else if input.total > 10 }}medium{{ else }}small{{ end }}`
+
+	tests := []struct {
+		name     string
+		source   string
+		data     map[string]interface{}
+		expected string
+	}{
+		{"first branch", source, map[string]interface{}{"input": map[string]interface{}{"total": 150}}, "big"},
+		{"else if branch", source, map[string]interface{}{"input": map[string]interface{}{"total": 50}}, "medium"},
+		{"else branch", source, map[string]interface{}{"input": map[string]interface{}{"total": 5}}, "small"},
+		{"no else", `{{ if input.paid }}paid{{ end }}`, map[string]interface{}{"input": map[string]interface{}{"paid": false}}, ""},
+		{"string equality", `{{ if input.status == "ready" }}go{{ end }}`, map[string]interface{}{"input": map[string]interface{}{"status": "ready"}}, "go"},
+		{"and or", `{{ if input.a && (input.b || input.c) }}yes{{ else }}no{{ end }}`, map[string]interface{}{"input": map[string]interface{}{"a": true, "b": false, "c": true}}, "yes"},
+		{"inside loop", `{{ for n in input.numbers }}{{ if n > 1 }}{{ n }}{{ end }}{{ end }}`, map[string]interface{}{"input": map[string]interface{}{"numbers": []interface{}{1, 2, 3}}}, "23"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rendered, err := RenderTemplate(test.source, test.data, true)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if rendered != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, rendered)
+			}
+		})
+	}
+}
+
+func TestRenderTemplateStrictAndLenient(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		source  string
+		lenient string
+		strict  string
+	}{
+		{"missing path", "[{{ input.missing }}]", "[]", "missing value input.missing"},
+		{"missing nested path", "[{{ input.customer.phone }}]", "[]", "missing value input.customer.phone"},
+		{"out of range index", "[{{ input.items[5].item_name }}]", "[]", "missing value input.items[5].item_name"},
+		{"missing piped", "[{{ input.missing | upper }}]", "[]", "missing value input.missing"},
+		{"missing loop", "[{{ for x in input.missing }}{{ x }}{{ end }}]", "[]", "missing value input.missing"},
+		{"missing default", `[{{ input.missing | default "-" }}]`, "[-]", ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rendered, err := RenderTemplate(test.source, templateTestData(), false)
+			if err != nil {
+				t.Fatalf("lenient: unexpected error: %v", err)
+			}
+			if rendered != test.lenient {
+				t.Errorf("lenient: expected %q, got %q", test.lenient, rendered)
+			}
+
+			rendered, err = RenderTemplate(test.source, templateTestData(), true)
+			if test.strict == "" {
+				if err != nil {
+					t.Fatalf("strict: unexpected error: %v", err)
+				}
+				if rendered != test.lenient {
+					t.Errorf("strict: expected %q, got %q", test.lenient, rendered)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.strict) {
+				t.Errorf("strict: expected an error containing %q, got %v", test.strict, err)
+			}
+		})
+	}
+}
+
+func TestParseTemplateErrors(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		source string
+		err    string
+	}{
+		{"unclosed tag", "hello {{ input.name", "unclosed {{"},
+		{"unknown function", "{{ input.name | shout }}", "unknown function shout"},
+		{"missing function", "{{ input.name | }}", "expected a function name after |"},
+		{"leading pipe", "{{ | upper }}", "unexpected |"},
+		{"double pipe", "{{ input.name | | upper }}", "unexpected |"},
+		{"two values", "{{ input.a input.b }}", "expected a single value before the first |"},
+		{"unclosed for", "{{ for x in input.items }}{{ x }}", "is not closed by {{ end }}"},
+		{"invalid for", "{{ for input.items }}{{ end }}", "expected {{ for name in path }}"},
+		{"unclosed if", "{{ if input.paid }}yes", "is not closed by {{ end }}"},
+		{"invalid if", "{{ if input.paid == }}yes{{ end }}", "invalid {{ if input.paid == }}"},
+		{"stray end", "hello {{ end }}", "unexpected {{ end }}"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := ParseTemplate(test.source)
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("expected an error containing %q, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestRenderHTMLTemplate(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		source   string
+		expected string
+	}{
+		{"escaped value", "<p>{{ input.html }}</p>", "<p>&lt;b&gt;Tom &amp; Jerry&lt;/b&gt;</p>"},
+		{"escaped after pipe", "{{ input.html | upper }}", "&lt;B&gt;TOM &amp; JERRY&lt;/B&gt;"},
+		{"raw", "{{ input.html | raw }}", "<b>Tom & Jerry</b>"},
+		{"safe", "{{ input.html | safe }}", "<b>Tom & Jerry</b>"},
+		{"escaped in loop", "{{ for tag in input.tags }}<i>{{ tag }}</i>{{ end }}", "<i>vip</i><i>takeaway</i>"},
+		{"quotes escaped", `{{ "a \"quoted\" 'word'" }}`, "a &#34;quoted&#34; &#39;word&#39;"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rendered, err := RenderHTMLTemplate(test.source, templateTestData(), true)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if rendered != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, rendered)
+			}
+		})
+	}
+
+	// raw only affects html rendering
+	rendered, err := RenderTemplate("{{ input.html | raw }}", templateTestData(), true)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if rendered != "<b>Tom & Jerry</b>" {
+		t.Errorf("expected the raw value, got %q", rendered)
+	}
+}
+
+func TestTemplatePaths(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		source   string
+		expected []string
+	}{
+		{"none", "hello", []string{}},
+		{"outputs and arguments", `{{ API_KEY }} {{ input.items | sum input.field }} {{ API_KEY }}`, []string{"API_KEY", "input.items", "input.field"}},
+		{"loop locals left out", "{{ for item in input.items }}{{ item.name }}{{ loop.index }}{{ env.SHOP }}{{ end }}", []string{"input.items", "env.SHOP"}},
+		{"conditions", "{{ if input.total > 10 && env.ENABLED }}{{ input.label }}{{ end }}", []string{"input.total", "env.ENABLED", "input.label"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			template, err := ParseTemplate(test.source)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if paths := template.Paths(); !reflect.DeepEqual(paths, test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, paths)
+			}
+		})
+	}
+}
+
+func TestMaskStringInTemplateErrors(t *testing.T) {
+
+	secrets := []string{"sk-live-123", "hunter2"}
+
+	tests := []struct {
+		name     string
+		source   string
+		data     map[string]interface{}
+		expected string
+	}{
+		{
+			name:     "secret in a function error",
+			source:   "{{ API_KEY | date }}",
+			data:     map[string]interface{}{"API_KEY": "sk-live-123"},
+			expected: "{{ API_KEY | date }}: date: *********** is not an RFC 3339 time",
+		},
+		{
+			name:     "several secrets",
+			source:   "{{ input.pair | date }}",
+			data:     map[string]interface{}{"input": map[string]interface{}{"pair": "sk-live-123:hunter2"}},
+			expected: "{{ input.pair | date }}: date: ***********:*********** is not an RFC 3339 time",
+		},
+		{
+			name:     "secret in the source",
+			source:   "{{ sk-live-123 }}",
+			data:     map[string]interface{}{},
+			expected: "missing value ***********",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := RenderTemplate(test.source, test.data, true)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			masked := MaskString(err.Error(), secrets)
+			if masked != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, masked)
+			}
+			for _, secret := range secrets {
+				if strings.Contains(masked, secret) {
+					t.Errorf("the secret %q leaked in %q", secret, masked)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package workflows
+
+import (
+	"time"
+)
+
+// RunLog is a log line of a run or of one of its steps.
+type RunLog struct {
+	Level     string    `json:"level" bson:"level" mapstructure:"level"`
+	TimeStamp time.Time `json:"timestamp" bson:"timestamp" mapstructure:"timestamp"`
+	Message   string    `json:"message" bson:"message" mapstructure:"message"`
+}
+
+// TriggerBase is inlined by every stored trigger, Type is the type the trigger is registered under.
+type TriggerBase struct {
+	Type string `json:"type" bson:"type" mapstructure:"type"`
+}
+
+// ActionBase is inlined by every stored action, Type is the type the action is registered under.
+type ActionBase struct {
+	Type  string       `json:"type" bson:"type" mapstructure:"type"`
+	Retry *RetryPolicy `json:"retry,omitempty" bson:"retry,omitempty" mapstructure:"retry"`
+}
+
+// RetryPolicy controls how many times a failing action is attempted before the run fails,
+// attempts are spaced by an exponential backoff with jitter, intervals are in seconds.
+// Requests that got no response are always retryable, responses only when their status code is listed
+// in RetryableStatusCodes (408, 429, 500, 502, 503 and 504 when empty).
+type RetryPolicy struct {
+	MaxAttempts          int     `json:"max_attempts" bson:"max_attempts" mapstructure:"max_attempts"`
+	InitialInterval      int     `json:"initial_interval" bson:"initial_interval" mapstructure:"initial_interval"`
+	MaxInterval          int     `json:"max_interval" bson:"max_interval" mapstructure:"max_interval"`
+	Multiplier           float64 `json:"multiplier" bson:"multiplier" mapstructure:"multiplier"`
+	RetryableStatusCodes []int   `json:"retryable_status_codes" bson:"retryable_status_codes" mapstructure:"retryable_status_codes"`
+}
+
+// DryRunRequest is an outbound request as it would be sent, with the secrets masked.
+type DryRunRequest struct {
+	Method  string            `json:"method" bson:"method" mapstructure:"method"`
+	URL     string            `json:"url" bson:"url" mapstructure:"url"`
+	Headers map[string]string `json:"headers" bson:"headers" mapstructure:"headers"`
+	Body    string            `json:"body" bson:"body" mapstructure:"body"`
+}
+
+// CatalogEntry describes a trigger or action type, Schema is the JSON schema of its definition
+// the editor renders its form from. SampleOutput is an example of what a trigger passes to the first action.
+type CatalogEntry struct {
+	Type         string                 `json:"type" bson:"type" mapstructure:"type"`
+	Label        string                 `json:"label" bson:"label" mapstructure:"label"`
+	Description  string                 `json:"description" bson:"description" mapstructure:"description"`
+	Schema       map[string]interface{} `json:"schema" bson:"schema" mapstructure:"schema"`
+	SampleOutput interface{}            `json:"sample_output,omitempty" bson:"sample_output,omitempty" mapstructure:"sample_output"`
+}
+
+// Catalog lists the trigger and action types workflows can be built from.
+type Catalog struct {
+	Triggers []CatalogEntry `json:"triggers" bson:"triggers" mapstructure:"triggers"`
+	Actions  []CatalogEntry `json:"actions" bson:"actions" mapstructure:"actions"`
+}
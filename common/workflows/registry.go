@@ -0,0 +1,389 @@
+// Package workflows holds the trigger and action types workflows are built from, the hub executes them
+// and the modules contribute their own types without depending on the hub.
+package workflows
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mitchellh/mapstructure"
+	"github.com/nutrixpos/hub/common/config"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Service is the workflows service the handlers are run with, the hub passes its own.
+type Service interface {
+	// AddLogsToWorkflowRunStep adds a log line to a step of a run.
+	AddLogsToWorkflowRunStep(tenant_id string, workflow_id string, run_id string, step_index int, log RunLog) (err error)
+}
+
+// TriggerHandler is implemented by every trigger type a workflow can start from.
+// Triggers also implement either EventTriggerHandler or ScheduledTriggerHandler
+// to be fired, or are fired by their own endpoint as the inbound webhook, other triggers can only be run manually.
+type TriggerHandler interface {
+	// Describe returns the catalog entry of the trigger type, its Type is the key it is registered under.
+	Describe() CatalogEntry
+	// Decode decodes the trigger of a workflow being saved into its concrete type and validates it,
+	// the returned value is what gets stored.
+	Decode(raw interface{}, config config.Config) (trigger interface{}, err error)
+	// SampleOutput returns an example of what the trigger passes to the first action.
+	SampleOutput() interface{}
+}
+
+// EventTriggerHandler is a trigger fired by an event published on the event manager.
+type EventTriggerHandler interface {
+	TriggerHandler
+	// EventID is the id of the event the trigger listens to.
+	EventID() string
+	// EventTenantID returns the tenant the event belongs to.
+	EventTenantID(event interface{}) (tenant_id string, err error)
+	// Match decides whether the event fires the stored trigger, output is passed to the first action.
+	Match(raw_trigger bson.Raw, event interface{}) (output interface{}, fire bool, err error)
+}
+
+// GatedEventTriggerHandler is implemented by the event triggers throttling what they match,
+// such as with a cooldown or a digest. Gate runs after a match and decides whether the workflow runs now,
+// logs are added to the run it starts.
+type GatedEventTriggerHandler interface {
+	Gate(service Service, tenant_id string, workflow_id string, raw_trigger bson.Raw, output interface{}) (gated_output interface{}, fire bool, logs []RunLog, err error)
+}
+
+// ScheduledTriggerHandler is a trigger evaluated by the scheduler, the stored trigger
+// must inline its schedule, a cron and a timezone.
+type ScheduledTriggerHandler interface {
+	TriggerHandler
+	// Evaluate decides whether the trigger fires for the due schedule, scheduled_at is in the trigger timezone.
+	Evaluate(service Service, tenant_id string, raw_trigger bson.Raw, scheduled_at time.Time, fired_at time.Time) (output interface{}, fire bool, err error)
+}
+
+// ActionContext is what an action knows about the step it runs in.
+type ActionContext struct {
+	// Context is cancelled when the run is, actions pass it to the requests they send.
+	Context    context.Context
+	Service    Service
+	TenantID   string
+	WorkflowID string
+	RunID      string
+	StepIndex  int
+}
+
+// Log adds a log line to the step of the action.
+func (ctx ActionContext) Log(level string, message string) {
+	ctx.Service.AddLogsToWorkflowRunStep(ctx.TenantID, ctx.WorkflowID, ctx.RunID, ctx.StepIndex, RunLog{
+		Level:     level,
+		Message:   message,
+		TimeStamp: time.Now(),
+	})
+}
+
+// ActionHandler is implemented by every action type a workflow can run.
+type ActionHandler interface {
+	// Describe returns the catalog entry of the action type, its Type is the key it is registered under.
+	Describe() CatalogEntry
+	// Decode decodes the action of a workflow being saved into its concrete type and validates it,
+	// path locates the action in the workflow. The returned value is what gets stored.
+	Decode(raw interface{}, path string) (action interface{}, err error)
+	// Execute runs the stored action with the output of the previous step and returns its own output.
+	// Failures worth retrying are reported with an *ActionRequestError.
+	Execute(ctx ActionContext, raw_action bson.Raw, input interface{}) (output interface{}, err error)
+}
+
+// DryRunActionHandler is implemented by the actions able to describe what they would do
+// without doing it, the others are only listed in a dry run.
+type DryRunActionHandler interface {
+	DryRun(ctx ActionContext, raw_action bson.Raw, input interface{}) (request *DryRunRequest, message string, err error)
+}
+
+// ActionDecodeError is returned when an action of a workflow being saved is invalid, Path locates it.
+type ActionDecodeError struct {
+	Path    string
+	Type    string
+	Message string
+}
+
+func (e *ActionDecodeError) Error() string {
+	if e.Type == "" {
+		return fmt.Sprintf("invalid action at %s: %s", e.Path, e.Message)
+	}
+	return fmt.Sprintf("invalid %s at %s: %s", e.Type, e.Path, e.Message)
+}
+
+// TypesRegistry holds the trigger and action types workflows can be built from.
+type TypesRegistry struct {
+	mu       sync.RWMutex
+	triggers map[string]TriggerHandler
+	actions  map[string]ActionHandler
+}
+
+// Types is the registry of the hub, the hub module registers the built in types and the other modules
+// contribute their own through modules.IWorkflowTypesModule.
+var Types = NewTypesRegistry()
+
+// NewTypesRegistry returns an empty registry.
+func NewTypesRegistry() *TypesRegistry {
+	return &TypesRegistry{
+		triggers: make(map[string]TriggerHandler),
+		actions:  make(map[string]ActionHandler),
+	}
+}
+
+// RegisterTrigger adds a trigger type, registering a type twice is an error.
+func (r *TypesRegistry) RegisterTrigger(handler TriggerHandler) error {
+
+	trigger_type := handler.Describe().Type
+	if trigger_type == "" {
+		return fmt.Errorf("trigger type is required")
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.triggers[trigger_type]; ok {
+		return fmt.Errorf("trigger type %s is already registered", trigger_type)
+	}
+
+	r.triggers[trigger_type] = handler
+	return nil
+}
+
+// MustRegisterTrigger is like RegisterTrigger but panics on error.
+func (r *TypesRegistry) MustRegisterTrigger(handler TriggerHandler) {
+	if err := r.RegisterTrigger(handler); err != nil {
+		panic(err)
+	}
+}
+
+// RegisterAction adds an action type, registering a type twice is an error.
+func (r *TypesRegistry) RegisterAction(handler ActionHandler) error {
+
+	action_type := handler.Describe().Type
+	if action_type == "" {
+		return fmt.Errorf("action type is required")
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.actions[action_type]; ok {
+		return fmt.Errorf("action type %s is already registered", action_type)
+	}
+
+	r.actions[action_type] = handler
+	return nil
+}
+
+// MustRegisterAction is like RegisterAction but panics on error.
+func (r *TypesRegistry) MustRegisterAction(handler ActionHandler) {
+	if err := r.RegisterAction(handler); err != nil {
+		panic(err)
+	}
+}
+
+// Trigger returns the handler of the trigger type.
+func (r *TypesRegistry) Trigger(trigger_type string) (handler TriggerHandler, ok bool) {
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	handler, ok = r.triggers[trigger_type]
+	return handler, ok
+}
+
+// Action returns the handler of the action type.
+func (r *TypesRegistry) Action(action_type string) (handler ActionHandler, ok bool) {
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	handler, ok = r.actions[action_type]
+	return handler, ok
+}
+
+// EventTriggers returns the event triggers listening to the event.
+func (r *TypesRegistry) EventTriggers(event_id string) map[string]EventTriggerHandler {
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	handlers := make(map[string]EventTriggerHandler)
+	for trigger_type, handler := range r.triggers {
+		if event_handler, ok := handler.(EventTriggerHandler); ok && event_handler.EventID() == event_id {
+			handlers[trigger_type] = event_handler
+		}
+	}
+
+	return handlers
+}
+
+// EventIDs returns the events the registered triggers listen to.
+func (r *TypesRegistry) EventIDs() []string {
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	seen := make(map[string]bool)
+	event_ids := make([]string, 0)
+
+	for _, handler := range r.triggers {
+		if event_handler, ok := handler.(EventTriggerHandler); ok && !seen[event_handler.EventID()] {
+			seen[event_handler.EventID()] = true
+			event_ids = append(event_ids, event_handler.EventID())
+		}
+	}
+
+	sort.Strings(event_ids)
+
+	return event_ids
+}
+
+// ScheduledTriggers returns the triggers evaluated by the scheduler.
+func (r *TypesRegistry) ScheduledTriggers() map[string]ScheduledTriggerHandler {
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	handlers := make(map[string]ScheduledTriggerHandler)
+	for trigger_type, handler := range r.triggers {
+		if scheduled_handler, ok := handler.(ScheduledTriggerHandler); ok {
+			handlers[trigger_type] = scheduled_handler
+		}
+	}
+
+	return handlers
+}
+
+// Catalog describes the registered types sorted by type, triggers come with their sample output.
+func (r *TypesRegistry) Catalog() Catalog {
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	catalog := Catalog{
+		Triggers: make([]CatalogEntry, 0, len(r.triggers)),
+		Actions:  make([]CatalogEntry, 0, len(r.actions)),
+	}
+
+	for _, handler := range r.triggers {
+		entry := handler.Describe()
+		entry.SampleOutput = handler.SampleOutput()
+		catalog.Triggers = append(catalog.Triggers, entry)
+	}
+
+	for _, handler := range r.actions {
+		catalog.Actions = append(catalog.Actions, handler.Describe())
+	}
+
+	sort.Slice(catalog.Triggers, func(i, j int) bool { return catalog.Triggers[i].Type < catalog.Triggers[j].Type })
+	sort.Slice(catalog.Actions, func(i, j int) bool { return catalog.Actions[i].Type < catalog.Actions[j].Type })
+
+	return catalog
+}
+
+// DecodeTrigger decodes the trigger of a workflow being saved with the handler of its type,
+// trigger is nil when the workflow has no trigger yet.
+func (r *TypesRegistry) DecodeTrigger(raw interface{}, config config.Config) (trigger interface{}, err error) {
+
+	if raw == nil {
+		return nil, nil
+	}
+
+	var base TriggerBase
+	err = mapstructure.Decode(raw, &base)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode trigger: %v", err)
+	}
+
+	if base.Type == "" {
+		return nil, nil
+	}
+
+	handler, ok := r.Trigger(base.Type)
+	if !ok {
+		return nil, fmt.Errorf("unsupported trigger type %s", base.Type)
+	}
+
+	trigger, err = handler.Decode(raw, config)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s trigger: %v", base.Type, err)
+	}
+
+	return trigger, nil
+}
+
+// DecodeActions decodes the actions of a workflow being saved with the handlers of their types,
+// path_prefix locates nested actions (such as condition branches) in the errors.
+func (r *TypesRegistry) DecodeActions(raw_actions []interface{}, path_prefix string) ([]interface{}, error) {
+
+	actions := make([]interface{}, 0, len(raw_actions))
+
+	for index, raw_action := range raw_actions {
+
+		path := fmt.Sprint(index)
+		if path_prefix != "" {
+			path = fmt.Sprintf("%s.%d", path_prefix, index)
+		}
+
+		var base ActionBase
+		err := mapstructure.Decode(raw_action, &base)
+		if err != nil {
+			return nil, &ActionDecodeError{Path: path, Message: err.Error()}
+		}
+
+		if base.Retry != nil {
+			err = validateRetryPolicy(base.Retry)
+			if err != nil {
+				return nil, &ActionDecodeError{Path: path, Type: base.Type, Message: fmt.Sprintf("retry policy: %v", err)}
+			}
+		}
+
+		handler, ok := r.Action(base.Type)
+		if !ok {
+			return nil, &ActionDecodeError{Path: path, Message: fmt.Sprintf("unsupported action type %s", base.Type)}
+		}
+
+		action, err := handler.Decode(raw_action, path)
+		if err != nil {
+			var decode_err *ActionDecodeError
+			if errors.As(err, &decode_err) {
+				return nil, err
+			}
+			return nil, &ActionDecodeError{Path: path, Type: base.Type, Message: err.Error()}
+		}
+
+		actions = append(actions, action)
+	}
+
+	return actions, nil
+}
+
+// validateRetryPolicy checks the bounds of an action retry policy, unset values get their defaults when the action runs.
+func validateRetryPolicy(policy *RetryPolicy) error {
+
+	if policy.MaxAttempts < 0 || policy.MaxAttempts > 20 {
+		return fmt.Errorf("max_attempts must be between 1 and 20")
+	}
+
+	if policy.InitialInterval < 0 || policy.MaxInterval < 0 {
+		return fmt.Errorf("intervals can't be negative")
+	}
+
+	if policy.MaxInterval > 0 && policy.InitialInterval > policy.MaxInterval {
+		return fmt.Errorf("initial_interval can't be greater than max_interval")
+	}
+
+	if policy.Multiplier < 0 {
+		return fmt.Errorf("multiplier can't be negative")
+	}
+
+	for _, code := range policy.RetryableStatusCodes {
+		if code < 100 || code > 599 {
+			return fmt.Errorf("invalid retryable status code %d", code)
+		}
+	}
+
+	return nil
+}
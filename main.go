@@ -1,9 +1,12 @@
 package main
 
 import (
+	"flag"
+	"fmt"
 	"log"
 	"net"
 	"net/http"
+	"os"
 
 	"github.com/gorilla/mux"
 	"github.com/nutrixpos/hub/common"
@@ -22,6 +25,27 @@ func main() {
 	// Create the configuration using the Viper config backend
 	conf := config.ConfigFactory("viper", "config.yaml", &logger)
 
+	// rotate-secret-keys re-encrypts the secret env vars and signing secrets with new data keys wrapped by the current master key, then exits
+	if len(os.Args) > 1 && os.Args[1] == "rotate-secret-keys" {
+		flags := flag.NewFlagSet("rotate-secret-keys", flag.ExitOnError)
+		tenant_id := flags.String("tenant", "", "rotate the data key of this tenant only")
+		flags.Parse(os.Args[2:])
+
+		workflows_svc := hub_services.WorkflowsService{
+			Config: conf,
+			Logger: &logger,
+		}
+
+		rotated, err := workflows_svc.RotateSecretsKeys(*tenant_id)
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+
+		logger.Info(fmt.Sprintf("rotated the secrets data keys of %d tenants", rotated))
+		return
+	}
+
 	seeder_svc := hub_services.SeederService{
 		Config: &conf,
 	}
@@ -9,6 +9,7 @@ import (
 	"fmt"
 
 	"github.com/nutrixpos/hub/common"
+	"github.com/nutrixpos/hub/common/workflows"
 	"github.com/nutrixpos/pos/common/customerrors"
 	"github.com/nutrixpos/pos/common/logger"
 )
@@ -30,6 +31,16 @@ type AppManager struct {
 // Run starts all saved module builders by igniting each module.
 func (manager *AppManager) Run() (err error) {
 
+	// workflow types are registered first, the modules running the workflows rely on them when started
+	for _, saved_module_builder := range saved_module_builders {
+		if m, ok := saved_module_builder.module.(IWorkflowTypesModule); ok {
+			err = m.RegisterWorkflowTypes(workflows.Types)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
 	for _, saved_module_builder := range saved_module_builders {
 		manager.RunModule(saved_module_builder.module_name, manager.Logger, saved_module_builder)
 	}
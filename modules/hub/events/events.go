@@ -1,7 +1,11 @@
 package events
 
+import "github.com/nutrixpos/hub/modules/hub/models"
+
 const (
-	EventLowStockId = "event_low_stock"
+	EventLowStockId       = "event_low_stock"
+	EventOrderIngestedId  = "event_order_ingested"
+	EventRefundIngestedId = "event_refund_ingested"
 )
 
 type EventLowStockData struct {
@@ -11,3 +15,17 @@ type EventLowStockData struct {
 	Threshold float64
 	Current   float64
 }
+
+// EventOrderIngestedData holds the orders newly ingested from the logs of a branch.
+type EventOrderIngestedData struct {
+	TenantId string
+	Label    string
+	Orders   []models.SalesPerDayOrder
+}
+
+// EventRefundIngestedData holds the refunds newly ingested from the logs of a branch.
+type EventRefundIngestedData struct {
+	TenantId string
+	Label    string
+	Refunds  []models.LogOrderItemRefund
+}
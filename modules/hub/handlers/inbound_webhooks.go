@@ -0,0 +1,96 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/nutrixpos/hub/common/config"
+	"github.com/nutrixpos/hub/modules/hub/services"
+	"github.com/nutrixpos/pos/common/logger"
+	core_handlers "github.com/nutrixpos/pos/modules/core/handlers"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// inboundWebhookMaxBodySize is the largest body an inbound webhook accepts.
+const inboundWebhookMaxBodySize = 1 << 20
+
+// InboundWebhookPOST starts the workflow whose inbound webhook trigger holds the token of the url, it is called
+// by external systems so the token is its only credential. The run is queued and 202 is returned right away.
+func InboundWebhookPOST(config config.Config, logger logger.ILogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		token := mux.Vars(r)["token"]
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, inboundWebhookMaxBodySize))
+		var max_bytes_err *http.MaxBytesError
+		if errors.As(err, &max_bytes_err) {
+			http.Error(w, fmt.Sprintf("Request body is larger than %d bytes", inboundWebhookMaxBodySize), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		workflows_svc := services.WorkflowsService{
+			Config: config,
+			Logger: logger,
+		}
+
+		workflow_id, err := workflows_svc.ReceiveInboundWebhook(token, r.Header, body)
+		if err == mongo.ErrNoDocuments {
+			http.Error(w, "Webhook not found", http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, services.ErrWorkflowDisabled) {
+			http.Error(w, "The workflow of the webhook is disabled", http.StatusConflict)
+			return
+		}
+		if errors.Is(err, services.ErrWorkflowSignatureInvalid) {
+			http.Error(w, "Invalid signature", http.StatusUnauthorized)
+			return
+		}
+		if errors.Is(err, services.ErrInboundWebhookBodyInvalid) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var schema_err *services.InboundWebhookSchemaError
+		if errors.As(err, &schema_err) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"errors": schema_err.Errors,
+			})
+			return
+		}
+
+		if errors.Is(err, services.ErrWorkflowQueueFull) {
+			http.Error(w, "The workflow queue is full, retry later", http.StatusServiceUnavailable)
+			logger.Warning(fmt.Sprintf("WARNING: %v", err))
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to receive the webhook", http.StatusInternalServerError)
+			logger.Error(fmt.Sprintf("ERROR: %v", err))
+			return
+		}
+
+		response := core_handlers.JSONApiOkResponse{
+			Data: map[string]string{
+				"workflow_id": workflow_id,
+			},
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			logger.Error(err.Error())
+			return
+		}
+	}
+}
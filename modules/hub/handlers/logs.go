@@ -10,6 +10,7 @@ import (
 	"github.com/mitchellh/mapstructure"
 	"github.com/nutrixpos/hub/common"
 	"github.com/nutrixpos/hub/common/config"
+	"github.com/nutrixpos/hub/modules/hub/events"
 	"github.com/nutrixpos/hub/modules/hub/models"
 	"github.com/nutrixpos/hub/modules/hub/services"
 	"github.com/nutrixpos/pos/common/logger"
@@ -18,7 +19,7 @@ import (
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-func LogsPost(config config.Config, logger logger.ILogger) http.HandlerFunc {
+func LogsPost(config config.Config, logger logger.ILogger, event_manager common.EventManager) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 
 		tenant_id := "1"
@@ -173,21 +174,37 @@ func LogsPost(config config.Config, logger logger.ILogger) http.HandlerFunc {
 			}
 
 			if len(client_sales_orders) > 0 {
-				err = sales_svc.InsertClientSalesOrders(tenant_id, client_sales_orders)
+				inserted_orders, err := sales_svc.InsertClientSalesOrders(tenant_id, client_sales_orders)
 				if err != nil {
 					http.Error(w, "Failed to insert logs", http.StatusInternalServerError)
 					logger.Error(fmt.Sprintf("ERROR: %v", err))
 					return
 				}
+
+				if len(inserted_orders) > 0 {
+					event_manager.Publish(events.EventOrderIngestedId, events.EventOrderIngestedData{
+						TenantId: tenant_id,
+						Label:    label,
+						Orders:   inserted_orders,
+					})
+				}
 			}
 
 			if len(client_sales_refunds) > 0 {
-				err = sales_svc.InsertClientSalesRefunds(tenant_id, client_sales_refunds)
+				inserted_refunds, err := sales_svc.InsertClientSalesRefunds(tenant_id, client_sales_refunds)
 				if err != nil {
 					http.Error(w, "Failed to insert logs", http.StatusInternalServerError)
 					logger.Error(fmt.Sprintf("ERROR: %v", err))
 					return
 				}
+
+				if len(inserted_refunds) > 0 {
+					event_manager.Publish(events.EventRefundIngestedId, events.EventRefundIngestedData{
+						TenantId: tenant_id,
+						Label:    label,
+						Refunds:  inserted_refunds,
+					})
+				}
 			}
 
 		}
@@ -0,0 +1,120 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/nutrixpos/hub/common/config"
+	"github.com/nutrixpos/hub/modules/hub/services"
+	"github.com/nutrixpos/pos/common/logger"
+	core_handlers "github.com/nutrixpos/pos/modules/core/handlers"
+)
+
+// SigningSecretsGET returns the signing secrets of the tenant still valid, the current one with its value
+// so it can be configured on the receivers. See services.VerifyWorkflowSignature for the verification scheme.
+func SigningSecretsGET(config config.Config, logger logger.ILogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		tenant_id, ok := requestTenantID(config, logger, w, r)
+		if !ok {
+			return
+		}
+
+		workflows_svc := services.WorkflowsService{
+			Config: config,
+			Logger: logger,
+		}
+
+		secrets, err := workflows_svc.GetSigningSecrets(tenant_id)
+		if errors.Is(err, services.ErrSecretsMasterKeyMissing) {
+			http.Error(w, "Signing secrets can't be stored, the secrets master key is not configured", http.StatusInternalServerError)
+			logger.Error(fmt.Sprintf("ERROR: %v", err))
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to get the signing secrets", http.StatusInternalServerError)
+			logger.Error(fmt.Sprintf("ERROR: %v", err))
+			return
+		}
+
+		response := core_handlers.JSONApiOkResponse{
+			Meta: core_handlers.JSONAPIMeta{
+				TotalRecords: len(secrets),
+			},
+			Data: secrets,
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// SigningSecretRotatePOST makes a new signing secret the current one, the previous one keeps signing
+// for grace_period_minutes (a day by default) so the receivers can be updated, 0 revokes it right away.
+func SigningSecretRotatePOST(config config.Config, logger logger.ILogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		tenant_id, ok := requestTenantID(config, logger, w, r)
+		if !ok {
+			return
+		}
+
+		request := struct {
+			Data struct {
+				GracePeriodMinutes *int `json:"grace_period_minutes"`
+			} `json:"data"`
+		}{}
+
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil && err != io.EOF {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		grace_period := services.DefaultSigningSecretGracePeriod
+		if request.Data.GracePeriodMinutes != nil {
+			if *request.Data.GracePeriodMinutes < 0 || *request.Data.GracePeriodMinutes > 7*24*60 {
+				http.Error(w, "grace_period_minutes must be between 0 and 10080", http.StatusBadRequest)
+				return
+			}
+			grace_period = time.Duration(*request.Data.GracePeriodMinutes) * time.Minute
+		}
+
+		workflows_svc := services.WorkflowsService{
+			Config: config,
+			Logger: logger,
+		}
+
+		secrets, err := workflows_svc.RotateSigningSecret(tenant_id, grace_period)
+		if errors.Is(err, services.ErrSecretsMasterKeyMissing) {
+			http.Error(w, "Signing secrets can't be stored, the secrets master key is not configured", http.StatusInternalServerError)
+			logger.Error(fmt.Sprintf("ERROR: %v", err))
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to rotate the signing secret", http.StatusInternalServerError)
+			logger.Error(fmt.Sprintf("ERROR: %v", err))
+			return
+		}
+
+		response := core_handlers.JSONApiOkResponse{
+			Meta: core_handlers.JSONAPIMeta{
+				TotalRecords: len(secrets),
+			},
+			Data: secrets,
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
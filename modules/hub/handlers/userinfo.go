@@ -0,0 +1,98 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/nutrixpos/hub/common/config"
+	"github.com/nutrixpos/pos/common/logger"
+)
+
+// requestTenantID returns the tenant of the request from the X-Userinfo header, defaulting to tenant "1" in dev.
+// It writes the error response and returns false when the header is missing or invalid.
+func requestTenantID(config config.Config, logger logger.ILogger, w http.ResponseWriter, r *http.Request) (tenant_id string, ok bool) {
+
+	tenant_id = "1"
+
+	if config.Env == "dev" {
+		return tenant_id, true
+	}
+
+	token := r.Header.Get("X-Userinfo")
+	if token == "" {
+		http.Error(w, "X-Userinfo header is required", http.StatusBadRequest)
+		return "", false
+	}
+
+	claims, err := userInfoClaims(token)
+	if err != nil {
+		http.Error(w, "Invalid X-Userinfo header", http.StatusBadRequest)
+		logger.Error(fmt.Sprintf("ERROR: %v", err))
+		return "", false
+	}
+
+	tenant_id, ok = claims["tenant_id"].(string)
+	if !ok || tenant_id == "" {
+		http.Error(w, "tenant_id claim is required and must be a string", http.StatusBadRequest)
+		logger.Error("ERROR: tenant_id claim is required and must be a string")
+		return "", false
+	}
+
+	return tenant_id, true
+}
+
+// requestUserName returns who sent the request from the X-Userinfo header, it is recorded with the decisions
+// taken through the api. The first of the name, preferred_username, email and sub claims is used, "dev" in dev.
+func requestUserName(config config.Config, r *http.Request) string {
+
+	if config.Env == "dev" {
+		return "dev"
+	}
+
+	claims, err := userInfoClaims(r.Header.Get("X-Userinfo"))
+	if err != nil {
+		return "unknown"
+	}
+
+	for _, claim := range []string{"name", "preferred_username", "email", "sub"} {
+		if name, ok := claims[claim].(string); ok && name != "" {
+			return name
+		}
+	}
+
+	return "unknown"
+}
+
+// requestUserEmail returns the email claim of the X-Userinfo header, empty in dev or when the claim is missing.
+func requestUserEmail(config config.Config, r *http.Request) string {
+
+	if config.Env == "dev" {
+		return ""
+	}
+
+	claims, err := userInfoClaims(r.Header.Get("X-Userinfo"))
+	if err != nil {
+		return ""
+	}
+
+	email, _ := claims["email"].(string)
+	return email
+}
+
+// userInfoClaims decodes the claims of the X-Userinfo header, a base64 encoded json object.
+func userInfoClaims(token string) (claims map[string]interface{}, err error) {
+
+	decodedData, err := base64.StdEncoding.DecodeString(token)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode token: %v", err)
+	}
+
+	err = json.Unmarshal(decodedData, &claims)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal token: %v", err)
+	}
+
+	return claims, nil
+}
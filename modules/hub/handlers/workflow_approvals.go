@@ -0,0 +1,189 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/nutrixpos/hub/common/config"
+	"github.com/nutrixpos/hub/modules/hub/services"
+	"github.com/nutrixpos/pos/common/logger"
+	core_handlers "github.com/nutrixpos/pos/modules/core/handlers"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// WorkflowApprovalsGET lists the approvals of the tenant newest first, they can be narrowed
+// with the status and workflow_id query params.
+func WorkflowApprovalsGET(config config.Config, logger logger.ILogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		page_number, err := strconv.Atoi(r.URL.Query().Get("page[number]"))
+		if err != nil || page_number == 0 {
+			page_number = 1
+		}
+
+		page_size, err := strconv.Atoi(r.URL.Query().Get("page[size]"))
+		if err != nil || page_size == 0 {
+			page_size = 50
+		}
+
+		tenant_id, ok := requestTenantID(config, logger, w, r)
+		if !ok {
+			return
+		}
+
+		workflows_svc := services.WorkflowsService{
+			Config: config,
+			Logger: logger,
+		}
+
+		approvals, total_records, err := workflows_svc.GetWorkflowApprovals(tenant_id, r.URL.Query().Get("status"), r.URL.Query().Get("workflow_id"), page_number, page_size)
+		if err != nil {
+			http.Error(w, "Failed to fetch workflow approvals", http.StatusInternalServerError)
+			logger.Error(fmt.Sprintf("ERROR: %v", err))
+			return
+		}
+
+		response := core_handlers.JSONApiOkResponse{
+			Meta: core_handlers.JSONAPIMeta{
+				TotalRecords: total_records,
+			},
+			Data: approvals,
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// WorkflowApprovalGET returns an approval with the input its run resumes with.
+func WorkflowApprovalGET(config config.Config, logger logger.ILogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		id := mux.Vars(r)["id"]
+		if id == "" {
+			http.Error(w, "id is required", http.StatusBadRequest)
+			return
+		}
+
+		tenant_id, ok := requestTenantID(config, logger, w, r)
+		if !ok {
+			return
+		}
+
+		workflows_svc := services.WorkflowsService{
+			Config: config,
+			Logger: logger,
+		}
+
+		approval, err := workflows_svc.GetWorkflowApproval(tenant_id, id)
+		if err == mongo.ErrNoDocuments {
+			http.Error(w, "Workflow approval not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to fetch workflow approval", http.StatusInternalServerError)
+			logger.Error(fmt.Sprintf("ERROR: %v", err))
+			return
+		}
+
+		response := core_handlers.JSONApiOkResponse{
+			Data: approval,
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// WorkflowApprovalApprovePOST approves a pending approval, its run resumes in the background.
+func WorkflowApprovalApprovePOST(config config.Config, logger logger.ILogger) http.HandlerFunc {
+	return decideWorkflowApproval(config, logger, true)
+}
+
+// WorkflowApprovalRejectPOST rejects a pending approval, its run is cancelled.
+func WorkflowApprovalRejectPOST(config config.Config, logger logger.ILogger) http.HandlerFunc {
+	return decideWorkflowApproval(config, logger, false)
+}
+
+// decideWorkflowApproval records the decision of the requester, who must be one of the approvers, with the
+// optional comment of the payload.
+func decideWorkflowApproval(config config.Config, logger logger.ILogger, approve bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		id := mux.Vars(r)["id"]
+		if id == "" {
+			http.Error(w, "id is required", http.StatusBadRequest)
+			return
+		}
+
+		tenant_id, ok := requestTenantID(config, logger, w, r)
+		if !ok {
+			return
+		}
+
+		request := struct {
+			Data struct {
+				Comment string `json:"comment"`
+			} `json:"data"`
+		}{}
+
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+				http.Error(w, "Invalid request payload", http.StatusBadRequest)
+				logger.Error(fmt.Sprintf("ERROR: %v", err))
+				return
+			}
+		}
+
+		// only the approvers decide, they are told apart by their email
+		approver_email := requestUserEmail(config, r)
+		if config.Env != "dev" && approver_email == "" {
+			http.Error(w, "email claim is required to decide workflow approvals", http.StatusForbidden)
+			return
+		}
+
+		workflows_svc := services.WorkflowsService{
+			Config: config,
+			Logger: logger,
+		}
+
+		approval, err := workflows_svc.DecideWorkflowApproval(tenant_id, id, approve, requestUserName(config, r), approver_email, request.Data.Comment)
+		if err == mongo.ErrNoDocuments {
+			http.Error(w, "Workflow approval not found", http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, services.ErrWorkflowApprovalForbidden) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if errors.Is(err, services.ErrWorkflowApprovalDecided) || errors.Is(err, services.ErrWorkflowRunFinished) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to decide workflow approval", http.StatusInternalServerError)
+			logger.Error(fmt.Sprintf("ERROR: %v", err))
+			return
+		}
+
+		response := core_handlers.JSONApiOkResponse{
+			Data: approval,
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/nutrixpos/hub/common/config"
+	"github.com/nutrixpos/hub/modules/hub/services"
+	"github.com/nutrixpos/pos/common/logger"
+	core_handlers "github.com/nutrixpos/pos/modules/core/handlers"
+	"go.mongodb.org/mongo-driver/mongo"
+	"gopkg.in/yaml.v3"
+)
+
+// WorkflowsExportGET downloads the workflows listed by the comma separated ids query param, all of them when
+// it is empty, as a bundle in the format query param, json (default) or yaml.
+func WorkflowsExportGET(config config.Config, logger logger.ILogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		format := r.URL.Query().Get("format")
+		if format == "" {
+			format = "json"
+		}
+
+		if format != "json" && format != "yaml" {
+			http.Error(w, "format must be json or yaml", http.StatusBadRequest)
+			return
+		}
+
+		workflow_ids := make([]string, 0)
+		for _, workflow_id := range strings.Split(r.URL.Query().Get("ids"), ",") {
+			if workflow_id = strings.TrimSpace(workflow_id); workflow_id != "" {
+				workflow_ids = append(workflow_ids, workflow_id)
+			}
+		}
+
+		tenant_id, ok := requestTenantID(config, logger, w, r)
+		if !ok {
+			return
+		}
+
+		workflows_svc := services.WorkflowsService{
+			Config: config,
+			Logger: logger,
+		}
+
+		bundle, err := workflows_svc.ExportWorkflowBundle(tenant_id, workflow_ids)
+		if err == mongo.ErrNoDocuments {
+			http.Error(w, "Workflow not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to export workflows", http.StatusInternalServerError)
+			logger.Error(fmt.Sprintf("ERROR: %v", err))
+			return
+		}
+
+		var content []byte
+		if format == "yaml" {
+			content, err = yaml.Marshal(bundle)
+			w.Header().Set("Content-Type", "application/yaml")
+		} else {
+			content, err = json.MarshalIndent(bundle, "", "  ")
+			w.Header().Set("Content-Type", "application/json")
+		}
+		if err != nil {
+			http.Error(w, "Failed to export workflows", http.StatusInternalServerError)
+			logger.Error(fmt.Sprintf("ERROR: %v", err))
+			return
+		}
+
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="workflows.%s"`, format))
+		w.Write(content)
+	}
+}
+
+// WorkflowsImportPOST imports the workflows of the bundle in data.bundle, sent as an exported object or as its
+// json or yaml text. The env vars and inventory items it references are mapped by data.env_vars and
+// data.inventory_items. Without data.confirm nothing is saved and the outcome of the import is returned for review,
+// a confirmed import of invalid workflows is refused with 422.
+func WorkflowsImportPOST(config config.Config, logger logger.ILogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		request := struct {
+			Data struct {
+				Bundle interface{} `json:"bundle"`
+				services.WorkflowBundleImportOptions
+			} `json:"data"`
+		}{}
+
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+
+		if request.Data.Bundle == nil {
+			http.Error(w, "data.bundle is required", http.StatusBadRequest)
+			return
+		}
+
+		bundle, err := services.ParseWorkflowBundle(request.Data.Bundle)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		tenant_id, ok := requestTenantID(config, logger, w, r)
+		if !ok {
+			return
+		}
+
+		workflows_svc := services.WorkflowsService{
+			Config: config,
+			Logger: logger,
+		}
+
+		result, err := workflows_svc.ImportWorkflowBundle(tenant_id, bundle, request.Data.WorkflowBundleImportOptions)
+		if errors.Is(err, services.ErrSecretsMasterKeyMissing) {
+			http.Error(w, "Secret env vars can't be stored, the secrets master key is not configured", http.StatusInternalServerError)
+			logger.Error(fmt.Sprintf("ERROR: %v", err))
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to import workflows", http.StatusInternalServerError)
+			logger.Error(fmt.Sprintf("ERROR: %v", err))
+			return
+		}
+
+		response := core_handlers.JSONApiOkResponse{
+			Meta: core_handlers.JSONAPIMeta{
+				TotalRecords: len(result.Workflows),
+			},
+			Data: result,
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if request.Data.Confirm && !result.Imported {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+		}
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
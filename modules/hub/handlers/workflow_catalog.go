@@ -0,0 +1,69 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/nutrixpos/hub/common/config"
+	"github.com/nutrixpos/hub/common/workflows"
+	"github.com/nutrixpos/pos/common/logger"
+	core_handlers "github.com/nutrixpos/pos/modules/core/handlers"
+)
+
+// WorkflowsCatalogGET lists the trigger and action types workflows can be built from with the
+// JSON schema of their definitions, the workflow editor renders its forms from it.
+func WorkflowsCatalogGET(config config.Config, logger logger.ILogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		_, ok := requestTenantID(config, logger, w, r)
+		if !ok {
+			return
+		}
+
+		catalog := workflows.Types.Catalog()
+
+		response := core_handlers.JSONApiOkResponse{
+			Meta: core_handlers.JSONAPIMeta{
+				TotalRecords: len(catalog.Triggers) + len(catalog.Actions),
+			},
+			Data: catalog,
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// WorkflowCatalogSchemaGET returns the JSON schema of a trigger or action type as a standalone document,
+// it is what the workflows being saved are validated against.
+func WorkflowCatalogSchemaGET(config config.Config, logger logger.ILogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		_, ok := requestTenantID(config, logger, w, r)
+		if !ok {
+			return
+		}
+
+		definition_type := mux.Vars(r)["type"]
+
+		var schema map[string]interface{}
+		if trigger, ok := workflows.Types.Trigger(definition_type); ok {
+			schema = trigger.Describe().Schema
+		} else if action, ok := workflows.Types.Action(definition_type); ok {
+			schema = action.Describe().Schema
+		} else {
+			http.Error(w, "Workflow type not found", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/schema+json")
+		if err := json.NewEncoder(w).Encode(schema); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
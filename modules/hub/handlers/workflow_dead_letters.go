@@ -0,0 +1,162 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/nutrixpos/hub/common/config"
+	"github.com/nutrixpos/hub/modules/hub/services"
+	"github.com/nutrixpos/pos/common/logger"
+	core_handlers "github.com/nutrixpos/pos/modules/core/handlers"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// WorkflowDeadLettersGET lists the dead letters of the tenant, they can be narrowed
+// with the status and workflow_id query params.
+func WorkflowDeadLettersGET(config config.Config, logger logger.ILogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		page_number, err := strconv.Atoi(r.URL.Query().Get("page[number]"))
+		if err != nil || page_number == 0 {
+			page_number = 1
+		}
+
+		page_size, err := strconv.Atoi(r.URL.Query().Get("page[size]"))
+		if err != nil || page_size == 0 {
+			page_size = 50
+		}
+
+		tenant_id, ok := requestTenantID(config, logger, w, r)
+		if !ok {
+			return
+		}
+
+		workflows_svc := services.WorkflowsService{
+			Config: config,
+			Logger: logger,
+		}
+
+		dead_letters, total_records, err := workflows_svc.GetDeadLetters(tenant_id, r.URL.Query().Get("status"), r.URL.Query().Get("workflow_id"), page_number, page_size)
+		if err != nil {
+			http.Error(w, "Failed to fetch dead letters", http.StatusInternalServerError)
+			logger.Error(fmt.Sprintf("ERROR: %v", err))
+			return
+		}
+
+		response := core_handlers.JSONApiOkResponse{
+			Meta: core_handlers.JSONAPIMeta{
+				TotalRecords: total_records,
+			},
+			Data: dead_letters,
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// WorkflowDeadLetterGET returns a dead letter with the input of the failed action.
+func WorkflowDeadLetterGET(config config.Config, logger logger.ILogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		id := mux.Vars(r)["id"]
+		if id == "" {
+			http.Error(w, "id is required", http.StatusBadRequest)
+			return
+		}
+
+		tenant_id, ok := requestTenantID(config, logger, w, r)
+		if !ok {
+			return
+		}
+
+		workflows_svc := services.WorkflowsService{
+			Config: config,
+			Logger: logger,
+		}
+
+		dead_letter, err := workflows_svc.GetDeadLetter(tenant_id, id)
+		if err == mongo.ErrNoDocuments {
+			http.Error(w, "Dead letter not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to fetch dead letter", http.StatusInternalServerError)
+			logger.Error(fmt.Sprintf("ERROR: %v", err))
+			return
+		}
+
+		response := core_handlers.JSONApiOkResponse{
+			Data: dead_letter,
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// WorkflowDeadLetterRedrivePOST redrives a pending dead letter into a new run of its workflow,
+// the id of the new run is returned while it executes in the background.
+func WorkflowDeadLetterRedrivePOST(config config.Config, logger logger.ILogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		id := mux.Vars(r)["id"]
+		if id == "" {
+			http.Error(w, "id is required", http.StatusBadRequest)
+			return
+		}
+
+		tenant_id, ok := requestTenantID(config, logger, w, r)
+		if !ok {
+			return
+		}
+
+		workflows_svc := services.WorkflowsService{
+			Config: config,
+			Logger: logger,
+		}
+
+		run_id, err := workflows_svc.RedriveDeadLetter(tenant_id, id)
+		if err == mongo.ErrNoDocuments {
+			http.Error(w, "Dead letter not found", http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, services.ErrDeadLetterRedriven) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if errors.Is(err, services.ErrWorkflowQueueFull) {
+			http.Error(w, "The workflow queue is full, retry later", http.StatusServiceUnavailable)
+			logger.Warning(fmt.Sprintf("WARNING: %v", err))
+			return
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to redrive dead letter: %v", err), http.StatusInternalServerError)
+			logger.Error(fmt.Sprintf("ERROR: %v", err))
+			return
+		}
+
+		response := core_handlers.JSONApiOkResponse{
+			Data: map[string]string{
+				"run_id": run_id,
+			},
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			logger.Error(err.Error())
+			return
+		}
+	}
+}
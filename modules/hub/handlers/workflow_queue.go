@@ -0,0 +1,41 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/nutrixpos/hub/common/config"
+	"github.com/nutrixpos/hub/modules/hub/models"
+	"github.com/nutrixpos/hub/modules/hub/services"
+	"github.com/nutrixpos/pos/common/logger"
+	core_handlers "github.com/nutrixpos/pos/modules/core/handlers"
+)
+
+// WorkflowQueueGET returns the depth of the workflow execution queue as seen by the tenant of the request,
+// the other tenants runs aren't counted.
+func WorkflowQueueGET(config config.Config, logger logger.ILogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		tenant_id, ok := requestTenantID(config, logger, w, r)
+		if !ok {
+			return
+		}
+
+		stats := models.WorkflowQueueStats{
+			Tenants: make([]models.WorkflowQueueTenantStats, 0),
+		}
+		if services.WorkflowQueue != nil {
+			stats = services.WorkflowQueue.Stats(tenant_id)
+		}
+
+		response := core_handlers.JSONApiOkResponse{
+			Data: stats,
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
@@ -0,0 +1,373 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/nutrixpos/hub/common/config"
+	"github.com/nutrixpos/hub/modules/hub/models"
+	"github.com/nutrixpos/hub/modules/hub/services"
+	"github.com/nutrixpos/pos/common/logger"
+	core_handlers "github.com/nutrixpos/pos/modules/core/handlers"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// WorkflowRunsPOST starts a run of the workflow with the payload of the request, or the sample payload
+// of its trigger when none is given. With dry_run the outbound requests are resolved and returned instead of sent.
+func WorkflowRunsPOST(config config.Config, logger logger.ILogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		workflow_id := mux.Vars(r)["id"]
+		if workflow_id == "" {
+			http.Error(w, "id is required", http.StatusBadRequest)
+			return
+		}
+
+		tenant_id, ok := requestTenantID(config, logger, w, r)
+		if !ok {
+			return
+		}
+
+		request := struct {
+			Data struct {
+				Payload interface{} `json:"payload"`
+				DryRun  bool        `json:"dry_run"`
+			} `json:"data"`
+		}{}
+
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+				http.Error(w, "Invalid request payload", http.StatusBadRequest)
+				logger.Error(fmt.Sprintf("ERROR: %v", err))
+				return
+			}
+		}
+
+		workflows_svc := services.WorkflowsService{
+			Config: config,
+			Logger: logger,
+		}
+
+		var response core_handlers.JSONApiOkResponse
+		status := http.StatusAccepted
+
+		if request.Data.DryRun {
+			steps, err := workflows_svc.DryRunWorkflow(tenant_id, workflow_id, request.Data.Payload)
+			if err == mongo.ErrNoDocuments {
+				http.Error(w, "Workflow not found", http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Failed to dry run workflow: %v", err), http.StatusBadRequest)
+				logger.Error(fmt.Sprintf("ERROR: %v", err))
+				return
+			}
+
+			response.Meta.TotalRecords = len(steps)
+			response.Data = steps
+			status = http.StatusOK
+		} else {
+			run_id, err := workflows_svc.StartManualRun(tenant_id, workflow_id, request.Data.Payload)
+			if err == mongo.ErrNoDocuments {
+				http.Error(w, "Workflow not found", http.StatusNotFound)
+				return
+			}
+			if errors.Is(err, services.ErrWorkflowQueueFull) {
+				http.Error(w, "The workflow queue is full, retry later", http.StatusServiceUnavailable)
+				logger.Warning(fmt.Sprintf("WARNING: %v", err))
+				return
+			}
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Failed to run workflow: %v", err), http.StatusBadRequest)
+				logger.Error(fmt.Sprintf("ERROR: %v", err))
+				return
+			}
+
+			response.Data = map[string]string{
+				"run_id": run_id,
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			logger.Error(err.Error())
+			return
+		}
+	}
+}
+
+// WorkflowRunCancelPOST cancels a running run of the workflow, the action in flight is interrupted and the
+// remaining steps are skipped. An optional data.reason is recorded in the run logs, the cancelled run is returned.
+func WorkflowRunCancelPOST(config config.Config, logger logger.ILogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		params := mux.Vars(r)
+		workflow_id, run_id := params["id"], params["run_id"]
+		if workflow_id == "" || run_id == "" {
+			http.Error(w, "id and run_id are required", http.StatusBadRequest)
+			return
+		}
+
+		tenant_id, ok := requestTenantID(config, logger, w, r)
+		if !ok {
+			return
+		}
+
+		request := struct {
+			Data struct {
+				Reason string `json:"reason"`
+			} `json:"data"`
+		}{}
+
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+				http.Error(w, "Invalid request payload", http.StatusBadRequest)
+				logger.Error(fmt.Sprintf("ERROR: %v", err))
+				return
+			}
+		}
+
+		workflows_svc := services.WorkflowsService{
+			Config: config,
+			Logger: logger,
+		}
+
+		err := workflows_svc.CancelWorkflowRun(tenant_id, workflow_id, run_id, request.Data.Reason)
+		if err == mongo.ErrNoDocuments {
+			http.Error(w, "Workflow run not found", http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, services.ErrWorkflowRunFinished) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to cancel workflow run", http.StatusInternalServerError)
+			logger.Error(fmt.Sprintf("ERROR: %v", err))
+			return
+		}
+
+		run, err := workflows_svc.GetWorkflowRun(tenant_id, workflow_id, run_id)
+		if err != nil {
+			http.Error(w, "Failed to get workflow run", http.StatusInternalServerError)
+			logger.Error(fmt.Sprintf("ERROR: %v", err))
+			return
+		}
+
+		response := core_handlers.JSONApiOkResponse{
+			Data: run,
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// WorkflowRunsGET lists the runs of the workflow newest first, they can be narrowed with the status query param
+// and the from and to query params (RFC3339) bounding their start time.
+func WorkflowRunsGET(config config.Config, logger logger.ILogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		workflow_id := mux.Vars(r)["id"]
+		if workflow_id == "" {
+			http.Error(w, "id is required", http.StatusBadRequest)
+			return
+		}
+
+		page_number, err := strconv.Atoi(r.URL.Query().Get("page[number]"))
+		if err != nil || page_number == 0 {
+			page_number = 1
+		}
+
+		page_size, err := strconv.Atoi(r.URL.Query().Get("page[size]"))
+		if err != nil || page_size == 0 {
+			page_size = 50
+		}
+
+		tenant_id, ok := requestTenantID(config, logger, w, r)
+		if !ok {
+			return
+		}
+
+		runs_filter := services.WorkflowRunsFilter{
+			Status: r.URL.Query().Get("status"),
+		}
+
+		if from := r.URL.Query().Get("from"); from != "" {
+			runs_filter.From, err = time.Parse(time.RFC3339, from)
+			if err != nil {
+				http.Error(w, "from must be an RFC3339 time", http.StatusBadRequest)
+				return
+			}
+		}
+
+		if to := r.URL.Query().Get("to"); to != "" {
+			runs_filter.To, err = time.Parse(time.RFC3339, to)
+			if err != nil {
+				http.Error(w, "to must be an RFC3339 time", http.StatusBadRequest)
+				return
+			}
+		}
+
+		workflows_svc := services.WorkflowsService{
+			Config: config,
+			Logger: logger,
+		}
+
+		runs, total_records, err := workflows_svc.GetWorkflowRuns(tenant_id, workflow_id, runs_filter, page_number, page_size)
+		if err != nil {
+			http.Error(w, "Failed to fetch workflow runs", http.StatusInternalServerError)
+			logger.Error(fmt.Sprintf("ERROR: %v", err))
+			return
+		}
+
+		response := core_handlers.JSONApiOkResponse{
+			Meta: core_handlers.JSONAPIMeta{
+				TotalRecords: total_records,
+			},
+			Data: runs,
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+const (
+	// workflowRunStreamPollInterval is how often a streamed run is read back while it runs.
+	workflowRunStreamPollInterval = 2 * time.Second
+	// workflowRunStreamPausedPollInterval is how often it is read back while paused, the updates
+	// made by this instance are still notified right away.
+	workflowRunStreamPausedPollInterval = 30 * time.Second
+)
+
+// WorkflowRunStreamGET streams the logs, step changes and status changes of a run as Server-Sent Events,
+// the run so far is sent first and the stream ends once the run reaches a final status.
+// A reconnecting stream resumes after the event of its Last-Event-ID header instead of from the start.
+// A run waiting for an approval or delayed is polled less often, as it may stay paused for hours.
+func WorkflowRunStreamGET(config config.Config, logger logger.ILogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		workflow_id := mux.Vars(r)["id"]
+		run_id := mux.Vars(r)["run_id"]
+		if workflow_id == "" || run_id == "" {
+			http.Error(w, "id and run_id are required", http.StatusBadRequest)
+			return
+		}
+
+		tenant_id, ok := requestTenantID(config, logger, w, r)
+		if !ok {
+			return
+		}
+
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+			return
+		}
+
+		// a reconnecting stream sends the id of the last event it got and goes on from there
+		var cursor services.WorkflowRunCursor
+		if last_event_id := r.Header.Get("Last-Event-ID"); last_event_id != "" {
+			var err error
+			cursor, err = services.ResumeWorkflowRunCursor(last_event_id)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		workflows_svc := services.WorkflowsService{
+			Config: config,
+			Logger: logger,
+		}
+
+		// subscribe before the first read so no update falls in between
+		updates, unsubscribe := services.SubscribeWorkflowRun(run_id)
+		defer unsubscribe()
+
+		run, err := workflows_svc.GetWorkflowRun(tenant_id, workflow_id, run_id)
+		if err == mongo.ErrNoDocuments {
+			http.Error(w, "Workflow run not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to fetch workflow run", http.StatusInternalServerError)
+			logger.Error(fmt.Sprintf("ERROR: %v", err))
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+
+		// runs updated by another instance aren't notified, they are polled
+		poll_interval := workflowRunStreamPollInterval
+		poll := time.NewTicker(poll_interval)
+		defer poll.Stop()
+
+		heartbeat := time.NewTicker(15 * time.Second)
+		defer heartbeat.Stop()
+
+		for {
+			for _, event := range cursor.Next(run) {
+				data, err := json.Marshal(event.Data)
+				if err != nil {
+					logger.Error(fmt.Sprintf("ERROR: %v", err))
+					return
+				}
+
+				_, err = fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", event.ID, event.Event, data)
+				if err != nil {
+					return
+				}
+			}
+			flusher.Flush()
+
+			if services.IsFinalWorkflowRunStatus(run.Status) {
+				return
+			}
+
+			interval := workflowRunStreamPollInterval
+			if run.Status == models.WorkflowRunStatusWaiting || run.Status == models.WorkflowRunStatusDelayed {
+				interval = workflowRunStreamPausedPollInterval
+			}
+			if interval != poll_interval {
+				poll_interval = interval
+				poll.Reset(poll_interval)
+			}
+
+			select {
+			case <-r.Context().Done():
+				return
+			case <-heartbeat.C:
+				fmt.Fprint(w, ": keep-alive\n\n")
+				flusher.Flush()
+				continue
+			case <-updates:
+			case <-poll.C:
+			}
+
+			run, err = workflows_svc.GetWorkflowRun(tenant_id, workflow_id, run_id)
+			if err != nil {
+				// the run can only vanish when purged, the stream can't go on either way
+				logger.Error(fmt.Sprintf("ERROR: %v", err))
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/nutrixpos/hub/common/config"
+	"github.com/nutrixpos/hub/modules/hub/services"
+	"github.com/nutrixpos/pos/common/logger"
+	core_handlers "github.com/nutrixpos/pos/modules/core/handlers"
+)
+
+// WorkflowStatsGET returns the run stats of the workflow over the from and to query params (RFC3339),
+// the last 7 days by default.
+func WorkflowStatsGET(config config.Config, logger logger.ILogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		workflow_id := mux.Vars(r)["id"]
+		if workflow_id == "" {
+			http.Error(w, "id is required", http.StatusBadRequest)
+			return
+		}
+
+		writeWorkflowRunStats(config, logger, w, r, workflow_id)
+	}
+}
+
+// WorkflowsStatsGET returns the run stats of all the workflows of the tenant over the from and to
+// query params (RFC3339), the last 7 days by default.
+func WorkflowsStatsGET(config config.Config, logger logger.ILogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeWorkflowRunStats(config, logger, w, r, "")
+	}
+}
+
+// writeWorkflowRunStats computes and writes the run stats of the workflow, or of the tenant when workflow_id is empty.
+func writeWorkflowRunStats(config config.Config, logger logger.ILogger, w http.ResponseWriter, r *http.Request, workflow_id string) {
+
+	var err error
+
+	to := time.Now()
+	if raw_to := r.URL.Query().Get("to"); raw_to != "" {
+		to, err = time.Parse(time.RFC3339, raw_to)
+		if err != nil {
+			http.Error(w, "to must be an RFC3339 time", http.StatusBadRequest)
+			return
+		}
+	}
+
+	from := to.AddDate(0, 0, -services.DefaultWorkflowRunStatsDays)
+	if raw_from := r.URL.Query().Get("from"); raw_from != "" {
+		from, err = time.Parse(time.RFC3339, raw_from)
+		if err != nil {
+			http.Error(w, "from must be an RFC3339 time", http.StatusBadRequest)
+			return
+		}
+	}
+
+	tenant_id, ok := requestTenantID(config, logger, w, r)
+	if !ok {
+		return
+	}
+
+	workflows_svc := services.WorkflowsService{
+		Config: config,
+		Logger: logger,
+	}
+
+	stats, err := workflows_svc.GetWorkflowRunStats(tenant_id, workflow_id, from, to)
+	if errors.Is(err, services.ErrWorkflowRunStatsWindow) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to compute workflow stats", http.StatusInternalServerError)
+		logger.Error(fmt.Sprintf("ERROR: %v", err))
+		return
+	}
+
+	response := core_handlers.JSONApiOkResponse{
+		Data: stats,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
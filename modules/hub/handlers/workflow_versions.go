@@ -0,0 +1,226 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/nutrixpos/hub/common/config"
+	"github.com/nutrixpos/hub/modules/hub/services"
+	"github.com/nutrixpos/pos/common/logger"
+	core_handlers "github.com/nutrixpos/pos/modules/core/handlers"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// WorkflowVersionsGET lists the saved versions of the workflow, newest first.
+func WorkflowVersionsGET(config config.Config, logger logger.ILogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		workflow_id := mux.Vars(r)["id"]
+		if workflow_id == "" {
+			http.Error(w, "id is required", http.StatusBadRequest)
+			return
+		}
+
+		page_number, err := strconv.Atoi(r.URL.Query().Get("page[number]"))
+		if err != nil || page_number == 0 {
+			page_number = 1
+		}
+
+		page_size, err := strconv.Atoi(r.URL.Query().Get("page[size]"))
+		if err != nil || page_size == 0 {
+			page_size = 50
+		}
+
+		tenant_id, ok := requestTenantID(config, logger, w, r)
+		if !ok {
+			return
+		}
+
+		workflows_svc := services.WorkflowsService{
+			Config: config,
+			Logger: logger,
+		}
+
+		versions, total_records, err := workflows_svc.GetWorkflowVersions(tenant_id, workflow_id, page_number, page_size)
+		if err != nil {
+			http.Error(w, "Failed to fetch workflow versions", http.StatusInternalServerError)
+			logger.Error(fmt.Sprintf("ERROR: %v", err))
+			return
+		}
+
+		response := core_handlers.JSONApiOkResponse{
+			Meta: core_handlers.JSONAPIMeta{
+				TotalRecords: total_records,
+			},
+			Data: versions,
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// WorkflowVersionGET returns a saved version of the workflow with its definition.
+func WorkflowVersionGET(config config.Config, logger logger.ILogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		params := mux.Vars(r)
+		workflow_id := params["id"]
+
+		version, err := strconv.Atoi(params["version"])
+		if err != nil {
+			http.Error(w, "version must be a number", http.StatusBadRequest)
+			return
+		}
+
+		tenant_id, ok := requestTenantID(config, logger, w, r)
+		if !ok {
+			return
+		}
+
+		workflows_svc := services.WorkflowsService{
+			Config: config,
+			Logger: logger,
+		}
+
+		workflow_version, err := workflows_svc.GetWorkflowVersion(tenant_id, workflow_id, version)
+		if err == mongo.ErrNoDocuments {
+			http.Error(w, "Workflow version not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to fetch workflow version", http.StatusInternalServerError)
+			logger.Error(fmt.Sprintf("ERROR: %v", err))
+			return
+		}
+
+		response := core_handlers.JSONApiOkResponse{
+			Data: workflow_version,
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// WorkflowVersionsDiffGET returns what changed between the versions given by the from and to query params.
+func WorkflowVersionsDiffGET(config config.Config, logger logger.ILogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		workflow_id := mux.Vars(r)["id"]
+		if workflow_id == "" {
+			http.Error(w, "id is required", http.StatusBadRequest)
+			return
+		}
+
+		from, err := strconv.Atoi(r.URL.Query().Get("from"))
+		if err != nil {
+			http.Error(w, "from must be a version number", http.StatusBadRequest)
+			return
+		}
+
+		to, err := strconv.Atoi(r.URL.Query().Get("to"))
+		if err != nil {
+			http.Error(w, "to must be a version number", http.StatusBadRequest)
+			return
+		}
+
+		tenant_id, ok := requestTenantID(config, logger, w, r)
+		if !ok {
+			return
+		}
+
+		workflows_svc := services.WorkflowsService{
+			Config: config,
+			Logger: logger,
+		}
+
+		changes, err := workflows_svc.DiffWorkflowVersions(tenant_id, workflow_id, from, to)
+		if err == mongo.ErrNoDocuments {
+			http.Error(w, "Workflow version not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to diff workflow versions", http.StatusInternalServerError)
+			logger.Error(fmt.Sprintf("ERROR: %v", err))
+			return
+		}
+
+		response := core_handlers.JSONApiOkResponse{
+			Meta: core_handlers.JSONAPIMeta{
+				TotalRecords: len(changes),
+			},
+			Data: changes,
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// WorkflowVersionRollbackPOST restores a previous version of the workflow, saving it as a new version.
+// A version that no longer validates, such as one reading a deleted env var, is refused with its field errors (422).
+func WorkflowVersionRollbackPOST(config config.Config, logger logger.ILogger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		params := mux.Vars(r)
+		workflow_id := params["id"]
+
+		version, err := strconv.Atoi(params["version"])
+		if err != nil {
+			http.Error(w, "version must be a number", http.StatusBadRequest)
+			return
+		}
+
+		tenant_id, ok := requestTenantID(config, logger, w, r)
+		if !ok {
+			return
+		}
+
+		workflows_svc := services.WorkflowsService{
+			Config: config,
+			Logger: logger,
+		}
+
+		new_version, err := workflows_svc.RollbackWorkflow(tenant_id, workflow_id, version)
+		if err == mongo.ErrNoDocuments {
+			http.Error(w, "Workflow version not found", http.StatusNotFound)
+			return
+		}
+		var validation_err *services.WorkflowValidationError
+		if errors.As(err, &validation_err) {
+			writeWorkflowValidationError(w, validation_err)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to roll back workflow", http.StatusInternalServerError)
+			logger.Error(fmt.Sprintf("ERROR: %v", err))
+			return
+		}
+
+		response := core_handlers.JSONApiOkResponse{
+			Data: map[string]int{
+				"version": new_version,
+			},
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"time"
@@ -13,6 +14,7 @@ import (
 	"github.com/nutrixpos/hub/common"
 	"github.com/nutrixpos/hub/common/config"
 	"github.com/nutrixpos/hub/modules/hub/models"
+	"github.com/nutrixpos/hub/modules/hub/services"
 	"github.com/nutrixpos/pos/common/logger"
 	core_handlers "github.com/nutrixpos/pos/modules/core/handlers"
 	"go.mongodb.org/mongo-driver/bson"
@@ -72,66 +74,27 @@ func EnvVarPATCH(config config.Config, logger logger.ILogger) http.HandlerFunc {
 			}
 		}
 
-		// Set up MongoDB connection
-		clientOptions := options.Client().ApplyURI(fmt.Sprintf("mongodb://%s:%v", config.Databases[0].Host, config.Databases[0].Port))
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-		defer cancel()
-
-		client, err := mongo.Connect(ctx, clientOptions)
-		if err != nil {
-			http.Error(w, "Failed to connect to database", http.StatusInternalServerError)
-			logger.Error(fmt.Sprintf("ERROR: %v", err))
-			return
-		}
-		defer client.Disconnect(ctx)
-		// Access the collection
-		collection := client.Database(config.Databases[0].Database).Collection(config.Databases[0].Tables["sales"])
-
 		request := struct {
 			Data models.WorkflowEnvVar `json:"data"`
 		}{}
 
-		err = json.NewDecoder(r.Body).Decode(&request)
+		err := json.NewDecoder(r.Body).Decode(&request)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
-		filter := bson.M{
-			"tenant_id":     tenant_id,
-			"env_vars.name": request.Data.Name,
+		workflows_svc := services.WorkflowsService{
+			Config: config,
+			Logger: logger,
 		}
-		update := bson.M{}
 
-		count, err := collection.CountDocuments(ctx, filter)
-		if err != nil {
-			http.Error(w, "Failed to count documents", http.StatusInternalServerError)
+		err = workflows_svc.SetEnvVar(tenant_id, request.Data)
+		if errors.Is(err, services.ErrSecretsMasterKeyMissing) {
+			http.Error(w, "Secret env vars can't be stored, the secrets master key is not configured", http.StatusInternalServerError)
 			logger.Error(fmt.Sprintf("ERROR: %v", err))
 			return
 		}
-
-		if count == 0 {
-			// Insert new env_var item if the item doesn't exist
-			filter = bson.M{"tenant_id": tenant_id}
-			update = bson.M{
-				"$push": bson.M{
-					"env_vars": bson.M{
-						"name":      request.Data.Name,
-						"value":     request.Data.Value,
-						"is_secret": request.Data.IsSecret,
-					},
-				},
-			}
-		} else {
-			// Update existing env_var item if the item exists
-			update = bson.M{
-				"$set": bson.M{
-					"env_vars.$.value": request.Data.Value,
-				},
-			}
-		}
-
-		_, err = collection.UpdateOne(ctx, filter, update, options.Update())
 		if err != nil {
 			http.Error(w, "Failed to update environment variable", http.StatusInternalServerError)
 			logger.Error(fmt.Sprintf("ERROR: %v", err))
@@ -211,6 +174,7 @@ func EnvVarsGet(config config.Config, logger logger.ILogger) http.HandlerFunc {
 		for i, env_var := range result.EnvVars {
 			env_vars[i] = env_var
 
+			// secrets are write only, their values are never returned
 			if env_var.IsSecret {
 				env_vars[i].Value = "********"
 			}
@@ -415,6 +379,8 @@ func WorkflowGET(config config.Config, logger logger.ILogger) http.HandlerFunc {
 			return
 		}
 
+		attachLatestWorkflowRuns(config, logger, tenant_id, result["workflows"].(primitive.A))
+
 		response := core_handlers.JSONApiOkResponse{
 			Meta: core_handlers.JSONAPIMeta{
 				TotalRecords: len(result["workflows"].(primitive.A)),
@@ -510,11 +476,14 @@ func WorkflowsGET(config config.Config, logger logger.ILogger) http.HandlerFunc
 			return
 		}
 
+		workflows, _ := result["workflows"].(primitive.A)
+		attachLatestWorkflowRuns(config, logger, tenant_id, workflows)
+
 		response := core_handlers.JSONApiOkResponse{
 			Meta: core_handlers.JSONAPIMeta{
-				TotalRecords: len(result["workflows"].(primitive.A)),
+				TotalRecords: len(workflows),
 			},
-			Data: result["workflows"],
+			Data: workflows,
 		}
 
 		jsonResponse, err := json.Marshal(response)
@@ -604,33 +573,28 @@ func WorkflowPOST(config config.Config, logger logger.ILogger) http.HandlerFunc
 		db_workflow := map[string]interface{}{}
 		db_workflow["actions"] = make([]interface{}, 0)
 
-		switch workflow.Trigger.Type {
-		case models.WorkflowTriggerTypeLowStockLabel:
-			var trigger models.WorkflowLowStockTrigger
-			err = mapstructure.Decode(request.Data["trigger"], &trigger)
-			if err != nil {
-				logger.Error(fmt.Sprintf("Failed to decode low stock trigger: %v", err))
-				http.Error(w, "Failed to decode low stock trigger", http.StatusBadRequest)
-				return
-			}
-			db_workflow["trigger"] = trigger
-			break
+		workflows_svc := services.WorkflowsService{
+			Config: config,
+			Logger: logger,
 		}
 
-		for index, action := range workflow.Actions {
-			switch action.Type {
-			case models.WorkflowActionTypeN8nWebhookLabel:
-				var webhookAction models.WorkflowN8nWebhookAction
-				err = mapstructure.Decode(request.Data["actions"].([]interface{})[index], &webhookAction)
-				if err != nil {
-					logger.Error(fmt.Sprintf("Failed to decode n8n webhook action: %v", err))
-					http.Error(w, "Failed to decode n8n webhook action", http.StatusBadRequest)
-					return
-				}
-				db_workflow["actions"] = append(db_workflow["actions"].([]interface{}), webhookAction)
-			}
+		trigger, actions, err := workflows_svc.DecodeWorkflowDefinition(tenant_id, request.Data)
+		var validation_err *services.WorkflowValidationError
+		if errors.As(err, &validation_err) {
+			writeWorkflowValidationError(w, validation_err)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to validate workflow", http.StatusInternalServerError)
+			logger.Error(fmt.Sprintf("ERROR: %v", err))
+			return
 		}
 
+		if trigger != nil {
+			db_workflow["trigger"] = trigger
+		}
+		db_workflow["actions"] = actions
+
 		// Set up MongoDB connection
 		clientOptions := options.Client().ApplyURI(fmt.Sprintf("mongodb://%s:%v", config.Databases[0].Host, config.Databases[0].Port))
 
@@ -657,7 +621,13 @@ func WorkflowPOST(config config.Config, logger logger.ILogger) http.HandlerFunc
 		db_workflow["description"] = workflow.Description
 		db_workflow["enabled"] = workflow.Enabled
 		db_workflow["status"] = "idle"
-		db_workflow["runs"] = make([]models.WorkflowRun, 0)
+
+		version, err := workflows_svc.RecordWorkflowVersion(tenant_id, db_workflow["id"].(string), db_workflow, "Created the workflow")
+		if err != nil {
+			http.Error(w, "Failed to record workflow version", http.StatusInternalServerError)
+			logger.Error(fmt.Sprintf("ERROR: %v", err))
+			return
+		}
 
 		// add new workflow
 		// Define the filter
@@ -667,6 +637,7 @@ func WorkflowPOST(config config.Config, logger logger.ILogger) http.HandlerFunc
 
 		_, err = collection.UpdateOne(ctx, filter, bson.M{"$push": bson.M{"workflows": db_workflow}})
 		if err != nil {
+			workflows_svc.DiscardWorkflowVersion(tenant_id, db_workflow["id"].(string), version)
 			http.Error(w, "Failed to insert workflow", http.StatusInternalServerError)
 			logger.Error(fmt.Sprintf("ERROR: %v", err))
 			return
@@ -760,32 +731,27 @@ func WorkflowPATCH(config config.Config, logger logger.ILogger) http.HandlerFunc
 		db_workflow := map[string]interface{}{}
 		db_workflow["actions"] = make([]interface{}, 0)
 
-		switch workflow.Trigger.Type {
-		case models.WorkflowTriggerTypeLowStockLabel:
-			var trigger models.WorkflowLowStockTrigger
-			err = mapstructure.Decode(request.Data["trigger"], &trigger)
-			if err != nil {
-				logger.Error(fmt.Sprintf("Failed to decode low stock trigger: %v", err))
-				http.Error(w, "Failed to decode low stock trigger", http.StatusBadRequest)
-				return
-			}
-			db_workflow["trigger"] = trigger
-			break
+		workflows_svc := services.WorkflowsService{
+			Config: config,
+			Logger: logger,
 		}
 
-		for index, action := range workflow.Actions {
-			switch action.Type {
-			case models.WorkflowActionTypeN8nWebhookLabel:
-				var webhookAction models.WorkflowN8nWebhookAction
-				err = mapstructure.Decode(request.Data["actions"].([]interface{})[index], &webhookAction)
-				if err != nil {
-					logger.Error(fmt.Sprintf("Failed to decode n8n webhook action: %v", err))
-					http.Error(w, "Failed to decode n8n webhook action", http.StatusBadRequest)
-					return
-				}
-				db_workflow["actions"] = append(db_workflow["actions"].([]interface{}), webhookAction)
-			}
+		trigger, actions, err := workflows_svc.DecodeWorkflowDefinition(tenant_id, request.Data)
+		var validation_err *services.WorkflowValidationError
+		if errors.As(err, &validation_err) {
+			writeWorkflowValidationError(w, validation_err)
+			return
 		}
+		if err != nil {
+			http.Error(w, "Failed to validate workflow", http.StatusInternalServerError)
+			logger.Error(fmt.Sprintf("ERROR: %v", err))
+			return
+		}
+
+		if trigger != nil {
+			db_workflow["trigger"] = trigger
+		}
+		db_workflow["actions"] = actions
 
 		// Set up MongoDB connection
 		clientOptions := options.Client().ApplyURI(fmt.Sprintf("mongodb://%s:%v", config.Databases[0].Host, config.Databases[0].Port))
@@ -812,7 +778,18 @@ func WorkflowPATCH(config config.Config, logger logger.ILogger) http.HandlerFunc
 		db_workflow["name"] = workflow.Name
 		db_workflow["description"] = workflow.Description
 		db_workflow["enabled"] = workflow.Enabled
-		db_workflow["runs"] = workflow.Runs
+
+		comment, _ := request.Data["version_comment"].(string)
+		if comment == "" {
+			comment = "Updated the workflow"
+		}
+
+		version, err := workflows_svc.RecordWorkflowVersion(tenant_id, workflow_id, db_workflow, comment)
+		if err != nil {
+			http.Error(w, "Failed to record workflow version", http.StatusInternalServerError)
+			logger.Error(fmt.Sprintf("ERROR: %v", err))
+			return
+		}
 
 		// Update existing workflow
 		filter := bson.M{
@@ -828,12 +805,14 @@ func WorkflowPATCH(config config.Config, logger logger.ILogger) http.HandlerFunc
 
 		result, err := collection.UpdateOne(ctx, filter, update)
 		if err != nil {
+			workflows_svc.DiscardWorkflowVersion(tenant_id, workflow_id, version)
 			logger.Error(fmt.Sprintf("ERROR: %v", err))
 			http.Error(w, "Failed to update workflow", http.StatusInternalServerError)
 			return
 		}
 
 		if result.MatchedCount == 0 {
+			workflows_svc.DiscardWorkflowVersion(tenant_id, workflow_id, version)
 			http.Error(w, "Workflow not found", http.StatusNotFound)
 			return
 		}
@@ -841,3 +820,48 @@ func WorkflowPATCH(config config.Config, logger logger.ILogger) http.HandlerFunc
 		w.WriteHeader(http.StatusOK)
 	}
 }
+
+// writeWorkflowValidationError responds with the field errors of a workflow being saved.
+func writeWorkflowValidationError(w http.ResponseWriter, validation_err *services.WorkflowValidationError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"errors": validation_err.Errors,
+	})
+}
+
+// attachLatestWorkflowRuns sets the latest runs of each workflow under its runs field, runs are stored in their
+// own collection and the full history is paged through /v1/api/workflows/{id}/runs.
+func attachLatestWorkflowRuns(config config.Config, logger logger.ILogger, tenant_id string, workflows primitive.A) {
+
+	workflow_ids := make([]string, 0, len(workflows))
+	for _, workflow := range workflows {
+		if w, ok := workflow.(bson.M); ok {
+			if id, ok := w["id"].(string); ok {
+				workflow_ids = append(workflow_ids, id)
+			}
+		}
+	}
+
+	workflows_svc := services.WorkflowsService{
+		Config: config,
+		Logger: logger,
+	}
+
+	runs, err := workflows_svc.GetLatestWorkflowRuns(tenant_id, workflow_ids, 20)
+	if err != nil {
+		logger.Error(fmt.Sprintf("ERROR: %v", err))
+		return
+	}
+
+	for _, workflow := range workflows {
+		if w, ok := workflow.(bson.M); ok {
+			id, _ := w["id"].(string)
+			if workflow_runs, ok := runs[id]; ok {
+				w["runs"] = workflow_runs
+			} else {
+				w["runs"] = []models.WorkflowRun{}
+			}
+		}
+	}
+}
@@ -1,11 +1,16 @@
 package hub
 
 import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
 	"github.com/gorilla/mux"
 	"github.com/nutrixpos/hub/common"
 	"github.com/nutrixpos/hub/common/config"
+	"github.com/nutrixpos/hub/common/workflows"
 	"github.com/nutrixpos/hub/modules"
-	"github.com/nutrixpos/hub/modules/hub/events"
 	"github.com/nutrixpos/hub/modules/hub/handlers"
 	"github.com/nutrixpos/hub/modules/hub/models"
 	"github.com/nutrixpos/hub/modules/hub/services"
@@ -39,6 +44,66 @@ func (h *HubModule) OnStart() func() error {
 			return err
 		}
 
+		ws := services.WorkflowsService{
+			Config: h.Config,
+			Logger: h.Logger,
+		}
+
+		err = ws.EnsureWorkflowRunsIndexes()
+		if err != nil {
+			return err
+		}
+
+		err = ws.EnsureWorkflowVersions()
+		if err != nil {
+			return err
+		}
+
+		err = ws.EnsureWorkflowTriggerThrottleIndexes()
+		if err != nil {
+			return err
+		}
+
+		err = ws.EnsureInboundWebhookIndexes()
+		if err != nil {
+			return err
+		}
+
+		err = ws.EnsureWorkflowApprovalsIndexes()
+		if err != nil {
+			return err
+		}
+
+		err = ws.EnsureDeadLettersIndexes()
+		if err != nil {
+			return err
+		}
+
+		// a failed migration leaves the runs embedded until the next start, it doesn't keep the hub from starting
+		migrated, err := ws.MigrateEmbeddedWorkflowRuns()
+		if err != nil {
+			h.Logger.Error(fmt.Sprintf("failed to move the embedded workflow runs to their own collection: %v", err))
+		}
+
+		if migrated > 0 {
+			h.Logger.Info(fmt.Sprintf("moved %d embedded workflow runs to their own collection", migrated))
+		}
+
+		encrypted, err := ws.EncryptPlaintextSecrets()
+		if errors.Is(err, services.ErrSecretsMasterKeyMissing) {
+			h.Logger.Warning("secret env vars are stored in plaintext, configure the secrets master key to encrypt them")
+		} else if err != nil {
+			return err
+		}
+
+		if strings.TrimSpace(h.Config.Secrets.MasterKey) == "" {
+			h.Logger.Warning("workflow requests are sent unsigned until the secrets master key is configured")
+		}
+
+		if encrypted > 0 {
+			h.Logger.Info(fmt.Sprintf("encrypted the plaintext secret env vars of %d tenants", encrypted))
+		}
+
 		return nil
 	}
 }
@@ -50,18 +115,43 @@ func (h *HubModule) OnEnd() func() {
 }
 
 func (h *HubModule) RegisterHttpHandlers(router *mux.Router, prefix string) {
-	router.Handle("/v1/api/logs", pos_middlewares.AllowCors(handlers.LogsPost(h.Config, h.Logger))).Methods("POST", "OPTIONS")
+	router.Handle("/v1/api/logs", pos_middlewares.AllowCors(handlers.LogsPost(h.Config, h.Logger, h.EventManager))).Methods("POST", "OPTIONS")
 	router.Handle("/v1/api/inventories", pos_middlewares.AllowCors(handlers.InventoryItemsPut(h.Config, h.Logger, h.EventManager))).Methods("PUT", "OPTIONS")
 	router.Handle("/v1/api/inventories", pos_middlewares.AllowCors(handlers.InventoryItemsGet(h.Config, h.Logger))).Methods("GET", "OPTIONS")
 	router.Handle("/v1/api/inventories", pos_middlewares.AllowCors(handlers.InventoryItemsPatch(h.Config, h.Logger))).Methods("PATCH", "OPTIONS")
 	router.Handle("/v1/api/sales", pos_middlewares.AllowCors(handlers.GetSalesPerDay(h.Config, h.Logger))).Methods("GET", "OPTIONS")
 	router.Handle("/v1/api/workflows", pos_middlewares.AllowCors(handlers.WorkflowsGET(h.Config, h.Logger))).Methods("GET", "OPTIONS")
+	router.Handle("/v1/api/workflows/catalog", pos_middlewares.AllowCors(handlers.WorkflowsCatalogGET(h.Config, h.Logger))).Methods("GET", "OPTIONS")
+	router.Handle("/v1/api/workflows/catalog/{type}/schema", pos_middlewares.AllowCors(handlers.WorkflowCatalogSchemaGET(h.Config, h.Logger))).Methods("GET", "OPTIONS")
+	router.Handle("/v1/api/workflows/export", pos_middlewares.AllowCors(handlers.WorkflowsExportGET(h.Config, h.Logger))).Methods("GET", "OPTIONS")
+	router.Handle("/v1/api/workflows/import", pos_middlewares.AllowCors(handlers.WorkflowsImportPOST(h.Config, h.Logger))).Methods("POST", "OPTIONS")
+	router.Handle("/v1/api/workflows/stats", pos_middlewares.AllowCors(handlers.WorkflowsStatsGET(h.Config, h.Logger))).Methods("GET", "OPTIONS")
+	router.Handle("/v1/api/workflows/queue", pos_middlewares.AllowCors(handlers.WorkflowQueueGET(h.Config, h.Logger))).Methods("GET", "OPTIONS")
 	router.Handle("/v1/api/workflows/{id}", pos_middlewares.AllowCors(handlers.WorkflowGET(h.Config, h.Logger))).Methods("GET", "OPTIONS")
 	router.Handle("/v1/api/workflows", pos_middlewares.AllowCors(handlers.WorkflowPOST(h.Config, h.Logger))).Methods("POST", "OPTIONS")
 	router.Handle("/v1/api/workflows/{id}", pos_middlewares.AllowCors(handlers.WorkflowPATCH(h.Config, h.Logger))).Methods("PATCH", "OPTIONS")
+	router.Handle("/v1/api/workflows/{id}/runs", pos_middlewares.AllowCors(handlers.WorkflowRunsGET(h.Config, h.Logger))).Methods("GET", "OPTIONS")
+	router.Handle("/v1/api/workflows/{id}/runs", pos_middlewares.AllowCors(handlers.WorkflowRunsPOST(h.Config, h.Logger))).Methods("POST", "OPTIONS")
+	router.Handle("/v1/api/workflows/{id}/runs/{run_id}/cancel", pos_middlewares.AllowCors(handlers.WorkflowRunCancelPOST(h.Config, h.Logger))).Methods("POST", "OPTIONS")
+	router.Handle("/v1/api/workflows/{id}/runs/{run_id}/stream", pos_middlewares.AllowCors(handlers.WorkflowRunStreamGET(h.Config, h.Logger))).Methods("GET", "OPTIONS")
+	router.Handle("/v1/api/workflows/{id}/stats", pos_middlewares.AllowCors(handlers.WorkflowStatsGET(h.Config, h.Logger))).Methods("GET", "OPTIONS")
+	router.Handle("/v1/api/workflows/{id}/versions", pos_middlewares.AllowCors(handlers.WorkflowVersionsGET(h.Config, h.Logger))).Methods("GET", "OPTIONS")
+	router.Handle("/v1/api/workflows/{id}/versions/diff", pos_middlewares.AllowCors(handlers.WorkflowVersionsDiffGET(h.Config, h.Logger))).Methods("GET", "OPTIONS")
+	router.Handle("/v1/api/workflows/{id}/versions/{version:[0-9]+}", pos_middlewares.AllowCors(handlers.WorkflowVersionGET(h.Config, h.Logger))).Methods("GET", "OPTIONS")
+	router.Handle("/v1/api/workflows/{id}/versions/{version:[0-9]+}/rollback", pos_middlewares.AllowCors(handlers.WorkflowVersionRollbackPOST(h.Config, h.Logger))).Methods("POST", "OPTIONS")
+	router.Handle("/v1/api/workflow_dead_letters", pos_middlewares.AllowCors(handlers.WorkflowDeadLettersGET(h.Config, h.Logger))).Methods("GET", "OPTIONS")
+	router.Handle("/v1/api/workflow_dead_letters/{id}", pos_middlewares.AllowCors(handlers.WorkflowDeadLetterGET(h.Config, h.Logger))).Methods("GET", "OPTIONS")
+	router.Handle("/v1/api/workflow_dead_letters/{id}/redrive", pos_middlewares.AllowCors(handlers.WorkflowDeadLetterRedrivePOST(h.Config, h.Logger))).Methods("POST", "OPTIONS")
+	router.Handle("/v1/api/workflow_approvals", pos_middlewares.AllowCors(handlers.WorkflowApprovalsGET(h.Config, h.Logger))).Methods("GET", "OPTIONS")
+	router.Handle("/v1/api/workflow_approvals/{id}", pos_middlewares.AllowCors(handlers.WorkflowApprovalGET(h.Config, h.Logger))).Methods("GET", "OPTIONS")
+	router.Handle("/v1/api/workflow_approvals/{id}/approve", pos_middlewares.AllowCors(handlers.WorkflowApprovalApprovePOST(h.Config, h.Logger))).Methods("POST", "OPTIONS")
+	router.Handle("/v1/api/workflow_approvals/{id}/reject", pos_middlewares.AllowCors(handlers.WorkflowApprovalRejectPOST(h.Config, h.Logger))).Methods("POST", "OPTIONS")
+	router.Handle("/v1/api/hooks/{token}", pos_middlewares.AllowCors(handlers.InboundWebhookPOST(h.Config, h.Logger))).Methods("POST", "OPTIONS")
 	router.Handle("/v1/api/env_vars", pos_middlewares.AllowCors(handlers.EnvVarsGet(h.Config, h.Logger))).Methods("GET", "OPTIONS")
 	router.Handle("/v1/api/env_vars/{name}", pos_middlewares.AllowCors(handlers.EnvVarPATCH(h.Config, h.Logger))).Methods("PATCH", "OPTIONS")
 	router.Handle("/v1/api/env_vars/{name}", pos_middlewares.AllowCors(handlers.EnvVarDelete(h.Config, h.Logger))).Methods("DELETE", "OPTIONS")
+	router.Handle("/v1/api/signing_secrets", pos_middlewares.AllowCors(handlers.SigningSecretsGET(h.Config, h.Logger))).Methods("GET", "OPTIONS")
+	router.Handle("/v1/api/signing_secrets/rotate", pos_middlewares.AllowCors(handlers.SigningSecretRotatePOST(h.Config, h.Logger))).Methods("POST", "OPTIONS")
 	router.Handle("/v1/api/languages", pos_middlewares.AllowCors(handlers.GetAvailableLanguages(h.Config, h.Logger))).Methods("GET", "OPTIONS")
 	router.Handle("/v1/api/languages/{code}", pos_middlewares.AllowCors(handlers.GetLanguage(h.Config, h.Logger))).Methods("GET", "OPTIONS")
 	router.Handle("/v1/api/settings", pos_middlewares.AllowCors(handlers.GetSettings(h.Config, h.Logger))).Methods("GET", "OPTIONS")
@@ -74,38 +164,127 @@ func (h *HubModule) RegisterHttpHandlers(router *mux.Router, prefix string) {
 	router.Handle("/v1/api/subscriptions/request_cancellation", pos_middlewares.AllowCors(handlers.SubscriptionRequestCancellation(h.Config, h.Logger))).Methods("POST", "OPTIONS")
 }
 
+// RegisterWorkflowTypes registers the trigger and action types that come with the hub.
+func (h *HubModule) RegisterWorkflowTypes(registry *workflows.TypesRegistry) error {
+	return services.RegisterBuiltinWorkflowTypes(registry)
+}
+
 func (h *HubModule) RegisterEventManager(manager common.EventManager) error {
 
 	h.EventManager = manager
-	eventChannel, err := manager.Subscribe(events.EventLowStockId)
-	if err != nil {
-		h.Logger.Error(err.Error())
-		return err
-	}
 	h.EventChannels = make(map[string][]common.EventChannel)
-	h.EventChannels[events.EventLowStockId] = append(h.EventChannels[events.EventLowStockId], eventChannel)
+
+	// actions raise the same events as the hub handlers
+	services.WorkflowEventManager = manager
+
+	// every event a registered trigger listens to, including the triggers contributed by other modules
+	for _, event_id := range workflows.Types.EventIDs() {
+		eventChannel, err := manager.Subscribe(event_id)
+		if err != nil {
+			h.Logger.Error(err.Error())
+			return err
+		}
+		h.EventChannels[event_id] = append(h.EventChannels[event_id], eventChannel)
+	}
 
 	return nil
 }
 
 func (h *HubModule) RegisterBackgroundWorkers() []modules.Worker {
-	return []modules.Worker{
+
+	workers := make([]modules.Worker, 0)
+
+	// the event workers only queue the runs, the queue workers execute them
+	services.WorkflowQueue = services.NewWorkflowExecutionQueue(h.Config.Workflows, h.Logger)
+	for i := 0; i < services.WorkflowQueue.Workers(); i++ {
+		workers = append(workers, modules.Worker{
+			Task: services.WorkflowQueue.Work,
+		})
+	}
+
+	for event_id, event_channels := range h.EventChannels {
+		for _, event_channel := range event_channels {
+			workers = append(workers, modules.Worker{
+				Task: func() {
+					for event := range event_channel.Channel {
+
+						ws := services.WorkflowsService{
+							Config: h.Config,
+							Logger: h.Logger,
+						}
+						err := ws.RunEventTriggeredWorkflows(event_id, event)
+						if err != nil {
+							h.Logger.Error(err.Error())
+						}
+					}
+				},
+			})
+		}
+	}
+
+	return append(workers, []modules.Worker{
 		{
 			Task: func() {
-				for low_stock_channel := range h.EventChannels[events.EventLowStockId][0].Channel {
+				ticker := time.NewTicker(30 * time.Second)
+				defer ticker.Stop()
+
+				for now := range ticker.C {
 
 					ws := services.WorkflowsService{
 						Config: h.Config,
 						Logger: h.Logger,
 					}
-					err := ws.RunLowStockTriggeredWorkflows(low_stock_channel.([]events.EventLowStockData))
+					err := ws.RunScheduledWorkflows(now)
+					if err != nil {
+						h.Logger.Error(err.Error())
+					}
+
+					err = ws.RunDueTriggerDigests(now)
+					if err != nil {
+						h.Logger.Error(err.Error())
+					}
+
+					err = ws.ExpireWorkflowApprovals(now)
+					if err != nil {
+						h.Logger.Error(err.Error())
+					}
+
+					err = ws.ResumeDelayedWorkflowRuns(now)
+					if err != nil {
+						h.Logger.Error(err.Error())
+					}
+
+					err = ws.RecoverResumedWorkflowRuns(now)
 					if err != nil {
 						h.Logger.Error(err.Error())
 					}
 				}
 			},
 		},
-	}
+		{
+			Task: func() {
+				ticker := time.NewTicker(time.Hour)
+				defer ticker.Stop()
+
+				for now := range ticker.C {
+
+					ws := services.WorkflowsService{
+						Config: h.Config,
+						Logger: h.Logger,
+					}
+					_, err := ws.PurgeExpiredWorkflowRuns(now)
+					if err != nil {
+						h.Logger.Error(err.Error())
+					}
+
+					_, err = ws.PurgeExpiredDeadLetters(now)
+					if err != nil {
+						h.Logger.Error(err.Error())
+					}
+				}
+			},
+		},
+	}...)
 }
 
 func (h *HubModule) EnsureSeeded() error {
@@ -13,13 +13,44 @@ type TenantSubscription struct {
 }
 
 type Tenant struct {
-	ID             string             `json:"id" bson:"id" mapstructure:"id"`
-	TenantID       string             `bson:"tenant_id" json:"tenant_id" mapstructure:"tenant_id"`
-	Sales          []SalesPerDay      `bson:"sales" json:"sales" mapstructure:"sales"`
-	InventoryItems []InventoryItem    `bson:"inventory_items" json:"inventory_items" mapstructure:"inventory_items"`
-	Subscription   TenantSubscription `bson:"subscription" json:"subscription" mapstructure:"subscription"`
-	Workflows      []interface{}      `json:"workflows" bson:"workflows" mapstructure:"workflows"`
-	EnvVars        []WorkflowEnvVar   `json:"env_vars" bson:"env_vars" mapstructure:"env_vars"`
+	ID             string                `json:"id" bson:"id" mapstructure:"id"`
+	TenantID       string                `bson:"tenant_id" json:"tenant_id" mapstructure:"tenant_id"`
+	Sales          []SalesPerDay         `bson:"sales" json:"sales" mapstructure:"sales"`
+	InventoryItems []InventoryItem       `bson:"inventory_items" json:"inventory_items" mapstructure:"inventory_items"`
+	Subscription   TenantSubscription    `bson:"subscription" json:"subscription" mapstructure:"subscription"`
+	Workflows      []interface{}         `json:"workflows" bson:"workflows" mapstructure:"workflows"`
+	EnvVars        []WorkflowEnvVar      `json:"env_vars" bson:"env_vars" mapstructure:"env_vars"`
+	SecretsKey     *TenantSecretsKey     `json:"-" bson:"secrets_key,omitempty"`
+	SigningSecrets []TenantSigningSecret `json:"-" bson:"signing_secrets,omitempty"`
+}
+
+// TenantSecretsKey is the data key encrypting the secret env vars of the tenant,
+// it is stored encrypted by the master key MasterKeyID.
+type TenantSecretsKey struct {
+	ID          string    `bson:"id"`
+	WrappedKey  string    `bson:"wrapped_key"`
+	MasterKeyID string    `bson:"master_key_id"`
+	CreatedAt   time.Time `bson:"created_at"`
+}
+
+// TenantSigningSecret signs the outbound workflow requests of the tenant, it is stored encrypted by the
+// tenant data key KeyID. The first signing secret of the tenant is the current one, the others were rotated
+// out and keep signing until ExpiresAt so receivers can switch to the new one.
+type TenantSigningSecret struct {
+	ID         string     `bson:"id"`
+	Ciphertext string     `bson:"ciphertext"`
+	KeyID      string     `bson:"key_id"`
+	CreatedAt  time.Time  `bson:"created_at"`
+	ExpiresAt  *time.Time `bson:"expires_at,omitempty"`
+}
+
+// WorkflowSigningSecret describes a signing secret of the tenant, Secret is only set on the current one.
+type WorkflowSigningSecret struct {
+	ID        string     `json:"id"`
+	Secret    string     `json:"secret,omitempty"`
+	Current   bool       `json:"current"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
 }
 
 type TenantAPIKey struct {
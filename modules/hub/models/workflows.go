@@ -2,19 +2,63 @@ package models
 
 import (
 	"time"
+
+	"github.com/nutrixpos/hub/common/workflows"
 )
 
 const (
-	WorkflowTriggerTypeLowStockLabel   = "trigger_low_stock"
-	WorkflowActionTypeN8nWebhookLabel  = "action_n8n_webhook"
-	TriggerLowStockMonitorTypeAny      = "any_item"
-	TriggerLowStockMonitorTypeSpecific = "specific_items"
+	WorkflowTriggerTypeLowStockLabel        = "trigger_low_stock"
+	WorkflowTriggerTypeScheduleLabel        = "trigger_schedule"
+	WorkflowTriggerTypeOrderIngestedLabel   = "trigger_order_ingested"
+	WorkflowTriggerTypeRefundIngestedLabel  = "trigger_refund_ingested"
+	WorkflowTriggerTypeDailySalesBelowLabel = "trigger_daily_sales_below_target"
+	WorkflowTriggerTypeInboundWebhookLabel  = "trigger_inbound_webhook"
+	WorkflowActionTypeN8nWebhookLabel       = "action_n8n_webhook"
+	WorkflowActionTypeHttpRequestLabel      = "action_http_request"
+	WorkflowActionTypeConditionLabel        = "action_condition"
+	WorkflowActionTypeFilterLabel           = "action_filter"
+	WorkflowActionTypeSendEmailLabel        = "action_send_email"
+	WorkflowActionTypeAdjustInventoryLabel  = "action_adjust_inventory"
+	WorkflowActionTypeWaitForApprovalLabel  = "action_wait_for_approval"
+	WorkflowActionTypeDelayLabel            = "action_delay"
+	TriggerLowStockMonitorTypeAny           = "any_item"
+	TriggerLowStockMonitorTypeSpecific      = "specific_items"
+	TriggerDailySalesEvaluateToday          = "today"
+	TriggerDailySalesEvaluateYesterday      = "yesterday"
+	TemplateMissingValuesStrict             = "strict"
+	TemplateMissingValuesLenient            = "lenient"
+
+	WorkflowRunStatusRunning   = "running"
+	WorkflowRunStatusCompleted = "completed"
+	WorkflowRunStatusFailed    = "failed"
+	WorkflowRunStatusCancelled = "cancelled"
+	WorkflowRunStatusWaiting   = "waiting" // paused until an approval is decided, see WorkflowApproval
+	WorkflowRunStatusDelayed   = "delayed" // paused until WorkflowRun.Delay is due
+
+	WorkflowRunStepStatusPending   = "pending"
+	WorkflowRunStepStatusRunning   = "running"
+	WorkflowRunStepStatusCompleted = "completed"
+	WorkflowRunStepStatusFailed    = "failed"
+	WorkflowRunStepStatusSkipped   = "skipped"
+	WorkflowRunStepStatusCancelled = "cancelled"
+	WorkflowRunStepStatusWaiting   = "waiting"
+
+	HttpRequestAuthTypeNone   = "none"
+	HttpRequestAuthTypeBasic  = "basic"
+	HttpRequestAuthTypeBearer = "bearer"
+
+	InboundWebhookSignatureEncodingHex    = "hex"
+	InboundWebhookSignatureEncodingBase64 = "base64"
 )
 
+// WorkflowEnvVar is a variable of the tenant workflows templates, the value of a secret is stored
+// encrypted in Ciphertext by the data key KeyID of the tenant and is never returned by the api.
 type WorkflowEnvVar struct {
-	Name     string `json:"name" bson:"name" mapstructure:"name"`
-	Value    string `json:"value" bson:"value" mapstructure:"value"`
-	IsSecret bool   `json:"is_secret" bson:"is_secret" mapstructure:"is_secret"`
+	Name       string `json:"name" bson:"name" mapstructure:"name"`
+	Value      string `json:"value" bson:"value" mapstructure:"value"`
+	IsSecret   bool   `json:"is_secret" bson:"is_secret" mapstructure:"is_secret"`
+	Ciphertext string `json:"-" bson:"ciphertext,omitempty"`
+	KeyID      string `json:"-" bson:"key_id,omitempty"`
 }
 
 type Workflow struct {
@@ -23,42 +67,225 @@ type Workflow struct {
 	Status      string               `json:"status" bson:"status" mapstructure:"status"`
 	Description string               `json:"description" bson:"description" mapstructure:"description"`
 	Enabled     bool                 `json:"enabled" bson:"enabled" mapstructure:"enabled"`
+	Version     int                  `json:"version" bson:"version" mapstructure:"version"` // Latest saved version, see WorkflowVersion
 	Trigger     WorkflowTriggerBase  `json:"trigger" bson:"trigger" mapstructure:"trigger"`
 	Actions     []WorkflowActionBase `json:"actions" bson:"actions" mapstructure:"actions"`
-	Runs        []WorkflowRun        `json:"runs" bson:"runs" mapstructure:"runs"`
 }
 
+// WorkflowRun is stored in its own collection, keyed by its id and scoped by tenant and workflow.
 type WorkflowRun struct {
-	ID        string           `json:"id" bson:"id" mapstructure:"id"`
+	ID         string `json:"id" bson:"id" mapstructure:"id"`
+	TenantID   string `json:"tenant_id" bson:"tenant_id" mapstructure:"tenant_id"`
+	WorkflowID string `json:"workflow_id" bson:"workflow_id" mapstructure:"workflow_id"`
+	// WorkflowVersion is the version of the workflow definition the run executed
+	WorkflowVersion int               `json:"workflow_version" bson:"workflow_version" mapstructure:"workflow_version"`
+	Logs            []WorkflowRunLog  `json:"logs" bson:"logs" mapstructure:"logs"`
+	Steps           []WorkflowRunStep `json:"steps" bson:"steps" mapstructure:"steps"`
+	StartTime       time.Time         `json:"start_time" bson:"start_time" mapstructure:"start_time"`
+	EndTime         time.Time         `json:"end_time" bson:"end_time" mapstructure:"end_time"`
+	Status          string            `json:"status" bson:"status" mapstructure:"status"`
+	Output          interface{}       `json:"output" bson:"output" mapstructure:"output"` // Output of the last action of the run
+	// Delay is set while a delay step pauses the run and kept once it resumed
+	Delay *WorkflowRunDelay `json:"delay,omitempty" bson:"delay,omitempty" mapstructure:"delay"`
+	// Resume is set when the run leaves waiting or delayed, and kept once it finished
+	Resume *WorkflowRunResume `json:"resume,omitempty" bson:"resume,omitempty" mapstructure:"resume"`
+}
+
+// WorkflowRunResume keeps what is needed to resume a run at ResumeIndex after the step it paused on (StepIndex).
+// The hub executing the resumed run renews LeaseUntil, another hub takes the run over once it lapses.
+type WorkflowRunResume struct {
+	StepIndex   int         `json:"step_index" bson:"step_index" mapstructure:"step_index"`
+	ResumeIndex int         `json:"resume_index" bson:"resume_index" mapstructure:"resume_index"`
+	Input       interface{} `json:"input" bson:"input" mapstructure:"input"`
+	LeaseUntil  time.Time   `json:"lease_until" bson:"lease_until" mapstructure:"lease_until"`
+}
+
+// WorkflowRunDelay keeps what is needed to resume a delayed run at the action after the delay step
+// (ResumeIndex) with the input the delay step received, once Until is due.
+type WorkflowRunDelay struct {
+	StepIndex   int         `json:"step_index" bson:"step_index" mapstructure:"step_index"`
+	ResumeIndex int         `json:"resume_index" bson:"resume_index" mapstructure:"resume_index"`
+	Input       interface{} `json:"input" bson:"input" mapstructure:"input"`
+	Until       time.Time   `json:"until" bson:"until" mapstructure:"until"`
+}
+
+// WorkflowRunStep tracks the execution of a single action of the workflow within a run,
+// Index identifies the step within the run, top level actions use their position in Workflow.Actions
+// while the actions of condition branches get the next free index when they start.
+// Path locates the action in the workflow definition (e.g. "2" or "2.then.0").
+type WorkflowRunStep struct {
+	Index     int              `json:"index" bson:"index" mapstructure:"index"`
+	Path      string           `json:"path" bson:"path" mapstructure:"path"`
+	Type      string           `json:"type" bson:"type" mapstructure:"type"`
+	Status    string           `json:"status" bson:"status" mapstructure:"status"`
 	Logs      []WorkflowRunLog `json:"logs" bson:"logs" mapstructure:"logs"`
 	StartTime time.Time        `json:"start_time" bson:"start_time" mapstructure:"start_time"`
 	EndTime   time.Time        `json:"end_time" bson:"end_time" mapstructure:"end_time"`
-	Status    string           `json:"status" bson:"status" mapstructure:"status"`
+	Output    interface{}      `json:"output" bson:"output" mapstructure:"output"`
 }
 
-type WorkflowRunLog struct {
-	Level     string    `json:"level" bson:"level" mapstructure:"level"`
-	TimeStamp time.Time `json:"timestamp" bson:"timestamp" mapstructure:"timestamp"`
-	Message   string    `json:"message" bson:"message" mapstructure:"message"`
+// WorkflowRunLog is a log line of a run or of one of its steps.
+type WorkflowRunLog = workflows.RunLog
+
+const (
+	WorkflowRunStreamEventLog    = "log"
+	WorkflowRunStreamEventStep   = "step"
+	WorkflowRunStreamEventStatus = "status"
+)
+
+// WorkflowRunStreamEvent is a change of a run pushed to its stream, Data is one of
+// WorkflowRunLogEvent, WorkflowRunStepEvent or WorkflowRunStatusEvent depending on Event.
+// ID is the position of the stream once the event is sent, a reconnecting stream resumes from it.
+type WorkflowRunStreamEvent struct {
+	ID    string      `json:"id"`
+	Event string      `json:"event"`
+	Data  interface{} `json:"data"`
 }
 
-type WorkflowTriggerBase struct {
-	Type string `json:"type" bson:"type" mapstructure:"type"`
+// WorkflowRunLogEvent is a new log entry of the run, StepIndex is set for the logs of a step.
+type WorkflowRunLogEvent struct {
+	StepIndex *int           `json:"step_index,omitempty"`
+	Path      string         `json:"path,omitempty"`
+	Log       WorkflowRunLog `json:"log"`
 }
 
-type WorkflowActionBase struct {
-	Type string `json:"type" bson:"type" mapstructure:"type"`
+// WorkflowRunStepEvent is a new step of the run or a change of its status.
+type WorkflowRunStepEvent struct {
+	Index  int         `json:"index"`
+	Path   string      `json:"path"`
+	Type   string      `json:"type"`
+	Status string      `json:"status"`
+	Output interface{} `json:"output,omitempty"`
 }
 
+// WorkflowRunStatusEvent is a change of the run status, the stream ends after a final status.
+type WorkflowRunStatusEvent struct {
+	Status  string      `json:"status"`
+	EndTime *time.Time  `json:"end_time,omitempty"`
+	Output  interface{} `json:"output,omitempty"`
+}
+
+type WorkflowTriggerBase = workflows.TriggerBase
+
+type WorkflowActionBase = workflows.ActionBase
+
+// WorkflowRetryPolicy controls how many times a failing action is attempted, see workflows.RetryPolicy.
+type WorkflowRetryPolicy = workflows.RetryPolicy
+
+// WorkflowLowStockTrigger fires on the low stock events of the monitored items. An item that fired is
+// suppressed for CooldownMinutes, items are told apart by DedupKey, a template over the event item
+// ({{ item_id }} when empty). With DigestMinutes the items are collected and the workflow runs once per window.
 type WorkflowLowStockTrigger struct {
 	WorkflowTriggerBase `json:",inline" bson:",inline" mapstructure:",squash"`
 	MonitorType         string   `json:"monitor_type" bson:"monitor_type" mapstructure:"monitor_type"`
 	ProductIDs          []string `json:"product_ids" bson:"product_ids" mapstructure:"product_ids"`
 	Output              string   `json:"output" bson:"output" mapstructure:"output"`
+	CooldownMinutes     int      `json:"cooldown_minutes" bson:"cooldown_minutes" mapstructure:"cooldown_minutes"`
+	DedupKey            string   `json:"dedup_key" bson:"dedup_key" mapstructure:"dedup_key"`
+	DigestMinutes       int      `json:"digest_minutes" bson:"digest_minutes" mapstructure:"digest_minutes"`
+}
+
+// WorkflowTriggerSchedule holds the schedule of the triggers evaluated by the scheduler, it is a
+// standard 5 fields cron expression (descriptors such as @daily are accepted) evaluated in the given IANA timezone.
+type WorkflowTriggerSchedule struct {
+	Cron     string `json:"cron" bson:"cron" mapstructure:"cron"`
+	TimeZone string `json:"timezone" bson:"timezone" mapstructure:"timezone"`
+	// LastScheduledAt is the last scheduled time the trigger was evaluated for, it is
+	// maintained by the scheduler only and guards against firing the same schedule twice.
+	LastScheduledAt time.Time `json:"last_scheduled_at" bson:"last_scheduled_at"`
+}
+
+// WorkflowScheduleTrigger fires the workflow on its schedule.
+type WorkflowScheduleTrigger struct {
+	WorkflowTriggerBase     `json:",inline" bson:",inline" mapstructure:",squash"`
+	WorkflowTriggerSchedule `json:",inline" bson:",inline" mapstructure:",squash"`
+}
+
+type WorkflowScheduleTriggerOutput struct {
+	ScheduledAt time.Time `json:"scheduled_at" bson:"scheduled_at" mapstructure:"scheduled_at"`
+	FiredAt     time.Time `json:"fired_at" bson:"fired_at" mapstructure:"fired_at"`
+	TimeZone    string    `json:"timezone" bson:"timezone" mapstructure:"timezone"`
+}
+
+// WorkflowOrderIngestedTrigger fires when orders are ingested from the POS logs,
+// optionally restricted to the given branch labels.
+type WorkflowOrderIngestedTrigger struct {
+	WorkflowTriggerBase `json:",inline" bson:",inline" mapstructure:",squash"`
+	Labels              []string `json:"labels" bson:"labels" mapstructure:"labels"`
+}
+
+type WorkflowOrderIngestedTriggerOutput struct {
+	Label  string             `json:"label" bson:"label" mapstructure:"label"`
+	Orders []SalesPerDayOrder `json:"orders" bson:"orders" mapstructure:"orders"`
+}
+
+// WorkflowRefundIngestedTrigger fires when refunds of at least MinRefundValue are ingested
+// from the POS logs, optionally restricted to the given branch labels.
+type WorkflowRefundIngestedTrigger struct {
+	WorkflowTriggerBase `json:",inline" bson:",inline" mapstructure:",squash"`
+	Labels              []string `json:"labels" bson:"labels" mapstructure:"labels"`
+	MinRefundValue      float64  `json:"min_refund_value" bson:"min_refund_value" mapstructure:"min_refund_value"`
+}
+
+type WorkflowRefundIngestedTriggerOutput struct {
+	Label   string               `json:"label" bson:"label" mapstructure:"label"`
+	Refunds []LogOrderItemRefund `json:"refunds" bson:"refunds" mapstructure:"refunds"`
+}
+
+// WorkflowDailySalesBelowTargetTrigger is evaluated on its schedule and fires when the sales of
+// one or more branches for the evaluated day are below Target, all the known branches are
+// evaluated when Labels is empty.
+type WorkflowDailySalesBelowTargetTrigger struct {
+	WorkflowTriggerBase     `json:",inline" bson:",inline" mapstructure:",squash"`
+	WorkflowTriggerSchedule `json:",inline" bson:",inline" mapstructure:",squash"`
+	Target                  float64  `json:"target" bson:"target" mapstructure:"target"`
+	Labels                  []string `json:"labels" bson:"labels" mapstructure:"labels"`
+	EvaluateDay             string   `json:"evaluate_day" bson:"evaluate_day" mapstructure:"evaluate_day"` // today or yesterday, relative to the scheduled time
+}
+
+type WorkflowDailySalesBelowTargetTriggerOutput struct {
+	Date     string                                      `json:"date" bson:"date" mapstructure:"date"`
+	Target   float64                                     `json:"target" bson:"target" mapstructure:"target"`
+	Branches []WorkflowDailySalesBelowTargetOutputBranch `json:"branches" bson:"branches" mapstructure:"branches"`
+}
+
+type WorkflowDailySalesBelowTargetOutputBranch struct {
+	Label      string  `json:"label" bson:"label" mapstructure:"label"`
+	TotalSales float64 `json:"total_sales" bson:"total_sales" mapstructure:"total_sales"`
+	OrderCount int     `json:"order_count" bson:"order_count" mapstructure:"order_count"`
+}
+
+// WorkflowInboundWebhookTrigger fires when a request is posted to /v1/api/hooks/{token}, the token is
+// generated when the trigger is saved without one. The json body of the request, validated against Schema
+// (a JSON schema kept as json text) when set, is passed to the first action.
+type WorkflowInboundWebhookTrigger struct {
+	WorkflowTriggerBase `json:",inline" bson:",inline" mapstructure:",squash"`
+	Token               string                           `json:"token" bson:"token" mapstructure:"token"`
+	Schema              string                           `json:"schema" bson:"schema" mapstructure:"schema"`
+	Signature           *WorkflowInboundWebhookSignature `json:"signature,omitempty" bson:"signature,omitempty" mapstructure:"signature"`
+}
+
+// WorkflowInboundWebhookSignature requires the requests to carry the HMAC-SHA256 of their body keyed by Secret,
+// a template over the tenant env vars (e.g. {{ env.SHOP_WEBHOOK_SECRET }}). With TimestampHeader the timestamp,
+// a dot and the body are signed instead and the timestamp must be within 5 minutes, as the hub signs its requests.
+type WorkflowInboundWebhookSignature struct {
+	Secret          string `json:"secret" bson:"secret" mapstructure:"secret"`
+	Header          string `json:"header" bson:"header" mapstructure:"header"`                               // X-Nutrix-Signature when empty
+	TimestampHeader string `json:"timestamp_header" bson:"timestamp_header" mapstructure:"timestamp_header"` // optional
+	Encoding        string `json:"encoding" bson:"encoding" mapstructure:"encoding"`                         // hex (default) or base64
 }
 
 type WorkflowLowStockTriggerOutput struct {
-	Items []WorkflowLowStockTriggerOutputItem `json:"items" bson:"items" mapstructure:"items"`
+	Items  []WorkflowLowStockTriggerOutputItem `json:"items" bson:"items" mapstructure:"items"`
+	Digest *WorkflowTriggerDigestWindow        `json:"digest,omitempty" bson:"digest,omitempty" mapstructure:"digest"`
+}
+
+// WorkflowTriggerDigestWindow describes the window a digest collected its events over,
+// Events counts every collected event including the ones merged by their dedup key.
+type WorkflowTriggerDigestWindow struct {
+	From   time.Time `json:"from" bson:"from" mapstructure:"from"`
+	To     time.Time `json:"to" bson:"to" mapstructure:"to"`
+	Events int       `json:"events" bson:"events" mapstructure:"events"`
 }
 
 type WorkflowLowStockTriggerOutputItem struct {
@@ -78,4 +305,377 @@ type WorkflowN8nWebhookAction struct {
 	Headers            map[string]string `json:"headers" bson:"headers" mapstructure:"headers"`
 	Timeout            int               `json:"timeout" bson:"timeout" mapstructure:"timeout"`
 	Output             string            `json:"output" bson:"output" mapstructure:"output"`
+	MissingValues      string            `json:"missing_values" bson:"missing_values" mapstructure:"missing_values"` // strict (default) or lenient, see common.Template
+}
+
+// WorkflowHttpRequestAction sends a generic HTTP request, URL, query params, headers and body
+// are templates (see common.Template) rendered against the tenant env vars and the action input.
+type WorkflowHttpRequestAction struct {
+	WorkflowActionBase `json:",inline" bson:",inline" mapstructure:",squash"`
+	URL                string                  `json:"url" bson:"url" mapstructure:"url"`
+	Method             string                  `json:"method" bson:"method" mapstructure:"method"`
+	QueryParams        map[string]string       `json:"query_params" bson:"query_params" mapstructure:"query_params"`
+	Headers            map[string]string       `json:"headers" bson:"headers" mapstructure:"headers"`
+	Body               string                  `json:"body" bson:"body" mapstructure:"body"` // Body template, the raw input is sent as json when empty
+	Auth               WorkflowHttpRequestAuth `json:"auth" bson:"auth" mapstructure:"auth"`
+	Timeout            int                     `json:"timeout" bson:"timeout" mapstructure:"timeout"`
+	MissingValues      string                  `json:"missing_values" bson:"missing_values" mapstructure:"missing_values"` // strict (default) or lenient, see common.Template
+}
+
+type WorkflowHttpRequestAuth struct {
+	Type     string `json:"type" bson:"type" mapstructure:"type"`
+	Username string `json:"username" bson:"username" mapstructure:"username"`
+	Password string `json:"password" bson:"password" mapstructure:"password"`
+	Token    string `json:"token" bson:"token" mapstructure:"token"`
+}
+
+// WorkflowHttpRequestActionOutput is the captured response of an http request action.
+type WorkflowHttpRequestActionOutput struct {
+	StatusCode int               `json:"status_code" bson:"status_code" mapstructure:"status_code"`
+	Headers    map[string]string `json:"headers" bson:"headers" mapstructure:"headers"`
+	Body       interface{}       `json:"body" bson:"body" mapstructure:"body"`
+}
+
+// WorkflowConditionAction evaluates its expression over the input and runs the actions of the
+// Then or Else branch accordingly, the output of the branch is passed to the next action.
+type WorkflowConditionAction struct {
+	WorkflowActionBase `json:",inline" bson:",inline" mapstructure:",squash"`
+	Expression         string        `json:"expression" bson:"expression" mapstructure:"expression"`
+	Then               []interface{} `json:"then" bson:"then" mapstructure:"then"`
+	Else               []interface{} `json:"else" bson:"else" mapstructure:"else"`
+}
+
+// WorkflowFilterAction drops what doesn't match its expression, expressions iterating over an array
+// (e.g. items[].quantity < 2) keep only the matching elements, other expressions let the whole input through or not.
+// The run stops without failing when nothing is left.
+type WorkflowFilterAction struct {
+	WorkflowActionBase `json:",inline" bson:",inline" mapstructure:",squash"`
+	Expression         string `json:"expression" bson:"expression" mapstructure:"expression"`
+}
+
+// WorkflowSendEmailAction sends an email through the configured SMTP server, every field is a template
+// (see common.Template) rendered against the tenant env vars and the action input. To, Cc and Bcc render
+// to comma separated addresses, so recipient lists can be kept in env vars (e.g. {{ OWNER_EMAILS }}).
+// FromName and ReplyTo are the sender identity of the tenant, the sender address is the configured one.
+type WorkflowSendEmailAction struct {
+	WorkflowActionBase `json:",inline" bson:",inline" mapstructure:",squash"`
+	To                 string `json:"to" bson:"to" mapstructure:"to"`
+	Cc                 string `json:"cc" bson:"cc" mapstructure:"cc"`
+	Bcc                string `json:"bcc" bson:"bcc" mapstructure:"bcc"`
+	FromName           string `json:"from_name" bson:"from_name" mapstructure:"from_name"`
+	ReplyTo            string `json:"reply_to" bson:"reply_to" mapstructure:"reply_to"`
+	Subject            string `json:"subject" bson:"subject" mapstructure:"subject"`
+	HtmlBody           string `json:"html_body" bson:"html_body" mapstructure:"html_body"` // values are html escaped unless piped through raw
+	TextBody           string `json:"text_body" bson:"text_body" mapstructure:"text_body"`
+	MissingValues      string `json:"missing_values" bson:"missing_values" mapstructure:"missing_values"` // strict (default) or lenient, see common.Template
+}
+
+// WorkflowSendEmailActionOutput describes the sent email.
+type WorkflowSendEmailActionOutput struct {
+	MessageID  string   `json:"message_id" bson:"message_id" mapstructure:"message_id"`
+	Subject    string   `json:"subject" bson:"subject" mapstructure:"subject"`
+	Recipients []string `json:"recipients" bson:"recipients" mapstructure:"recipients"`
+}
+
+const (
+	InventoryAdjustmentOperationSet       = "set"
+	InventoryAdjustmentOperationIncrement = "increment"
+	InventoryAdjustmentOperationDecrement = "decrement"
+)
+
+// WorkflowAdjustInventoryAction changes the quantities of the tenant inventory items, the fields of each
+// adjustment are templates (see common.Template) rendered against the tenant env vars and the action input.
+// Adjustments aren't idempotent, a redriven run applies them again.
+type WorkflowAdjustInventoryAction struct {
+	WorkflowActionBase `json:",inline" bson:",inline" mapstructure:",squash"`
+	Adjustments        []WorkflowInventoryAdjustment `json:"adjustments" bson:"adjustments" mapstructure:"adjustments"`
+	MissingValues      string                        `json:"missing_values" bson:"missing_values" mapstructure:"missing_values"` // strict (default) or lenient, see common.Template
+}
+
+// WorkflowInventoryAdjustment sets, increments or decrements the quantity of an inventory item.
+// Label picks the branch (e.g. branch:downtown) when the item id is stocked by more than one.
+type WorkflowInventoryAdjustment struct {
+	ItemID    string `json:"item_id" bson:"item_id" mapstructure:"item_id"`
+	Label     string `json:"label" bson:"label" mapstructure:"label"`
+	Operation string `json:"operation" bson:"operation" mapstructure:"operation"`
+	Quantity  string `json:"quantity" bson:"quantity" mapstructure:"quantity"`
+}
+
+// WorkflowAdjustInventoryActionOutput lists the adjusted items with their quantities before and after.
+type WorkflowAdjustInventoryActionOutput struct {
+	Items []WorkflowAdjustedInventoryItem `json:"items" bson:"items" mapstructure:"items"`
+}
+
+// WorkflowAdjustedInventoryItem is an inventory item changed by an adjust inventory action.
+type WorkflowAdjustedInventoryItem struct {
+	ItemID    string  `json:"item_id" bson:"item_id" mapstructure:"item_id"`
+	ItemName  string  `json:"item_name" bson:"item_name" mapstructure:"item_name"`
+	Label     string  `json:"label" bson:"label" mapstructure:"label"`
+	Operation string  `json:"operation" bson:"operation" mapstructure:"operation"`
+	Previous  float64 `json:"previous" bson:"previous" mapstructure:"previous"`
+	Quantity  float64 `json:"quantity" bson:"quantity" mapstructure:"quantity"`
+	LowStock  bool    `json:"low_stock" bson:"low_stock" mapstructure:"low_stock"`
+}
+
+const (
+	WorkflowDeadLetterStatusPending  = "pending"
+	WorkflowDeadLetterStatusRedriven = "redriven"
+)
+
+// WorkflowDeadLetter records an action that failed after all its attempts, it keeps what is needed
+// to redrive the run from the top level action holding the failed step (ResumeIndex) with the input it received.
+type WorkflowDeadLetter struct {
+	ID           string      `json:"id" bson:"id" mapstructure:"id"`
+	TenantID     string      `json:"tenant_id" bson:"tenant_id" mapstructure:"tenant_id"`
+	WorkflowID   string      `json:"workflow_id" bson:"workflow_id" mapstructure:"workflow_id"`
+	RunID        string      `json:"run_id" bson:"run_id" mapstructure:"run_id"`
+	StepIndex    int         `json:"step_index" bson:"step_index" mapstructure:"step_index"`
+	StepPath     string      `json:"step_path" bson:"step_path" mapstructure:"step_path"`
+	ActionType   string      `json:"action_type" bson:"action_type" mapstructure:"action_type"`
+	Attempts     int         `json:"attempts" bson:"attempts" mapstructure:"attempts"`
+	Error        string      `json:"error" bson:"error" mapstructure:"error"`
+	Input        interface{} `json:"input" bson:"input" mapstructure:"input"`
+	ResumeIndex  int         `json:"resume_index" bson:"resume_index" mapstructure:"resume_index"`
+	ResumeInput  interface{} `json:"resume_input" bson:"resume_input" mapstructure:"resume_input"`
+	Status       string      `json:"status" bson:"status" mapstructure:"status"`
+	CreatedAt    time.Time   `json:"created_at" bson:"created_at" mapstructure:"created_at"`
+	RedrivenAt   time.Time   `json:"redriven_at,omitempty" bson:"redriven_at,omitempty" mapstructure:"redriven_at"`
+	RedriveRunID string      `json:"redrive_run_id,omitempty" bson:"redrive_run_id,omitempty" mapstructure:"redrive_run_id"`
+}
+
+const (
+	WorkflowApprovalStatusPending   = "pending"
+	WorkflowApprovalStatusApproved  = "approved"
+	WorkflowApprovalStatusRejected  = "rejected"
+	WorkflowApprovalStatusCancelled = "cancelled" // the run was cancelled while waiting
+
+	WorkflowApprovalTimeoutReject  = "reject"
+	WorkflowApprovalTimeoutApprove = "approve"
+)
+
+// WorkflowWaitForApprovalAction pauses the run until one of the approvers approves or rejects it, or TimeoutMinutes
+// run out (OnTimeout decides then). The approvers are notified by email, the action input is passed on once approved.
+// It can only be a top level action.
+type WorkflowWaitForApprovalAction struct {
+	WorkflowActionBase `json:",inline" bson:",inline" mapstructure:",squash"`
+	Approvers          string `json:"approvers" bson:"approvers" mapstructure:"approvers"` // comma separated emails template
+	Subject            string `json:"subject" bson:"subject" mapstructure:"subject"`
+	Message            string `json:"message" bson:"message" mapstructure:"message"`
+	TimeoutMinutes     int    `json:"timeout_minutes" bson:"timeout_minutes" mapstructure:"timeout_minutes"`
+	OnTimeout          string `json:"on_timeout" bson:"on_timeout" mapstructure:"on_timeout"` // reject (default) or approve
+	MissingValues      string `json:"missing_values" bson:"missing_values" mapstructure:"missing_values"`
+}
+
+// WorkflowDelayAction pauses the run for DurationMinutes or until the time rendered from the Until template,
+// either an RFC3339 timestamp or the next HH:MM in TimeZone (e.g. 08:00 for the start of the next work day).
+// The action input is passed on once the delay is over. It can only be a top level action.
+type WorkflowDelayAction struct {
+	WorkflowActionBase `json:",inline" bson:",inline" mapstructure:",squash"`
+	DurationMinutes    int    `json:"duration_minutes" bson:"duration_minutes" mapstructure:"duration_minutes"`
+	Until              string `json:"until" bson:"until" mapstructure:"until"`
+	TimeZone           string `json:"timezone" bson:"timezone" mapstructure:"timezone"` // IANA timezone template, defaults to the hub timezone
+	MissingValues      string `json:"missing_values" bson:"missing_values" mapstructure:"missing_values"`
+}
+
+// WorkflowApproval is the decision a waiting run waits for, it keeps what is needed to resume the run
+// at the action after the approval step (ResumeIndex) with the input the approval step received.
+type WorkflowApproval struct {
+	ID              string      `json:"id" bson:"id" mapstructure:"id"`
+	TenantID        string      `json:"tenant_id" bson:"tenant_id" mapstructure:"tenant_id"`
+	WorkflowID      string      `json:"workflow_id" bson:"workflow_id" mapstructure:"workflow_id"`
+	WorkflowVersion int         `json:"workflow_version" bson:"workflow_version" mapstructure:"workflow_version"`
+	RunID           string      `json:"run_id" bson:"run_id" mapstructure:"run_id"`
+	StepIndex       int         `json:"step_index" bson:"step_index" mapstructure:"step_index"`
+	ResumeIndex     int         `json:"resume_index" bson:"resume_index" mapstructure:"resume_index"`
+	Input           interface{} `json:"input" bson:"input" mapstructure:"input"`
+	Approvers       []string    `json:"approvers" bson:"approvers" mapstructure:"approvers"`
+	Subject         string      `json:"subject" bson:"subject" mapstructure:"subject"`
+	Message         string      `json:"message" bson:"message" mapstructure:"message"`
+	OnTimeout       string      `json:"on_timeout" bson:"on_timeout" mapstructure:"on_timeout"`
+	Status          string      `json:"status" bson:"status" mapstructure:"status"`
+	CreatedAt       time.Time   `json:"created_at" bson:"created_at" mapstructure:"created_at"`
+	ExpiresAt       time.Time   `json:"expires_at" bson:"expires_at" mapstructure:"expires_at"`
+	DecidedAt       time.Time   `json:"decided_at,omitempty" bson:"decided_at,omitempty" mapstructure:"decided_at"`
+	DecidedBy       string      `json:"decided_by,omitempty" bson:"decided_by,omitempty" mapstructure:"decided_by"` // the user, or timeout
+	Comment         string      `json:"comment,omitempty" bson:"comment,omitempty" mapstructure:"comment"`
+}
+
+// WorkflowQueueStats describes the workflow execution queue, waits are in seconds.
+type WorkflowQueueStats struct {
+	Workers           int                        `json:"workers"`
+	TenantConcurrency int                        `json:"tenant_concurrency"`
+	Capacity          int                        `json:"capacity"`
+	Queued            int                        `json:"queued"`
+	Running           int                        `json:"running"`
+	OldestWait        float64                    `json:"oldest_wait"`
+	Enqueued          uint64                     `json:"enqueued"`
+	Completed         uint64                     `json:"completed"`
+	Failed            uint64                     `json:"failed"`
+	Rejected          uint64                     `json:"rejected"`
+	Tenants           []WorkflowQueueTenantStats `json:"tenants"`
+}
+
+// WorkflowQueueTenantStats describes the runs of a tenant in the workflow execution queue.
+type WorkflowQueueTenantStats struct {
+	TenantID   string  `json:"tenant_id"`
+	Queued     int     `json:"queued"`
+	Running    int     `json:"running"`
+	OldestWait float64 `json:"oldest_wait"`
+}
+
+// WorkflowRunStats summarizes the runs started between From and To, of a workflow or of the whole tenant
+// (WorkflowID is empty then). SuccessRate is the share of completed runs among the completed and failed ones,
+// durations are in seconds and only count the finished runs, leaving out the time spent waiting for approvals and delays.
+type WorkflowRunStats struct {
+	WorkflowID   string                   `json:"workflow_id,omitempty"`
+	From         time.Time                `json:"from"`
+	To           time.Time                `json:"to"`
+	TotalRuns    int                      `json:"total_runs"`
+	RunsByStatus map[string]int           `json:"runs_by_status"`
+	SuccessRate  float64                  `json:"success_rate"`
+	DurationP50  float64                  `json:"duration_p50"`
+	DurationP95  float64                  `json:"duration_p95"`
+	TopErrors    []WorkflowRunErrorStats  `json:"top_errors"`
+	Actions      []WorkflowActionRunStats `json:"actions"`
+}
+
+// WorkflowRunErrorStats counts the failed runs that ended with the same error message.
+type WorkflowRunErrorStats struct {
+	Message string `json:"message"`
+	Count   int    `json:"count"`
+}
+
+// WorkflowActionRunStats counts the executions of an action of a workflow, Path locates it in the workflow.
+// FailureRate is the share of failed executions among the completed and failed ones.
+type WorkflowActionRunStats struct {
+	WorkflowID  string  `json:"workflow_id"`
+	Path        string  `json:"path"`
+	Type        string  `json:"type"`
+	Executions  int     `json:"executions"`
+	Failures    int     `json:"failures"`
+	FailureRate float64 `json:"failure_rate"`
+}
+
+// WorkflowTriggerCooldown records when a trigger last fired for a dedup key, the events suppressed
+// since are kept to be logged on the next run of the workflow.
+type WorkflowTriggerCooldown struct {
+	TenantID   string                    `json:"tenant_id" bson:"tenant_id" mapstructure:"tenant_id"`
+	WorkflowID string                    `json:"workflow_id" bson:"workflow_id" mapstructure:"workflow_id"`
+	Key        string                    `json:"key" bson:"key" mapstructure:"key"`
+	FiredAt    time.Time                 `json:"fired_at" bson:"fired_at" mapstructure:"fired_at"`
+	ExpiresAt  time.Time                 `json:"expires_at" bson:"expires_at" mapstructure:"expires_at"`
+	Suppressed []WorkflowSuppressedEvent `json:"suppressed" bson:"suppressed" mapstructure:"suppressed"`
+}
+
+// WorkflowSuppressedEvent is an event a trigger matched but didn't run the workflow for.
+type WorkflowSuppressedEvent struct {
+	Key         string    `json:"key" bson:"key" mapstructure:"key"`
+	Description string    `json:"description" bson:"description" mapstructure:"description"`
+	At          time.Time `json:"at" bson:"at" mapstructure:"at"`
+}
+
+const (
+	WorkflowTriggerDigestStatusPending = "pending"
+	WorkflowTriggerDigestStatusSent    = "sent"
+)
+
+// WorkflowTriggerDigest collects the low stock items of a workflow over a digest window,
+// ID is derived from the workflow and the window so concurrent events share the document.
+type WorkflowTriggerDigest struct {
+	ID          string                       `json:"id" bson:"_id" mapstructure:"id"`
+	TenantID    string                       `json:"tenant_id" bson:"tenant_id" mapstructure:"tenant_id"`
+	WorkflowID  string                       `json:"workflow_id" bson:"workflow_id" mapstructure:"workflow_id"`
+	WindowStart time.Time                    `json:"window_start" bson:"window_start" mapstructure:"window_start"`
+	DueAt       time.Time                    `json:"due_at" bson:"due_at" mapstructure:"due_at"`
+	Status      string                       `json:"status" bson:"status" mapstructure:"status"`
+	Events      int                          `json:"events" bson:"events" mapstructure:"events"`
+	Entries     []WorkflowTriggerDigestEntry `json:"entries" bson:"entries" mapstructure:"entries"`
+	ExpiresAt   *time.Time                   `json:"expires_at,omitempty" bson:"expires_at,omitempty" mapstructure:"expires_at"`
+}
+
+// WorkflowTriggerDigestEntry is an item of a digest, a later event with the same key replaces it.
+type WorkflowTriggerDigestEntry struct {
+	Key  string                            `json:"key" bson:"key" mapstructure:"key"`
+	Item WorkflowLowStockTriggerOutputItem `json:"item" bson:"item" mapstructure:"item"`
+	At   time.Time                         `json:"at" bson:"at" mapstructure:"at"`
+}
+
+// WorkflowDryRunStep describes what a step of the workflow would do for the given trigger payload,
+// Request holds the outbound request the step would send, Message the decision of conditions and filters.
+type WorkflowDryRunStep struct {
+	Path    string                 `json:"path" bson:"path" mapstructure:"path"`
+	Type    string                 `json:"type" bson:"type" mapstructure:"type"`
+	Request *WorkflowDryRunRequest `json:"request,omitempty" bson:"request,omitempty" mapstructure:"request"`
+	Message string                 `json:"message,omitempty" bson:"message,omitempty" mapstructure:"message"`
+	Error   string                 `json:"error,omitempty" bson:"error,omitempty" mapstructure:"error"`
+}
+
+// WorkflowDryRunRequest is an outbound request as it would be sent, with the secrets masked.
+type WorkflowDryRunRequest = workflows.DryRunRequest
+
+// WorkflowVersion is an immutable snapshot of a workflow definition, one is recorded every time the workflow is saved.
+type WorkflowVersion struct {
+	TenantID   string      `json:"tenant_id" bson:"tenant_id" mapstructure:"tenant_id"`
+	WorkflowID string      `json:"workflow_id" bson:"workflow_id" mapstructure:"workflow_id"`
+	Version    int         `json:"version" bson:"version" mapstructure:"version"`
+	Definition interface{} `json:"definition" bson:"definition" mapstructure:"definition"`
+	Comment    string      `json:"comment" bson:"comment" mapstructure:"comment"`
+	CreatedAt  time.Time   `json:"created_at" bson:"created_at" mapstructure:"created_at"`
+}
+
+const (
+	WorkflowVersionChangeAdded   = "added"
+	WorkflowVersionChangeRemoved = "removed"
+	WorkflowVersionChangeChanged = "changed"
+)
+
+// WorkflowVersionChange is a difference between two versions of a workflow definition,
+// Path is the dotted path of the changed field (e.g. actions.0.url).
+type WorkflowVersionChange struct {
+	Path   string      `json:"path" bson:"path" mapstructure:"path"`
+	Change string      `json:"change" bson:"change" mapstructure:"change"`
+	From   interface{} `json:"from" bson:"from" mapstructure:"from"`
+	To     interface{} `json:"to" bson:"to" mapstructure:"to"`
+}
+
+// WorkflowCatalogEntry describes a trigger or action type, see workflows.CatalogEntry.
+type WorkflowCatalogEntry = workflows.CatalogEntry
+
+// WorkflowCatalog lists the trigger and action types workflows can be built from.
+type WorkflowCatalog = workflows.Catalog
+
+// WorkflowBundle is a portable export of workflows that can be imported into another tenant. The env vars
+// are referenced by their names in the templates and listed without their values, the inventory items
+// are listed so they can be mapped to the items of the importing tenant.
+type WorkflowBundle struct {
+	Format         string                        `json:"format" yaml:"format"`
+	Version        int                           `json:"version" yaml:"version"`
+	ExportedAt     time.Time                     `json:"exported_at" yaml:"exported_at"`
+	EnvVars        []WorkflowBundleEnvVar        `json:"env_vars" yaml:"env_vars"`
+	InventoryItems []WorkflowBundleInventoryItem `json:"inventory_items" yaml:"inventory_items"`
+	Workflows      []WorkflowBundleWorkflow      `json:"workflows" yaml:"workflows"`
+	// Warnings lists what was left out of the export, such as credentials written in the actions.
+	Warnings []string `json:"warnings,omitempty" yaml:"warnings,omitempty"`
+}
+
+// WorkflowBundleEnvVar is an env var the workflows of a bundle reference.
+type WorkflowBundleEnvVar struct {
+	Name     string `json:"name" yaml:"name"`
+	IsSecret bool   `json:"is_secret" yaml:"is_secret"`
+}
+
+// WorkflowBundleInventoryItem is an inventory item the workflows of a bundle reference.
+type WorkflowBundleInventoryItem struct {
+	ID   string `json:"id" yaml:"id"`
+	Name string `json:"name" yaml:"name"`
+	Unit string `json:"unit" yaml:"unit"`
+}
+
+// WorkflowBundleWorkflow is the definition of a workflow in a bundle, without its id, version and state.
+type WorkflowBundleWorkflow struct {
+	Name        string                 `json:"name" yaml:"name"`
+	Description string                 `json:"description" yaml:"description"`
+	Enabled     bool                   `json:"enabled" yaml:"enabled"`
+	Trigger     map[string]interface{} `json:"trigger,omitempty" yaml:"trigger,omitempty"`
+	Actions     []interface{}          `json:"actions" yaml:"actions"`
 }
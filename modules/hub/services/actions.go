@@ -0,0 +1,794 @@
+package services
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mitchellh/mapstructure"
+	"github.com/nutrixpos/hub/common"
+	"github.com/nutrixpos/hub/common/workflows"
+	"github.com/nutrixpos/hub/modules/hub/models"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// actionSchema returns the JSON schema of an action definition, every action accepts a retry policy.
+func actionSchema(action_type string, required []string, properties map[string]interface{}) map[string]interface{} {
+
+	properties["retry"] = map[string]interface{}{
+		"type":        "object",
+		"description": "Retry policy of the action, intervals are in seconds",
+		"properties": map[string]interface{}{
+			"max_attempts":           jsonSchemaProperty("integer", "Attempts before the run fails, between 1 and 20"),
+			"initial_interval":       jsonSchemaProperty("integer", "Wait before the second attempt"),
+			"max_interval":           jsonSchemaProperty("integer", "Longest wait between two attempts"),
+			"multiplier":             jsonSchemaProperty("number", "Growth of the wait between attempts"),
+			"retryable_status_codes": jsonSchemaArray(jsonSchemaProperty("integer", "Response status code"), "Status codes worth another attempt"),
+		},
+	}
+
+	return jsonSchemaObject(action_type, required, properties)
+}
+
+// errExecutorAction is returned when running an action the executor evaluates itself.
+func errExecutorAction(action_type string) error {
+	return fmt.Errorf("%s actions are evaluated by the workflow executor", action_type)
+}
+
+// n8nWebhookActionHandler calls an n8n webhook with the action input.
+type n8nWebhookActionHandler struct{}
+
+func (n8nWebhookActionHandler) Describe() models.WorkflowCatalogEntry {
+	return models.WorkflowCatalogEntry{
+		Type:        models.WorkflowActionTypeN8nWebhookLabel,
+		Label:       "n8n webhook",
+		Description: "Calls an n8n webhook with the action input.",
+		Schema: actionSchema(models.WorkflowActionTypeN8nWebhookLabel, []string{"webhook_url"}, map[string]interface{}{
+			"webhook_url":    jsonSchemaProperty("string", "Webhook URL, env vars can be referenced"),
+			"method":         jsonSchemaProperty("string", "HTTP method of the call", http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete),
+			"headers":        jsonSchemaStringMap("Headers of the call"),
+			"timeout":        jsonSchemaProperty("integer", "Timeout of the call in seconds"),
+			"input":          jsonSchemaProperty("string", "Input template"),
+			"output":         jsonSchemaProperty("string", "Output template"),
+			"missing_values": missingValuesSchema(),
+		}),
+	}
+}
+
+func (n8nWebhookActionHandler) Decode(raw interface{}, path string) (interface{}, error) {
+
+	var action models.WorkflowN8nWebhookAction
+	err := mapstructure.Decode(raw, &action)
+	if err != nil {
+		return nil, err
+	}
+
+	templates := map[string]string{"webhook_url": action.WebhookURL}
+	for key, value := range action.Headers {
+		templates["header name "+key] = key
+		templates["header "+key] = value
+	}
+
+	action.MissingValues, err = validateTemplates(action.MissingValues, templates)
+	if err != nil {
+		return nil, err
+	}
+
+	return action, nil
+}
+
+func (n8nWebhookActionHandler) Execute(ctx workflows.ActionContext, raw_action bson.Raw, input interface{}) (interface{}, error) {
+
+	var action models.WorkflowN8nWebhookAction
+	err := bson.Unmarshal(raw_action, &action)
+	if err != nil {
+		return nil, err
+	}
+
+	ws, err := workflowsService(ctx.Service)
+	if err != nil {
+		return nil, err
+	}
+
+	return ws.RunN8nAction(ctx.Context, input, action, ctx.TenantID, ctx.WorkflowID, ctx.RunID, ctx.StepIndex)
+}
+
+func (n8nWebhookActionHandler) DryRun(ctx workflows.ActionContext, raw_action bson.Raw, input interface{}) (*models.WorkflowDryRunRequest, string, error) {
+
+	var action models.WorkflowN8nWebhookAction
+	err := bson.Unmarshal(raw_action, &action)
+	if err != nil {
+		return nil, "", err
+	}
+
+	ws, err := workflowsService(ctx.Service)
+	if err != nil {
+		return nil, "", err
+	}
+
+	http_req, secrets_values, err := ws.prepareN8nRequest(input, action, ctx.TenantID, true)
+	if err != nil {
+		return nil, "", err
+	}
+
+	request, err := describeRequest(http_req, secrets_values)
+	return request, "Request not sent, the action input is passed to the next action", err
+}
+
+// httpRequestActionHandler sends a generic HTTP request.
+type httpRequestActionHandler struct{}
+
+func (httpRequestActionHandler) Describe() models.WorkflowCatalogEntry {
+	return models.WorkflowCatalogEntry{
+		Type:        models.WorkflowActionTypeHttpRequestLabel,
+		Label:       "HTTP request",
+		Description: "Sends an HTTP request, its response is passed to the next action.",
+		Schema: actionSchema(models.WorkflowActionTypeHttpRequestLabel, []string{"url"}, map[string]interface{}{
+			"url":            jsonSchemaProperty("string", "URL template"),
+			"method":         jsonSchemaProperty("string", "HTTP method, defaults to POST", http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete, http.MethodHead),
+			"query_params":   jsonSchemaStringMap("Query parameter templates"),
+			"headers":        jsonSchemaStringMap("Header templates"),
+			"body":           jsonSchemaProperty("string", "Body template, the input is sent as json when empty"),
+			"timeout":        jsonSchemaProperty("integer", "Timeout of the request in seconds"),
+			"missing_values": missingValuesSchema(),
+			"auth": map[string]interface{}{
+				"type":        "object",
+				"description": "Authentication of the request",
+				"properties": map[string]interface{}{
+					"type":     jsonSchemaProperty("string", "Authentication scheme", models.HttpRequestAuthTypeNone, models.HttpRequestAuthTypeBasic, models.HttpRequestAuthTypeBearer),
+					"username": jsonSchemaProperty("string", "Username of basic auth"),
+					"password": jsonSchemaProperty("string", "Password of basic auth, env vars can be referenced"),
+					"token":    jsonSchemaProperty("string", "Token of bearer auth, env vars can be referenced"),
+				},
+			},
+		}),
+	}
+}
+
+func (httpRequestActionHandler) Decode(raw interface{}, path string) (interface{}, error) {
+
+	var action models.WorkflowHttpRequestAction
+	err := mapstructure.Decode(raw, &action)
+	if err != nil {
+		return nil, err
+	}
+
+	err = validateHttpRequestAction(&action)
+	if err != nil {
+		return nil, err
+	}
+
+	return action, nil
+}
+
+func (httpRequestActionHandler) Execute(ctx workflows.ActionContext, raw_action bson.Raw, input interface{}) (interface{}, error) {
+
+	var action models.WorkflowHttpRequestAction
+	err := bson.Unmarshal(raw_action, &action)
+	if err != nil {
+		return nil, err
+	}
+
+	ws, err := workflowsService(ctx.Service)
+	if err != nil {
+		return nil, err
+	}
+
+	return ws.RunHttpRequestAction(ctx.Context, input, action, ctx.TenantID, ctx.WorkflowID, ctx.RunID, ctx.StepIndex)
+}
+
+func (httpRequestActionHandler) DryRun(ctx workflows.ActionContext, raw_action bson.Raw, input interface{}) (*models.WorkflowDryRunRequest, string, error) {
+
+	var action models.WorkflowHttpRequestAction
+	err := bson.Unmarshal(raw_action, &action)
+	if err != nil {
+		return nil, "", err
+	}
+
+	ws, err := workflowsService(ctx.Service)
+	if err != nil {
+		return nil, "", err
+	}
+
+	http_req, secrets_values, err := ws.prepareHttpRequest(input, action, ctx.TenantID, true)
+	if err != nil {
+		return nil, "", err
+	}
+
+	request, err := describeRequest(http_req, secrets_values)
+	return request, "Request not sent, the action input is passed to the next action", err
+}
+
+// validateHttpRequestAction checks the http request action before it is saved,
+// the method and auth type are normalized in place.
+func validateHttpRequestAction(action *models.WorkflowHttpRequestAction) error {
+
+	if strings.TrimSpace(action.URL) == "" {
+		return fmt.Errorf("url is required")
+	}
+
+	action.Method = strings.ToUpper(action.Method)
+	switch action.Method {
+	case "":
+		action.Method = http.MethodPost
+	case http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete, http.MethodHead:
+	default:
+		return fmt.Errorf("unsupported method %s", action.Method)
+	}
+
+	if action.Timeout < 0 {
+		return fmt.Errorf("timeout can't be negative")
+	}
+
+	templates := map[string]string{
+		"url":           action.URL,
+		"body":          action.Body,
+		"auth username": action.Auth.Username,
+		"auth password": action.Auth.Password,
+		"auth token":    action.Auth.Token,
+	}
+	for key, value := range action.QueryParams {
+		templates["query param "+key] = value
+	}
+	for key, value := range action.Headers {
+		templates["header name "+key] = key
+		templates["header "+key] = value
+	}
+
+	var err error
+	action.MissingValues, err = validateTemplates(action.MissingValues, templates)
+	if err != nil {
+		return err
+	}
+
+	switch action.Auth.Type {
+	case "":
+		action.Auth.Type = models.HttpRequestAuthTypeNone
+	case models.HttpRequestAuthTypeNone:
+	case models.HttpRequestAuthTypeBasic:
+		if action.Auth.Username == "" {
+			return fmt.Errorf("auth username is required for basic auth")
+		}
+	case models.HttpRequestAuthTypeBearer:
+		if action.Auth.Token == "" {
+			return fmt.Errorf("auth token is required for bearer auth")
+		}
+	default:
+		return fmt.Errorf("unsupported auth type %s", action.Auth.Type)
+	}
+
+	return nil
+}
+
+// validateTemplates parses the templates of an action keyed by the field holding them and checks
+// its missing values mode, which is returned normalized.
+func validateTemplates(missing_values string, templates map[string]string) (string, error) {
+
+	switch missing_values {
+	case "":
+		missing_values = models.TemplateMissingValuesStrict
+	case models.TemplateMissingValuesStrict, models.TemplateMissingValuesLenient:
+	default:
+		return "", fmt.Errorf("unsupported missing_values %s", missing_values)
+	}
+
+	for field, template := range templates {
+		_, err := common.ParseTemplate(template)
+		if err != nil {
+			return "", fmt.Errorf("invalid %s template: %v", field, err)
+		}
+	}
+
+	return missing_values, nil
+}
+
+// missingValuesSchema returns the JSON schema of the missing values mode of the templates of an action.
+func missingValuesSchema() map[string]interface{} {
+	return jsonSchemaProperty("string", "Whether a value missing from a template fails the action (strict) or renders empty (lenient)", models.TemplateMissingValuesStrict, models.TemplateMissingValuesLenient)
+}
+
+// conditionActionHandler runs the then or else branch depending on its expression,
+// the executor evaluates it as it runs the branch itself.
+type conditionActionHandler struct {
+	registry *workflows.TypesRegistry
+}
+
+func (conditionActionHandler) Describe() models.WorkflowCatalogEntry {
+	return models.WorkflowCatalogEntry{
+		Type:        models.WorkflowActionTypeConditionLabel,
+		Label:       "Condition",
+		Description: "Runs the then or else actions depending on an expression over the input.",
+		Schema: actionSchema(models.WorkflowActionTypeConditionLabel, []string{"expression"}, map[string]interface{}{
+			"expression": jsonSchemaProperty("string", "Expression over the input, such as total > 100"),
+			"then":       jsonSchemaArray(map[string]interface{}{"type": "object"}, "Actions run when the expression holds"),
+			"else":       jsonSchemaArray(map[string]interface{}{"type": "object"}, "Actions run otherwise"),
+		}),
+	}
+}
+
+func (h conditionActionHandler) Decode(raw interface{}, path string) (interface{}, error) {
+
+	var action models.WorkflowConditionAction
+	err := mapstructure.Decode(raw, &action)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = common.ParseExpression(action.Expression)
+	if err != nil {
+		return nil, fmt.Errorf("invalid expression: %v", err)
+	}
+
+	action.Then, err = h.registry.DecodeActions(action.Then, path+".then")
+	if err != nil {
+		return nil, err
+	}
+
+	action.Else, err = h.registry.DecodeActions(action.Else, path+".else")
+	if err != nil {
+		return nil, err
+	}
+
+	return action, nil
+}
+
+func (conditionActionHandler) Execute(ctx workflows.ActionContext, raw_action bson.Raw, input interface{}) (interface{}, error) {
+	return nil, errExecutorAction(models.WorkflowActionTypeConditionLabel)
+}
+
+// filterActionHandler drops what doesn't match its expression, the executor evaluates it as it may stop the run.
+type filterActionHandler struct{}
+
+func (filterActionHandler) Describe() models.WorkflowCatalogEntry {
+	return models.WorkflowCatalogEntry{
+		Type:        models.WorkflowActionTypeFilterLabel,
+		Label:       "Filter",
+		Description: "Keeps what matches an expression, items[].quantity < 2 keeps the matching items. The run stops when nothing is left.",
+		Schema: actionSchema(models.WorkflowActionTypeFilterLabel, []string{"expression"}, map[string]interface{}{
+			"expression": jsonSchemaProperty("string", "Expression over the input"),
+		}),
+	}
+}
+
+func (filterActionHandler) Decode(raw interface{}, path string) (interface{}, error) {
+
+	var action models.WorkflowFilterAction
+	err := mapstructure.Decode(raw, &action)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = common.ParseExpression(action.Expression)
+	if err != nil {
+		return nil, fmt.Errorf("invalid expression: %v", err)
+	}
+
+	return action, nil
+}
+
+func (filterActionHandler) Execute(ctx workflows.ActionContext, raw_action bson.Raw, input interface{}) (interface{}, error) {
+	return nil, errExecutorAction(models.WorkflowActionTypeFilterLabel)
+}
+
+// waitForApprovalActionHandler pauses the run until an approver approves or rejects it,
+// the executor evaluates it as the run resumes from the approval.
+type waitForApprovalActionHandler struct{}
+
+func (waitForApprovalActionHandler) Describe() models.WorkflowCatalogEntry {
+	return models.WorkflowCatalogEntry{
+		Type:        models.WorkflowActionTypeWaitForApprovalLabel,
+		Label:       "Wait for approval",
+		Description: "Pauses the run and emails the approvers, the run resumes with the action input once approved and is cancelled once rejected. Only allowed as a top level action.",
+		Schema: actionSchema(models.WorkflowActionTypeWaitForApprovalLabel, []string{"approvers"}, map[string]interface{}{
+			"approvers":       jsonSchemaProperty("string", "Comma separated approver emails template, such as {{ OWNER_EMAILS }}"),
+			"subject":         jsonSchemaProperty("string", "Subject template of the approval"),
+			"message":         jsonSchemaProperty("string", "Message template shown to the approvers"),
+			"timeout_minutes": jsonSchemaProperty("integer", fmt.Sprintf("Minutes to wait for a decision, defaults to %d", DefaultWorkflowApprovalTimeoutMinutes)),
+			"on_timeout":      jsonSchemaProperty("string", "Decision taken once the timeout runs out", models.WorkflowApprovalTimeoutReject, models.WorkflowApprovalTimeoutApprove),
+			"missing_values":  missingValuesSchema(),
+		}),
+	}
+}
+
+func (waitForApprovalActionHandler) Decode(raw interface{}, path string) (interface{}, error) {
+
+	var action models.WorkflowWaitForApprovalAction
+	err := mapstructure.Decode(raw, &action)
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.Contains(path, ".") {
+		return nil, fmt.Errorf("%s can only be a top level action", models.WorkflowActionTypeWaitForApprovalLabel)
+	}
+
+	if strings.TrimSpace(action.Approvers) == "" {
+		return nil, fmt.Errorf("approvers is required")
+	}
+
+	if action.TimeoutMinutes < 0 || action.TimeoutMinutes > maxWorkflowApprovalTimeoutMinutes {
+		return nil, fmt.Errorf("timeout_minutes must be between 0 and %d", maxWorkflowApprovalTimeoutMinutes)
+	}
+	if action.TimeoutMinutes == 0 {
+		action.TimeoutMinutes = DefaultWorkflowApprovalTimeoutMinutes
+	}
+
+	switch action.OnTimeout {
+	case "":
+		action.OnTimeout = models.WorkflowApprovalTimeoutReject
+	case models.WorkflowApprovalTimeoutReject, models.WorkflowApprovalTimeoutApprove:
+	default:
+		return nil, fmt.Errorf("unsupported on_timeout %s", action.OnTimeout)
+	}
+
+	action.MissingValues, err = validateTemplates(action.MissingValues, map[string]string{
+		"approvers": action.Approvers,
+		"subject":   action.Subject,
+		"message":   action.Message,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return action, nil
+}
+
+func (waitForApprovalActionHandler) Execute(ctx workflows.ActionContext, raw_action bson.Raw, input interface{}) (interface{}, error) {
+	return nil, errExecutorAction(models.WorkflowActionTypeWaitForApprovalLabel)
+}
+
+func (waitForApprovalActionHandler) DryRun(ctx workflows.ActionContext, raw_action bson.Raw, input interface{}) (*models.WorkflowDryRunRequest, string, error) {
+
+	var action models.WorkflowWaitForApprovalAction
+	err := bson.Unmarshal(raw_action, &action)
+	if err != nil {
+		return nil, "", err
+	}
+
+	ws, err := workflowsService(ctx.Service)
+	if err != nil {
+		return nil, "", err
+	}
+
+	approval, err := ws.prepareApproval(input, action, ctx.TenantID)
+	if err != nil {
+		return nil, "", err
+	}
+
+	outcome := "rejected"
+	if approval.OnTimeout == models.WorkflowApprovalTimeoutApprove {
+		outcome = "approved"
+	}
+
+	return nil, fmt.Sprintf("Run would wait for the approval of %s, without a decision by %s it would be %s", strings.Join(approval.Approvers, ", "), approval.ExpiresAt.Format(time.RFC3339), outcome), nil
+}
+
+// delayActionHandler pauses the run for a duration or until a given time, the executor evaluates it
+// as the run resumes once the delay is over.
+type delayActionHandler struct{}
+
+func (delayActionHandler) Describe() models.WorkflowCatalogEntry {
+	return models.WorkflowCatalogEntry{
+		Type:        models.WorkflowActionTypeDelayLabel,
+		Label:       "Delay",
+		Description: "Pauses the run for a duration or until a time, the action input is passed on once the delay is over. Only allowed as a top level action.",
+		Schema: actionSchema(models.WorkflowActionTypeDelayLabel, nil, map[string]interface{}{
+			"duration_minutes": jsonSchemaProperty("integer", "Minutes to pause the run, either this or until is required"),
+			"until":            jsonSchemaProperty("string", "Template of when the run resumes, an RFC3339 timestamp or a HH:MM time such as 08:00 for its next occurrence"),
+			"timezone":         jsonSchemaProperty("string", "IANA timezone template a HH:MM until is evaluated in, defaults to the hub timezone"),
+			"missing_values":   missingValuesSchema(),
+		}),
+	}
+}
+
+func (delayActionHandler) Decode(raw interface{}, path string) (interface{}, error) {
+
+	var action models.WorkflowDelayAction
+	err := mapstructure.Decode(raw, &action)
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.Contains(path, ".") {
+		return nil, fmt.Errorf("%s can only be a top level action", models.WorkflowActionTypeDelayLabel)
+	}
+
+	if action.DurationMinutes < 0 || action.DurationMinutes > maxWorkflowDelayMinutes {
+		return nil, fmt.Errorf("duration_minutes must be between 0 and %d", maxWorkflowDelayMinutes)
+	}
+
+	action.Until = strings.TrimSpace(action.Until)
+	if action.DurationMinutes == 0 && action.Until == "" {
+		return nil, fmt.Errorf("either duration_minutes or until is required")
+	}
+	if action.DurationMinutes > 0 && action.Until != "" {
+		return nil, fmt.Errorf("duration_minutes and until can't be both set")
+	}
+
+	action.MissingValues, err = validateTemplates(action.MissingValues, map[string]string{
+		"until":    action.Until,
+		"timezone": action.TimeZone,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// values without placeholders are checked now rather than when the run gets there
+	if !strings.Contains(action.TimeZone, "{{") {
+		_, err = delayLocation(strings.TrimSpace(action.TimeZone), "")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if action.Until != "" && !strings.Contains(action.Until, "{{") {
+		_, err = parseDelayUntil(action.Until, time.UTC, time.Now())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return action, nil
+}
+
+func (delayActionHandler) Execute(ctx workflows.ActionContext, raw_action bson.Raw, input interface{}) (interface{}, error) {
+	return nil, errExecutorAction(models.WorkflowActionTypeDelayLabel)
+}
+
+func (delayActionHandler) DryRun(ctx workflows.ActionContext, raw_action bson.Raw, input interface{}) (*models.WorkflowDryRunRequest, string, error) {
+
+	var action models.WorkflowDelayAction
+	err := bson.Unmarshal(raw_action, &action)
+	if err != nil {
+		return nil, "", err
+	}
+
+	now := time.Now()
+
+	ws, err := workflowsService(ctx.Service)
+	if err != nil {
+		return nil, "", err
+	}
+
+	until, err := ws.prepareDelay(input, action, ctx.TenantID, now)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if !until.After(now) {
+		return nil, fmt.Sprintf("Delay until %s is already over, the run would go on", until.Format(time.RFC3339)), nil
+	}
+
+	return nil, fmt.Sprintf("Run would be delayed until %s", until.Format(time.RFC3339)), nil
+}
+
+// sendEmailActionHandler sends an email through the configured SMTP server.
+type sendEmailActionHandler struct{}
+
+func (sendEmailActionHandler) Describe() models.WorkflowCatalogEntry {
+	return models.WorkflowCatalogEntry{
+		Type:        models.WorkflowActionTypeSendEmailLabel,
+		Label:       "Send email",
+		Description: "Sends an email through the configured SMTP server, it's attempted 3 times unless a retry policy is set.",
+		Schema: actionSchema(models.WorkflowActionTypeSendEmailLabel, []string{"to", "subject"}, map[string]interface{}{
+			"to":             jsonSchemaProperty("string", "Comma separated recipients template, such as {{ OWNER_EMAILS }}"),
+			"cc":             jsonSchemaProperty("string", "Comma separated cc recipients template"),
+			"bcc":            jsonSchemaProperty("string", "Comma separated bcc recipients template"),
+			"from_name":      jsonSchemaProperty("string", "Sender name template, defaults to the configured sender name"),
+			"reply_to":       jsonSchemaProperty("string", "Reply-To addresses template"),
+			"subject":        jsonSchemaProperty("string", "Subject template"),
+			"html_body":      jsonSchemaProperty("string", "HTML body template"),
+			"text_body":      jsonSchemaProperty("string", "Plain text body template"),
+			"missing_values": missingValuesSchema(),
+		}),
+	}
+}
+
+func (sendEmailActionHandler) Decode(raw interface{}, path string) (interface{}, error) {
+
+	var action models.WorkflowSendEmailAction
+	err := mapstructure.Decode(raw, &action)
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.TrimSpace(action.To) == "" {
+		return nil, fmt.Errorf("to is required")
+	}
+
+	if strings.TrimSpace(action.Subject) == "" {
+		return nil, fmt.Errorf("subject is required")
+	}
+
+	if strings.TrimSpace(action.HtmlBody) == "" && strings.TrimSpace(action.TextBody) == "" {
+		return nil, fmt.Errorf("html_body or text_body is required")
+	}
+
+	action.MissingValues, err = validateTemplates(action.MissingValues, map[string]string{
+		"to":        action.To,
+		"cc":        action.Cc,
+		"bcc":       action.Bcc,
+		"from_name": action.FromName,
+		"reply_to":  action.ReplyTo,
+		"subject":   action.Subject,
+		"html_body": action.HtmlBody,
+		"text_body": action.TextBody,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// mail servers refuse messages for a while under load, emails are retried unless told otherwise
+	if action.Retry == nil {
+		action.Retry = &models.WorkflowRetryPolicy{MaxAttempts: 3, InitialInterval: 30}
+	}
+
+	return action, nil
+}
+
+func (sendEmailActionHandler) Execute(ctx workflows.ActionContext, raw_action bson.Raw, input interface{}) (interface{}, error) {
+
+	var action models.WorkflowSendEmailAction
+	err := bson.Unmarshal(raw_action, &action)
+	if err != nil {
+		return nil, err
+	}
+
+	ws, err := workflowsService(ctx.Service)
+	if err != nil {
+		return nil, err
+	}
+
+	return ws.RunSendEmailAction(ctx.Context, input, action, ctx.TenantID, ctx.WorkflowID, ctx.RunID, ctx.StepIndex)
+}
+
+func (sendEmailActionHandler) DryRun(ctx workflows.ActionContext, raw_action bson.Raw, input interface{}) (*models.WorkflowDryRunRequest, string, error) {
+
+	var action models.WorkflowSendEmailAction
+	err := bson.Unmarshal(raw_action, &action)
+	if err != nil {
+		return nil, "", err
+	}
+
+	ws, err := workflowsService(ctx.Service)
+	if err != nil {
+		return nil, "", err
+	}
+
+	message, err := ws.prepareEmail(input, action, ctx.TenantID)
+	if err != nil {
+		return nil, "", err
+	}
+
+	request := &models.WorkflowDryRunRequest{
+		Method:  "SMTP",
+		URL:     "smtp://" + ws.smtpAddress(),
+		Headers: make(map[string]string),
+		Body:    common.MaskString(message.TextBody, message.SecretsValues),
+	}
+
+	if message.HtmlBody != "" {
+		request.Body = common.MaskString(message.HtmlBody, message.SecretsValues)
+	}
+
+	headers := message.headers()
+	for key := range headers {
+		request.Headers[key] = common.MaskString(headers.Get(key), message.SecretsValues)
+	}
+	if len(message.Bcc) > 0 {
+		request.Headers["Bcc"] = common.MaskString(joinAddresses(message.Bcc), message.SecretsValues)
+	}
+
+	return request, "Email not sent, the action input is passed to the next action", nil
+}
+
+// adjustInventoryActionHandler sets, increments or decrements tenant inventory items.
+type adjustInventoryActionHandler struct{}
+
+func (adjustInventoryActionHandler) Describe() models.WorkflowCatalogEntry {
+	return models.WorkflowCatalogEntry{
+		Type:        models.WorkflowActionTypeAdjustInventoryLabel,
+		Label:       "Adjust inventory",
+		Description: "Sets, increments or decrements inventory items, items taken below their alert threshold raise a low stock event.",
+		Schema: actionSchema(models.WorkflowActionTypeAdjustInventoryLabel, []string{"adjustments"}, map[string]interface{}{
+			"adjustments": jsonSchemaArray(map[string]interface{}{
+				"type":     "object",
+				"required": []string{"item_id", "operation", "quantity"},
+				"properties": map[string]interface{}{
+					"item_id":   jsonSchemaProperty("string", "Inventory item id template, such as {{ input.item_id }}"),
+					"label":     jsonSchemaProperty("string", "Branch label template, such as branch:downtown, required when several branches stock the item"),
+					"operation": jsonSchemaProperty("string", "How the quantity is applied", models.InventoryAdjustmentOperationSet, models.InventoryAdjustmentOperationIncrement, models.InventoryAdjustmentOperationDecrement),
+					"quantity":  jsonSchemaProperty("string", "Quantity template, it must render a number"),
+				},
+			}, "Adjustments applied in order"),
+			"missing_values": missingValuesSchema(),
+		}),
+	}
+}
+
+func (adjustInventoryActionHandler) Decode(raw interface{}, path string) (interface{}, error) {
+
+	var action models.WorkflowAdjustInventoryAction
+	err := mapstructure.Decode(raw, &action)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(action.Adjustments) == 0 {
+		return nil, fmt.Errorf("adjustments are required")
+	}
+
+	templates := make(map[string]string)
+	for index, adjustment := range action.Adjustments {
+
+		field := fmt.Sprintf("adjustments[%d]", index)
+
+		switch adjustment.Operation {
+		case models.InventoryAdjustmentOperationSet, models.InventoryAdjustmentOperationIncrement, models.InventoryAdjustmentOperationDecrement:
+		default:
+			return nil, fmt.Errorf("%s: unsupported operation %s", field, adjustment.Operation)
+		}
+
+		if strings.TrimSpace(adjustment.ItemID) == "" {
+			return nil, fmt.Errorf("%s: item_id is required", field)
+		}
+
+		if strings.TrimSpace(adjustment.Quantity) == "" {
+			return nil, fmt.Errorf("%s: quantity is required", field)
+		}
+
+		templates[field+".item_id"] = adjustment.ItemID
+		templates[field+".label"] = adjustment.Label
+		templates[field+".quantity"] = adjustment.Quantity
+	}
+
+	action.MissingValues, err = validateTemplates(action.MissingValues, templates)
+	if err != nil {
+		return nil, err
+	}
+
+	return action, nil
+}
+
+func (adjustInventoryActionHandler) Execute(ctx workflows.ActionContext, raw_action bson.Raw, input interface{}) (interface{}, error) {
+
+	var action models.WorkflowAdjustInventoryAction
+	err := bson.Unmarshal(raw_action, &action)
+	if err != nil {
+		return nil, err
+	}
+
+	ws, err := workflowsService(ctx.Service)
+	if err != nil {
+		return nil, err
+	}
+
+	return ws.RunAdjustInventoryAction(input, action, ctx.TenantID, ctx.WorkflowID, ctx.RunID, ctx.StepIndex)
+}
+
+func (adjustInventoryActionHandler) DryRun(ctx workflows.ActionContext, raw_action bson.Raw, input interface{}) (*models.WorkflowDryRunRequest, string, error) {
+
+	var action models.WorkflowAdjustInventoryAction
+	err := bson.Unmarshal(raw_action, &action)
+	if err != nil {
+		return nil, "", err
+	}
+
+	ws, err := workflowsService(ctx.Service)
+	if err != nil {
+		return nil, "", err
+	}
+
+	adjustments, err := ws.prepareInventoryAdjustments(input, action, ctx.TenantID)
+	if err != nil {
+		return nil, "", err
+	}
+
+	planned := make([]string, 0, len(adjustments))
+	for _, adjustment := range adjustments {
+		planned = append(planned, fmt.Sprintf("%s %s by %v", adjustment.Operation, adjustment.ItemID, adjustment.Quantity))
+	}
+
+	return nil, fmt.Sprintf("Inventory not changed, would %s. The action input is passed to the next action", strings.Join(planned, ", ")), nil
+}
@@ -0,0 +1,525 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/nutrixpos/hub/common"
+	"github.com/nutrixpos/hub/modules/hub/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// DefaultWorkflowApprovalTimeoutMinutes is how long an approval waits when its action doesn't tell, a day.
+	DefaultWorkflowApprovalTimeoutMinutes = 24 * 60
+
+	// maxWorkflowApprovalTimeoutMinutes caps how long a run waits for an approval, 30 days.
+	maxWorkflowApprovalTimeoutMinutes = 30 * 24 * 60
+
+	// WorkflowApprovalDecidedByTimeout is who decided the approvals decided by their timeout.
+	WorkflowApprovalDecidedByTimeout = "timeout"
+)
+
+// ErrWorkflowApprovalDecided is returned when deciding an approval that isn't pending anymore.
+var ErrWorkflowApprovalDecided = errors.New("workflow approval was already decided")
+
+// ErrWorkflowApprovalForbidden is returned when the approval is decided by someone who isn't one of its approvers.
+var ErrWorkflowApprovalForbidden = errors.New("only the approvers of the workflow approval can decide it")
+
+// getApprovalsCollection returns the collection of the workflow approvals.
+// The caller is responsible for disconnecting the returned client.
+func (ws *WorkflowsService) getApprovalsCollection(ctx context.Context) (client *mongo.Client, collection *mongo.Collection, err error) {
+	return ws.getDocumentsCollection(ctx, "workflow_approvals")
+}
+
+// EnsureWorkflowApprovalsIndexes creates the indexes used to list the approvals and find the expired ones.
+func (ws *WorkflowsService) EnsureWorkflowApprovalsIndexes() (err error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), ws.dbDeadline())
+	defer cancel()
+
+	client, collection, err := ws.getApprovalsCollection(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect(ctx)
+
+	_, err = collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "id", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys: bson.D{{Key: "tenant_id", Value: 1}, {Key: "status", Value: 1}, {Key: "created_at", Value: -1}},
+		},
+		{
+			Keys: bson.D{{Key: "status", Value: 1}, {Key: "expires_at", Value: 1}},
+		},
+		{
+			Keys: bson.D{{Key: "run_id", Value: 1}, {Key: "status", Value: 1}},
+		},
+	})
+
+	return err
+}
+
+// requestApproval pauses the run on the approval step, the approval is stored with the input of the step
+// and the approvers are notified. ErrWorkflowRunCancelled is returned when the run was cancelled meanwhile.
+func (ws *WorkflowsService) requestApproval(execution *workflowExecution, step_index int, raw_action bson.Raw, input interface{}) (err error) {
+
+	var action models.WorkflowWaitForApprovalAction
+	err = bson.Unmarshal(raw_action, &action)
+	if err != nil {
+		return err
+	}
+
+	approval, err := ws.prepareApproval(input, action, execution.TenantID)
+	if err != nil {
+		return err
+	}
+
+	run, err := ws.GetWorkflowRun(execution.TenantID, execution.WorkflowID, execution.RunID)
+	if err != nil {
+		return err
+	}
+
+	approval.ID = primitive.NewObjectID().Hex()
+	approval.TenantID = execution.TenantID
+	approval.WorkflowID = execution.WorkflowID
+	approval.WorkflowVersion = run.WorkflowVersion
+	approval.RunID = execution.RunID
+	approval.StepIndex = step_index
+	approval.ResumeIndex = execution.ResumeIndex + 1
+	approval.Status = models.WorkflowApprovalStatusPending
+
+	approval.Input, err = toJSONValue(input)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), ws.dbDeadline())
+	defer cancel()
+
+	client, collection, err := ws.getApprovalsCollection(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect(ctx)
+
+	_, err = collection.InsertOne(ctx, approval)
+	if err != nil {
+		return err
+	}
+
+	err = ws.updateWorkflowRunWhere(execution.TenantID, execution.WorkflowID, execution.RunID, bson.M{"status": models.WorkflowRunStatusRunning}, bson.M{
+		"$set": bson.M{"status": models.WorkflowRunStatusWaiting},
+	})
+	if err == mongo.ErrNoDocuments {
+		ws.setWorkflowApprovalStatus(approval.TenantID, approval.ID, models.WorkflowApprovalStatusCancelled, "", "")
+		return ErrWorkflowRunCancelled
+	}
+	if err != nil {
+		return err
+	}
+
+	ws.SetWorkflowRunStepStatus(execution.TenantID, execution.WorkflowID, execution.RunID, step_index, models.WorkflowRunStepStatusWaiting)
+	ws.AddLogsToWorkflowRunStep(execution.TenantID, execution.WorkflowID, execution.RunID, step_index, models.WorkflowRunLog{
+		Level:     "INFO",
+		Message:   fmt.Sprintf("Waiting for approval %s from %s until %s", approval.ID, strings.Join(approval.Approvers, ", "), approval.ExpiresAt.Format(time.RFC3339)),
+		TimeStamp: time.Now(),
+	})
+
+	err = ws.notifyApprovers(approval)
+	if err != nil {
+		ws.AddLogsToWorkflowRunStep(execution.TenantID, execution.WorkflowID, execution.RunID, step_index, models.WorkflowRunLog{
+			Level:     "WARNING",
+			Message:   fmt.Sprintf("Failed to notify the approvers: %v", err),
+			TimeStamp: time.Now(),
+		})
+	}
+
+	return nil
+}
+
+// prepareApproval renders the templates of the action against the tenant env vars and the action input,
+// secrets are masked in what is stored as the approval is shown to the approvers.
+func (ws *WorkflowsService) prepareApproval(input interface{}, action models.WorkflowWaitForApprovalAction, tenant_id string) (approval models.WorkflowApproval, err error) {
+
+	tenant_svc := TenantService{
+		Config: ws.Config,
+		Logger: ws.Logger,
+	}
+
+	tenant, err := tenant_svc.GetTenantById(tenant_id)
+	if err != nil {
+		return approval, err
+	}
+
+	env_vars, err := ws.DecryptEnvVars(tenant)
+	if err != nil {
+		return approval, err
+	}
+
+	vars_basket, secrets_values, err := BuildVarsBasket(env_vars, input)
+	if err != nil {
+		return approval, err
+	}
+
+	rendered := map[string]string{}
+	for field, template := range map[string]string{
+		"approvers": action.Approvers,
+		"subject":   action.Subject,
+		"message":   action.Message,
+	} {
+		rendered[field], err = renderActionTemplate(field, template, vars_basket, secrets_values, action.MissingValues)
+		if err != nil {
+			return approval, err
+		}
+	}
+
+	approvers, err := parseAddressList("approvers", rendered["approvers"])
+	if err != nil {
+		return approval, errors.New(common.MaskString(err.Error(), secrets_values))
+	}
+
+	if len(approvers) == 0 {
+		return approval, fmt.Errorf("the approval has no approvers")
+	}
+
+	for _, approver := range approvers {
+		approval.Approvers = append(approval.Approvers, approver.Address)
+	}
+
+	approval.Subject = strings.Join(strings.Fields(common.MaskString(rendered["subject"], secrets_values)), " ")
+	if approval.Subject == "" {
+		approval.Subject = "Workflow approval required"
+	}
+	approval.Message = common.MaskString(rendered["message"], secrets_values)
+
+	timeout := action.TimeoutMinutes
+	if timeout <= 0 {
+		timeout = DefaultWorkflowApprovalTimeoutMinutes
+	}
+
+	approval.OnTimeout = action.OnTimeout
+	if approval.OnTimeout == "" {
+		approval.OnTimeout = models.WorkflowApprovalTimeoutReject
+	}
+
+	approval.CreatedAt = time.Now()
+	approval.ExpiresAt = approval.CreatedAt.Add(time.Duration(timeout) * time.Minute)
+
+	return approval, nil
+}
+
+// notifyApprovers emails the approvers what they are asked to decide and how.
+func (ws *WorkflowsService) notifyApprovers(approval models.WorkflowApproval) error {
+
+	if ws.Config.Smtp.Host == "" || ws.Config.Smtp.FromAddress == "" {
+		return fmt.Errorf("smtp host and from address must be configured to notify the approvers")
+	}
+
+	message := emailMessage{
+		From:    mail.Address{Name: ws.Config.Smtp.FromName, Address: ws.Config.Smtp.FromAddress},
+		Subject: approval.Subject,
+	}
+
+	for _, approver := range approval.Approvers {
+		message.To = append(message.To, &mail.Address{Address: approver})
+	}
+
+	outcome := "rejected"
+	if approval.OnTimeout == models.WorkflowApprovalTimeoutApprove {
+		outcome = "approved"
+	}
+
+	var body strings.Builder
+	if approval.Message != "" {
+		body.WriteString(approval.Message + "\n\n")
+	}
+	fmt.Fprintf(&body, "Run %s of workflow %s is waiting for your approval (%s).\n\n", approval.RunID, approval.WorkflowID, approval.ID)
+	if ws.Config.Workflows.ApprovalURL != "" {
+		fmt.Fprintf(&body, "Approve or reject it at %s\n\n", strings.ReplaceAll(ws.Config.Workflows.ApprovalURL, "{id}", url.PathEscape(approval.ID)))
+	} else {
+		body.WriteString("Approve or reject it from the pending workflow approvals of your dashboard.\n\n")
+	}
+	fmt.Fprintf(&body, "Without a decision by %s the run is %s.\n", approval.ExpiresAt.Format(time.RFC1123), outcome)
+	message.TextBody = body.String()
+
+	var err error
+	message.MessageID, err = newEmailMessageID(ws.Config.Smtp.FromAddress)
+	if err != nil {
+		return err
+	}
+
+	return ws.sendEmail(context.Background(), message)
+}
+
+// GetWorkflowApprovals returns a page of the tenant approvals, newest first,
+// status and workflow_id narrow the results when not empty.
+func (ws *WorkflowsService) GetWorkflowApprovals(tenant_id string, status string, workflow_id string, page_number int, page_size int) (approvals []models.WorkflowApproval, total_records int, err error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), ws.dbDeadline())
+	defer cancel()
+
+	client, collection, err := ws.getApprovalsCollection(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer client.Disconnect(ctx)
+
+	filter := bson.M{"tenant_id": tenant_id}
+	if status != "" {
+		filter["status"] = status
+	}
+	if workflow_id != "" {
+		filter["workflow_id"] = workflow_id
+	}
+
+	count, err := collection.CountDocuments(ctx, filter)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	skip := (page_number - 1) * page_size
+
+	cursor, err := collection.Find(ctx, filter, options.Find().
+		SetSort(bson.M{"created_at": -1}).
+		SetSkip(int64(skip)).
+		SetLimit(int64(page_size)))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	approvals = make([]models.WorkflowApproval, 0)
+	err = cursor.All(ctx, &approvals)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return approvals, int(count), nil
+}
+
+// GetWorkflowApproval returns an approval of the tenant, mongo.ErrNoDocuments is returned when it doesn't exist.
+func (ws *WorkflowsService) GetWorkflowApproval(tenant_id string, id string) (approval models.WorkflowApproval, err error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), ws.dbDeadline())
+	defer cancel()
+
+	client, collection, err := ws.getApprovalsCollection(ctx)
+	if err != nil {
+		return approval, err
+	}
+	defer client.Disconnect(ctx)
+
+	err = collection.FindOne(ctx, bson.M{"tenant_id": tenant_id, "id": id}).Decode(&approval)
+	return approval, err
+}
+
+// DecideWorkflowApproval approves or rejects the pending approval. An approved run resumes in the background
+// at the action after the approval step, a rejected one is cancelled. approver_email is the email of the requester,
+// ErrWorkflowApprovalForbidden is returned unless it is one of the approvers, an empty one skips the check as in dev.
+// ErrWorkflowApprovalDecided is returned when the approval isn't pending anymore and ErrWorkflowRunFinished when
+// its run was cancelled meanwhile.
+func (ws *WorkflowsService) DecideWorkflowApproval(tenant_id string, id string, approve bool, decided_by string, approver_email string, comment string) (approval models.WorkflowApproval, err error) {
+
+	approval, err = ws.GetWorkflowApproval(tenant_id, id)
+	if err != nil {
+		return approval, err
+	}
+
+	if approver_email != "" && !isWorkflowApprover(approval, approver_email) {
+		return approval, ErrWorkflowApprovalForbidden
+	}
+
+	if approval.Status != models.WorkflowApprovalStatusPending {
+		return approval, ErrWorkflowApprovalDecided
+	}
+
+	err = ws.decideWorkflowApproval(approval, approve, decided_by, comment)
+	if err != nil {
+		return approval, err
+	}
+
+	return ws.GetWorkflowApproval(tenant_id, id)
+}
+
+// isWorkflowApprover tells whether the email is one of the approvers of the approval, emails are compared case insensitively.
+func isWorkflowApprover(approval models.WorkflowApproval, email string) bool {
+
+	for _, approver := range approval.Approvers {
+		if strings.EqualFold(strings.TrimSpace(approver), strings.TrimSpace(email)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ExpireWorkflowApprovals decides the pending approvals whose timeout ran out with their timeout outcome.
+func (ws *WorkflowsService) ExpireWorkflowApprovals(now time.Time) (err error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), ws.dbDeadline())
+	defer cancel()
+
+	client, collection, err := ws.getApprovalsCollection(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect(ctx)
+
+	cursor, err := collection.Find(ctx, bson.M{
+		"status":     models.WorkflowApprovalStatusPending,
+		"expires_at": bson.M{"$lte": now},
+	}, options.Find().SetSort(bson.M{"expires_at": 1}).SetLimit(100))
+	if err != nil {
+		return err
+	}
+
+	expired := make([]models.WorkflowApproval, 0)
+	err = cursor.All(ctx, &expired)
+	if err != nil {
+		return err
+	}
+
+	for _, approval := range expired {
+		comment := fmt.Sprintf("No decision before %s", approval.ExpiresAt.Format(time.RFC3339))
+
+		err = ws.decideWorkflowApproval(approval, approval.OnTimeout == models.WorkflowApprovalTimeoutApprove, WorkflowApprovalDecidedByTimeout, comment)
+		if err != nil && !errors.Is(err, ErrWorkflowApprovalDecided) && !errors.Is(err, ErrWorkflowRunFinished) {
+			ws.Logger.Error(fmt.Sprintf("failed to expire the approval %s: %v", approval.ID, err))
+		}
+	}
+
+	return nil
+}
+
+// decideWorkflowApproval records the decision and resumes or cancels the run. The run is moved out of
+// waiting first, which settles concurrent decisions, timeouts and cancellations of the same run.
+func (ws *WorkflowsService) decideWorkflowApproval(approval models.WorkflowApproval, approve bool, decided_by string, comment string) (err error) {
+
+	status, run_status := models.WorkflowApprovalStatusRejected, models.WorkflowRunStatusCancelled
+	if approve {
+		status, run_status = models.WorkflowApprovalStatusApproved, models.WorkflowRunStatusRunning
+	}
+
+	decision := fmt.Sprintf("Approval %s %s by %s", approval.ID, status, decided_by)
+	if comment != "" {
+		decision += ": " + comment
+	}
+
+	set := bson.M{"status": run_status}
+	if approve {
+		set["resume"] = workflowRunResume(approval.StepIndex, approval.ResumeIndex, approval.Input)
+	} else {
+		set["end_time"] = time.Now()
+	}
+
+	err = ws.updateWorkflowRunWhere(approval.TenantID, approval.WorkflowID, approval.RunID, bson.M{"status": models.WorkflowRunStatusWaiting}, bson.M{
+		"$set": set,
+		"$push": bson.M{"logs": models.WorkflowRunLog{
+			Level:     "INFO",
+			Message:   decision,
+			TimeStamp: time.Now(),
+		}},
+	})
+	if err == mongo.ErrNoDocuments {
+		// the run was cancelled or purged while waiting
+		ws.setWorkflowApprovalStatus(approval.TenantID, approval.ID, models.WorkflowApprovalStatusCancelled, "", "")
+		return ErrWorkflowRunFinished
+	}
+	if err != nil {
+		return err
+	}
+
+	decided, err := ws.setWorkflowApprovalStatus(approval.TenantID, approval.ID, status, decided_by, comment)
+	if err != nil {
+		return err
+	}
+	if !decided {
+		return ErrWorkflowApprovalDecided
+	}
+
+	ws.AddLogsToWorkflowRunStep(approval.TenantID, approval.WorkflowID, approval.RunID, approval.StepIndex, models.WorkflowRunLog{
+		Level:     "INFO",
+		Message:   decision,
+		TimeStamp: time.Now(),
+	})
+
+	if !approve {
+		ws.SetWorkflowRunStepStatus(approval.TenantID, approval.WorkflowID, approval.RunID, approval.StepIndex, models.WorkflowRunStepStatusCancelled)
+		ws.SkipPendingWorkflowRunSteps(approval.TenantID, approval.WorkflowID, approval.RunID)
+		return nil
+	}
+
+	return ws.resumeWorkflowRun(approval.TenantID, approval.WorkflowID, approval.RunID, approval.WorkflowVersion, approval.StepIndex, approval.ResumeIndex, approval.Input)
+}
+
+// setWorkflowApprovalStatus moves the pending approval to status, decided reports false when it wasn't pending anymore.
+func (ws *WorkflowsService) setWorkflowApprovalStatus(tenant_id string, id string, status string, decided_by string, comment string) (decided bool, err error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), ws.dbDeadline())
+	defer cancel()
+
+	client, collection, err := ws.getApprovalsCollection(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer client.Disconnect(ctx)
+
+	set := bson.M{
+		"status":     status,
+		"decided_at": time.Now(),
+	}
+	if decided_by != "" {
+		set["decided_by"] = decided_by
+	}
+	if comment != "" {
+		set["comment"] = comment
+	}
+
+	result, err := collection.UpdateOne(ctx, bson.M{
+		"tenant_id": tenant_id,
+		"id":        id,
+		"status":    models.WorkflowApprovalStatusPending,
+	}, bson.M{"$set": set})
+	if err != nil {
+		return false, err
+	}
+
+	return result.ModifiedCount > 0, nil
+}
+
+// cancelWaitingApproval cancels the pending approval of a cancelled run, if any.
+func (ws *WorkflowsService) cancelWaitingApproval(tenant_id string, run_id string) (err error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), ws.dbDeadline())
+	defer cancel()
+
+	client, collection, err := ws.getApprovalsCollection(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect(ctx)
+
+	_, err = collection.UpdateMany(ctx, bson.M{
+		"tenant_id": tenant_id,
+		"run_id":    run_id,
+		"status":    models.WorkflowApprovalStatusPending,
+	}, bson.M{
+		"$set": bson.M{
+			"status":     models.WorkflowApprovalStatusCancelled,
+			"decided_at": time.Now(),
+		},
+	})
+
+	return err
+}
@@ -0,0 +1,377 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/nutrixpos/hub/modules/hub/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// DefaultWorkflowDeadLettersRetentionDays is used when the config doesn't set the dead letters retention.
+const DefaultWorkflowDeadLettersRetentionDays = 90
+
+// ErrDeadLetterRedriven is returned when redriving a dead letter that was already redriven.
+var ErrDeadLetterRedriven = errors.New("dead letter was already redriven")
+
+// getDeadLettersCollection returns the collection of the dead letters.
+// The caller is responsible for disconnecting the returned client.
+func (ws *WorkflowsService) getDeadLettersCollection(ctx context.Context) (client *mongo.Client, collection *mongo.Collection, err error) {
+	return ws.getDocumentsCollection(ctx, "workflow_dead_letters")
+}
+
+// EnsureDeadLettersIndexes creates the indexes used to look up, list and purge the dead letters.
+func (ws *WorkflowsService) EnsureDeadLettersIndexes() (err error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), ws.dbDeadline())
+	defer cancel()
+
+	client, collection, err := ws.getDeadLettersCollection(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect(ctx)
+
+	_, err = collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "id", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys: bson.D{{Key: "tenant_id", Value: 1}, {Key: "created_at", Value: -1}},
+		},
+		{
+			Keys: bson.D{{Key: "tenant_id", Value: 1}, {Key: "status", Value: 1}, {Key: "created_at", Value: -1}},
+		},
+		{
+			Keys: bson.D{{Key: "created_at", Value: 1}},
+		},
+	})
+
+	return err
+}
+
+// PurgeExpiredDeadLetters deletes the dead letters created before the retention period of the config.
+func (ws *WorkflowsService) PurgeExpiredDeadLetters(now time.Time) (deleted int64, err error) {
+
+	retention_days := ws.Config.Workflows.DeadLettersRetentionDays
+	if retention_days <= 0 {
+		retention_days = DefaultWorkflowDeadLettersRetentionDays
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), ws.dbDeadline())
+	defer cancel()
+
+	client, collection, err := ws.getDeadLettersCollection(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer client.Disconnect(ctx)
+
+	result, err := collection.DeleteMany(ctx, bson.M{
+		"created_at": bson.M{"$lt": now.AddDate(0, 0, -retention_days)},
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return result.DeletedCount, nil
+}
+
+// toJSONValue converts value to the generic form it has once encoded to json,
+// this is the form the actions see their input in.
+func toJSONValue(value interface{}) (interface{}, error) {
+
+	b, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+
+	var generic interface{}
+	err = json.Unmarshal(b, &generic)
+	return generic, err
+}
+
+// deadLetterStep stores the action that failed at the step of the run in the dead letters.
+func (ws *WorkflowsService) deadLetterStep(execution *workflowExecution, step_index int, path string, action_type string, attempts int, input interface{}, step_err error) {
+
+	stored_input, err := toJSONValue(input)
+	if err != nil {
+		ws.Logger.Error(fmt.Sprintf("failed to dead letter step %s of run %s: %v", path, execution.RunID, err))
+		return
+	}
+
+	resume_input, err := toJSONValue(execution.ResumeInput)
+	if err != nil {
+		ws.Logger.Error(fmt.Sprintf("failed to dead letter step %s of run %s: %v", path, execution.RunID, err))
+		return
+	}
+
+	dead_letter := models.WorkflowDeadLetter{
+		ID:          primitive.NewObjectID().Hex(),
+		TenantID:    execution.TenantID,
+		WorkflowID:  execution.WorkflowID,
+		RunID:       execution.RunID,
+		StepIndex:   step_index,
+		StepPath:    path,
+		ActionType:  action_type,
+		Attempts:    attempts,
+		Error:       step_err.Error(),
+		Input:       stored_input,
+		ResumeIndex: execution.ResumeIndex,
+		ResumeInput: resume_input,
+		Status:      models.WorkflowDeadLetterStatusPending,
+		CreatedAt:   time.Now(),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), ws.dbDeadline())
+	defer cancel()
+
+	client, collection, err := ws.getDeadLettersCollection(ctx)
+	if err != nil {
+		ws.Logger.Error(err.Error())
+		return
+	}
+	defer client.Disconnect(ctx)
+
+	_, err = collection.InsertOne(ctx, dead_letter)
+	if err != nil {
+		ws.Logger.Error(err.Error())
+		return
+	}
+
+	ws.AddLogsToWorkflowRun(action_type, execution.TenantID, execution.WorkflowID, execution.RunID, models.WorkflowRunLog{
+		Level:     "ERROR",
+		Message:   fmt.Sprintf("Step %s failed after %d attempts, stored as dead letter %s", path, attempts, dead_letter.ID),
+		TimeStamp: time.Now(),
+	})
+}
+
+// GetDeadLetters returns a page of the tenant dead letters, newest first,
+// status and workflow_id narrow the results when not empty.
+func (ws *WorkflowsService) GetDeadLetters(tenant_id string, status string, workflow_id string, page_number int, page_size int) (dead_letters []models.WorkflowDeadLetter, total_records int, err error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), ws.dbDeadline())
+	defer cancel()
+
+	client, collection, err := ws.getDeadLettersCollection(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer client.Disconnect(ctx)
+
+	filter := bson.M{"tenant_id": tenant_id}
+	if status != "" {
+		filter["status"] = status
+	}
+	if workflow_id != "" {
+		filter["workflow_id"] = workflow_id
+	}
+
+	count, err := collection.CountDocuments(ctx, filter)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	skip := (page_number - 1) * page_size
+
+	cursor, err := collection.Find(ctx, filter, options.Find().
+		SetSort(bson.M{"created_at": -1}).
+		SetSkip(int64(skip)).
+		SetLimit(int64(page_size)))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	dead_letters = make([]models.WorkflowDeadLetter, 0)
+	err = cursor.All(ctx, &dead_letters)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return dead_letters, int(count), nil
+}
+
+// GetDeadLetter returns a dead letter of the tenant, mongo.ErrNoDocuments is returned when it doesn't exist.
+func (ws *WorkflowsService) GetDeadLetter(tenant_id string, id string) (dead_letter models.WorkflowDeadLetter, err error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), ws.dbDeadline())
+	defer cancel()
+
+	client, collection, err := ws.getDeadLettersCollection(ctx)
+	if err != nil {
+		return dead_letter, err
+	}
+	defer client.Disconnect(ctx)
+
+	err = collection.FindOne(ctx, bson.M{"tenant_id": tenant_id, "id": id}).Decode(&dead_letter)
+	return dead_letter, err
+}
+
+// RedriveDeadLetter starts a new run of the workflow resuming at the top level action holding the failed step,
+// with the input that action received. The steps before it are marked as skipped.
+// The run executes the definition of the failed run and is queued, its id is returned right away.
+func (ws *WorkflowsService) RedriveDeadLetter(tenant_id string, id string) (run_id string, err error) {
+
+	dead_letter, err := ws.GetDeadLetter(tenant_id, id)
+	if err != nil {
+		return "", err
+	}
+
+	if dead_letter.Status != models.WorkflowDeadLetterStatusPending {
+		return "", ErrDeadLetterRedriven
+	}
+
+	// a dead letter outlives the runs retention, the current definition is redriven once its run is purged
+	version := 0
+	run, err := ws.GetWorkflowRun(tenant_id, dead_letter.WorkflowID, dead_letter.RunID)
+	if err == nil {
+		version = run.WorkflowVersion
+	} else if err != mongo.ErrNoDocuments {
+		return "", err
+	}
+
+	workflow, actions, err := ws.workflowVersionActions(tenant_id, dead_letter.WorkflowID, version)
+	if err == mongo.ErrNoDocuments {
+		return "", fmt.Errorf("workflow %s of the dead letter no longer exists", dead_letter.WorkflowID)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if dead_letter.ResumeIndex >= len(actions) {
+		return "", fmt.Errorf("workflow %s no longer has an action at step %d", workflow.ID, dead_letter.ResumeIndex)
+	}
+
+	claimed, err := ws.claimDeadLetter(tenant_id, id)
+	if err != nil {
+		return "", err
+	}
+
+	if !claimed {
+		return "", ErrDeadLetterRedriven
+	}
+
+	run_id, err = ws.StartWorkflowRun(tenant_id, workflow)
+	if err != nil {
+		ws.releaseDeadLetter(tenant_id, id)
+		return "", err
+	}
+
+	ws.setDeadLetterRedriveRun(tenant_id, id, run_id)
+
+	ws.AddLogsToWorkflowRun("dead_letter", tenant_id, workflow.ID, run_id, models.WorkflowRunLog{
+		Level:     "INFO",
+		Message:   fmt.Sprintf("Redriving dead letter %s of run %s from step %d", id, dead_letter.RunID, dead_letter.ResumeIndex),
+		TimeStamp: time.Now(),
+	})
+
+	for index := 0; index < dead_letter.ResumeIndex; index++ {
+		ws.SetWorkflowRunStepStatus(tenant_id, workflow.ID, run_id, index, models.WorkflowRunStepStatusSkipped)
+		ws.AddLogsToWorkflowRunStep(tenant_id, workflow.ID, run_id, index, models.WorkflowRunLog{
+			Level:     "INFO",
+			Message:   fmt.Sprintf("Skipped, already ran in run %s", dead_letter.RunID),
+			TimeStamp: time.Now(),
+		})
+	}
+
+	resume_input, err := toJSONValue(dead_letter.ResumeInput)
+	if err != nil {
+		ws.FailWorkflow(tenant_id, workflow.ID, run_id, err.Error())
+		return run_id, err
+	}
+
+	err = ws.queueWorkflowRun(tenant_id, workflow.ID, func() error {
+		return ws.runWorkflowActionsFrom(tenant_id, workflow.ID, run_id, actions, resume_input, dead_letter.ResumeIndex, len(actions))
+	})
+	if err != nil {
+		ws.FailWorkflow(tenant_id, workflow.ID, run_id, err.Error())
+		ws.releaseDeadLetter(tenant_id, id)
+		return run_id, err
+	}
+
+	return run_id, nil
+}
+
+// claimDeadLetter moves the dead letter from pending to redriven, it reports false when it was no longer pending.
+func (ws *WorkflowsService) claimDeadLetter(tenant_id string, id string) (claimed bool, err error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), ws.dbDeadline())
+	defer cancel()
+
+	client, collection, err := ws.getDeadLettersCollection(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer client.Disconnect(ctx)
+
+	result, err := collection.UpdateOne(ctx, bson.M{
+		"tenant_id": tenant_id,
+		"id":        id,
+		"status":    models.WorkflowDeadLetterStatusPending,
+	}, bson.M{
+		"$set": bson.M{
+			"status":      models.WorkflowDeadLetterStatusRedriven,
+			"redriven_at": time.Now(),
+		},
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return result.ModifiedCount == 1, nil
+}
+
+// releaseDeadLetter moves a claimed dead letter back to pending when its redrive couldn't start,
+// so it can be redriven again.
+func (ws *WorkflowsService) releaseDeadLetter(tenant_id string, id string) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), ws.dbDeadline())
+	defer cancel()
+
+	client, collection, err := ws.getDeadLettersCollection(ctx)
+	if err != nil {
+		ws.Logger.Error(err.Error())
+		return
+	}
+	defer client.Disconnect(ctx)
+
+	_, err = collection.UpdateOne(ctx, bson.M{
+		"tenant_id": tenant_id,
+		"id":        id,
+		"status":    models.WorkflowDeadLetterStatusRedriven,
+	}, bson.M{
+		"$set":   bson.M{"status": models.WorkflowDeadLetterStatusPending},
+		"$unset": bson.M{"redriven_at": "", "redrive_run_id": ""},
+	})
+	if err != nil {
+		ws.Logger.Error(err.Error())
+	}
+}
+
+// setDeadLetterRedriveRun records the run the dead letter was redriven into.
+func (ws *WorkflowsService) setDeadLetterRedriveRun(tenant_id string, id string, run_id string) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), ws.dbDeadline())
+	defer cancel()
+
+	client, collection, err := ws.getDeadLettersCollection(ctx)
+	if err != nil {
+		ws.Logger.Error(err.Error())
+		return
+	}
+	defer client.Disconnect(ctx)
+
+	_, err = collection.UpdateOne(ctx, bson.M{"tenant_id": tenant_id, "id": id}, bson.M{
+		"$set": bson.M{"redrive_run_id": run_id},
+	})
+	if err != nil {
+		ws.Logger.Error(err.Error())
+	}
+}
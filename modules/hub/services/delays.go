@@ -0,0 +1,241 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/nutrixpos/hub/common"
+	"github.com/nutrixpos/hub/modules/hub/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// maxWorkflowDelayMinutes caps how long a delay step pauses a run, 30 days.
+const maxWorkflowDelayMinutes = 30 * 24 * 60
+
+// delayWorkflowRun pauses the run on the delay step until the time computed from the action, the run is moved to
+// delayed with what is needed to resume it. delayed is false when that time already passed, the run goes on then.
+// ErrWorkflowRunCancelled is returned when the run was cancelled meanwhile.
+func (ws *WorkflowsService) delayWorkflowRun(execution *workflowExecution, step_index int, raw_action bson.Raw, input interface{}) (delayed bool, err error) {
+
+	var action models.WorkflowDelayAction
+	err = bson.Unmarshal(raw_action, &action)
+	if err != nil {
+		return false, err
+	}
+
+	now := time.Now()
+
+	until, err := ws.prepareDelay(input, action, execution.TenantID, now)
+	if err != nil {
+		return false, err
+	}
+
+	if !until.After(now) {
+		ws.AddLogsToWorkflowRunStep(execution.TenantID, execution.WorkflowID, execution.RunID, step_index, models.WorkflowRunLog{
+			Level:     "INFO",
+			Message:   fmt.Sprintf("Delay until %s is already over, going on", until.Format(time.RFC3339)),
+			TimeStamp: time.Now(),
+		})
+		return false, nil
+	}
+
+	delay := models.WorkflowRunDelay{
+		StepIndex:   step_index,
+		ResumeIndex: execution.ResumeIndex + 1,
+		Until:       until,
+	}
+
+	delay.Input, err = toJSONValue(input)
+	if err != nil {
+		return false, err
+	}
+
+	err = ws.updateWorkflowRunWhere(execution.TenantID, execution.WorkflowID, execution.RunID, bson.M{"status": models.WorkflowRunStatusRunning}, bson.M{
+		"$set": bson.M{
+			"status": models.WorkflowRunStatusDelayed,
+			"delay":  delay,
+		},
+	})
+	if err == mongo.ErrNoDocuments {
+		return false, ErrWorkflowRunCancelled
+	}
+	if err != nil {
+		return false, err
+	}
+
+	ws.SetWorkflowRunStepStatus(execution.TenantID, execution.WorkflowID, execution.RunID, step_index, models.WorkflowRunStepStatusWaiting)
+	ws.AddLogsToWorkflowRunStep(execution.TenantID, execution.WorkflowID, execution.RunID, step_index, models.WorkflowRunLog{
+		Level:     "INFO",
+		Message:   fmt.Sprintf("Delaying the run until %s", until.Format(time.RFC3339)),
+		TimeStamp: time.Now(),
+	})
+
+	return true, nil
+}
+
+// prepareDelay computes when the delay of the action is over, either after its duration or at the time
+// rendered from its until template against the tenant env vars and the action input.
+func (ws *WorkflowsService) prepareDelay(input interface{}, action models.WorkflowDelayAction, tenant_id string, now time.Time) (until time.Time, err error) {
+
+	if action.DurationMinutes > 0 {
+		return now.Add(time.Duration(action.DurationMinutes) * time.Minute), nil
+	}
+
+	tenant_svc := TenantService{
+		Config: ws.Config,
+		Logger: ws.Logger,
+	}
+
+	tenant, err := tenant_svc.GetTenantById(tenant_id)
+	if err != nil {
+		return until, err
+	}
+
+	env_vars, err := ws.DecryptEnvVars(tenant)
+	if err != nil {
+		return until, err
+	}
+
+	vars_basket, secrets_values, err := BuildVarsBasket(env_vars, input)
+	if err != nil {
+		return until, err
+	}
+
+	rendered_until, err := renderActionTemplate("until", action.Until, vars_basket, secrets_values, action.MissingValues)
+	if err != nil {
+		return until, err
+	}
+
+	timezone, err := renderActionTemplate("timezone", action.TimeZone, vars_basket, secrets_values, action.MissingValues)
+	if err != nil {
+		return until, err
+	}
+
+	location, err := delayLocation(strings.TrimSpace(timezone), ws.Config.TimeZone)
+	if err != nil {
+		return until, errors.New(common.MaskString(err.Error(), secrets_values))
+	}
+
+	until, err = parseDelayUntil(rendered_until, location, now)
+	if err != nil {
+		return until, errors.New(common.MaskString(err.Error(), secrets_values))
+	}
+
+	if until.After(now.Add(maxWorkflowDelayMinutes * time.Minute)) {
+		return until, fmt.Errorf("delay until %s is longer than %d days", until.Format(time.RFC3339), maxWorkflowDelayMinutes/(24*60))
+	}
+
+	return until, nil
+}
+
+// delayLocation loads the timezone of a delay, fallback_timezone is used when it is empty, defaulting to UTC.
+func delayLocation(timezone string, fallback_timezone string) (*time.Location, error) {
+
+	if timezone == "" {
+		timezone = fallback_timezone
+	}
+
+	if timezone == "" {
+		return time.UTC, nil
+	}
+
+	location, err := time.LoadLocation(timezone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timezone %s: %v", timezone, err)
+	}
+
+	return location, nil
+}
+
+// parseDelayUntil parses the end of a delay, either an RFC3339 timestamp or HH:MM meaning its next occurrence
+// after now in the location.
+func parseDelayUntil(value string, location *time.Location, now time.Time) (time.Time, error) {
+
+	value = strings.TrimSpace(value)
+
+	if until, err := time.Parse(time.RFC3339, value); err == nil {
+		return until, nil
+	}
+
+	clock, err := time.Parse("15:04", value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("until must be an RFC3339 timestamp or a HH:MM time, got %q", value)
+	}
+
+	local := now.In(location)
+	until := time.Date(local.Year(), local.Month(), local.Day(), clock.Hour(), clock.Minute(), 0, 0, location)
+	if !until.After(local) {
+		until = time.Date(local.Year(), local.Month(), local.Day()+1, clock.Hour(), clock.Minute(), 0, 0, location)
+	}
+
+	return until, nil
+}
+
+// ResumeDelayedWorkflowRuns resumes the delayed runs whose delay is over, each run is moved back to running
+// before resuming so a run is resumed once across the hub instances.
+func (ws *WorkflowsService) ResumeDelayedWorkflowRuns(now time.Time) (err error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), ws.dbDeadline())
+	defer cancel()
+
+	client, collection, err := ws.getRunsCollection(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect(ctx)
+
+	cursor, err := collection.Find(ctx, bson.M{
+		"status":      models.WorkflowRunStatusDelayed,
+		"delay.until": bson.M{"$lte": now},
+	}, options.Find().
+		SetSort(bson.M{"delay.until": 1}).
+		SetLimit(100).
+		SetProjection(bson.M{"logs": 0, "steps": 0, "output": 0}))
+	if err != nil {
+		return err
+	}
+
+	due := make([]models.WorkflowRun, 0)
+	err = cursor.All(ctx, &due)
+	if err != nil {
+		return err
+	}
+
+	for _, run := range due {
+		if run.Delay == nil {
+			continue
+		}
+
+		err = ws.updateWorkflowRunWhere(run.TenantID, run.WorkflowID, run.ID, bson.M{"status": models.WorkflowRunStatusDelayed}, bson.M{
+			"$set": bson.M{
+				"status": models.WorkflowRunStatusRunning,
+				"resume": workflowRunResume(run.Delay.StepIndex, run.Delay.ResumeIndex, run.Delay.Input),
+			},
+			"$push": bson.M{"logs": models.WorkflowRunLog{
+				Level:     "INFO",
+				Message:   fmt.Sprintf("Delay until %s is over, resuming the run", run.Delay.Until.Format(time.RFC3339)),
+				TimeStamp: time.Now(),
+			}},
+		})
+		if err == mongo.ErrNoDocuments {
+			// cancelled or resumed by another instance meanwhile
+			continue
+		}
+		if err != nil {
+			ws.Logger.Error(fmt.Sprintf("failed to resume the delayed run %s: %v", run.ID, err))
+			continue
+		}
+
+		err = ws.resumeWorkflowRun(run.TenantID, run.WorkflowID, run.ID, run.WorkflowVersion, run.Delay.StepIndex, run.Delay.ResumeIndex, run.Delay.Input)
+		if err != nil {
+			ws.Logger.Error(fmt.Sprintf("failed to resume the delayed run %s: %v", run.ID, err))
+		}
+	}
+
+	return nil
+}
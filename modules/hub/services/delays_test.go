@@ -0,0 +1,190 @@
+package services
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseDelayUntil(t *testing.T) {
+
+	new_york, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	at := func(value string) time.Time {
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return parsed
+	}
+
+	tests := []struct {
+		name     string
+		value    string
+		location *time.Location
+		now      time.Time
+		expected time.Time
+		invalid  bool
+	}{
+		{
+			name:     "timestamp",
+			value:    "2024-06-01T09:30:00Z",
+			location: new_york,
+			now:      at("2024-06-01T08:00:00Z"),
+			expected: at("2024-06-01T09:30:00Z"),
+		},
+		{
+			name:     "timestamp with an offset",
+			value:    "2024-06-01T09:30:00+02:00",
+			location: new_york,
+			now:      at("2024-06-01T08:00:00Z"),
+			expected: at("2024-06-01T07:30:00Z"),
+		},
+		{
+			name:     "timestamp in the past kept",
+			value:    "2024-05-01T09:30:00Z",
+			location: new_york,
+			now:      at("2024-06-01T08:00:00Z"),
+			expected: at("2024-05-01T09:30:00Z"),
+		},
+		{
+			name:     "later today",
+			value:    "09:30",
+			location: new_york,
+			now:      at("2024-06-01T08:00:00-04:00"),
+			expected: at("2024-06-01T09:30:00-04:00"),
+		},
+		{
+			name:     "now is after today's time",
+			value:    "09:30",
+			location: new_york,
+			now:      at("2024-06-01T10:00:00-04:00"),
+			expected: at("2024-06-02T09:30:00-04:00"),
+		},
+		{
+			name:     "now is today's time",
+			value:    "09:30",
+			location: new_york,
+			now:      at("2024-06-01T09:30:00-04:00"),
+			expected: at("2024-06-02T09:30:00-04:00"),
+		},
+		{
+			name:     "day of the location not of utc",
+			value:    "23:00",
+			location: new_york,
+			now:      at("2024-06-02T02:00:00Z"),
+			expected: at("2024-06-01T23:00:00-04:00"),
+		},
+		{
+			name:     "end of the month",
+			value:    "08:00",
+			location: new_york,
+			now:      at("2024-01-31T22:00:00-05:00"),
+			expected: at("2024-02-01T08:00:00-05:00"),
+		},
+		{
+			name:     "tomorrow starts daylight saving time",
+			value:    "09:00",
+			location: new_york,
+			now:      at("2024-03-09T10:00:00-05:00"),
+			expected: at("2024-03-10T09:00:00-04:00"),
+		},
+		{
+			name:     "tomorrow ends daylight saving time",
+			value:    "09:00",
+			location: new_york,
+			now:      at("2024-11-02T10:00:00-04:00"),
+			expected: at("2024-11-03T09:00:00-05:00"),
+		},
+		{
+			name:     "later on the day daylight saving time starts",
+			value:    "09:00",
+			location: new_york,
+			now:      at("2024-03-10T01:00:00-05:00"),
+			expected: at("2024-03-10T09:00:00-04:00"),
+		},
+		{
+			name:     "utc",
+			value:    " 09:30 ",
+			location: time.UTC,
+			now:      at("2024-06-01T10:00:00Z"),
+			expected: at("2024-06-02T09:30:00Z"),
+		},
+		{
+			name:     "invalid time",
+			value:    "25:00",
+			location: new_york,
+			now:      at("2024-06-01T08:00:00Z"),
+			invalid:  true,
+		},
+		{
+			name:     "not a time",
+			value:    "tomorrow",
+			location: new_york,
+			now:      at("2024-06-01T08:00:00Z"),
+			invalid:  true,
+		},
+		{
+			name:     "empty",
+			value:    "",
+			location: new_york,
+			now:      at("2024-06-01T08:00:00Z"),
+			invalid:  true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			until, err := parseDelayUntil(test.value, test.location, test.now)
+			if test.invalid {
+				if err == nil {
+					t.Errorf("expected an error, got %v", until)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !until.Equal(test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, until)
+			}
+		})
+	}
+}
+
+func TestDelayLocation(t *testing.T) {
+
+	tests := []struct {
+		name              string
+		timezone          string
+		fallback_timezone string
+		expected          string
+		invalid           bool
+	}{
+		{"timezone", "Europe/Berlin", "America/New_York", "Europe/Berlin", false},
+		{"fallback", "", "America/New_York", "America/New_York", false},
+		{"utc by default", "", "", "UTC", false},
+		{"invalid timezone", "Mars/Olympus", "", "", true},
+		{"invalid fallback", "", "Mars/Olympus", "", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			location, err := delayLocation(test.timezone, test.fallback_timezone)
+			if test.invalid {
+				if err == nil {
+					t.Errorf("expected an error, got %v", location)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if location.String() != test.expected {
+				t.Errorf("expected %v, got %v", test.expected, location)
+			}
+		})
+	}
+}
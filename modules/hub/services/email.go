@@ -0,0 +1,438 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nutrixpos/hub/common"
+	"github.com/nutrixpos/hub/modules/hub/models"
+)
+
+const (
+	SmtpTLSStartTLS = "starttls"
+	SmtpTLSImplicit = "tls"
+	SmtpTLSNone     = "none"
+)
+
+// emailMessage is a rendered email ready to be sent.
+type emailMessage struct {
+	From          mail.Address
+	ReplyTo       []*mail.Address
+	To            []*mail.Address
+	Cc            []*mail.Address
+	Bcc           []*mail.Address
+	Subject       string
+	HtmlBody      string
+	TextBody      string
+	MessageID     string
+	SecretsValues []string // masked in the output and the errors
+}
+
+// recipients returns the addresses the message is delivered to, bcc included.
+func (m emailMessage) recipients() []string {
+
+	recipients := make([]string, 0, len(m.To)+len(m.Cc)+len(m.Bcc))
+	for _, list := range [][]*mail.Address{m.To, m.Cc, m.Bcc} {
+		for _, address := range list {
+			recipients = append(recipients, address.Address)
+		}
+	}
+
+	return recipients
+}
+
+// headers returns the headers of the message, bcc recipients are left out.
+func (m emailMessage) headers() textproto.MIMEHeader {
+
+	headers := textproto.MIMEHeader{}
+	headers.Set("From", m.From.String())
+	headers.Set("To", joinAddresses(m.To))
+	if len(m.Cc) > 0 {
+		headers.Set("Cc", joinAddresses(m.Cc))
+	}
+	if len(m.ReplyTo) > 0 {
+		headers.Set("Reply-To", joinAddresses(m.ReplyTo))
+	}
+	headers.Set("Subject", mime.QEncoding.Encode("utf-8", m.Subject))
+	headers.Set("Date", time.Now().Format(time.RFC1123Z))
+	headers.Set("Message-ID", m.MessageID)
+	headers.Set("MIME-Version", "1.0")
+
+	return headers
+}
+
+// bytes encodes the message, a message with both bodies is sent as multipart/alternative.
+func (m emailMessage) bytes() ([]byte, error) {
+
+	var buffer bytes.Buffer
+	headers := m.headers()
+
+	writeHeaders := func(headers textproto.MIMEHeader) {
+		for _, key := range []string{"From", "To", "Cc", "Reply-To", "Subject", "Date", "Message-ID", "MIME-Version", "Content-Type", "Content-Transfer-Encoding"} {
+			if value := headers.Get(key); value != "" {
+				fmt.Fprintf(&buffer, "%s: %s\r\n", key, value)
+			}
+		}
+		buffer.WriteString("\r\n")
+	}
+
+	if m.HtmlBody == "" || m.TextBody == "" {
+		content_type, body := "text/plain; charset=utf-8", m.TextBody
+		if m.HtmlBody != "" {
+			content_type, body = "text/html; charset=utf-8", m.HtmlBody
+		}
+
+		headers.Set("Content-Type", content_type)
+		headers.Set("Content-Transfer-Encoding", "quoted-printable")
+		writeHeaders(headers)
+
+		err := writeQuotedPrintable(&buffer, body)
+		return buffer.Bytes(), err
+	}
+
+	var parts bytes.Buffer
+	writer := multipart.NewWriter(&parts)
+
+	for _, part := range []struct{ content_type, body string }{
+		{"text/plain; charset=utf-8", m.TextBody},
+		{"text/html; charset=utf-8", m.HtmlBody},
+	} {
+		part_writer, err := writer.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.content_type},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		var encoded bytes.Buffer
+		err = writeQuotedPrintable(&encoded, part.body)
+		if err != nil {
+			return nil, err
+		}
+		part_writer.Write(encoded.Bytes())
+	}
+
+	err := writer.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	headers.Set("Content-Type", "multipart/alternative; boundary="+writer.Boundary())
+	writeHeaders(headers)
+	buffer.Write(parts.Bytes())
+
+	return buffer.Bytes(), nil
+}
+
+func writeQuotedPrintable(buffer *bytes.Buffer, body string) error {
+
+	writer := quotedprintable.NewWriter(buffer)
+	_, err := writer.Write([]byte(body))
+	if err != nil {
+		return err
+	}
+
+	return writer.Close()
+}
+
+func joinAddresses(addresses []*mail.Address) string {
+
+	formatted := make([]string, len(addresses))
+	for i, address := range addresses {
+		formatted[i] = address.String()
+	}
+
+	return strings.Join(formatted, ", ")
+}
+
+// parseAddressList parses comma or semicolon separated addresses, blank entries are skipped
+// so a list rendered from optional env vars can be empty.
+func parseAddressList(field string, list string) ([]*mail.Address, error) {
+
+	addresses := make([]*mail.Address, 0)
+	for _, entry := range strings.FieldsFunc(list, func(r rune) bool { return r == ',' || r == ';' || r == '\n' }) {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		address, err := mail.ParseAddress(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s address %q: %v", field, entry, err)
+		}
+		addresses = append(addresses, address)
+	}
+
+	return addresses, nil
+}
+
+// RunSendEmailAction renders the email of the action and sends it through the configured SMTP server,
+// connection failures and transient SMTP replies (4xx) are retryable, permanent ones (5xx) are not.
+// The connection to the server is closed when ctx is cancelled.
+func (ws *WorkflowsService) RunSendEmailAction(ctx context.Context, input interface{}, action models.WorkflowSendEmailAction, tenant_id string, workflow_id string, run_id string, step_index int) (output interface{}, err error) {
+
+	ws.AddLogsToWorkflowRunStep(tenant_id, workflow_id, run_id, step_index, models.WorkflowRunLog{
+		Level:     "INFO",
+		Message:   "Running send email action...",
+		TimeStamp: time.Now(),
+	})
+
+	message, err := ws.prepareEmail(input, action, tenant_id)
+	if err != nil {
+		return nil, err
+	}
+
+	err = ws.sendEmail(ctx, message)
+	if err != nil {
+		return nil, err
+	}
+
+	recipients := message.recipients()
+
+	ws.AddLogsToWorkflowRunStep(tenant_id, workflow_id, run_id, step_index, models.WorkflowRunLog{
+		Level:     "INFO",
+		Message:   fmt.Sprintf("Successfully sent email %s to %d recipients", message.MessageID, len(recipients)),
+		TimeStamp: time.Now(),
+	})
+
+	return models.WorkflowSendEmailActionOutput{
+		MessageID:  message.MessageID,
+		Subject:    common.MaskString(message.Subject, message.SecretsValues),
+		Recipients: recipients,
+	}, nil
+}
+
+// prepareEmail renders the templates of the action against the tenant env vars and the action input.
+func (ws *WorkflowsService) prepareEmail(input interface{}, action models.WorkflowSendEmailAction, tenant_id string) (message emailMessage, err error) {
+
+	if ws.Config.Smtp.Host == "" || ws.Config.Smtp.FromAddress == "" {
+		return message, fmt.Errorf("smtp host and from address must be configured to send emails")
+	}
+
+	tenant_svc := TenantService{
+		Config: ws.Config,
+		Logger: ws.Logger,
+	}
+
+	tenant, err := tenant_svc.GetTenantById(tenant_id)
+	if err != nil {
+		return message, err
+	}
+
+	env_vars, err := ws.DecryptEnvVars(tenant)
+	if err != nil {
+		return message, err
+	}
+
+	vars_basket, secrets_values, err := BuildVarsBasket(env_vars, input)
+	if err != nil {
+		return message, err
+	}
+	message.SecretsValues = secrets_values
+
+	rendered := map[string]string{}
+	for field, template := range map[string]string{
+		"to":        action.To,
+		"cc":        action.Cc,
+		"bcc":       action.Bcc,
+		"from_name": action.FromName,
+		"reply_to":  action.ReplyTo,
+		"subject":   action.Subject,
+		"text_body": action.TextBody,
+	} {
+		rendered[field], err = renderActionTemplate(field, template, vars_basket, secrets_values, action.MissingValues)
+		if err != nil {
+			return message, err
+		}
+	}
+
+	// the values output into the html body are escaped, the trusted ones are piped through raw
+	rendered["html_body"], err = renderActionHTMLTemplate("html_body", action.HtmlBody, vars_basket, secrets_values, action.MissingValues)
+	if err != nil {
+		return message, err
+	}
+
+	for field, list := range map[string]*[]*mail.Address{
+		"to":       &message.To,
+		"cc":       &message.Cc,
+		"bcc":      &message.Bcc,
+		"reply_to": &message.ReplyTo,
+	} {
+		*list, err = parseAddressList(field, rendered[field])
+		if err != nil {
+			return message, errors.New(common.MaskString(err.Error(), secrets_values))
+		}
+	}
+
+	if len(message.To)+len(message.Cc)+len(message.Bcc) == 0 {
+		return message, fmt.Errorf("the email has no recipients")
+	}
+
+	message.From = mail.Address{Name: ws.Config.Smtp.FromName, Address: ws.Config.Smtp.FromAddress}
+	if name := strings.TrimSpace(rendered["from_name"]); name != "" {
+		message.From.Name = name
+	}
+
+	// a subject can't span lines, the rendered templates may hold new lines
+	message.Subject = strings.Join(strings.Fields(rendered["subject"]), " ")
+	message.HtmlBody = rendered["html_body"]
+	message.TextBody = rendered["text_body"]
+
+	message.MessageID, err = newEmailMessageID(ws.Config.Smtp.FromAddress)
+	if err != nil {
+		return message, err
+	}
+
+	return message, nil
+}
+
+// newEmailMessageID returns a random Message-ID on the domain of the sender address.
+func newEmailMessageID(from_address string) (string, error) {
+
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		return "", err
+	}
+
+	domain := from_address[strings.LastIndex(from_address, "@")+1:]
+	return fmt.Sprintf("<%s@%s>", hex.EncodeToString(id), domain), nil
+}
+
+// smtpAddress returns the address of the SMTP server, the port defaults to the submission port of the TLS mode.
+func (ws *WorkflowsService) smtpAddress() string {
+
+	port := ws.Config.Smtp.Port
+	if port == 0 {
+		port = 587
+		if ws.Config.Smtp.TLS == SmtpTLSImplicit {
+			port = 465
+		}
+	}
+
+	return net.JoinHostPort(ws.Config.Smtp.Host, strconv.Itoa(port))
+}
+
+// sendEmail delivers the message through the configured SMTP server, cancelling ctx aborts the delivery.
+func (ws *WorkflowsService) sendEmail(ctx context.Context, message emailMessage) error {
+
+	smtp_config := ws.Config.Smtp
+
+	timeout := 30 * time.Second
+	if smtp_config.Timeout > 0 {
+		timeout = time.Duration(smtp_config.Timeout) * time.Second
+	}
+
+	data, err := message.bytes()
+	if err != nil {
+		return err
+	}
+
+	address := ws.smtpAddress()
+	dialer := &net.Dialer{Timeout: timeout}
+	tls_config := &tls.Config{ServerName: smtp_config.Host}
+
+	var conn net.Conn
+	switch smtp_config.TLS {
+	case SmtpTLSImplicit:
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: tls_config}).DialContext(ctx, "tcp", address)
+	case "", SmtpTLSStartTLS, SmtpTLSNone:
+		conn, err = dialer.DialContext(ctx, "tcp", address)
+	default:
+		return fmt.Errorf("unsupported smtp tls mode %s", smtp_config.TLS)
+	}
+	if err != nil {
+		return &ActionRequestError{Message: fmt.Sprintf("error connecting to the smtp server: %s", err.Error())}
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	// the smtp client has no context, closing the connection interrupts it
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+	})
+	defer stop()
+
+	client, err := smtp.NewClient(conn, smtp_config.Host)
+	if err != nil {
+		conn.Close()
+		return smtpError("connecting to the smtp server", err)
+	}
+	defer client.Close()
+
+	if smtp_config.TLS == "" || smtp_config.TLS == SmtpTLSStartTLS {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			return fmt.Errorf("the smtp server doesn't support STARTTLS")
+		}
+
+		err = client.StartTLS(tls_config)
+		if err != nil {
+			return smtpError("starting tls", err)
+		}
+	}
+
+	if smtp_config.Username != "" {
+		err = client.Auth(smtp.PlainAuth("", smtp_config.Username, smtp_config.Password, smtp_config.Host))
+		if err != nil {
+			return smtpError("authenticating", err)
+		}
+	}
+
+	err = client.Mail(message.From.Address)
+	if err != nil {
+		return smtpError("setting the sender", err)
+	}
+
+	for _, recipient := range message.recipients() {
+		err = client.Rcpt(recipient)
+		if err != nil {
+			return smtpError("adding recipient "+recipient, err)
+		}
+	}
+
+	writer, err := client.Data()
+	if err != nil {
+		return smtpError("sending the message", err)
+	}
+
+	_, err = writer.Write(data)
+	if err != nil {
+		return smtpError("sending the message", err)
+	}
+
+	err = writer.Close()
+	if err != nil {
+		return smtpError("sending the message", err)
+	}
+
+	return client.Quit()
+}
+
+// smtpError wraps the error of an smtp step, permanent replies (5xx) fail the action right away
+// while transient replies and connection failures are retryable.
+func smtpError(step string, err error) error {
+
+	message := fmt.Sprintf("error %s: %s", step, err.Error())
+
+	var reply *textproto.Error
+	if errors.As(err, &reply) && reply.Code >= 500 {
+		return errors.New(message)
+	}
+
+	return &ActionRequestError{Message: message}
+}
@@ -0,0 +1,360 @@
+package services
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mitchellh/mapstructure"
+	"github.com/nutrixpos/hub/common"
+	"github.com/nutrixpos/hub/common/config"
+	"github.com/nutrixpos/hub/modules/hub/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// inboundWebhookTokenSize is the number of random bytes of a generated token.
+const inboundWebhookTokenSize = 32
+
+// inboundWebhookTokenPattern is what a token set by the client must look like, it must be as hard to guess as a generated one.
+var inboundWebhookTokenPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{43,128}$`)
+
+// ErrInboundWebhookBodyInvalid is returned when the body of an inbound webhook isn't json.
+var ErrInboundWebhookBodyInvalid = errors.New("request body must be json")
+
+// ErrWorkflowDisabled is returned when a trigger fires for a workflow that is disabled.
+var ErrWorkflowDisabled = errors.New("workflow is disabled")
+
+// InboundWebhookSchemaError is returned when the body of an inbound webhook doesn't match the trigger schema.
+type InboundWebhookSchemaError struct {
+	Errors []common.JSONSchemaError
+}
+
+func (e *InboundWebhookSchemaError) Error() string {
+	messages := make([]string, 0, len(e.Errors))
+	for _, schema_err := range e.Errors {
+		messages = append(messages, schema_err.Error())
+	}
+	return "request body doesn't match the schema: " + strings.Join(messages, ", ")
+}
+
+// EnsureInboundWebhookIndexes indexes the inbound webhook tokens of the tenant workflows, they are looked up on every request.
+func (ws *WorkflowsService) EnsureInboundWebhookIndexes() (err error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), ws.dbDeadline())
+	defer cancel()
+
+	client, collection, err := ws.getTenantsCollection(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect(ctx)
+
+	_, err = collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "workflows.trigger.token", Value: 1}},
+	})
+
+	return err
+}
+
+// ReceiveInboundWebhook queues a run of the workflow whose inbound webhook trigger holds the token, the request
+// is checked against the trigger signature and schema and its json body is passed to the first action.
+// mongo.ErrNoDocuments is returned when no workflow holds the token, ErrWorkflowDisabled when it is disabled.
+func (ws *WorkflowsService) ReceiveInboundWebhook(token string, header http.Header, body []byte) (workflow_id string, err error) {
+
+	if token == "" {
+		return "", mongo.ErrNoDocuments
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), ws.dbDeadline())
+	defer cancel()
+
+	client, collection, err := ws.getTenantsCollection(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer client.Disconnect(ctx)
+
+	var tenant models.Tenant
+	err = collection.FindOne(ctx, bson.M{"workflows.trigger.token": token}).Decode(&tenant)
+	if err != nil {
+		return "", err
+	}
+
+	workflow, actions, trigger, err := findInboundWebhookWorkflow(tenant, token)
+	if err != nil {
+		return "", err
+	}
+
+	if !workflow.Enabled {
+		return "", fmt.Errorf("%w: %s", ErrWorkflowDisabled, workflow.ID)
+	}
+
+	if trigger.Signature != nil {
+		err = ws.verifyInboundWebhookSignature(tenant, *trigger.Signature, header, body, time.Now())
+		if err != nil {
+			return "", err
+		}
+	}
+
+	var payload interface{}
+	err = json.Unmarshal(body, &payload)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInboundWebhookBodyInvalid, err)
+	}
+
+	if trigger.Schema != "" {
+		schema, err := common.ParseJSONSchema(trigger.Schema)
+		if err != nil {
+			return "", fmt.Errorf("invalid schema of the trigger of workflow %s: %v", workflow.ID, err)
+		}
+
+		schema_errors := common.ValidateJSONSchema(schema, payload)
+		if len(schema_errors) > 0 {
+			return "", &InboundWebhookSchemaError{Errors: schema_errors}
+		}
+	}
+
+	err = ws.QueueWorkflow(tenant.TenantID, workflow, actions, payload)
+	if err != nil {
+		return "", err
+	}
+
+	return workflow.ID, nil
+}
+
+// findInboundWebhookWorkflow returns the workflow of the tenant whose inbound webhook trigger holds the token.
+func findInboundWebhookWorkflow(tenant models.Tenant, token string) (workflow models.Workflow, actions []bson.Raw, trigger models.WorkflowInboundWebhookTrigger, err error) {
+
+	for _, raw_workflow := range tenant.Workflows {
+
+		workflow, actions, err = DecodeWorkflow(raw_workflow)
+		if err != nil || workflow.Trigger.Type != models.WorkflowTriggerTypeInboundWebhookLabel {
+			continue
+		}
+
+		var raw_trigger bson.Raw
+		raw_trigger, err = rawWorkflowTrigger(raw_workflow)
+		if err != nil {
+			return workflow, actions, trigger, err
+		}
+
+		trigger = models.WorkflowInboundWebhookTrigger{}
+		err = decodeTrigger(raw_trigger, &trigger)
+		if err != nil {
+			return workflow, actions, trigger, err
+		}
+
+		if trigger.Token == token {
+			return workflow, actions, trigger, nil
+		}
+	}
+
+	return workflow, actions, trigger, mongo.ErrNoDocuments
+}
+
+// verifyInboundWebhookSignature checks the signature header of the request against the body, the header
+// may list several signatures (comma separated) and each may be prefixed by its scheme (sha256= or v1=).
+func (ws *WorkflowsService) verifyInboundWebhookSignature(tenant models.Tenant, signature models.WorkflowInboundWebhookSignature, header http.Header, body []byte, now time.Time) error {
+
+	env_vars, err := ws.DecryptEnvVars(tenant)
+	if err != nil {
+		return err
+	}
+
+	vars_basket, secrets_values, err := BuildVarsBasket(env_vars, nil)
+	if err != nil {
+		return err
+	}
+
+	secret, err := renderActionTemplate("signature.secret", signature.Secret, vars_basket, secrets_values, models.TemplateMissingValuesStrict)
+	if err != nil {
+		return err
+	}
+
+	if secret == "" {
+		return fmt.Errorf("signature.secret rendered empty")
+	}
+
+	signature_header := signature.Header
+	if signature_header == "" {
+		signature_header = WorkflowSignatureHeader
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+
+	if signature.TimestampHeader != "" {
+		timestamp_header := strings.TrimSpace(header.Get(signature.TimestampHeader))
+
+		timestamp, err := strconv.ParseInt(timestamp_header, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%w: invalid %s header", ErrWorkflowSignatureInvalid, signature.TimestampHeader)
+		}
+
+		age := now.Sub(time.Unix(timestamp, 0))
+		if age > WorkflowSignatureTolerance || age < -WorkflowSignatureTolerance {
+			return fmt.Errorf("%w: %s is outside of the %v tolerance", ErrWorkflowSignatureInvalid, signature.TimestampHeader, WorkflowSignatureTolerance)
+		}
+
+		mac.Write([]byte(timestamp_header))
+		mac.Write([]byte("."))
+	}
+
+	mac.Write(body)
+
+	var expected string
+	if signature.Encoding == models.InboundWebhookSignatureEncodingBase64 {
+		expected = base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	} else {
+		expected = hex.EncodeToString(mac.Sum(nil))
+	}
+
+	for _, entry := range strings.Split(header.Get(signature_header), ",") {
+		entry = strings.TrimSpace(entry)
+		for _, prefix := range []string{"sha256=", workflowSignatureVersion + "="} {
+			entry = strings.TrimPrefix(entry, prefix)
+		}
+
+		if signature.Encoding != models.InboundWebhookSignatureEncodingBase64 {
+			entry = strings.ToLower(entry)
+		}
+
+		if entry != "" && hmac.Equal([]byte(entry), []byte(expected)) {
+			return nil
+		}
+	}
+
+	return ErrWorkflowSignatureInvalid
+}
+
+// generateInboundWebhookToken returns a new random url safe token.
+func generateInboundWebhookToken() (string, error) {
+
+	token := make([]byte, inboundWebhookTokenSize)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(token), nil
+}
+
+// inboundWebhookTriggerHandler fires on the requests posted to the hook url of the workflow.
+type inboundWebhookTriggerHandler struct{}
+
+func (inboundWebhookTriggerHandler) Describe() models.WorkflowCatalogEntry {
+	return models.WorkflowCatalogEntry{
+		Type:        models.WorkflowTriggerTypeInboundWebhookLabel,
+		Label:       "Inbound webhook",
+		Description: "Fires when an external system posts json to the workflow hook url /v1/api/hooks/{token}.",
+		Schema: jsonSchemaObject(models.WorkflowTriggerTypeInboundWebhookLabel, nil, map[string]interface{}{
+			"token": jsonSchemaProperty("string", "Secret part of the hook url, generated when empty"),
+			"schema": map[string]interface{}{
+				"type":        []string{"object", "string"},
+				"description": "JSON schema the request body must match, as an object or json text",
+			},
+			"signature": map[string]interface{}{
+				"type":        "object",
+				"description": "Require the requests to carry the HMAC-SHA256 of their body",
+				"required":    []string{"secret"},
+				"properties": map[string]interface{}{
+					"secret":           jsonSchemaProperty("string", "Template of the HMAC key, such as {{ env.SHOP_WEBHOOK_SECRET }}"),
+					"header":           jsonSchemaProperty("string", "Header carrying the signature, defaults to "+WorkflowSignatureHeader),
+					"timestamp_header": jsonSchemaProperty("string", "Header carrying a unix timestamp signed before the body, it must be within 5 minutes"),
+					"encoding":         jsonSchemaProperty("string", "Encoding of the signature", models.InboundWebhookSignatureEncodingHex, models.InboundWebhookSignatureEncodingBase64),
+				},
+			},
+		}),
+	}
+}
+
+func (inboundWebhookTriggerHandler) Decode(raw interface{}, config config.Config) (interface{}, error) {
+
+	// the schema may be sent as an object, it is stored as json text
+	if raw_map, ok := raw.(map[string]interface{}); ok {
+		if schema, ok := raw_map["schema"]; ok && schema != nil {
+			if _, is_text := schema.(string); !is_text {
+				schema_json, err := json.Marshal(schema)
+				if err != nil {
+					return nil, fmt.Errorf("invalid schema: %v", err)
+				}
+
+				copied := make(map[string]interface{}, len(raw_map))
+				for key, value := range raw_map {
+					copied[key] = value
+				}
+				copied["schema"] = string(schema_json)
+				raw = copied
+			}
+		}
+	}
+
+	var trigger models.WorkflowInboundWebhookTrigger
+	err := mapstructure.Decode(raw, &trigger)
+	if err != nil {
+		return nil, err
+	}
+
+	if trigger.Token == "" {
+		trigger.Token, err = generateInboundWebhookToken()
+		if err != nil {
+			return nil, err
+		}
+	} else if !inboundWebhookTokenPattern.MatchString(trigger.Token) {
+		return nil, fmt.Errorf("token must be 43 to 128 url safe characters, leave it empty to generate one")
+	}
+
+	if strings.TrimSpace(trigger.Schema) != "" {
+		_, err = common.ParseJSONSchema(trigger.Schema)
+		if err != nil {
+			return nil, fmt.Errorf("invalid schema: %v", err)
+		}
+	} else {
+		trigger.Schema = ""
+	}
+
+	if trigger.Signature != nil {
+		if strings.TrimSpace(trigger.Signature.Secret) == "" {
+			return nil, fmt.Errorf("signature.secret is required")
+		}
+
+		_, err = common.ParseTemplate(trigger.Signature.Secret)
+		if err != nil {
+			return nil, fmt.Errorf("invalid signature.secret template: %v", err)
+		}
+
+		if trigger.Signature.Header == "" {
+			trigger.Signature.Header = WorkflowSignatureHeader
+		}
+
+		switch trigger.Signature.Encoding {
+		case "":
+			trigger.Signature.Encoding = models.InboundWebhookSignatureEncodingHex
+		case models.InboundWebhookSignatureEncodingHex, models.InboundWebhookSignatureEncodingBase64:
+		default:
+			return nil, fmt.Errorf("unsupported signature.encoding %s", trigger.Signature.Encoding)
+		}
+	}
+
+	return trigger, nil
+}
+
+func (inboundWebhookTriggerHandler) SampleOutput() interface{} {
+	return map[string]interface{}{
+		"event": "order.created",
+		"data": map[string]interface{}{
+			"id":    "sample_order",
+			"total": 42.5,
+		},
+	}
+}
@@ -0,0 +1,263 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nutrixpos/hub/common"
+	"github.com/nutrixpos/hub/modules/hub/events"
+	"github.com/nutrixpos/hub/modules/hub/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// WorkflowEventManager publishes the events raised by workflow actions, it is set up with the hub event manager.
+// Actions don't publish while it isn't, such as from the command line.
+var WorkflowEventManager common.EventManager
+
+// inventoryAdjustment is an adjustment of an adjust inventory action with its templates rendered.
+type inventoryAdjustment struct {
+	ItemID    string
+	Label     string
+	Operation string
+	Quantity  float64
+}
+
+// RunAdjustInventoryAction applies the adjustments of the action to the tenant inventory items and publishes
+// a low stock event for the items it takes below their alert threshold, as uploading the inventory does.
+func (ws *WorkflowsService) RunAdjustInventoryAction(input interface{}, action models.WorkflowAdjustInventoryAction, tenant_id string, workflow_id string, run_id string, step_index int) (output interface{}, err error) {
+
+	ws.AddLogsToWorkflowRunStep(tenant_id, workflow_id, run_id, step_index, models.WorkflowRunLog{
+		Level:     "INFO",
+		Message:   "Running adjust inventory action...",
+		TimeStamp: time.Now(),
+	})
+
+	adjustments, err := ws.prepareInventoryAdjustments(input, action, tenant_id)
+	if err != nil {
+		return nil, err
+	}
+
+	result := models.WorkflowAdjustInventoryActionOutput{
+		Items: make([]models.WorkflowAdjustedInventoryItem, 0, len(adjustments)),
+	}
+	low_stock_events := make([]events.EventLowStockData, 0)
+
+	for _, adjustment := range adjustments {
+
+		item, previous, err := ws.adjustInventoryItem(tenant_id, adjustment)
+		if err != nil {
+			// the adjustments already applied stay, their low stock events are still published
+			ws.publishLowStockEvents(low_stock_events)
+			return nil, err
+		}
+
+		adjusted := models.WorkflowAdjustedInventoryItem{
+			ItemID:    item.ID,
+			ItemName:  item.Name,
+			Label:     strings.Join(item.Labels, ", "),
+			Operation: adjustment.Operation,
+			Previous:  previous,
+			Quantity:  item.Quantity,
+			LowStock:  item.Quantity <= item.Settings.AlertThreshold && previous > item.Settings.AlertThreshold,
+		}
+		result.Items = append(result.Items, adjusted)
+
+		ws.AddLogsToWorkflowRunStep(tenant_id, workflow_id, run_id, step_index, models.WorkflowRunLog{
+			Level:     "INFO",
+			Message:   fmt.Sprintf("Adjusted %s (%s) from %v to %v", item.Name, item.ID, previous, item.Quantity),
+			TimeStamp: time.Now(),
+		})
+
+		if item.Quantity < 0 {
+			ws.AddLogsToWorkflowRunStep(tenant_id, workflow_id, run_id, step_index, models.WorkflowRunLog{
+				Level:     "WARNING",
+				Message:   fmt.Sprintf("The quantity of %s (%s) is negative", item.Name, item.ID),
+				TimeStamp: time.Now(),
+			})
+		}
+
+		if adjusted.LowStock {
+			low_stock_events = append(low_stock_events, events.EventLowStockData{
+				TenantId:  tenant_id,
+				ItemID:    item.ID,
+				ItemName:  item.Name,
+				Threshold: item.Settings.AlertThreshold,
+				Current:   item.Quantity,
+			})
+		}
+	}
+
+	ws.publishLowStockEvents(low_stock_events)
+
+	return result, nil
+}
+
+// prepareInventoryAdjustments renders the adjustments of the action against the tenant env vars and the action input
+// and checks the items they target exist.
+func (ws *WorkflowsService) prepareInventoryAdjustments(input interface{}, action models.WorkflowAdjustInventoryAction, tenant_id string) (adjustments []inventoryAdjustment, err error) {
+
+	tenant_svc := TenantService{
+		Config: ws.Config,
+		Logger: ws.Logger,
+	}
+
+	tenant, err := tenant_svc.GetTenantById(tenant_id)
+	if err != nil {
+		return nil, err
+	}
+
+	env_vars, err := ws.DecryptEnvVars(tenant)
+	if err != nil {
+		return nil, err
+	}
+
+	vars_basket, secrets_values, err := BuildVarsBasket(env_vars, input)
+	if err != nil {
+		return nil, err
+	}
+
+	for index, adjustment := range action.Adjustments {
+
+		field := fmt.Sprintf("adjustments[%d]", index)
+
+		var rendered inventoryAdjustment
+		rendered.Operation = adjustment.Operation
+
+		rendered.ItemID, err = renderActionTemplate(field+".item_id", adjustment.ItemID, vars_basket, secrets_values, action.MissingValues)
+		if err != nil {
+			return nil, err
+		}
+		rendered.ItemID = strings.TrimSpace(rendered.ItemID)
+		if rendered.ItemID == "" {
+			return nil, fmt.Errorf("%s.item_id rendered empty", field)
+		}
+
+		rendered.Label, err = renderActionTemplate(field+".label", adjustment.Label, vars_basket, secrets_values, action.MissingValues)
+		if err != nil {
+			return nil, err
+		}
+		rendered.Label = strings.TrimSpace(rendered.Label)
+
+		var quantity string
+		quantity, err = renderActionTemplate(field+".quantity", adjustment.Quantity, vars_basket, secrets_values, action.MissingValues)
+		if err != nil {
+			return nil, err
+		}
+
+		rendered.Quantity, err = strconv.ParseFloat(strings.TrimSpace(quantity), 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s.quantity rendered %q which isn't a number", field, common.MaskString(quantity, secrets_values))
+		}
+
+		matches := 0
+		labels := make([]string, 0)
+		for _, item := range tenant.InventoryItems {
+			if item.ID == rendered.ItemID && (rendered.Label == "" || slices.Contains(item.Labels, rendered.Label)) {
+				matches++
+				labels = append(labels, item.Labels...)
+			}
+		}
+
+		if matches == 0 {
+			return nil, fmt.Errorf("%s: inventory item %s not found", field, rendered.ItemID)
+		}
+
+		// an item stocked by several branches must be told which one to adjust
+		if matches > 1 {
+			return nil, fmt.Errorf("%s: inventory item %s is stocked by %s, a label is required", field, rendered.ItemID, strings.Join(labels, ", "))
+		}
+
+		adjustments = append(adjustments, rendered)
+	}
+
+	return adjustments, nil
+}
+
+// adjustInventoryItem applies the adjustment in a single update so concurrent adjustments don't overwrite each other,
+// it returns the item as adjusted and its quantity before.
+func (ws *WorkflowsService) adjustInventoryItem(tenant_id string, adjustment inventoryAdjustment) (item models.InventoryItem, previous float64, err error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), ws.dbDeadline())
+	defer cancel()
+
+	client, collection, err := ws.getTenantsCollection(ctx)
+	if err != nil {
+		return item, 0, err
+	}
+	defer client.Disconnect(ctx)
+
+	match := bson.M{"id": adjustment.ItemID}
+	if adjustment.Label != "" {
+		match["labels"] = adjustment.Label
+	}
+
+	var update bson.M
+	switch adjustment.Operation {
+	case models.InventoryAdjustmentOperationSet:
+		update = bson.M{"$set": bson.M{"inventory_items.$.quantity": adjustment.Quantity}}
+	case models.InventoryAdjustmentOperationIncrement:
+		update = bson.M{"$inc": bson.M{"inventory_items.$.quantity": adjustment.Quantity}}
+	case models.InventoryAdjustmentOperationDecrement:
+		update = bson.M{"$inc": bson.M{"inventory_items.$.quantity": -adjustment.Quantity}}
+	default:
+		return item, 0, fmt.Errorf("unsupported operation %s", adjustment.Operation)
+	}
+
+	var before models.Tenant
+	err = collection.FindOneAndUpdate(ctx, bson.M{
+		"tenant_id":       tenant_id,
+		"inventory_items": bson.M{"$elemMatch": match},
+	}, update, options.FindOneAndUpdate().
+		SetProjection(bson.M{"inventory_items": 1}).
+		SetReturnDocument(options.Before),
+	).Decode(&before)
+
+	if err == mongo.ErrNoDocuments {
+		return item, 0, fmt.Errorf("inventory item %s not found", adjustment.ItemID)
+	}
+	if err != nil {
+		return item, 0, err
+	}
+
+	// the positional operator updated the first item matching, which is the one found here
+	for _, candidate := range before.InventoryItems {
+		if candidate.ID == adjustment.ItemID && (adjustment.Label == "" || slices.Contains(candidate.Labels, adjustment.Label)) {
+			item = candidate
+			break
+		}
+	}
+
+	previous = item.Quantity
+	switch adjustment.Operation {
+	case models.InventoryAdjustmentOperationSet:
+		item.Quantity = adjustment.Quantity
+	case models.InventoryAdjustmentOperationIncrement:
+		item.Quantity += adjustment.Quantity
+	case models.InventoryAdjustmentOperationDecrement:
+		item.Quantity -= adjustment.Quantity
+	}
+
+	return item, previous, nil
+}
+
+// publishLowStockEvents publishes the low stock events raised by an action, the low stock triggers
+// handle them as the ones of an uploaded inventory.
+func (ws *WorkflowsService) publishLowStockEvents(low_stock_events []events.EventLowStockData) {
+
+	if len(low_stock_events) == 0 {
+		return
+	}
+
+	if WorkflowEventManager == nil {
+		ws.Logger.Warning(fmt.Sprintf("%d low stock events weren't published, there is no event manager", len(low_stock_events)))
+		return
+	}
+
+	WorkflowEventManager.Publish(events.EventLowStockId, low_stock_events)
+}
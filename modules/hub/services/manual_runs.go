@@ -0,0 +1,311 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/nutrixpos/hub/common"
+	"github.com/nutrixpos/hub/common/workflows"
+	"github.com/nutrixpos/hub/modules/hub/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// SampleTriggerOutput returns an example of what the trigger type passes to the first action,
+// it is used to try workflows without waiting for the trigger to fire.
+func SampleTriggerOutput(trigger_type string) (output interface{}, err error) {
+
+	handler, ok := workflows.Types.Trigger(trigger_type)
+	if !ok {
+		return nil, fmt.Errorf("no sample payload for trigger type %s", trigger_type)
+	}
+
+	return handler.SampleOutput(), nil
+}
+
+// GetWorkflow returns a workflow of the tenant with the raw documents of its actions,
+// mongo.ErrNoDocuments is returned when it doesn't exist.
+func (ws *WorkflowsService) GetWorkflow(tenant_id string, workflow_id string) (workflow models.Workflow, actions []bson.Raw, err error) {
+
+	tenant_svc := TenantService{
+		Config: ws.Config,
+		Logger: ws.Logger,
+	}
+
+	tenant, err := tenant_svc.GetTenantById(tenant_id)
+	if err != nil {
+		return workflow, nil, err
+	}
+
+	for _, raw_workflow := range tenant.Workflows {
+		workflow, actions, err = DecodeWorkflow(raw_workflow)
+		if err == nil && workflow.ID == workflow_id {
+			return workflow, actions, nil
+		}
+	}
+
+	return models.Workflow{}, nil, mongo.ErrNoDocuments
+}
+
+// StartManualRun starts a run of the workflow with the given trigger payload regardless of its trigger,
+// the sample payload of the trigger is used when payload is nil.
+// The run is queued and its id returned right away.
+func (ws *WorkflowsService) StartManualRun(tenant_id string, workflow_id string, payload interface{}) (run_id string, err error) {
+
+	workflow, actions, err := ws.GetWorkflow(tenant_id, workflow_id)
+	if err != nil {
+		return "", err
+	}
+
+	if payload == nil {
+		payload, err = SampleTriggerOutput(workflow.Trigger.Type)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	run_id, err = ws.StartWorkflowRun(tenant_id, workflow)
+	if err != nil {
+		return "", err
+	}
+
+	ws.AddLogsToWorkflowRun("manual", tenant_id, workflow.ID, run_id, models.WorkflowRunLog{
+		Level:     "INFO",
+		Message:   "Workflow started manually, running actions...",
+		TimeStamp: time.Now(),
+	})
+
+	err = ws.queueWorkflowRun(tenant_id, workflow.ID, func() error {
+		return ws.RunWorkflowActions(tenant_id, workflow.ID, run_id, actions, payload)
+	})
+	if err != nil {
+		ws.SkipPendingWorkflowRunSteps(tenant_id, workflow.ID, run_id)
+		ws.FailWorkflow(tenant_id, workflow.ID, run_id, err.Error())
+		return run_id, err
+	}
+
+	return run_id, nil
+}
+
+// DryRunWorkflow walks the workflow actions with the given trigger payload without sending anything,
+// the env vars and templates of each request are resolved and the request is returned with its secrets masked.
+// Conditions and filters are evaluated, as the requests aren't sent each action passes its input through.
+// The sample payload of the trigger is used when payload is nil.
+func (ws *WorkflowsService) DryRunWorkflow(tenant_id string, workflow_id string, payload interface{}) (steps []models.WorkflowDryRunStep, err error) {
+
+	workflow, actions, err := ws.GetWorkflow(tenant_id, workflow_id)
+	if err != nil {
+		return nil, err
+	}
+
+	if payload == nil {
+		payload, err = SampleTriggerOutput(workflow.Trigger.Type)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	input, err := toJSONValue(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	steps = make([]models.WorkflowDryRunStep, 0)
+	ws.dryRunActions(tenant_id, actions, input, "", &steps)
+
+	return steps, nil
+}
+
+// dryRunActions describes the actions into steps, it returns false when a filter or an error stopped the walk.
+func (ws *WorkflowsService) dryRunActions(tenant_id string, actions []bson.Raw, input interface{}, path_prefix string, steps *[]models.WorkflowDryRunStep) (output interface{}, proceed bool) {
+
+	output = input
+
+	for position, raw_action := range actions {
+
+		path := fmt.Sprint(position)
+		if path_prefix != "" {
+			path = fmt.Sprintf("%s.%d", path_prefix, position)
+		}
+
+		var action models.WorkflowActionBase
+		err := bson.Unmarshal(raw_action, &action)
+
+		step := models.WorkflowDryRunStep{
+			Path: path,
+			Type: action.Type,
+		}
+
+		if err != nil {
+			step.Error = fmt.Sprintf("failed to decode action: %v", err)
+			*steps = append(*steps, step)
+			return output, false
+		}
+
+		switch action.Type {
+		case models.WorkflowActionTypeConditionLabel:
+			var condition models.WorkflowConditionAction
+			branches := struct {
+				Then []bson.Raw `bson:"then"`
+				Else []bson.Raw `bson:"else"`
+			}{}
+
+			err = bson.Unmarshal(raw_action, &condition)
+			if err == nil {
+				err = bson.Unmarshal(raw_action, &branches)
+			}
+
+			var holds bool
+			if err == nil {
+				holds, err = evaluateExpression(condition.Expression, output)
+			}
+
+			if err != nil {
+				step.Error = err.Error()
+				*steps = append(*steps, step)
+				return output, false
+			}
+
+			branch, branch_actions := "then", branches.Then
+			if !holds {
+				branch, branch_actions = "else", branches.Else
+			}
+
+			step.Message = fmt.Sprintf("Condition %s evaluated to %t, would run the %s branch (%d actions)", condition.Expression, holds, branch, len(branch_actions))
+			*steps = append(*steps, step)
+
+			output, proceed = ws.dryRunActions(tenant_id, branch_actions, output, path+"."+branch, steps)
+			if !proceed {
+				return output, false
+			}
+
+		case models.WorkflowActionTypeFilterLabel:
+			var filter models.WorkflowFilterAction
+			err = bson.Unmarshal(raw_action, &filter)
+
+			var expression *common.Expression
+			if err == nil {
+				expression, err = common.ParseExpression(filter.Expression)
+			}
+
+			keep := false
+			if err == nil {
+				if expression.IterablePath() != "" {
+					var total, kept int
+					output, total, kept, err = expression.Filter(output)
+					keep = kept > 0
+					step.Message = fmt.Sprintf("Filter %s would keep %d of %d %s", filter.Expression, kept, total, expression.IterablePath())
+				} else {
+					keep, err = expression.Evaluate(output)
+					step.Message = fmt.Sprintf("Filter %s evaluated to %t", filter.Expression, keep)
+				}
+			}
+
+			if err != nil {
+				step.Message = ""
+				step.Error = err.Error()
+				*steps = append(*steps, step)
+				return output, false
+			}
+
+			if !keep {
+				step.Message += ", the run would stop here"
+			}
+
+			*steps = append(*steps, step)
+
+			if !keep {
+				return output, false
+			}
+
+		default:
+			handler, ok := workflows.Types.Action(action.Type)
+			if !ok {
+				step.Error = fmt.Sprintf("unsupported action type: %s", action.Type)
+				*steps = append(*steps, step)
+				return output, false
+			}
+
+			dry_run_handler, ok := handler.(workflows.DryRunActionHandler)
+			if !ok {
+				step.Message = "Action not run, it can't be previewed, the action input is passed to the next action"
+				*steps = append(*steps, step)
+				continue
+			}
+
+			step.Request, step.Message, err = dry_run_handler.DryRun(workflows.ActionContext{
+				Context:  context.Background(),
+				Service:  ws,
+				TenantID: tenant_id,
+			}, raw_action, output)
+			if err != nil {
+				step.Request = nil
+				step.Message = ""
+				step.Error = err.Error()
+				*steps = append(*steps, step)
+				return output, false
+			}
+
+			*steps = append(*steps, step)
+		}
+	}
+
+	return output, true
+}
+
+// evaluateExpression parses and evaluates a condition expression over the input.
+func evaluateExpression(source string, input interface{}) (bool, error) {
+
+	expression, err := common.ParseExpression(source)
+	if err != nil {
+		return false, fmt.Errorf("invalid expression %s: %v", source, err)
+	}
+
+	return expression.Evaluate(input)
+}
+
+// describeRequest captures the request as it would be sent with the secrets masked,
+// the credentials of the Authorization header are always masked.
+func describeRequest(http_req *http.Request, secrets_values []string) (*models.WorkflowDryRunRequest, error) {
+
+	// a secret can be percent encoded in the url, by the template or when the url is parsed
+	url_secrets := make([]string, 0, 3*len(secrets_values))
+	for _, secret := range secrets_values {
+		url_secrets = append(url_secrets, secret, url.QueryEscape(secret), url.PathEscape(secret))
+	}
+
+	request := &models.WorkflowDryRunRequest{
+		Method:  http_req.Method,
+		URL:     common.MaskString(http_req.URL.String(), url_secrets),
+		Headers: make(map[string]string),
+	}
+
+	for key := range http_req.Header {
+		value := http_req.Header.Get(key)
+		if key == "Authorization" {
+			if scheme, _, found := strings.Cut(value, " "); found {
+				value = scheme + " ***********"
+			} else {
+				value = "***********"
+			}
+		}
+		request.Headers[key] = common.MaskString(value, secrets_values)
+	}
+
+	if http_req.Body != nil {
+		body, err := io.ReadAll(http_req.Body)
+		if err != nil {
+			return nil, err
+		}
+		http_req.Body = io.NopCloser(bytes.NewReader(body))
+		request.Body = common.MaskString(string(body), secrets_values)
+	}
+
+	return request, nil
+}
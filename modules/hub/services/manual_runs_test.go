@@ -0,0 +1,97 @@
+package services
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestDescribeRequest(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		url      string
+		secrets  []string
+		expected string
+	}{
+		{
+			name:     "secret in the query",
+			url:      "https://api.example/items?key=s3cret",
+			secrets:  []string{"s3cret"},
+			expected: "https://api.example/items?key=***********",
+		},
+		{
+			name:     "query escaped secret",
+			url:      "https://api.example/items?key=p%40ss+word%2F1",
+			secrets:  []string{"p@ss word/1"},
+			expected: "https://api.example/items?key=***********",
+		},
+		{
+			name:     "path escaped secret",
+			url:      "https://api.example/a%20b%2Fc/items",
+			secrets:  []string{"a b/c"},
+			expected: "https://api.example/***********/items",
+		},
+		{
+			name:     "secret escaped when the url is parsed",
+			url:      "https://api.example/shops/my shop/items",
+			secrets:  []string{"my shop"},
+			expected: "https://api.example/shops/***********/items",
+		},
+		{
+			name:     "several secrets",
+			url:      "https://api.example/t%C3%B6ken/items?key=s3cret",
+			secrets:  []string{"s3cret", "töken"},
+			expected: "https://api.example/***********/items?key=***********",
+		},
+		{
+			name:     "no secrets",
+			url:      "https://api.example/items?key=value",
+			secrets:  []string{},
+			expected: "https://api.example/items?key=value",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			http_req, err := http.NewRequest(http.MethodGet, test.url, nil)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			request, err := describeRequest(http_req, test.secrets)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if request.URL != test.expected {
+				t.Errorf("expected %v, got %v", test.expected, request.URL)
+			}
+		})
+	}
+
+	// the headers and the body are masked as they are sent
+	http_req, err := http.NewRequest(http.MethodPost, "https://api.example/items", strings.NewReader(`{"key":"s3cret"}`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	http_req.Header.Set("Authorization", "Bearer token")
+	http_req.Header.Set("X-Api-Key", "s3cret")
+
+	request, err := describeRequest(http_req, []string{"s3cret"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := map[string]string{
+		"Authorization": "Bearer ***********",
+		"X-Api-Key":     "***********",
+	}
+	for key, value := range expected {
+		if request.Headers[key] != value {
+			t.Errorf("expected %s header %v, got %v", key, value, request.Headers[key])
+		}
+	}
+	if request.Body != `{"key":"***********"}` {
+		t.Errorf("expected the body %v, got %v", `{"key":"***********"}`, request.Body)
+	}
+}
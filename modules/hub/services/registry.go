@@ -0,0 +1,101 @@
+package services
+
+import (
+	"fmt"
+
+	"github.com/nutrixpos/hub/common/workflows"
+)
+
+// RegisterBuiltinWorkflowTypes registers the trigger and action types that come with the hub.
+func RegisterBuiltinWorkflowTypes(registry *workflows.TypesRegistry) (err error) {
+
+	for _, trigger := range []workflows.TriggerHandler{
+		lowStockTriggerHandler{},
+		scheduleTriggerHandler{},
+		orderIngestedTriggerHandler{},
+		refundIngestedTriggerHandler{},
+		dailySalesBelowTargetTriggerHandler{},
+		inboundWebhookTriggerHandler{},
+	} {
+		err = registry.RegisterTrigger(trigger)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, action := range []workflows.ActionHandler{
+		n8nWebhookActionHandler{},
+		httpRequestActionHandler{},
+		conditionActionHandler{registry: registry},
+		filterActionHandler{},
+		sendEmailActionHandler{},
+		waitForApprovalActionHandler{},
+		delayActionHandler{},
+		adjustInventoryActionHandler{},
+	} {
+		err = registry.RegisterAction(action)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// workflowsService returns the hub service the built in handlers are run with, they can't run with another service.
+func workflowsService(service workflows.Service) (*WorkflowsService, error) {
+
+	ws, ok := service.(*WorkflowsService)
+	if !ok {
+		return nil, fmt.Errorf("the built in workflow types can't run with the %T service", service)
+	}
+
+	return ws, nil
+}
+
+// jsonSchemaObject returns the JSON schema of an object, the type property is added to every definition.
+func jsonSchemaObject(definition_type string, required []string, properties map[string]interface{}) map[string]interface{} {
+
+	properties["type"] = map[string]interface{}{"type": "string", "const": definition_type}
+
+	return map[string]interface{}{
+		"$schema":              "https://json-schema.org/draft/2020-12/schema",
+		"type":                 "object",
+		"required":             append([]string{"type"}, required...),
+		"properties":           properties,
+		"additionalProperties": true,
+	}
+}
+
+// jsonSchemaProperty returns the JSON schema of a property, enum lists its allowed values when not empty.
+func jsonSchemaProperty(property_type string, description string, enum ...interface{}) map[string]interface{} {
+
+	property := map[string]interface{}{
+		"type":        property_type,
+		"description": description,
+	}
+
+	if len(enum) > 0 {
+		property["enum"] = enum
+	}
+
+	return property
+}
+
+// jsonSchemaArray returns the JSON schema of an array property.
+func jsonSchemaArray(items map[string]interface{}, description string) map[string]interface{} {
+	return map[string]interface{}{
+		"type":        "array",
+		"items":       items,
+		"description": description,
+	}
+}
+
+// jsonSchemaStringMap returns the JSON schema of an object of strings, such as headers.
+func jsonSchemaStringMap(description string) map[string]interface{} {
+	return map[string]interface{}{
+		"type":                 "object",
+		"additionalProperties": map[string]interface{}{"type": "string"},
+		"description":          description,
+	}
+}
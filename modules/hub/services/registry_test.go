@@ -0,0 +1,46 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/nutrixpos/hub/common/workflows"
+	"github.com/nutrixpos/hub/modules/hub/models"
+)
+
+// otherWorkflowsService is a workflows.Service that isn't the hub one.
+type otherWorkflowsService struct{}
+
+func (otherWorkflowsService) AddLogsToWorkflowRunStep(tenant_id string, workflow_id string, run_id string, step_index int, log models.WorkflowRunLog) error {
+	return nil
+}
+
+func TestWorkflowsService(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		service workflows.Service
+		invalid bool
+	}{
+		{"hub service", &WorkflowsService{}, false},
+		{"other service", otherWorkflowsService{}, true},
+		{"no service", nil, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ws, err := workflowsService(test.service)
+			if test.invalid && (err == nil || ws != nil) {
+				t.Errorf("expected an error, got %v", ws)
+			}
+			if !test.invalid && (err != nil || ws == nil) {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+
+	// a built in handler run with another service fails instead of panicking
+	_, _, _, err := lowStockTriggerHandler{}.Gate(otherWorkflowsService{}, "tenant", "workflow", nil, models.WorkflowLowStockTriggerOutput{})
+	if err == nil {
+		t.Error("expected an error from the low stock gate")
+	}
+}
@@ -0,0 +1,135 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/nutrixpos/hub/modules/hub/models"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// DefaultRetryableStatusCodes are the response status codes retried when the retry policy doesn't list its own.
+var DefaultRetryableStatusCodes = []int{408, 429, 500, 502, 503, 504}
+
+// ActionRequestError is returned by the actions whose outbound request failed,
+// StatusCode is 0 when no response was received.
+type ActionRequestError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *ActionRequestError) Error() string {
+	return e.Message
+}
+
+// normalizeRetryPolicy fills the defaults of the retry policy, an action without a policy is attempted once.
+func normalizeRetryPolicy(policy *models.WorkflowRetryPolicy) models.WorkflowRetryPolicy {
+
+	if policy == nil {
+		return models.WorkflowRetryPolicy{MaxAttempts: 1}
+	}
+
+	normalized := *policy
+
+	if normalized.MaxAttempts < 1 {
+		normalized.MaxAttempts = 1
+	}
+
+	if normalized.InitialInterval <= 0 {
+		normalized.InitialInterval = 1
+	}
+
+	if normalized.MaxInterval <= 0 {
+		normalized.MaxInterval = 300
+	}
+
+	if normalized.Multiplier < 1 {
+		normalized.Multiplier = 2
+	}
+
+	if len(normalized.RetryableStatusCodes) == 0 {
+		normalized.RetryableStatusCodes = DefaultRetryableStatusCodes
+	}
+
+	return normalized
+}
+
+// isRetryable reports whether the error of an attempt is worth another attempt under the policy.
+func isRetryable(policy models.WorkflowRetryPolicy, err error) bool {
+
+	var request_err *ActionRequestError
+	if !errors.As(err, &request_err) {
+		return false
+	}
+
+	if request_err.StatusCode == 0 {
+		return true
+	}
+
+	for _, code := range policy.RetryableStatusCodes {
+		if code == request_err.StatusCode {
+			return true
+		}
+	}
+
+	return false
+}
+
+// retryBackoff returns the wait before the attempt following the given one, the exponential interval
+// is capped at the policy max interval and half of it is randomized to spread the retries.
+func retryBackoff(policy models.WorkflowRetryPolicy, attempt int) time.Duration {
+
+	interval := float64(policy.InitialInterval) * math.Pow(policy.Multiplier, float64(attempt-1))
+	interval = math.Min(interval, float64(policy.MaxInterval))
+
+	backoff := time.Duration(interval * float64(time.Second))
+	half := backoff / 2
+
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// runActionWithRetry runs the action until it succeeds, fails with a non retryable error or
+// runs out of attempts, every failed attempt is logged on the step.
+func (ws *WorkflowsService) runActionWithRetry(execution *workflowExecution, step_index int, action_type string, raw_action bson.Raw, input interface{}) (output interface{}, attempts int, err error) {
+
+	var base models.WorkflowActionBase
+	err = bson.Unmarshal(raw_action, &base)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	policy := normalizeRetryPolicy(base.Retry)
+
+	for attempts = 1; ; attempts++ {
+
+		output, err = ws.runAction(execution.Context, execution.TenantID, execution.WorkflowID, execution.RunID, step_index, action_type, raw_action, input)
+		if err == nil {
+			return output, attempts, nil
+		}
+
+		if attempts >= policy.MaxAttempts || !isRetryable(policy, err) || execution.Context.Err() != nil {
+			return nil, attempts, err
+		}
+
+		backoff := retryBackoff(policy, attempts)
+
+		ws.AddLogsToWorkflowRunStep(execution.TenantID, execution.WorkflowID, execution.RunID, step_index, models.WorkflowRunLog{
+			Level:     "WARNING",
+			Message:   fmt.Sprintf("Attempt %d of %d failed: %s, retrying in %s", attempts, policy.MaxAttempts, err.Error(), backoff.Round(time.Millisecond)),
+			TimeStamp: time.Now(),
+		})
+
+		select {
+		case <-time.After(backoff):
+		case <-execution.Context.Done():
+			return nil, attempts, ErrWorkflowRunCancelled
+		}
+
+		if ws.workflowRunCancelled(execution) {
+			return nil, attempts, ErrWorkflowRunCancelled
+		}
+	}
+}
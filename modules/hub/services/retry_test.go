@@ -0,0 +1,121 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/nutrixpos/hub/modules/hub/models"
+)
+
+func TestNormalizeRetryPolicy(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		policy   *models.WorkflowRetryPolicy
+		expected models.WorkflowRetryPolicy
+	}{
+		{
+			name:     "no policy",
+			policy:   nil,
+			expected: models.WorkflowRetryPolicy{MaxAttempts: 1},
+		},
+		{
+			name:     "defaults",
+			policy:   &models.WorkflowRetryPolicy{},
+			expected: models.WorkflowRetryPolicy{MaxAttempts: 1, InitialInterval: 1, MaxInterval: 300, Multiplier: 2, RetryableStatusCodes: DefaultRetryableStatusCodes},
+		},
+		{
+			name:     "multiplier below one",
+			policy:   &models.WorkflowRetryPolicy{MaxAttempts: 3, Multiplier: 0.5},
+			expected: models.WorkflowRetryPolicy{MaxAttempts: 3, InitialInterval: 1, MaxInterval: 300, Multiplier: 2, RetryableStatusCodes: DefaultRetryableStatusCodes},
+		},
+		{
+			name:     "kept as set",
+			policy:   &models.WorkflowRetryPolicy{MaxAttempts: 5, InitialInterval: 2, MaxInterval: 60, Multiplier: 3, RetryableStatusCodes: []int{409}},
+			expected: models.WorkflowRetryPolicy{MaxAttempts: 5, InitialInterval: 2, MaxInterval: 60, Multiplier: 3, RetryableStatusCodes: []int{409}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if normalized := normalizeRetryPolicy(test.policy); !reflect.DeepEqual(normalized, test.expected) {
+				t.Errorf("expected %+v, got %+v", test.expected, normalized)
+			}
+		})
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		policy  models.WorkflowRetryPolicy
+		attempt int
+		// interval is the exponential interval before jitter, the backoff is between its half and itself
+		interval time.Duration
+	}{
+		{"first attempt", models.WorkflowRetryPolicy{InitialInterval: 1, MaxInterval: 300, Multiplier: 2}, 1, time.Second},
+		{"second attempt", models.WorkflowRetryPolicy{InitialInterval: 1, MaxInterval: 300, Multiplier: 2}, 2, 2 * time.Second},
+		{"fifth attempt", models.WorkflowRetryPolicy{InitialInterval: 1, MaxInterval: 300, Multiplier: 2}, 5, 16 * time.Second},
+		{"other multiplier", models.WorkflowRetryPolicy{InitialInterval: 2, MaxInterval: 300, Multiplier: 3}, 3, 18 * time.Second},
+		{"fractional multiplier", models.WorkflowRetryPolicy{InitialInterval: 10, MaxInterval: 300, Multiplier: 1.5}, 2, 15 * time.Second},
+		{"capped at the max interval", models.WorkflowRetryPolicy{InitialInterval: 1, MaxInterval: 10, Multiplier: 2}, 6, 10 * time.Second},
+		{"far attempt stays capped", models.WorkflowRetryPolicy{InitialInterval: 1, MaxInterval: 300, Multiplier: 2}, 100, 300 * time.Second},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			lowest, highest := test.interval, time.Duration(0)
+
+			for i := 0; i < 500; i++ {
+				backoff := retryBackoff(test.policy, test.attempt)
+				if backoff < test.interval/2 || backoff > test.interval {
+					t.Fatalf("backoff %s is outside of [%s, %s]", backoff, test.interval/2, test.interval)
+				}
+				lowest = min(lowest, backoff)
+				highest = max(highest, backoff)
+			}
+
+			// the jitter spreads the retries over the upper half of the interval
+			if highest-lowest < test.interval/4 {
+				t.Errorf("backoffs only spread between %s and %s", lowest, highest)
+			}
+		})
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+
+	policy := normalizeRetryPolicy(&models.WorkflowRetryPolicy{})
+	custom := normalizeRetryPolicy(&models.WorkflowRetryPolicy{RetryableStatusCodes: []int{409, 500}})
+
+	tests := []struct {
+		name     string
+		policy   models.WorkflowRetryPolicy
+		err      error
+		expected bool
+	}{
+		{"no response", policy, &ActionRequestError{StatusCode: 0, Message: "connection refused"}, true},
+		{"default retryable status", policy, &ActionRequestError{StatusCode: 503}, true},
+		{"too many requests", policy, &ActionRequestError{StatusCode: 429}, true},
+		{"client error", policy, &ActionRequestError{StatusCode: 400}, false},
+		{"not found", policy, &ActionRequestError{StatusCode: 404}, false},
+		{"listed status", custom, &ActionRequestError{StatusCode: 409}, true},
+		{"default status not listed", custom, &ActionRequestError{StatusCode: 503}, false},
+		{"wrapped", policy, fmt.Errorf("step failed: %w", &ActionRequestError{StatusCode: 502}), true},
+		{"not a request error", policy, errors.New("invalid template"), false},
+		{"cancelled", policy, ErrWorkflowRunCancelled, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if retryable := isRetryable(test.policy, test.err); retryable != test.expected {
+				t.Errorf("expected %v, got %v", test.expected, retryable)
+			}
+		})
+	}
+}
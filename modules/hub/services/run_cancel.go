@@ -0,0 +1,200 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nutrixpos/hub/modules/hub/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ErrWorkflowRunCancelled is returned by the executor when the run it executes was cancelled.
+var ErrWorkflowRunCancelled = errors.New("workflow run was cancelled")
+
+// ErrWorkflowRunFinished is returned by CancelWorkflowRun when the run already reached a final status.
+var ErrWorkflowRunFinished = errors.New("workflow run already finished")
+
+// workflowRunCancellations holds the cancel func of the context of each run executed by this process.
+type workflowRunCancellations struct {
+	mu      sync.Mutex
+	cancels map[string]context.CancelFunc
+}
+
+var runningWorkflowRuns = &workflowRunCancellations{
+	cancels: make(map[string]context.CancelFunc),
+}
+
+// watchWorkflowRunCancellation returns the context of the run, it is cancelled when the run is.
+// release must be called once the run stops executing.
+func watchWorkflowRunCancellation(run_id string) (ctx context.Context, release func()) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	runningWorkflowRuns.mu.Lock()
+	runningWorkflowRuns.cancels[run_id] = cancel
+	runningWorkflowRuns.mu.Unlock()
+
+	return ctx, func() {
+		runningWorkflowRuns.mu.Lock()
+		delete(runningWorkflowRuns.cancels, run_id)
+		runningWorkflowRuns.mu.Unlock()
+
+		cancel()
+	}
+}
+
+// workflowRunCancelled reports whether the run of the execution was cancelled. The status is read back before
+// each step and attempt, as a run executed here may be cancelled through another hub instance, whose
+// cancellation then interrupts the execution context.
+func (ws *WorkflowsService) workflowRunCancelled(execution *workflowExecution) bool {
+
+	if execution.Context.Err() != nil {
+		return true
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), ws.dbDeadline())
+	defer cancel()
+
+	client, collection, err := ws.getRunsCollection(ctx)
+	if err != nil {
+		ws.Logger.Error(err.Error())
+		return false
+	}
+	defer client.Disconnect(ctx)
+
+	var run struct {
+		Status string `bson:"status"`
+	}
+
+	err = collection.FindOne(ctx, bson.M{
+		"tenant_id":   execution.TenantID,
+		"workflow_id": execution.WorkflowID,
+		"id":          execution.RunID,
+	}, options.FindOne().SetProjection(bson.M{"status": 1})).Decode(&run)
+	if err != nil {
+		ws.Logger.Error(fmt.Sprintf("failed to check whether run %s was cancelled: %v", execution.RunID, err))
+		return false
+	}
+
+	if run.Status != models.WorkflowRunStatusCancelled {
+		return false
+	}
+
+	cancelWorkflowRunContext(execution.RunID)
+	return true
+}
+
+// cancelWorkflowRunContext cancels the context of the run when this process executes it.
+func cancelWorkflowRunContext(run_id string) {
+
+	runningWorkflowRuns.mu.Lock()
+	cancel, ok := runningWorkflowRuns.cancels[run_id]
+	runningWorkflowRuns.mu.Unlock()
+
+	if ok {
+		cancel()
+	}
+}
+
+// CancelWorkflowRun marks the running or paused run as cancelled and stops its execution, the action in flight
+// is interrupted (its requests are aborted), a pending approval is cancelled and the remaining steps are skipped.
+// A run executed by another hub instance stops before its next step or attempt, see workflowRunCancelled.
+// mongo.ErrNoDocuments is returned when the run doesn't exist and ErrWorkflowRunFinished when it isn't running anymore.
+func (ws *WorkflowsService) CancelWorkflowRun(tenant_id string, workflow_id string, run_id string, reason string) (err error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), ws.dbDeadline())
+	defer cancel()
+
+	client, collection, err := ws.getRunsCollection(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect(ctx)
+
+	message := "Workflow run cancelled"
+	if reason != "" {
+		message += ": " + reason
+	}
+
+	// only a running or paused run is cancelled, the executor finishing it at the same time can't override it
+	result, err := collection.UpdateOne(ctx, bson.M{
+		"tenant_id":   tenant_id,
+		"workflow_id": workflow_id,
+		"id":          run_id,
+		"status":      bson.M{"$in": []string{models.WorkflowRunStatusRunning, models.WorkflowRunStatusWaiting, models.WorkflowRunStatusDelayed}},
+	}, bson.M{
+		"$set": bson.M{
+			"status":   models.WorkflowRunStatusCancelled,
+			"end_time": time.Now(),
+		},
+		"$push": bson.M{"logs": models.WorkflowRunLog{
+			Level:     "WARNING",
+			Message:   message,
+			TimeStamp: time.Now(),
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	if result.MatchedCount == 0 {
+		_, err = ws.GetWorkflowRun(tenant_id, workflow_id, run_id)
+		if err != nil {
+			return err
+		}
+		return ErrWorkflowRunFinished
+	}
+
+	cancelWorkflowRunContext(run_id)
+
+	err = ws.cancelWaitingApproval(tenant_id, run_id)
+	if err != nil {
+		ws.Logger.Error(fmt.Sprintf("failed to cancel the approval of the run %s: %v", run_id, err))
+	}
+
+	// a paused run has no executor to stop its steps
+	err = ws.stopPausedWorkflowRunSteps(tenant_id, workflow_id, run_id)
+	if err != nil {
+		ws.Logger.Error(fmt.Sprintf("failed to stop the steps of the run %s: %v", run_id, err))
+	}
+
+	notifyWorkflowRun(run_id)
+
+	return nil
+}
+
+// stopCancelledWorkflowRun marks the step interrupted by the cancellation and skips the steps that didn't start.
+func (ws *WorkflowsService) stopCancelledWorkflowRun(execution *workflowExecution, step_index int) {
+
+	if step_index >= 0 {
+		ws.AddLogsToWorkflowRunStep(execution.TenantID, execution.WorkflowID, execution.RunID, step_index, models.WorkflowRunLog{
+			Level:     "WARNING",
+			Message:   "Step interrupted, the run was cancelled",
+			TimeStamp: time.Now(),
+		})
+		ws.SetWorkflowRunStepStatus(execution.TenantID, execution.WorkflowID, execution.RunID, step_index, models.WorkflowRunStepStatusCancelled)
+	}
+
+	ws.SkipPendingWorkflowRunSteps(execution.TenantID, execution.WorkflowID, execution.RunID)
+}
+
+// stopPausedWorkflowRunSteps marks the step a cancelled run paused on as cancelled and skips the steps that didn't start.
+func (ws *WorkflowsService) stopPausedWorkflowRunSteps(tenant_id string, workflow_id string, run_id string) (err error) {
+
+	run, err := ws.GetWorkflowRun(tenant_id, workflow_id, run_id)
+	if err != nil {
+		return err
+	}
+
+	for _, step := range run.Steps {
+		if step.Status == models.WorkflowRunStepStatusWaiting {
+			ws.SetWorkflowRunStepStatus(tenant_id, workflow_id, run_id, step.Index, models.WorkflowRunStepStatusCancelled)
+		}
+	}
+
+	return ws.SkipPendingWorkflowRunSteps(tenant_id, workflow_id, run_id)
+}
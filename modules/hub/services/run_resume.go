@@ -0,0 +1,122 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/nutrixpos/hub/modules/hub/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// workflowRunResumeLease is how long a resumed run is held by the hub executing it without renewing its lease,
+// it is renewed while the run is queued or executed.
+const workflowRunResumeLease = 2 * time.Minute
+
+// workflowRunResume returns the resume of a run leaving waiting or delayed, leased to this hub.
+func workflowRunResume(step_index int, resume_index int, input interface{}) models.WorkflowRunResume {
+	return models.WorkflowRunResume{
+		StepIndex:   step_index,
+		ResumeIndex: resume_index,
+		Input:       input,
+		LeaseUntil:  time.Now().Add(workflowRunResumeLease),
+	}
+}
+
+// renewWorkflowRunResumeLease renews the resume lease of the run until stop is closed or the run stops running.
+func (ws *WorkflowsService) renewWorkflowRunResumeLease(tenant_id string, workflow_id string, run_id string) (stop chan struct{}) {
+
+	stop = make(chan struct{})
+
+	go func() {
+		ticker := time.NewTicker(workflowRunResumeLease / 4)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case now := <-ticker.C:
+				err := ws.updateWorkflowRunWhere(tenant_id, workflow_id, run_id, bson.M{"status": models.WorkflowRunStatusRunning}, bson.M{
+					"$set": bson.M{"resume.lease_until": now.Add(workflowRunResumeLease)},
+				})
+				if err == mongo.ErrNoDocuments {
+					return
+				}
+				if err != nil {
+					ws.Logger.Error(fmt.Sprintf("failed to renew the resume lease of run %s: %v", run_id, err))
+				}
+			}
+		}
+	}()
+
+	return stop
+}
+
+// RecoverResumedWorkflowRuns takes over the resumed runs whose lease lapsed while they were still running,
+// the hub executing them stopped. They are resumed again from the action after the step they paused on,
+// so the actions that ran since are executed again.
+func (ws *WorkflowsService) RecoverResumedWorkflowRuns(now time.Time) (err error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), ws.dbDeadline())
+	defer cancel()
+
+	client, collection, err := ws.getRunsCollection(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect(ctx)
+
+	cursor, err := collection.Find(ctx, bson.M{
+		"status":             models.WorkflowRunStatusRunning,
+		"resume.lease_until": bson.M{"$lt": now},
+	}, options.Find().
+		SetLimit(100).
+		SetProjection(bson.M{"logs": 0, "steps": 0, "output": 0}))
+	if err != nil {
+		return err
+	}
+
+	stale := make([]models.WorkflowRun, 0)
+	err = cursor.All(ctx, &stale)
+	if err != nil {
+		return err
+	}
+
+	for _, run := range stale {
+		if run.Resume == nil {
+			continue
+		}
+
+		// the lease is claimed with a compare and set, a single hub takes the run over
+		resume := workflowRunResume(run.Resume.StepIndex, run.Resume.ResumeIndex, run.Resume.Input)
+		err = ws.updateWorkflowRunWhere(run.TenantID, run.WorkflowID, run.ID, bson.M{
+			"status":             models.WorkflowRunStatusRunning,
+			"resume.lease_until": run.Resume.LeaseUntil,
+		}, bson.M{
+			"$set": bson.M{"resume": resume},
+			"$push": bson.M{"logs": models.WorkflowRunLog{
+				Level:     "WARNING",
+				Message:   fmt.Sprintf("The hub executing the resumed run stopped, resuming it again from step %d", run.Resume.ResumeIndex),
+				TimeStamp: time.Now(),
+			}},
+		})
+		if err == mongo.ErrNoDocuments {
+			// finished, cancelled or taken over by another instance meanwhile
+			continue
+		}
+		if err != nil {
+			ws.Logger.Error(fmt.Sprintf("failed to take over the resumed run %s: %v", run.ID, err))
+			continue
+		}
+
+		err = ws.resumeWorkflowRun(run.TenantID, run.WorkflowID, run.ID, run.WorkflowVersion, resume.StepIndex, resume.ResumeIndex, resume.Input)
+		if err != nil {
+			ws.Logger.Error(fmt.Sprintf("failed to take over the resumed run %s: %v", run.ID, err))
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,246 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/nutrixpos/hub/modules/hub/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	// DefaultWorkflowRunStatsDays is the window of the run stats when it isn't given.
+	DefaultWorkflowRunStatsDays = 7
+
+	// MaxWorkflowRunStatsDays caps the window of the run stats, they are computed from the runs on every request.
+	MaxWorkflowRunStatsDays = 90
+
+	// workflowRunStatsTopErrors is how many error messages the run stats list.
+	workflowRunStatsTopErrors = 10
+)
+
+// ErrWorkflowRunStatsWindow is returned when the window of the run stats is empty or too long.
+var ErrWorkflowRunStatsWindow = fmt.Errorf("the stats window must end after it starts and span at most %d days", MaxWorkflowRunStatsDays)
+
+// GetWorkflowRunStats computes the stats of the runs started between from and to, of the workflow
+// or of the whole tenant when workflow_id is empty.
+func (ws *WorkflowsService) GetWorkflowRunStats(tenant_id string, workflow_id string, from time.Time, to time.Time) (stats models.WorkflowRunStats, err error) {
+
+	if !to.After(from) || to.Sub(from) > MaxWorkflowRunStatsDays*24*time.Hour {
+		return stats, ErrWorkflowRunStatsWindow
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), ws.dbDeadline())
+	defer cancel()
+
+	client, collection, err := ws.getRunsCollection(ctx)
+	if err != nil {
+		return stats, err
+	}
+	defer client.Disconnect(ctx)
+
+	match := bson.M{
+		"tenant_id":  tenant_id,
+		"start_time": bson.M{"$gte": from, "$lt": to},
+	}
+	if workflow_id != "" {
+		match["workflow_id"] = workflow_id
+	}
+
+	// only what the stats need leaves the database, the error of a run is its last error log
+	cursor, err := collection.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: match}},
+		{{Key: "$project", Value: bson.M{
+			"workflow_id": 1,
+			"status":      1,
+			"start_time":  1,
+			"end_time":    1,
+			"error": bson.M{"$let": bson.M{
+				"vars": bson.M{"errors": bson.M{"$filter": bson.M{
+					"input": bson.M{"$ifNull": bson.A{"$logs", bson.A{}}},
+					"cond":  bson.M{"$eq": bson.A{"$$this.level", "ERROR"}},
+				}}},
+				"in": bson.M{"$arrayElemAt": bson.A{"$$errors.message", -1}},
+			}},
+			"steps": bson.M{"$map": bson.M{
+				"input": bson.M{"$ifNull": bson.A{"$steps", bson.A{}}},
+				"in": bson.M{
+					"path":       "$$this.path",
+					"type":       "$$this.type",
+					"status":     "$$this.status",
+					"start_time": "$$this.start_time",
+					"end_time":   "$$this.end_time",
+				},
+			}},
+		}}},
+	})
+	if err != nil {
+		return stats, err
+	}
+	defer cursor.Close(ctx)
+
+	stats = models.WorkflowRunStats{
+		WorkflowID:   workflow_id,
+		From:         from,
+		To:           to,
+		RunsByStatus: make(map[string]int),
+		TopErrors:    make([]models.WorkflowRunErrorStats, 0),
+		Actions:      make([]models.WorkflowActionRunStats, 0),
+	}
+
+	type actionKey struct {
+		workflow_id string
+		path        string
+		action_type string
+	}
+
+	durations := make([]float64, 0)
+	error_counts := make(map[string]int)
+	actions := make(map[actionKey]*models.WorkflowActionRunStats)
+
+	for cursor.Next(ctx) {
+
+		var run struct {
+			WorkflowID string    `bson:"workflow_id"`
+			Status     string    `bson:"status"`
+			StartTime  time.Time `bson:"start_time"`
+			EndTime    time.Time `bson:"end_time"`
+			Error      string    `bson:"error"`
+			Steps      []struct {
+				Path      string    `bson:"path"`
+				Type      string    `bson:"type"`
+				Status    string    `bson:"status"`
+				StartTime time.Time `bson:"start_time"`
+				EndTime   time.Time `bson:"end_time"`
+			} `bson:"steps"`
+		}
+
+		err = cursor.Decode(&run)
+		if err != nil {
+			return stats, err
+		}
+
+		stats.TotalRuns++
+		stats.RunsByStatus[run.Status]++
+
+		if IsFinalWorkflowRunStatus(run.Status) && !run.EndTime.Before(run.StartTime) {
+			duration := run.EndTime.Sub(run.StartTime)
+
+			// the time spent waiting for an approval or a delay isn't execution time
+			for _, step := range run.Steps {
+				if step.Type != models.WorkflowActionTypeWaitForApprovalLabel && step.Type != models.WorkflowActionTypeDelayLabel {
+					continue
+				}
+				if step.StartTime.IsZero() {
+					continue
+				}
+
+				paused_until := step.EndTime
+				if paused_until.IsZero() || paused_until.After(run.EndTime) {
+					paused_until = run.EndTime
+				}
+				if paused_until.After(step.StartTime) {
+					duration -= paused_until.Sub(step.StartTime)
+				}
+			}
+
+			if duration < 0 {
+				duration = 0
+			}
+
+			durations = append(durations, duration.Seconds())
+		}
+
+		if run.Status == models.WorkflowRunStatusFailed && run.Error != "" {
+			error_counts[run.Error]++
+		}
+
+		for _, step := range run.Steps {
+			if step.Status != models.WorkflowRunStepStatusCompleted && step.Status != models.WorkflowRunStepStatusFailed {
+				continue
+			}
+
+			key := actionKey{workflow_id: run.WorkflowID, path: step.Path, action_type: step.Type}
+			action, ok := actions[key]
+			if !ok {
+				action = &models.WorkflowActionRunStats{WorkflowID: run.WorkflowID, Path: step.Path, Type: step.Type}
+				actions[key] = action
+			}
+
+			action.Executions++
+			if step.Status == models.WorkflowRunStepStatusFailed {
+				action.Failures++
+			}
+		}
+	}
+
+	err = cursor.Err()
+	if err != nil {
+		return stats, err
+	}
+
+	completed, failed := stats.RunsByStatus[models.WorkflowRunStatusCompleted], stats.RunsByStatus[models.WorkflowRunStatusFailed]
+	if completed+failed > 0 {
+		stats.SuccessRate = roundStat(float64(completed) / float64(completed+failed))
+	}
+
+	sort.Float64s(durations)
+	stats.DurationP50 = roundStat(percentile(durations, 0.5))
+	stats.DurationP95 = roundStat(percentile(durations, 0.95))
+
+	for message, count := range error_counts {
+		stats.TopErrors = append(stats.TopErrors, models.WorkflowRunErrorStats{Message: message, Count: count})
+	}
+	sort.Slice(stats.TopErrors, func(i, j int) bool {
+		if stats.TopErrors[i].Count != stats.TopErrors[j].Count {
+			return stats.TopErrors[i].Count > stats.TopErrors[j].Count
+		}
+		return stats.TopErrors[i].Message < stats.TopErrors[j].Message
+	})
+	if len(stats.TopErrors) > workflowRunStatsTopErrors {
+		stats.TopErrors = stats.TopErrors[:workflowRunStatsTopErrors]
+	}
+
+	for _, action := range actions {
+		action.FailureRate = roundStat(float64(action.Failures) / float64(action.Executions))
+		stats.Actions = append(stats.Actions, *action)
+	}
+
+	// the least reliable actions first
+	sort.Slice(stats.Actions, func(i, j int) bool {
+		a, b := stats.Actions[i], stats.Actions[j]
+		if a.FailureRate != b.FailureRate {
+			return a.FailureRate > b.FailureRate
+		}
+		if a.WorkflowID != b.WorkflowID {
+			return a.WorkflowID < b.WorkflowID
+		}
+		return a.Path < b.Path
+	})
+
+	return stats, nil
+}
+
+// percentile returns the nearest rank percentile of the sorted values, 0 when there are none.
+func percentile(sorted []float64, p float64) float64 {
+
+	if len(sorted) == 0 {
+		return 0
+	}
+
+	rank := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+
+	return sorted[rank]
+}
+
+// roundStat rounds a rate or a duration in seconds to 3 decimals.
+func roundStat(value float64) float64 {
+	return math.Round(value*1000) / 1000
+}
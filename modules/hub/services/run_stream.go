@@ -0,0 +1,211 @@
+package services
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/nutrixpos/hub/modules/hub/models"
+)
+
+// workflowRunSubscribers wakes up the streams of a run whenever the run is updated,
+// streams read the run again on wake up so a missed notification only delays them.
+type workflowRunSubscribers struct {
+	mu          sync.Mutex
+	subscribers map[string]map[chan struct{}]struct{}
+}
+
+var workflowRunUpdates = &workflowRunSubscribers{
+	subscribers: make(map[string]map[chan struct{}]struct{}),
+}
+
+// SubscribeWorkflowRun returns a channel notified when the run is updated by this process,
+// unsubscribe must be called once the stream ends.
+func SubscribeWorkflowRun(run_id string) (updates <-chan struct{}, unsubscribe func()) {
+
+	channel := make(chan struct{}, 1)
+
+	workflowRunUpdates.mu.Lock()
+	if workflowRunUpdates.subscribers[run_id] == nil {
+		workflowRunUpdates.subscribers[run_id] = make(map[chan struct{}]struct{})
+	}
+	workflowRunUpdates.subscribers[run_id][channel] = struct{}{}
+	workflowRunUpdates.mu.Unlock()
+
+	return channel, func() {
+		workflowRunUpdates.mu.Lock()
+		defer workflowRunUpdates.mu.Unlock()
+
+		delete(workflowRunUpdates.subscribers[run_id], channel)
+		if len(workflowRunUpdates.subscribers[run_id]) == 0 {
+			delete(workflowRunUpdates.subscribers, run_id)
+		}
+	}
+}
+
+// notifyWorkflowRun wakes up the streams of the run without blocking the executor.
+func notifyWorkflowRun(run_id string) {
+
+	workflowRunUpdates.mu.Lock()
+	defer workflowRunUpdates.mu.Unlock()
+
+	for channel := range workflowRunUpdates.subscribers[run_id] {
+		select {
+		case channel <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// IsFinalWorkflowRunStatus reports whether the run won't change anymore.
+func IsFinalWorkflowRunStatus(status string) bool {
+	return status == models.WorkflowRunStatusCompleted || status == models.WorkflowRunStatusFailed || status == models.WorkflowRunStatusCancelled
+}
+
+// WorkflowRunCursor remembers what a stream already sent of a run, Next returns what changed since.
+type WorkflowRunCursor struct {
+	started     bool
+	logs        int
+	status      string
+	step_logs   map[int]int
+	step_status map[int]string
+}
+
+// Next returns the events of the changes of the run since the previous call,
+// the first call returns the whole run so far.
+func (c *WorkflowRunCursor) Next(run models.WorkflowRun) (events []models.WorkflowRunStreamEvent) {
+
+	c.start()
+
+	for _, log := range run.Logs[min(c.logs, len(run.Logs)):] {
+		c.logs++
+		events = append(events, c.event(models.WorkflowRunStreamEventLog, models.WorkflowRunLogEvent{Log: log}))
+	}
+
+	for _, step := range run.Steps {
+
+		// a step reaching its final status is reported after its last logs
+		status_changed := c.step_status[step.Index] != step.Status
+		final := step.Status == models.WorkflowRunStepStatusCompleted || step.Status == models.WorkflowRunStepStatusFailed || step.Status == models.WorkflowRunStepStatusSkipped ||
+			step.Status == models.WorkflowRunStepStatusCancelled
+
+		if status_changed && !final {
+			events = append(events, c.stepEvent(step))
+		}
+
+		for _, log := range step.Logs[min(c.step_logs[step.Index], len(step.Logs)):] {
+			step_index := step.Index
+			c.step_logs[step.Index]++
+			events = append(events, c.event(models.WorkflowRunStreamEventLog, models.WorkflowRunLogEvent{StepIndex: &step_index, Path: step.Path, Log: log}))
+		}
+
+		if status_changed && final {
+			events = append(events, c.stepEvent(step))
+		}
+	}
+
+	if run.Status != c.status {
+		event := models.WorkflowRunStatusEvent{Status: run.Status}
+		if IsFinalWorkflowRunStatus(run.Status) {
+			end_time := run.EndTime
+			event.EndTime = &end_time
+			event.Output = run.Output
+		}
+
+		c.status = run.Status
+		events = append(events, c.event(models.WorkflowRunStreamEventStatus, event))
+	}
+
+	return events
+}
+
+func (c *WorkflowRunCursor) stepEvent(step models.WorkflowRunStep) models.WorkflowRunStreamEvent {
+
+	c.step_status[step.Index] = step.Status
+
+	event := models.WorkflowRunStepEvent{
+		Index:  step.Index,
+		Path:   step.Path,
+		Type:   step.Type,
+		Status: step.Status,
+	}
+	if step.Status == models.WorkflowRunStepStatusCompleted {
+		event.Output = step.Output
+	}
+
+	return c.event(models.WorkflowRunStreamEventStep, event)
+}
+
+func (c *WorkflowRunCursor) start() {
+
+	if !c.started {
+		c.started = true
+		c.step_logs = make(map[int]int)
+		c.step_status = make(map[int]string)
+	}
+}
+
+// event returns an event identified by the position of the cursor once it is sent.
+func (c *WorkflowRunCursor) event(event string, data interface{}) models.WorkflowRunStreamEvent {
+	return models.WorkflowRunStreamEvent{ID: c.position(), Event: event, Data: data}
+}
+
+// position lists the logs sent of the run then those of each step as "3,0:2,1:5",
+// logs are only ever appended so it locates the stream in the run on any instance.
+func (c *WorkflowRunCursor) position() string {
+
+	indexes := make([]int, 0, len(c.step_logs))
+	for index, logs := range c.step_logs {
+		if logs > 0 {
+			indexes = append(indexes, index)
+		}
+	}
+	sort.Ints(indexes)
+
+	position := strconv.Itoa(c.logs)
+	for _, index := range indexes {
+		position += fmt.Sprintf(",%d:%d", index, c.step_logs[index])
+	}
+
+	return position
+}
+
+// ResumeWorkflowRunCursor returns a cursor past the event of the given id, as sent back by a reconnecting stream
+// in its Last-Event-ID header. The logs sent before aren't sent again while the statuses of the run and its steps
+// are, they are current values rather than changes.
+func ResumeWorkflowRunCursor(last_event_id string) (cursor WorkflowRunCursor, err error) {
+
+	cursor.start()
+
+	invalid := fmt.Errorf("invalid event id %q", last_event_id)
+
+	fields := strings.Split(last_event_id, ",")
+
+	cursor.logs, err = strconv.Atoi(fields[0])
+	if err != nil || cursor.logs < 0 {
+		return WorkflowRunCursor{}, invalid
+	}
+
+	for _, field := range fields[1:] {
+		index, logs, found := strings.Cut(field, ":")
+		if !found {
+			return WorkflowRunCursor{}, invalid
+		}
+
+		step_index, err := strconv.Atoi(index)
+		if err != nil {
+			return WorkflowRunCursor{}, invalid
+		}
+
+		step_logs, err := strconv.Atoi(logs)
+		if err != nil || step_logs < 0 {
+			return WorkflowRunCursor{}, invalid
+		}
+
+		cursor.step_logs[step_index] = step_logs
+	}
+
+	return cursor, nil
+}
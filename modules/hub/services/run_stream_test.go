@@ -0,0 +1,170 @@
+package services
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/nutrixpos/hub/modules/hub/models"
+)
+
+// streamEventNames names the events as "log", "log 0" for a log of step 0 or "step 0 completed".
+func streamEventNames(events []models.WorkflowRunStreamEvent) []string {
+
+	names := make([]string, 0, len(events))
+	for _, event := range events {
+		switch data := event.Data.(type) {
+		case models.WorkflowRunLogEvent:
+			if data.StepIndex == nil {
+				names = append(names, "log")
+			} else {
+				names = append(names, fmt.Sprintf("log %d", *data.StepIndex))
+			}
+		case models.WorkflowRunStepEvent:
+			names = append(names, fmt.Sprintf("step %d %s", data.Index, data.Status))
+		case models.WorkflowRunStatusEvent:
+			names = append(names, "status "+data.Status)
+		}
+	}
+
+	return names
+}
+
+func TestWorkflowRunCursorStepStatus(t *testing.T) {
+
+	step := func(index int, status string, logs int) models.WorkflowRunStep {
+		return models.WorkflowRunStep{Index: index, Status: status, Logs: make([]models.WorkflowRunLog, logs)}
+	}
+
+	tests := []struct {
+		name     string
+		steps    []models.WorkflowRunStep
+		expected []string
+	}{
+		{
+			name:     "running step before its logs",
+			steps:    []models.WorkflowRunStep{step(0, models.WorkflowRunStepStatusRunning, 1)},
+			expected: []string{"step 0 running", "log 0"},
+		},
+		{
+			name:     "waiting step before its logs",
+			steps:    []models.WorkflowRunStep{step(0, models.WorkflowRunStepStatusWaiting, 1)},
+			expected: []string{"step 0 waiting", "log 0"},
+		},
+		{
+			name:     "completed step after its logs",
+			steps:    []models.WorkflowRunStep{step(0, models.WorkflowRunStepStatusCompleted, 1)},
+			expected: []string{"log 0", "step 0 completed"},
+		},
+		{
+			name:     "failed step after its logs",
+			steps:    []models.WorkflowRunStep{step(0, models.WorkflowRunStepStatusFailed, 1)},
+			expected: []string{"log 0", "step 0 failed"},
+		},
+		{
+			name:     "skipped step after its logs",
+			steps:    []models.WorkflowRunStep{step(0, models.WorkflowRunStepStatusSkipped, 1)},
+			expected: []string{"log 0", "step 0 skipped"},
+		},
+		{
+			name:     "cancelled step after its logs",
+			steps:    []models.WorkflowRunStep{step(0, models.WorkflowRunStepStatusCompleted, 1), step(1, models.WorkflowRunStepStatusCancelled, 2)},
+			expected: []string{"log 0", "step 0 completed", "log 1", "log 1", "step 1 cancelled"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var cursor WorkflowRunCursor
+			run := models.WorkflowRun{Status: models.WorkflowRunStatusRunning, Steps: test.steps}
+
+			events := streamEventNames(cursor.Next(run))
+			expected := append(test.expected, "status "+models.WorkflowRunStatusRunning)
+			if !reflect.DeepEqual(events, expected) {
+				t.Errorf("expected %v, got %v", expected, events)
+			}
+
+			if events := cursor.Next(run); len(events) != 0 {
+				t.Errorf("expected no events for an unchanged run, got %v", streamEventNames(events))
+			}
+		})
+	}
+}
+
+func TestResumeWorkflowRunCursor(t *testing.T) {
+
+	logs := func(count int) []models.WorkflowRunLog {
+		return make([]models.WorkflowRunLog, count)
+	}
+
+	// the run is streamed in two parts, the resumed streams must send the logs the first one sent after each event
+	started := models.WorkflowRun{
+		Status: models.WorkflowRunStatusRunning,
+		Logs:   logs(1),
+		Steps: []models.WorkflowRunStep{
+			{Index: 0, Status: models.WorkflowRunStepStatusCompleted, Logs: logs(2)},
+			{Index: 1, Status: models.WorkflowRunStepStatusRunning, Logs: logs(1)},
+		},
+	}
+	finished := models.WorkflowRun{
+		Status: models.WorkflowRunStatusCompleted,
+		Logs:   logs(2),
+		Steps: []models.WorkflowRunStep{
+			{Index: 0, Status: models.WorkflowRunStepStatusCompleted, Logs: logs(2)},
+			{Index: 1, Status: models.WorkflowRunStepStatusCompleted, Logs: logs(3)},
+			{Index: 2, Status: models.WorkflowRunStepStatusCancelled, Logs: logs(1)},
+		},
+	}
+
+	var cursor WorkflowRunCursor
+	events := append(cursor.Next(started), cursor.Next(finished)...)
+
+	if last := events[len(events)-1].ID; last != "2,0:2,1:3,2:1" {
+		t.Errorf("expected the last event id %q, got %q", "2,0:2,1:3,2:1", last)
+	}
+
+	logEvents := func(events []models.WorkflowRunStreamEvent) []string {
+		names := make([]string, 0)
+		for _, name := range streamEventNames(events) {
+			if strings.HasPrefix(name, "log") {
+				names = append(names, name)
+			}
+		}
+		// a resumed stream reads the run as it is now, the logs of the run and of each step keep their own order
+		sort.Strings(names)
+		return names
+	}
+
+	for i, event := range events {
+		t.Run(event.ID, func(t *testing.T) {
+			resumed, err := ResumeWorkflowRunCursor(event.ID)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			resumed_events := resumed.Next(finished)
+
+			expected := logEvents(events[i+1:])
+			if got := logEvents(resumed_events); !reflect.DeepEqual(got, expected) {
+				t.Errorf("expected the logs %v, got %v", expected, got)
+			}
+
+			// the statuses are current values, they are sent again
+			names := streamEventNames(resumed_events)
+			if names[len(names)-1] != "status "+models.WorkflowRunStatusCompleted {
+				t.Errorf("expected the run status last, got %v", names)
+			}
+		})
+	}
+
+	invalid_ids := []string{"", "x", "-1", "3,0", "3,a:1", "3,0:x", "3,0:-2"}
+	for _, id := range invalid_ids {
+		t.Run("invalid "+id, func(t *testing.T) {
+			if _, err := ResumeWorkflowRunCursor(id); err == nil {
+				t.Errorf("expected an error for the event id %q", id)
+			}
+		})
+	}
+}
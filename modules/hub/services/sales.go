@@ -117,7 +117,9 @@ func (ss *SalesService) GetSalesPerday(page_number int, page_size int, tenant_id
 	return results[0].Sales, totalRecords, err
 }
 
-func (ss *SalesService) InsertClientSalesOrders(tenant_id string, salesPerDayOrder []models.SalesPerDayOrder) (err error) {
+// InsertClientSalesOrders adds the orders to the sales of their day, orders that were already
+// ingested are skipped, it returns the newly inserted orders.
+func (ss *SalesService) InsertClientSalesOrders(tenant_id string, salesPerDayOrder []models.SalesPerDayOrder) (inserted []models.SalesPerDayOrder, err error) {
 
 	clientOptions := options.Client().ApplyURI(fmt.Sprintf("mongodb://%s:%v", ss.Config.Databases[0].Host, ss.Config.Databases[0].Port))
 
@@ -129,7 +131,13 @@ func (ss *SalesService) InsertClientSalesOrders(tenant_id string, salesPerDayOrd
 	ctx, cancel := context.WithTimeout(context.Background(), deadline)
 	defer cancel()
 
+	inserted = make([]models.SalesPerDayOrder, 0)
+
 	client, err := mongo.Connect(ctx, clientOptions)
+	if err != nil {
+		return inserted, err
+	}
+	defer client.Disconnect(ctx)
 
 	// connected to db
 
@@ -143,10 +151,10 @@ func (ss *SalesService) InsertClientSalesOrders(tenant_id string, salesPerDayOrd
 		if err == mongo.ErrNoDocuments {
 			_, err = collection.InsertOne(ctx, bson.D{{Key: "tenant_id", Value: tenant_id}, {Key: "sales", Value: []bson.D{}}})
 			if err != nil {
-				return err
+				return inserted, err
 			}
 		} else {
-			return err
+			return inserted, err
 		}
 	}
 
@@ -163,7 +171,7 @@ func (ss *SalesService) InsertClientSalesOrders(tenant_id string, salesPerDayOrd
 
 		count, err := collection.CountDocuments(ctx, filter)
 		if err != nil {
-			return err
+			return inserted, err
 		}
 
 		if count == 0 {
@@ -183,9 +191,11 @@ func (ss *SalesService) InsertClientSalesOrders(tenant_id string, salesPerDayOrd
 			}
 			_, err = collection.UpdateOne(context.TODO(), bson.M{"tenant_id": tenant_id}, update)
 			if err != nil {
-				return fmt.Errorf("failed to add order: %v", err)
+				return inserted, fmt.Errorf("failed to add order: %v", err)
 			}
 
+			inserted = append(inserted, sales_order)
+
 		} else {
 
 			// check if sales.$[elem].orders.id already exists
@@ -204,7 +214,7 @@ func (ss *SalesService) InsertClientSalesOrders(tenant_id string, salesPerDayOrd
 			}
 			salesorder_count, err := collection.CountDocuments(ctx, filter_salesorder)
 			if err != nil {
-				return err
+				return inserted, err
 			}
 
 			if salesorder_count == 0 {
@@ -229,16 +239,20 @@ func (ss *SalesService) InsertClientSalesOrders(tenant_id string, salesPerDayOrd
 
 				_, err := collection.UpdateOne(context.TODO(), filter, update, opts)
 				if err != nil {
-					return fmt.Errorf("failed to add order: %v", err)
+					return inserted, fmt.Errorf("failed to add order: %v", err)
 				}
+
+				inserted = append(inserted, sales_order)
 			}
 		}
 	}
 
-	return nil
+	return inserted, nil
 }
 
-func (ss *SalesService) InsertClientSalesRefunds(tenant_id string, salesPerDayRefunds []models.LogOrderItemRefund) (err error) {
+// InsertClientSalesRefunds adds the refunds to the sales of their day, refunds that were already
+// ingested are skipped, it returns the newly inserted refunds.
+func (ss *SalesService) InsertClientSalesRefunds(tenant_id string, salesPerDayRefunds []models.LogOrderItemRefund) (inserted []models.LogOrderItemRefund, err error) {
 
 	clientOptions := options.Client().ApplyURI(fmt.Sprintf("mongodb://%s:%v", ss.Config.Databases[0].Host, ss.Config.Databases[0].Port))
 
@@ -250,7 +264,13 @@ func (ss *SalesService) InsertClientSalesRefunds(tenant_id string, salesPerDayRe
 	ctx, cancel := context.WithTimeout(context.Background(), deadline)
 	defer cancel()
 
+	inserted = make([]models.LogOrderItemRefund, 0)
+
 	client, err := mongo.Connect(ctx, clientOptions)
+	if err != nil {
+		return inserted, err
+	}
+	defer client.Disconnect(ctx)
 
 	// connected to db
 
@@ -264,10 +284,10 @@ func (ss *SalesService) InsertClientSalesRefunds(tenant_id string, salesPerDayRe
 		if err == mongo.ErrNoDocuments {
 			_, err = collection.InsertOne(ctx, bson.D{{Key: "tenant_id", Value: tenant_id}, {Key: "sales", Value: []bson.D{}}})
 			if err != nil {
-				return err
+				return inserted, err
 			}
 		} else {
-			return err
+			return inserted, err
 		}
 	}
 
@@ -280,7 +300,7 @@ func (ss *SalesService) InsertClientSalesRefunds(tenant_id string, salesPerDayRe
 
 		count, err := collection.CountDocuments(ctx, filter)
 		if err != nil {
-			return err
+			return inserted, err
 		}
 
 		if count == 0 {
@@ -309,9 +329,11 @@ func (ss *SalesService) InsertClientSalesRefunds(tenant_id string, salesPerDayRe
 			}
 			_, err = collection.UpdateOne(context.TODO(), bson.M{"tenant_id": tenant_id}, update)
 			if err != nil {
-				return fmt.Errorf("failed to add order: %v", err)
+				return inserted, fmt.Errorf("failed to add order: %v", err)
 			}
 
+			inserted = append(inserted, refund)
+
 		} else {
 
 			// check if sales.$[elem].orders.id already exists
@@ -330,7 +352,7 @@ func (ss *SalesService) InsertClientSalesRefunds(tenant_id string, salesPerDayRe
 			}
 			salesrefund_count, err := collection.CountDocuments(ctx, filter_salesrefund)
 			if err != nil {
-				return err
+				return inserted, err
 			}
 
 			if salesrefund_count == 0 {
@@ -363,12 +385,14 @@ func (ss *SalesService) InsertClientSalesRefunds(tenant_id string, salesPerDayRe
 
 				_, err := collection.UpdateOne(context.TODO(), filter, update, opts)
 				if err != nil {
-					return fmt.Errorf("failed to add order: %v", err)
+					return inserted, fmt.Errorf("failed to add order: %v", err)
 				}
+
+				inserted = append(inserted, refund)
 			}
 
 		}
 	}
 
-	return nil
+	return inserted, nil
 }
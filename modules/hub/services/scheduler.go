@@ -0,0 +1,215 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/nutrixpos/hub/common/workflows"
+	"github.com/nutrixpos/hub/modules/hub/models"
+	"github.com/robfig/cron/v3"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ParseScheduleTrigger parses the cron expression and the timezone of a trigger schedule,
+// fallback_timezone is used when the trigger doesn't specify one, defaulting to UTC.
+func ParseScheduleTrigger(trigger models.WorkflowTriggerSchedule, fallback_timezone string) (schedule cron.Schedule, location *time.Location, err error) {
+
+	if trigger.Cron == "" {
+		return nil, nil, fmt.Errorf("cron expression is required")
+	}
+
+	schedule, err = cron.ParseStandard(trigger.Cron)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid cron expression %s: %v", trigger.Cron, err)
+	}
+
+	timezone := trigger.TimeZone
+	if timezone == "" {
+		timezone = fallback_timezone
+	}
+
+	location = time.UTC
+	if timezone != "" {
+		location, err = time.LoadLocation(timezone)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid timezone %s: %v", timezone, err)
+		}
+	}
+
+	return schedule, location, nil
+}
+
+// RunScheduledWorkflows evaluates every scheduled trigger (such as schedule and daily sales below target)
+// that is due at now and runs the workflows they fire.
+//
+// The last scheduled time of each trigger is persisted and claimed with a compare and set
+// before running, so a schedule is never fired twice across restarts or hub instances.
+// Schedules missed while the hub was down are collapsed into a single run for the latest one.
+func (ws *WorkflowsService) RunScheduledWorkflows(now time.Time) (err error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), ws.dbDeadline())
+	defer cancel()
+
+	client, collection, err := ws.getTenantsCollection(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect(ctx)
+
+	handlers := workflows.Types.ScheduledTriggers()
+	if len(handlers) == 0 {
+		return nil
+	}
+
+	trigger_types := bson.A{}
+	for trigger_type := range handlers {
+		trigger_types = append(trigger_types, trigger_type)
+	}
+
+	cursor, err := collection.Find(ctx, bson.M{
+		"workflows.trigger.type": bson.M{"$in": trigger_types},
+	}, options.Find().SetProjection(bson.M{
+		"tenant_id": 1,
+		"workflows": 1,
+	}))
+	if err != nil {
+		return err
+	}
+
+	var tenants []models.Tenant
+	err = cursor.All(ctx, &tenants)
+	if err != nil {
+		return err
+	}
+
+	for _, tenant := range tenants {
+		for _, raw_workflow := range tenant.Workflows {
+
+			workflow, actions, err := DecodeWorkflow(raw_workflow)
+			if err != nil {
+				ws.Logger.Error(err.Error())
+				continue
+			}
+
+			if !workflow.Enabled {
+				continue
+			}
+
+			handler, ok := handlers[workflow.Trigger.Type]
+			if !ok {
+				continue
+			}
+
+			raw_trigger, err := rawWorkflowTrigger(raw_workflow)
+			if err != nil {
+				ws.Logger.Error(err.Error())
+				continue
+			}
+
+			var trigger models.WorkflowScheduleTrigger
+			err = decodeTrigger(raw_trigger, &trigger)
+			if err != nil {
+				ws.Logger.Error(err.Error())
+				continue
+			}
+
+			schedule, location, err := ParseScheduleTrigger(trigger.WorkflowTriggerSchedule, ws.Config.TimeZone)
+			if err != nil {
+				ws.Logger.Error(fmt.Sprintf("workflow %s has an invalid schedule: %v", workflow.ID, err))
+				continue
+			}
+
+			last := trigger.LastScheduledAt
+
+			// a new or just edited schedule starts counting from now
+			if last.IsZero() {
+				_, err = ws.claimSchedule(tenant.TenantID, workflow.ID, last, now.Truncate(time.Second))
+				if err != nil {
+					ws.Logger.Error(err.Error())
+				}
+				continue
+			}
+
+			due := schedule.Next(last.In(location))
+			if due.After(now) {
+				continue
+			}
+
+			for next := schedule.Next(due); !next.After(now); next = schedule.Next(next) {
+				due = next
+			}
+
+			claimed, err := ws.claimSchedule(tenant.TenantID, workflow.ID, last, due)
+			if err != nil {
+				ws.Logger.Error(err.Error())
+				continue
+			}
+
+			if !claimed {
+				continue
+			}
+
+			output, fire, err := handler.Evaluate(ws, tenant.TenantID, raw_trigger, due.In(location), now)
+			if err != nil {
+				ws.Logger.Error(fmt.Sprintf("failed to evaluate the %s trigger of workflow %s: %v", workflow.Trigger.Type, workflow.ID, err))
+				continue
+			}
+
+			if !fire {
+				continue
+			}
+
+			err = ws.QueueWorkflow(tenant.TenantID, workflow, actions, output)
+			if err != nil {
+				ws.Logger.Error(err.Error())
+			}
+		}
+	}
+
+	return nil
+}
+
+// claimSchedule moves the last scheduled time of the workflow trigger from last to due,
+// it reports false when another evaluation already moved it.
+func (ws *WorkflowsService) claimSchedule(tenant_id string, workflow_id string, last time.Time, due time.Time) (claimed bool, err error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), ws.dbDeadline())
+	defer cancel()
+
+	client, collection, err := ws.getTenantsCollection(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer client.Disconnect(ctx)
+
+	var last_condition interface{} = last
+	if last.IsZero() {
+		// matches both the zero time and a missing field
+		last_condition = bson.M{"$in": bson.A{nil, time.Time{}}}
+	}
+
+	filter := bson.M{
+		"tenant_id": tenant_id,
+		"workflows": bson.M{
+			"$elemMatch": bson.M{
+				"id":                        workflow_id,
+				"trigger.last_scheduled_at": last_condition,
+			},
+		},
+	}
+
+	update := bson.M{
+		"$set": bson.M{
+			"workflows.$.trigger.last_scheduled_at": due.UTC(),
+		},
+	}
+
+	result, err := collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return false, err
+	}
+
+	return result.ModifiedCount == 1, nil
+}
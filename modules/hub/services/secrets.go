@@ -0,0 +1,517 @@
+package services
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/nutrixpos/hub/modules/hub/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ErrSecretsMasterKeyMissing is returned when a secret env var has to be encrypted without a configured master key.
+var ErrSecretsMasterKeyMissing = errors.New("secrets master key is not configured, set secrets.master_key or SECRETS_MASTER_KEY")
+
+const (
+	secretsKeySize = 32
+
+	// envVarWriteAttempts bounds the retries of env var writes racing with a key rotation.
+	envVarWriteAttempts = 3
+)
+
+// masterKeys decodes the configured master keys by their ids, current_id is the id of the key wrapping new data keys.
+func (ws *WorkflowsService) masterKeys() (current_id string, keys map[string][]byte, err error) {
+
+	if strings.TrimSpace(ws.Config.Secrets.MasterKey) == "" {
+		return "", nil, ErrSecretsMasterKeyMissing
+	}
+
+	keys = map[string][]byte{}
+	encoded_keys := append([]string{ws.Config.Secrets.MasterKey}, ws.Config.Secrets.PreviousMasterKeys...)
+
+	for i, encoded := range encoded_keys {
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil || len(key) != secretsKeySize {
+			if i == 0 {
+				return "", nil, fmt.Errorf("secrets master key must be %d base64 encoded bytes", secretsKeySize)
+			}
+			return "", nil, fmt.Errorf("previous secrets master key %d must be %d base64 encoded bytes", i-1, secretsKeySize)
+		}
+
+		id := masterKeyID(key)
+		if i == 0 {
+			current_id = id
+		}
+		keys[id] = key
+	}
+
+	return current_id, keys, nil
+}
+
+// masterKeyID identifies a master key without revealing it, so data keys know which key wrapped them.
+func masterKeyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+// sealSecret encrypts plaintext with AES-256-GCM, the nonce is prepended to the base64 encoded ciphertext.
+// aad binds the ciphertext to its owner so it can't be moved to another tenant or env var.
+func sealSecret(key []byte, plaintext []byte, aad string) (string, error) {
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return "", err
+	}
+
+	sealed := gcm.Seal(nonce, nonce, plaintext, []byte(aad))
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// openSecret decrypts a value sealed by sealSecret with the same key and aad.
+func openSecret(key []byte, encoded string, aad string) ([]byte, error) {
+
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("ciphertext is too short")
+	}
+
+	return gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], []byte(aad))
+}
+
+func envVarAAD(tenant_id string, name string) string {
+	return tenant_id + ":" + name
+}
+
+// newTenantSecretsKey generates a data key for the tenant wrapped by the current master key.
+func (ws *WorkflowsService) newTenantSecretsKey(tenant_id string) (key []byte, secrets_key models.TenantSecretsKey, err error) {
+
+	current_id, master_keys, err := ws.masterKeys()
+	if err != nil {
+		return nil, secrets_key, err
+	}
+
+	key = make([]byte, secretsKeySize)
+	_, err = rand.Read(key)
+	if err != nil {
+		return nil, secrets_key, err
+	}
+
+	wrapped, err := sealSecret(master_keys[current_id], key, tenant_id)
+	if err != nil {
+		return nil, secrets_key, err
+	}
+
+	secrets_key = models.TenantSecretsKey{
+		ID:          primitive.NewObjectID().Hex(),
+		WrappedKey:  wrapped,
+		MasterKeyID: current_id,
+		CreatedAt:   time.Now(),
+	}
+
+	return key, secrets_key, nil
+}
+
+// unwrapTenantSecretsKey decrypts the data key of the tenant with the master key that wrapped it.
+func (ws *WorkflowsService) unwrapTenantSecretsKey(tenant_id string, secrets_key *models.TenantSecretsKey) ([]byte, error) {
+
+	_, master_keys, err := ws.masterKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	master_key, ok := master_keys[secrets_key.MasterKeyID]
+	if !ok {
+		return nil, fmt.Errorf("master key %s wrapping the data key of tenant %s is not configured", secrets_key.MasterKeyID, tenant_id)
+	}
+
+	key, err := openSecret(master_key, secrets_key.WrappedKey, tenant_id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap the data key of tenant %s: %w", tenant_id, err)
+	}
+
+	return key, nil
+}
+
+// tenantSecretsKey returns the data key of the tenant, creating it on the first secret.
+func (ws *WorkflowsService) tenantSecretsKey(ctx context.Context, collection *mongo.Collection, tenant_id string) (key []byte, key_id string, err error) {
+
+	var tenant models.Tenant
+	err = collection.FindOne(ctx, bson.M{"tenant_id": tenant_id}, options.FindOne().SetProjection(bson.M{"tenant_id": 1, "secrets_key": 1})).Decode(&tenant)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if tenant.SecretsKey != nil {
+		key, err = ws.unwrapTenantSecretsKey(tenant_id, tenant.SecretsKey)
+		return key, tenant.SecretsKey.ID, err
+	}
+
+	key, secrets_key, err := ws.newTenantSecretsKey(tenant_id)
+	if err != nil {
+		return nil, "", err
+	}
+
+	result, err := collection.UpdateOne(
+		ctx,
+		bson.M{"tenant_id": tenant_id, "secrets_key": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"secrets_key": secrets_key}},
+	)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if result.MatchedCount == 0 {
+		// another request created the data key first, use the stored one
+		return ws.tenantSecretsKey(ctx, collection, tenant_id)
+	}
+
+	return key, secrets_key.ID, nil
+}
+
+// SetEnvVar creates or updates the env var of the tenant, an existing env var keeps its is_secret flag.
+// Secret values are stored encrypted with the tenant data key and never in plaintext.
+func (ws *WorkflowsService) SetEnvVar(tenant_id string, env_var models.WorkflowEnvVar) error {
+
+	ctx, cancel := context.WithTimeout(context.Background(), ws.dbDeadline())
+	defer cancel()
+
+	client, collection, err := ws.getTenantsCollection(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect(ctx)
+
+	for attempt := 0; attempt < envVarWriteAttempts; attempt++ {
+
+		var tenant models.Tenant
+		err = collection.FindOne(ctx, bson.M{"tenant_id": tenant_id}, options.FindOne().SetProjection(bson.M{"env_vars": 1})).Decode(&tenant)
+		if err != nil {
+			return err
+		}
+
+		exists := false
+		is_secret := env_var.IsSecret
+		for _, existing := range tenant.EnvVars {
+			if existing.Name == env_var.Name {
+				exists = true
+				is_secret = existing.IsSecret
+				break
+			}
+		}
+
+		filter := bson.M{"tenant_id": tenant_id}
+		fields := bson.M{"value": env_var.Value}
+
+		if is_secret {
+			key, key_id, err := ws.tenantSecretsKey(ctx, collection, tenant_id)
+			if err != nil {
+				return err
+			}
+
+			ciphertext, err := sealSecret(key, []byte(env_var.Value), envVarAAD(tenant_id, env_var.Name))
+			if err != nil {
+				return err
+			}
+
+			fields = bson.M{"value": "", "ciphertext": ciphertext, "key_id": key_id}
+			// a rotation replacing the data key meanwhile makes the write miss, it's sealed again with the new key
+			filter["secrets_key.id"] = key_id
+		}
+
+		var update bson.M
+		if exists {
+			filter["env_vars.name"] = env_var.Name
+
+			set := bson.M{}
+			for field, value := range fields {
+				set["env_vars.$."+field] = value
+			}
+			update = bson.M{"$set": set}
+
+			if !is_secret {
+				update["$unset"] = bson.M{"env_vars.$.ciphertext": "", "env_vars.$.key_id": ""}
+			}
+		} else {
+			filter["env_vars.name"] = bson.M{"$ne": env_var.Name}
+
+			fields["name"] = env_var.Name
+			fields["is_secret"] = is_secret
+			update = bson.M{"$push": bson.M{"env_vars": fields}}
+		}
+
+		result, err := collection.UpdateOne(ctx, filter, update)
+		if err != nil {
+			return err
+		}
+
+		if result.MatchedCount > 0 {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("env var %s was modified concurrently, please retry", env_var.Name)
+}
+
+// DecryptEnvVars returns the env vars of the tenant with the plaintext values of the secrets,
+// secrets stored before encryption was enabled are returned as they are.
+func (ws *WorkflowsService) DecryptEnvVars(tenant models.Tenant) ([]models.WorkflowEnvVar, error) {
+
+	env_vars := make([]models.WorkflowEnvVar, len(tenant.EnvVars))
+	var key []byte
+
+	for i, env_var := range tenant.EnvVars {
+		env_vars[i] = env_var
+
+		if !env_var.IsSecret || env_var.Ciphertext == "" {
+			continue
+		}
+
+		if tenant.SecretsKey == nil || tenant.SecretsKey.ID != env_var.KeyID {
+			return nil, fmt.Errorf("data key %s of the secret env var %s was not found", env_var.KeyID, env_var.Name)
+		}
+
+		if key == nil {
+			var err error
+			key, err = ws.unwrapTenantSecretsKey(tenant.TenantID, tenant.SecretsKey)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		plaintext, err := openSecret(key, env_var.Ciphertext, envVarAAD(tenant.TenantID, env_var.Name))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt the secret env var %s: %w", env_var.Name, err)
+		}
+
+		env_vars[i].Value = string(plaintext)
+		env_vars[i].Ciphertext = ""
+		env_vars[i].KeyID = ""
+	}
+
+	return env_vars, nil
+}
+
+// RotateTenantSecretsKey replaces the data key of the tenant with a new one wrapped by the current master key
+// and encrypts the secrets and signing secrets again with it, plaintext secrets stored before encryption was enabled are encrypted too.
+func (ws *WorkflowsService) RotateTenantSecretsKey(tenant_id string) (rotated bool, err error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), ws.dbDeadline())
+	defer cancel()
+
+	client, collection, err := ws.getTenantsCollection(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer client.Disconnect(ctx)
+
+	for attempt := 0; attempt < envVarWriteAttempts; attempt++ {
+
+		raw, err := collection.FindOne(ctx, bson.M{"tenant_id": tenant_id}, options.FindOne().SetProjection(bson.M{"tenant_id": 1, "env_vars": 1, "secrets_key": 1, "signing_secrets": 1})).Raw()
+		if err != nil {
+			return false, err
+		}
+
+		var tenant models.Tenant
+		err = bson.Unmarshal(raw, &tenant)
+		if err != nil {
+			return false, err
+		}
+
+		has_secrets := false
+		for _, env_var := range tenant.EnvVars {
+			if env_var.IsSecret {
+				has_secrets = true
+				break
+			}
+		}
+
+		if !has_secrets && tenant.SecretsKey == nil {
+			return false, nil
+		}
+
+		env_vars, err := ws.DecryptEnvVars(tenant)
+		if err != nil {
+			return false, err
+		}
+
+		key, secrets_key, err := ws.newTenantSecretsKey(tenant_id)
+		if err != nil {
+			return false, err
+		}
+
+		signing_secrets, err := ws.resealSigningSecrets(tenant, key, secrets_key.ID)
+		if err != nil {
+			return false, err
+		}
+
+		for i, env_var := range env_vars {
+			if !env_var.IsSecret {
+				continue
+			}
+
+			ciphertext, err := sealSecret(key, []byte(env_var.Value), envVarAAD(tenant_id, env_var.Name))
+			if err != nil {
+				return false, err
+			}
+
+			env_vars[i].Value = ""
+			env_vars[i].Ciphertext = ciphertext
+			env_vars[i].KeyID = secrets_key.ID
+		}
+
+		// only replace the env vars and the data key that were read, a concurrent write retries the rotation
+		filter := bson.M{"tenant_id": tenant_id}
+
+		stored_env_vars, err := raw.LookupErr("env_vars")
+		if err != nil {
+			filter["env_vars"] = bson.M{"$exists": false}
+		} else {
+			filter["env_vars"] = stored_env_vars
+		}
+
+		if tenant.SecretsKey == nil {
+			filter["secrets_key"] = bson.M{"$exists": false}
+		} else {
+			filter["secrets_key.id"] = tenant.SecretsKey.ID
+		}
+
+		set := bson.M{"env_vars": env_vars, "secrets_key": secrets_key}
+		if len(signing_secrets) > 0 {
+			filter["signing_secrets"] = raw.Lookup("signing_secrets")
+			set["signing_secrets"] = signing_secrets
+		}
+
+		result, err := collection.UpdateOne(ctx, filter, bson.M{"$set": set})
+		if err != nil {
+			return false, err
+		}
+
+		if result.MatchedCount > 0 {
+			return true, nil
+		}
+	}
+
+	return false, fmt.Errorf("env vars of tenant %s were modified concurrently during the key rotation, please retry", tenant_id)
+}
+
+// RotateSecretsKeys rotates the data key of the tenant, or of every tenant having secrets when tenant_id is empty.
+// It's meant to run after the master key is replaced, while the old one is still in the previous master keys.
+func (ws *WorkflowsService) RotateSecretsKeys(tenant_id string) (rotated int, err error) {
+
+	tenant_ids := []string{tenant_id}
+	if tenant_id == "" {
+		tenant_ids, err = ws.tenantsWithSecrets(bson.M{
+			"$or": []bson.M{
+				{"env_vars.is_secret": true},
+				{"secrets_key": bson.M{"$exists": true}},
+			},
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	for _, id := range tenant_ids {
+		ok, err := ws.RotateTenantSecretsKey(id)
+		if err != nil {
+			return rotated, fmt.Errorf("failed to rotate the data key of tenant %s: %w", id, err)
+		}
+
+		if ok {
+			rotated++
+		}
+	}
+
+	return rotated, nil
+}
+
+// EncryptPlaintextSecrets encrypts the secret env vars stored in plaintext before encryption was enabled.
+func (ws *WorkflowsService) EncryptPlaintextSecrets() (encrypted int, err error) {
+
+	tenant_ids, err := ws.tenantsWithSecrets(bson.M{
+		"env_vars": bson.M{"$elemMatch": bson.M{"is_secret": true, "ciphertext": bson.M{"$exists": false}}},
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if len(tenant_ids) == 0 {
+		return 0, nil
+	}
+
+	_, _, err = ws.masterKeys()
+	if err != nil {
+		return 0, err
+	}
+
+	for _, tenant_id := range tenant_ids {
+		_, err = ws.RotateTenantSecretsKey(tenant_id)
+		if err != nil {
+			return encrypted, fmt.Errorf("failed to encrypt the secrets of tenant %s: %w", tenant_id, err)
+		}
+		encrypted++
+	}
+
+	return encrypted, nil
+}
+
+func (ws *WorkflowsService) tenantsWithSecrets(filter bson.M) (tenant_ids []string, err error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), ws.dbDeadline())
+	defer cancel()
+
+	client, collection, err := ws.getTenantsCollection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Disconnect(ctx)
+
+	values, err := collection.Distinct(ctx, "tenant_id", filter)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, value := range values {
+		if id, ok := value.(string); ok && id != "" {
+			tenant_ids = append(tenant_ids, id)
+		}
+	}
+
+	return tenant_ids, nil
+}
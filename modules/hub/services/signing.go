@@ -0,0 +1,417 @@
+package services
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nutrixpos/hub/modules/hub/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Outbound workflow requests are signed so receivers can tell they come from the hub.
+//
+// Every request carries two headers:
+//
+//	X-Nutrix-Timestamp: 1767225600
+//	X-Nutrix-Signature: v1=5257a869e7ecebeda32affa62cdca3fa51cad7e77a0e56ff536d0ce8e108d8bd
+//
+// The signature is the hex encoded HMAC-SHA256 of the timestamp, a dot and the raw request body
+// (e.g. "1767225600.{"items":[]}"), keyed by the tenant signing secret as it is shown (whsec_...).
+// To verify a request, receivers:
+//
+//  1. Reject it when the timestamp is more than 5 minutes away from their clock, so it can't be replayed later.
+//  2. Compute the HMAC over the timestamp header, a dot and the body exactly as received, before parsing it.
+//  3. Accept it when any v1 entry of the signature header equals it, using a constant time comparison.
+//
+// After a rotation, requests carry a v1 entry per signing secret still valid (comma separated) so receivers
+// can move to the new secret during the grace period. VerifyWorkflowSignature implements these steps.
+const (
+	WorkflowSignatureHeader = "X-Nutrix-Signature"
+	WorkflowTimestampHeader = "X-Nutrix-Timestamp"
+
+	// WorkflowSignatureTolerance is how far the timestamp of a signed request may be from the receiver clock.
+	WorkflowSignatureTolerance = 5 * time.Minute
+
+	// DefaultSigningSecretGracePeriod is how long a rotated out signing secret keeps signing.
+	DefaultSigningSecretGracePeriod = 24 * time.Hour
+
+	workflowSignatureVersion = "v1"
+	signingSecretPrefix      = "whsec_"
+	signingSecretSize        = 32
+)
+
+// ErrWorkflowSignatureInvalid is returned by VerifyWorkflowSignature when no signature of the request matches.
+var ErrWorkflowSignatureInvalid = errors.New("workflow request signature is invalid")
+
+func signingSecretAAD(tenant_id string, id string) string {
+	return tenant_id + ":signing_secret:" + id
+}
+
+// ComputeWorkflowSignature returns the hex encoded HMAC-SHA256 of the timestamp and body keyed by the secret.
+func ComputeWorkflowSignature(secret string, timestamp string, body []byte) string {
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyWorkflowSignature checks the signature and timestamp headers of a request signed by the hub
+// against the body as received, it is the reference of the verification receivers implement.
+func VerifyWorkflowSignature(secret string, signature_header string, timestamp_header string, body []byte, now time.Time) error {
+
+	timestamp, err := strconv.ParseInt(strings.TrimSpace(timestamp_header), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid %s header", WorkflowTimestampHeader)
+	}
+
+	age := now.Sub(time.Unix(timestamp, 0))
+	if age > WorkflowSignatureTolerance || age < -WorkflowSignatureTolerance {
+		return fmt.Errorf("%s is outside of the %v tolerance", WorkflowTimestampHeader, WorkflowSignatureTolerance)
+	}
+
+	expected := ComputeWorkflowSignature(secret, strings.TrimSpace(timestamp_header), body)
+
+	for _, entry := range strings.Split(signature_header, ",") {
+		version, signature, found := strings.Cut(strings.TrimSpace(entry), "=")
+		if found && version == workflowSignatureVersion && hmac.Equal([]byte(signature), []byte(expected)) {
+			return nil
+		}
+	}
+
+	return ErrWorkflowSignatureInvalid
+}
+
+// signWorkflowRequest sets the signature headers of the request with a v1 entry per secret.
+func signWorkflowRequest(http_req *http.Request, body []byte, secrets []string, now time.Time) {
+
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+
+	signatures := make([]string, 0, len(secrets))
+	for _, secret := range secrets {
+		signatures = append(signatures, workflowSignatureVersion+"="+ComputeWorkflowSignature(secret, timestamp, body))
+	}
+
+	http_req.Header.Set(WorkflowTimestampHeader, timestamp)
+	http_req.Header.Set(WorkflowSignatureHeader, strings.Join(signatures, ","))
+}
+
+// unsignedRequestsWarning is logged once on the runs whose requests are sent unsigned.
+const unsignedRequestsWarning = "Outbound requests are sent unsigned, configure the secrets master key to sign them"
+
+// signOutboundRequest signs the request with the signing secrets of the tenant, creating its first one if needed.
+// The request is left unsigned when the secrets master key isn't configured, as signing secrets are stored encrypted.
+// A dry run only describes the signature headers so it doesn't create the signing secret.
+func (ws *WorkflowsService) signOutboundRequest(tenant models.Tenant, http_req *http.Request, body []byte, dry_run bool) error {
+
+	if strings.TrimSpace(ws.Config.Secrets.MasterKey) == "" {
+		return nil
+	}
+
+	if dry_run {
+		http_req.Header.Set(WorkflowTimestampHeader, strconv.FormatInt(time.Now().Unix(), 10))
+		http_req.Header.Set(WorkflowSignatureHeader, workflowSignatureVersion+"=<computed when sent>")
+		return nil
+	}
+
+	secrets, err := ws.activeSigningSecrets(tenant, time.Now())
+	if err != nil {
+		return err
+	}
+
+	if len(secrets) == 0 {
+		_, err = ws.rotateSigningSecret(tenant.TenantID, 0, true)
+		if err != nil {
+			return fmt.Errorf("failed to create the signing secret: %w", err)
+		}
+
+		tenant_svc := TenantService{
+			Config: ws.Config,
+			Logger: ws.Logger,
+		}
+
+		tenant, err = tenant_svc.GetTenantById(tenant.TenantID)
+		if err != nil {
+			return err
+		}
+
+		secrets, err = ws.activeSigningSecrets(tenant, time.Now())
+		if err != nil {
+			return err
+		}
+	}
+
+	signWorkflowRequest(http_req, body, secrets, time.Now())
+
+	return nil
+}
+
+// activeSigningSecrets decrypts the signing secrets of the tenant that didn't expire, the current one first.
+func (ws *WorkflowsService) activeSigningSecrets(tenant models.Tenant, now time.Time) (secrets []string, err error) {
+
+	var key []byte
+
+	for _, signing_secret := range tenant.SigningSecrets {
+
+		if signing_secret.ExpiresAt != nil && !signing_secret.ExpiresAt.After(now) {
+			continue
+		}
+
+		if tenant.SecretsKey == nil || tenant.SecretsKey.ID != signing_secret.KeyID {
+			return nil, fmt.Errorf("data key %s of the signing secret %s was not found", signing_secret.KeyID, signing_secret.ID)
+		}
+
+		if key == nil {
+			key, err = ws.unwrapTenantSecretsKey(tenant.TenantID, tenant.SecretsKey)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		plaintext, err := openSecret(key, signing_secret.Ciphertext, signingSecretAAD(tenant.TenantID, signing_secret.ID))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt the signing secret %s: %w", signing_secret.ID, err)
+		}
+
+		secrets = append(secrets, string(plaintext))
+	}
+
+	return secrets, nil
+}
+
+// GetSigningSecrets returns the signing secrets of the tenant still valid, only the current one with its value.
+func (ws *WorkflowsService) GetSigningSecrets(tenant_id string) (secrets []models.WorkflowSigningSecret, err error) {
+
+	tenant_svc := TenantService{
+		Config: ws.Config,
+		Logger: ws.Logger,
+	}
+
+	tenant, err := tenant_svc.GetTenantById(tenant_id)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(tenant.SigningSecrets) == 0 {
+		return ws.rotateSigningSecret(tenant_id, 0, true)
+	}
+
+	return ws.describeSigningSecrets(tenant, time.Now())
+}
+
+// describeSigningSecrets lists the signing secrets of the tenant still valid, the value of the current one is decrypted.
+func (ws *WorkflowsService) describeSigningSecrets(tenant models.Tenant, now time.Time) (secrets []models.WorkflowSigningSecret, err error) {
+
+	secrets = make([]models.WorkflowSigningSecret, 0, len(tenant.SigningSecrets))
+
+	for i, signing_secret := range tenant.SigningSecrets {
+
+		if signing_secret.ExpiresAt != nil && !signing_secret.ExpiresAt.After(now) {
+			continue
+		}
+
+		secret := models.WorkflowSigningSecret{
+			ID:        signing_secret.ID,
+			Current:   i == 0,
+			CreatedAt: signing_secret.CreatedAt,
+			ExpiresAt: signing_secret.ExpiresAt,
+		}
+
+		if secret.Current {
+			values, err := ws.activeSigningSecrets(models.Tenant{
+				TenantID:       tenant.TenantID,
+				SecretsKey:     tenant.SecretsKey,
+				SigningSecrets: tenant.SigningSecrets[:1],
+			}, now)
+			if err != nil {
+				return nil, err
+			}
+			secret.Secret = values[0]
+		}
+
+		secrets = append(secrets, secret)
+	}
+
+	return secrets, nil
+}
+
+// RotateSigningSecret makes a new signing secret the current one of the tenant, the previous ones keep
+// signing during the grace period so receivers can switch, a zero grace period drops them right away.
+// It returns the signing secrets still valid.
+func (ws *WorkflowsService) RotateSigningSecret(tenant_id string, grace_period time.Duration) (secrets []models.WorkflowSigningSecret, err error) {
+	return ws.rotateSigningSecret(tenant_id, grace_period, false)
+}
+
+// rotateSigningSecret rotates the signing secret of the tenant, if_missing only creates the first one
+// so concurrent first requests agree on it.
+func (ws *WorkflowsService) rotateSigningSecret(tenant_id string, grace_period time.Duration, if_missing bool) (secrets []models.WorkflowSigningSecret, err error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), ws.dbDeadline())
+	defer cancel()
+
+	client, collection, err := ws.getTenantsCollection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Disconnect(ctx)
+
+	for attempt := 0; attempt < envVarWriteAttempts; attempt++ {
+
+		key, key_id, err := ws.tenantSecretsKey(ctx, collection, tenant_id)
+		if err != nil {
+			return nil, err
+		}
+
+		raw, err := collection.FindOne(ctx, bson.M{"tenant_id": tenant_id}, options.FindOne().SetProjection(bson.M{"tenant_id": 1, "secrets_key": 1, "signing_secrets": 1})).Raw()
+		if err != nil {
+			return nil, err
+		}
+
+		var tenant models.Tenant
+		err = bson.Unmarshal(raw, &tenant)
+		if err != nil {
+			return nil, err
+		}
+
+		now := time.Now()
+
+		if if_missing && len(tenant.SigningSecrets) > 0 {
+			return ws.describeSigningSecrets(tenant, now)
+		}
+
+		random := make([]byte, signingSecretSize)
+		_, err = rand.Read(random)
+		if err != nil {
+			return nil, err
+		}
+
+		id := primitive.NewObjectID().Hex()
+		value := signingSecretPrefix + base64.RawURLEncoding.EncodeToString(random)
+
+		ciphertext, err := sealSecret(key, []byte(value), signingSecretAAD(tenant_id, id))
+		if err != nil {
+			return nil, err
+		}
+
+		signing_secrets := []models.TenantSigningSecret{{
+			ID:         id,
+			Ciphertext: ciphertext,
+			KeyID:      key_id,
+			CreatedAt:  now,
+		}}
+
+		if grace_period > 0 {
+			expires_at := now.Add(grace_period)
+			for _, previous := range tenant.SigningSecrets {
+				if previous.ExpiresAt != nil && !previous.ExpiresAt.After(now) {
+					continue
+				}
+				if previous.ExpiresAt == nil || previous.ExpiresAt.After(expires_at) {
+					previous.ExpiresAt = &expires_at
+				}
+				signing_secrets = append(signing_secrets, previous)
+			}
+		}
+
+		// only replace the signing secrets that were read, with the data key they are sealed with
+		filter := bson.M{"tenant_id": tenant_id, "secrets_key.id": key_id}
+
+		stored_signing_secrets, err := raw.LookupErr("signing_secrets")
+		if err != nil {
+			filter["signing_secrets"] = bson.M{"$exists": false}
+		} else {
+			filter["signing_secrets"] = stored_signing_secrets
+		}
+
+		result, err := collection.UpdateOne(ctx, filter, bson.M{"$set": bson.M{"signing_secrets": signing_secrets}})
+		if err != nil {
+			return nil, err
+		}
+
+		if result.MatchedCount > 0 {
+			tenant.SigningSecrets = signing_secrets
+			return ws.describeSigningSecrets(tenant, now)
+		}
+	}
+
+	return nil, fmt.Errorf("signing secrets of tenant %s were modified concurrently, please retry", tenant_id)
+}
+
+// resealSigningSecrets decrypts the signing secrets of the tenant with its current data key and
+// seals them with the new one, the data key rotation replaces both at once.
+func (ws *WorkflowsService) resealSigningSecrets(tenant models.Tenant, key []byte, key_id string) (signing_secrets []models.TenantSigningSecret, err error) {
+
+	if len(tenant.SigningSecrets) == 0 {
+		return nil, nil
+	}
+
+	if tenant.SecretsKey == nil {
+		return nil, fmt.Errorf("data key of the signing secrets of tenant %s was not found", tenant.TenantID)
+	}
+
+	old_key, err := ws.unwrapTenantSecretsKey(tenant.TenantID, tenant.SecretsKey)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+
+	for _, signing_secret := range tenant.SigningSecrets {
+
+		// the expired ones are dropped on the way
+		if signing_secret.ExpiresAt != nil && !signing_secret.ExpiresAt.After(now) {
+			continue
+		}
+
+		if signing_secret.KeyID != tenant.SecretsKey.ID {
+			return nil, fmt.Errorf("data key %s of the signing secret %s was not found", signing_secret.KeyID, signing_secret.ID)
+		}
+
+		aad := signingSecretAAD(tenant.TenantID, signing_secret.ID)
+
+		plaintext, err := openSecret(old_key, signing_secret.Ciphertext, aad)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt the signing secret %s: %w", signing_secret.ID, err)
+		}
+
+		signing_secret.Ciphertext, err = sealSecret(key, plaintext, aad)
+		if err != nil {
+			return nil, err
+		}
+		signing_secret.KeyID = key_id
+
+		signing_secrets = append(signing_secrets, signing_secret)
+	}
+
+	return signing_secrets, nil
+}
+
+// warnUnsignedRequest logs on the run that its requests are sent unsigned, once per run.
+func (ws *WorkflowsService) warnUnsignedRequest(tenant_id string, workflow_id string, run_id string) {
+
+	err := ws.updateWorkflowRunWhere(tenant_id, workflow_id, run_id, bson.M{"logs.message": bson.M{"$ne": unsignedRequestsWarning}}, bson.M{
+		"$push": bson.M{"logs": models.WorkflowRunLog{
+			Level:     "WARNING",
+			Message:   unsignedRequestsWarning,
+			TimeStamp: time.Now(),
+		}},
+	})
+	if err != nil && err != mongo.ErrNoDocuments {
+		ws.Logger.Error(fmt.Sprintf("failed to log the unsigned requests of run %s: %v", run_id, err))
+	}
+}
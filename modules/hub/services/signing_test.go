@@ -0,0 +1,252 @@
+package services
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testSigningSecret    = "whsec_3q2-7wAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA"
+	testSigningTimestamp = "1767225600"
+	testSigningBody      = `{"order_id":"A1","items":[]}`
+
+	// computed independently, printf '1767225600.{"order_id":"A1","items":[]}' | openssl dgst -sha256 -hmac <secret>
+	testSigningSignature      = "a7c5d6a7bda471cbdcc3176d271488ea192a2a46d3685f7d72f7c62153a7611a"
+	testSigningEmptySignature = "df437e22bf7557251ba4d8ef769b5f4c6dd1fba5955c3fdb882319296b424f47"
+)
+
+func TestComputeWorkflowSignature(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		body     string
+		expected string
+	}{
+		{"body", testSigningBody, testSigningSignature},
+		{"empty body", "", testSigningEmptySignature},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			signature := ComputeWorkflowSignature(testSigningSecret, testSigningTimestamp, []byte(test.body))
+			if signature != test.expected {
+				t.Errorf("expected %s, got %s", test.expected, signature)
+			}
+		})
+	}
+}
+
+func TestVerifyWorkflowSignature(t *testing.T) {
+
+	signed_at := time.Unix(1767225600, 0)
+
+	tests := []struct {
+		name      string
+		secret    string
+		signature string
+		timestamp string
+		body      string
+		now       time.Time
+		err       error
+		err_text  string
+	}{
+		{
+			name:      "known vector",
+			secret:    testSigningSecret,
+			signature: "v1=" + testSigningSignature,
+			timestamp: testSigningTimestamp,
+			body:      testSigningBody,
+			now:       signed_at,
+		},
+		{
+			name:      "empty body",
+			secret:    testSigningSecret,
+			signature: "v1=" + testSigningEmptySignature,
+			timestamp: testSigningTimestamp,
+			body:      "",
+			now:       signed_at,
+		},
+		{
+			name:      "spaces around the headers",
+			secret:    testSigningSecret,
+			signature: " v1=" + testSigningSignature + " ",
+			timestamp: " " + testSigningTimestamp + " ",
+			body:      testSigningBody,
+			now:       signed_at,
+		},
+		{
+			name:      "tampered body",
+			secret:    testSigningSecret,
+			signature: "v1=" + testSigningSignature,
+			timestamp: testSigningTimestamp,
+			body:      `{"order_id":"A2","items":[]}`,
+			now:       signed_at,
+			err:       ErrWorkflowSignatureInvalid,
+		},
+		{
+			name:      "body reencoded",
+			secret:    testSigningSecret,
+			signature: "v1=" + testSigningSignature,
+			timestamp: testSigningTimestamp,
+			body:      `{"items":[],"order_id":"A1"}`,
+			now:       signed_at,
+			err:       ErrWorkflowSignatureInvalid,
+		},
+		{
+			name:      "wrong secret",
+			secret:    "whsec_other",
+			signature: "v1=" + testSigningSignature,
+			timestamp: testSigningTimestamp,
+			body:      testSigningBody,
+			now:       signed_at,
+			err:       ErrWorkflowSignatureInvalid,
+		},
+		{
+			name:      "timestamp swapped",
+			secret:    testSigningSecret,
+			signature: "v1=" + testSigningSignature,
+			timestamp: "1767225601",
+			body:      testSigningBody,
+			now:       signed_at,
+			err:       ErrWorkflowSignatureInvalid,
+		},
+		{
+			name:      "unknown version",
+			secret:    testSigningSecret,
+			signature: "v0=" + testSigningSignature,
+			timestamp: testSigningTimestamp,
+			body:      testSigningBody,
+			now:       signed_at,
+			err:       ErrWorkflowSignatureInvalid,
+		},
+		{
+			name:      "uppercase hex",
+			secret:    testSigningSecret,
+			signature: "v1=" + strings.ToUpper(testSigningSignature),
+			timestamp: testSigningTimestamp,
+			body:      testSigningBody,
+			now:       signed_at,
+			err:       ErrWorkflowSignatureInvalid,
+		},
+		{
+			name:      "missing signature",
+			secret:    testSigningSecret,
+			signature: "",
+			timestamp: testSigningTimestamp,
+			body:      testSigningBody,
+			now:       signed_at,
+			err:       ErrWorkflowSignatureInvalid,
+		},
+		{
+			name:      "received at the end of the tolerance",
+			secret:    testSigningSecret,
+			signature: "v1=" + testSigningSignature,
+			timestamp: testSigningTimestamp,
+			body:      testSigningBody,
+			now:       signed_at.Add(WorkflowSignatureTolerance),
+		},
+		{
+			name:      "receiver clock behind within the tolerance",
+			secret:    testSigningSecret,
+			signature: "v1=" + testSigningSignature,
+			timestamp: testSigningTimestamp,
+			body:      testSigningBody,
+			now:       signed_at.Add(-WorkflowSignatureTolerance),
+		},
+		{
+			name:      "replayed after the tolerance",
+			secret:    testSigningSecret,
+			signature: "v1=" + testSigningSignature,
+			timestamp: testSigningTimestamp,
+			body:      testSigningBody,
+			now:       signed_at.Add(WorkflowSignatureTolerance + time.Second),
+			err_text:  "outside of the 5m0s tolerance",
+		},
+		{
+			name:      "timestamp in the future",
+			secret:    testSigningSecret,
+			signature: "v1=" + testSigningSignature,
+			timestamp: testSigningTimestamp,
+			body:      testSigningBody,
+			now:       signed_at.Add(-WorkflowSignatureTolerance - time.Second),
+			err_text:  "outside of the 5m0s tolerance",
+		},
+		{
+			name:      "invalid timestamp",
+			secret:    testSigningSecret,
+			signature: "v1=" + testSigningSignature,
+			timestamp: "2026-01-01T00:00:00Z",
+			body:      testSigningBody,
+			now:       signed_at,
+			err_text:  "invalid X-Nutrix-Timestamp header",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := VerifyWorkflowSignature(test.secret, test.signature, test.timestamp, []byte(test.body), test.now)
+
+			switch {
+			case test.err != nil:
+				if !errors.Is(err, test.err) {
+					t.Errorf("expected %v, got %v", test.err, err)
+				}
+			case test.err_text != "":
+				if err == nil || !strings.Contains(err.Error(), test.err_text) {
+					t.Errorf("expected an error containing %q, got %v", test.err_text, err)
+				}
+			case err != nil:
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestVerifyWorkflowSignatureRotation(t *testing.T) {
+
+	old_secret := testSigningSecret
+	new_secret := "whsec_rotated-BBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBB"
+	now := time.Unix(1767225600, 0)
+	body := []byte(testSigningBody)
+
+	tests := []struct {
+		name    string
+		signed  []string
+		secret  string
+		invalid bool
+	}{
+		{"before the rotation", []string{old_secret}, old_secret, false},
+		{"overlap verified with the new secret", []string{new_secret, old_secret}, new_secret, false},
+		{"overlap verified with the old secret", []string{new_secret, old_secret}, old_secret, false},
+		{"after the grace period with the new secret", []string{new_secret}, new_secret, false},
+		{"after the grace period with the old secret", []string{new_secret}, old_secret, true},
+		{"before the rotation with the new secret", []string{old_secret}, new_secret, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			http_req, err := http.NewRequest(http.MethodPost, "https://example.com/hooks", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			signWorkflowRequest(http_req, body, test.signed, now)
+
+			signature_header := http_req.Header.Get(WorkflowSignatureHeader)
+			if entries := strings.Split(signature_header, ","); len(entries) != len(test.signed) {
+				t.Errorf("expected %d signatures, got %q", len(test.signed), signature_header)
+			}
+
+			err = VerifyWorkflowSignature(test.secret, signature_header, http_req.Header.Get(WorkflowTimestampHeader), body, now)
+			if test.invalid && !errors.Is(err, ErrWorkflowSignatureInvalid) {
+				t.Errorf("expected %v, got %v", ErrWorkflowSignatureInvalid, err)
+			}
+			if !test.invalid && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
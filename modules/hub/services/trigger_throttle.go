@@ -0,0 +1,354 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/nutrixpos/hub/modules/hub/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// maxSuppressedEvents bounds the suppressed events kept per dedup key until the next run logs them.
+	maxSuppressedEvents = 20
+
+	// triggerThrottleRetention is how long cooldowns and sent digests are kept after they stop mattering.
+	triggerThrottleRetention = 24 * time.Hour
+)
+
+// getTriggerCooldownsCollection returns the collection of the trigger cooldowns.
+// The caller is responsible for disconnecting the returned client.
+func (ws *WorkflowsService) getTriggerCooldownsCollection(ctx context.Context) (client *mongo.Client, collection *mongo.Collection, err error) {
+	return ws.getCollection(ctx, "workflow_trigger_cooldowns")
+}
+
+// getTriggerDigestsCollection returns the collection of the trigger digests.
+// The caller is responsible for disconnecting the returned client.
+func (ws *WorkflowsService) getTriggerDigestsCollection(ctx context.Context) (client *mongo.Client, collection *mongo.Collection, err error) {
+	return ws.getCollection(ctx, "workflow_trigger_digests")
+}
+
+// EnsureWorkflowTriggerThrottleIndexes creates the indexes claiming the cooldowns and expiring the throttle state.
+func (ws *WorkflowsService) EnsureWorkflowTriggerThrottleIndexes() (err error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), ws.dbDeadline())
+	defer cancel()
+
+	client, cooldowns, err := ws.getTriggerCooldownsCollection(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect(ctx)
+
+	_, err = cooldowns.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "tenant_id", Value: 1}, {Key: "workflow_id", Value: 1}, {Key: "key", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys:    bson.D{{Key: "expires_at", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	digests := cooldowns.Database().Collection(ws.collectionName("workflow_trigger_digests"))
+
+	_, err = digests.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys: bson.D{{Key: "status", Value: 1}, {Key: "due_at", Value: 1}},
+		},
+		{
+			Keys:    bson.D{{Key: "expires_at", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	})
+
+	return err
+}
+
+// claimTriggerCooldown claims the dedup key of the workflow trigger unless it fired less than cooldown ago,
+// the unique index makes concurrent claims of a fresh key fail all but one.
+func (ws *WorkflowsService) claimTriggerCooldown(tenant_id string, workflow_id string, key string, cooldown time.Duration, now time.Time) (claimed bool, err error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), ws.dbDeadline())
+	defer cancel()
+
+	client, collection, err := ws.getTriggerCooldownsCollection(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer client.Disconnect(ctx)
+
+	_, err = collection.UpdateOne(ctx, bson.M{
+		"tenant_id":   tenant_id,
+		"workflow_id": workflow_id,
+		"key":         key,
+		"fired_at":    bson.M{"$lte": now.Add(-cooldown)},
+	}, bson.M{
+		"$set": bson.M{
+			"fired_at":   now,
+			"expires_at": now.Add(cooldown + triggerThrottleRetention),
+		},
+	}, options.Update().SetUpsert(true))
+
+	if mongo.IsDuplicateKeyError(err) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// suppressTriggerEvent records an event suppressed by the cooldown of its dedup key, the next run of the workflow logs it.
+func (ws *WorkflowsService) suppressTriggerEvent(tenant_id string, workflow_id string, event models.WorkflowSuppressedEvent) (err error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), ws.dbDeadline())
+	defer cancel()
+
+	client, collection, err := ws.getTriggerCooldownsCollection(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect(ctx)
+
+	_, err = collection.UpdateOne(ctx, bson.M{
+		"tenant_id":   tenant_id,
+		"workflow_id": workflow_id,
+		"key":         event.Key,
+	}, bson.M{
+		"$push": bson.M{
+			"suppressed": bson.M{"$each": []models.WorkflowSuppressedEvent{event}, "$slice": -maxSuppressedEvents},
+		},
+	})
+
+	return err
+}
+
+// takeSuppressedEventsLogs removes the events of the workflow suppressed since its last run and returns them as run logs.
+func (ws *WorkflowsService) takeSuppressedEventsLogs(tenant_id string, workflow_id string) (logs []models.WorkflowRunLog, err error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), ws.dbDeadline())
+	defer cancel()
+
+	client, collection, err := ws.getTriggerCooldownsCollection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Disconnect(ctx)
+
+	cursor, err := collection.Find(ctx, bson.M{
+		"tenant_id":    tenant_id,
+		"workflow_id":  workflow_id,
+		"suppressed.0": bson.M{"$exists": true},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var cooldowns []models.WorkflowTriggerCooldown
+	err = cursor.All(ctx, &cooldowns)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, cooldown := range cooldowns {
+
+		var last time.Time
+		for _, event := range cooldown.Suppressed {
+			logs = append(logs, models.WorkflowRunLog{
+				Level:     "INFO",
+				Message:   fmt.Sprintf("Suppressed %s, its dedup key %s was in cooldown", event.Description, event.Key),
+				TimeStamp: event.At,
+			})
+
+			if event.At.After(last) {
+				last = event.At
+			}
+		}
+
+		// events suppressed meanwhile are left for the next run
+		_, err = collection.UpdateOne(ctx, bson.M{
+			"tenant_id":   tenant_id,
+			"workflow_id": workflow_id,
+			"key":         cooldown.Key,
+		}, bson.M{
+			"$pull": bson.M{"suppressed": bson.M{"at": bson.M{"$lte": last}}},
+		})
+		if err != nil {
+			return logs, err
+		}
+	}
+
+	return logs, nil
+}
+
+// addToTriggerDigest adds the entries to the digest of the workflow for the window now falls in,
+// an entry replaces the one with the same dedup key. Entries arriving after the window was sent go to the next one.
+func (ws *WorkflowsService) addToTriggerDigest(tenant_id string, workflow_id string, window time.Duration, entries []models.WorkflowTriggerDigestEntry, now time.Time) (err error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), ws.dbDeadline())
+	defer cancel()
+
+	client, collection, err := ws.getTriggerDigestsCollection(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect(ctx)
+
+	window_start := now.Truncate(window)
+
+	for _, entry := range entries {
+		for {
+			id := fmt.Sprintf("%s:%s:%d", tenant_id, workflow_id, window_start.Unix())
+
+			result, err := collection.UpdateOne(ctx, bson.M{
+				"_id":         id,
+				"status":      models.WorkflowTriggerDigestStatusPending,
+				"entries.key": entry.Key,
+			}, bson.M{
+				"$set": bson.M{"entries.$": entry},
+				"$inc": bson.M{"events": 1},
+			})
+			if err != nil {
+				return err
+			}
+
+			if result.MatchedCount > 0 {
+				break
+			}
+
+			_, err = collection.UpdateOne(ctx, bson.M{
+				"_id":    id,
+				"status": models.WorkflowTriggerDigestStatusPending,
+			}, bson.M{
+				"$push": bson.M{"entries": entry},
+				"$inc":  bson.M{"events": 1},
+				"$setOnInsert": bson.M{
+					"tenant_id":    tenant_id,
+					"workflow_id":  workflow_id,
+					"window_start": window_start,
+					"due_at":       window_start.Add(window),
+				},
+			}, options.Update().SetUpsert(true))
+
+			if mongo.IsDuplicateKeyError(err) {
+				window_start = window_start.Add(window)
+				continue
+			}
+			if err != nil {
+				return err
+			}
+
+			break
+		}
+	}
+
+	return nil
+}
+
+// RunDueTriggerDigests runs the workflows whose digest window ended, each digest is claimed
+// before running so it is sent once across hub instances.
+func (ws *WorkflowsService) RunDueTriggerDigests(now time.Time) (err error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), ws.dbDeadline())
+	defer cancel()
+
+	client, collection, err := ws.getTriggerDigestsCollection(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect(ctx)
+
+	for {
+		var digest models.WorkflowTriggerDigest
+		err = collection.FindOneAndUpdate(ctx, bson.M{
+			"status": models.WorkflowTriggerDigestStatusPending,
+			"due_at": bson.M{"$lte": now},
+		}, bson.M{
+			"$set": bson.M{
+				"status":     models.WorkflowTriggerDigestStatusSent,
+				"expires_at": now.Add(triggerThrottleRetention),
+			},
+		}, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&digest)
+
+		if err == mongo.ErrNoDocuments {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		err = ws.runTriggerDigest(digest)
+		if err != nil {
+			ws.Logger.Error(fmt.Sprintf("failed to run the digest %s: %v", digest.ID, err))
+		}
+	}
+}
+
+// runTriggerDigest queues a run of the workflow of the digest with the collected items.
+func (ws *WorkflowsService) runTriggerDigest(digest models.WorkflowTriggerDigest) (err error) {
+
+	tenant_svc := TenantService{
+		Config: ws.Config,
+		Logger: ws.Logger,
+	}
+
+	tenant, err := tenant_svc.GetTenantById(digest.TenantID)
+	if err != nil {
+		return err
+	}
+
+	for _, raw_workflow := range tenant.Workflows {
+
+		workflow, actions, err := DecodeWorkflow(raw_workflow)
+		if err != nil || workflow.ID != digest.WorkflowID {
+			continue
+		}
+
+		// the digest of a workflow disabled since its window opened is dropped
+		if !workflow.Enabled {
+			return nil
+		}
+
+		// concurrent events may have pushed the same key twice, the latest wins
+		positions := make(map[string]int)
+		items := make([]models.WorkflowLowStockTriggerOutputItem, 0, len(digest.Entries))
+		for _, entry := range digest.Entries {
+			if position, ok := positions[entry.Key]; ok {
+				items[position] = entry.Item
+				continue
+			}
+			positions[entry.Key] = len(items)
+			items = append(items, entry.Item)
+		}
+
+		logs, err := ws.takeSuppressedEventsLogs(digest.TenantID, digest.WorkflowID)
+		if err != nil {
+			ws.Logger.Error(err.Error())
+		}
+
+		logs = append(logs, models.WorkflowRunLog{
+			Level:     "INFO",
+			Message:   fmt.Sprintf("Collected %d events into a digest of %d items between %s and %s", digest.Events, len(items), digest.WindowStart.Format(time.RFC3339), digest.DueAt.Format(time.RFC3339)),
+			TimeStamp: time.Now(),
+		})
+
+		output := models.WorkflowLowStockTriggerOutput{
+			Items: items,
+			Digest: &models.WorkflowTriggerDigestWindow{
+				From:   digest.WindowStart,
+				To:     digest.DueAt,
+				Events: digest.Events,
+			},
+		}
+
+		return ws.QueueWorkflow(digest.TenantID, workflow, actions, output, logs...)
+	}
+
+	return fmt.Errorf("workflow %s of the digest no longer exists", digest.WorkflowID)
+}
@@ -0,0 +1,784 @@
+package services
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mitchellh/mapstructure"
+	"github.com/nutrixpos/hub/common"
+	"github.com/nutrixpos/hub/common/config"
+	"github.com/nutrixpos/hub/common/workflows"
+	"github.com/nutrixpos/hub/modules/hub/events"
+	"github.com/nutrixpos/hub/modules/hub/models"
+	core_models "github.com/nutrixpos/pos/modules/core/models"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// rawWorkflowTrigger returns the raw document of the trigger of a workflow as stored in the tenant document,
+// it is nil when the workflow has no trigger.
+func rawWorkflowTrigger(raw_workflow interface{}) (bson.Raw, error) {
+
+	b, err := bson.Marshal(raw_workflow)
+	if err != nil {
+		return nil, err
+	}
+
+	raw_trigger := struct {
+		Trigger bson.Raw `bson:"trigger"`
+	}{}
+
+	err = bson.Unmarshal(b, &raw_trigger)
+	return raw_trigger.Trigger, err
+}
+
+// decodeTrigger decodes the raw document of a stored trigger into its concrete type.
+func decodeTrigger(raw_trigger bson.Raw, trigger interface{}) error {
+
+	if raw_trigger == nil {
+		return nil
+	}
+
+	return bson.Unmarshal(raw_trigger, trigger)
+}
+
+// matchesLabels reports whether label is one of the trigger labels, an empty list matches every label.
+func matchesLabels(labels []string, label string) bool {
+
+	if len(labels) == 0 {
+		return true
+	}
+
+	for _, l := range labels {
+		if l == label {
+			return true
+		}
+	}
+
+	return false
+}
+
+// RunEventTriggeredWorkflows runs the workflows of the event tenant whose trigger listens to the event and matches it.
+func (ws *WorkflowsService) RunEventTriggeredWorkflows(event_id string, event interface{}) (err error) {
+
+	handlers := workflows.Types.EventTriggers(event_id)
+	if len(handlers) == 0 {
+		return nil
+	}
+
+	var tenant_id string
+	for _, handler := range handlers {
+		tenant_id, err = handler.EventTenantID(event)
+		break
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if tenant_id == "" {
+		return nil
+	}
+
+	tenant_svc := TenantService{
+		Config: ws.Config,
+		Logger: ws.Logger,
+	}
+
+	tenant, err := tenant_svc.GetTenantById(tenant_id)
+	if err != nil {
+		return err
+	}
+
+	for _, raw_workflow := range tenant.Workflows {
+
+		workflow, actions, err := DecodeWorkflow(raw_workflow)
+		if err != nil {
+			ws.Logger.Error(err.Error())
+			continue
+		}
+
+		if !workflow.Enabled {
+			continue
+		}
+
+		handler, ok := handlers[workflow.Trigger.Type]
+		if !ok {
+			continue
+		}
+
+		raw_trigger, err := rawWorkflowTrigger(raw_workflow)
+		if err != nil {
+			ws.Logger.Error(err.Error())
+			continue
+		}
+
+		output, fire, err := handler.Match(raw_trigger, event)
+		if err != nil {
+			ws.Logger.Error(fmt.Sprintf("failed to match the %s trigger of workflow %s: %v", workflow.Trigger.Type, workflow.ID, err))
+			continue
+		}
+
+		if !fire {
+			continue
+		}
+
+		var logs []models.WorkflowRunLog
+		if gated, ok := handler.(workflows.GatedEventTriggerHandler); ok {
+			output, fire, logs, err = gated.Gate(ws, tenant.TenantID, workflow.ID, raw_trigger, output)
+			if err != nil {
+				ws.Logger.Error(fmt.Sprintf("failed to gate the %s trigger of workflow %s: %v", workflow.Trigger.Type, workflow.ID, err))
+				continue
+			}
+
+			if !fire {
+				continue
+			}
+		}
+
+		err = ws.QueueWorkflow(tenant.TenantID, workflow, actions, output, logs...)
+		if err != nil {
+			ws.Logger.Error(err.Error())
+		}
+	}
+
+	return nil
+}
+
+// EvaluateDailySalesBelowTarget computes the sales of each evaluated branch for the day of scheduled_at
+// (or the day before it) and returns the branches whose sales are below the trigger target.
+func (ws *WorkflowsService) EvaluateDailySalesBelowTarget(tenant_id string, trigger models.WorkflowDailySalesBelowTargetTrigger, scheduled_at time.Time) (output models.WorkflowDailySalesBelowTargetTriggerOutput, err error) {
+
+	day := scheduled_at
+	if trigger.EvaluateDay == models.TriggerDailySalesEvaluateYesterday {
+		day = day.AddDate(0, 0, -1)
+	}
+
+	output = models.WorkflowDailySalesBelowTargetTriggerOutput{
+		Date:     day.Format("2006-01-02"),
+		Target:   trigger.Target,
+		Branches: make([]models.WorkflowDailySalesBelowTargetOutputBranch, 0),
+	}
+
+	tenant_svc := TenantService{
+		Config: ws.Config,
+		Logger: ws.Logger,
+	}
+
+	tenant, err := tenant_svc.GetTenantById(tenant_id)
+	if err != nil {
+		return output, err
+	}
+
+	totals := make(map[string]*models.WorkflowDailySalesBelowTargetOutputBranch)
+
+	labels := trigger.Labels
+	if len(labels) == 0 {
+		labels = knownBranchLabels(tenant)
+	}
+
+	for _, label := range labels {
+		totals[label] = &models.WorkflowDailySalesBelowTargetOutputBranch{
+			Label: label,
+		}
+	}
+
+	for _, sales_per_day := range tenant.Sales {
+
+		if sales_per_day.Date != output.Date {
+			continue
+		}
+
+		for _, order := range sales_per_day.Orders {
+			for _, label := range order.Labels {
+				if total, ok := totals[label]; ok {
+					total.TotalSales += order.Order.SalePrice
+					total.OrderCount++
+				}
+			}
+		}
+	}
+
+	for _, label := range labels {
+		if totals[label].TotalSales < trigger.Target {
+			output.Branches = append(output.Branches, *totals[label])
+		}
+	}
+
+	return output, nil
+}
+
+// knownBranchLabels returns the branch labels seen in the tenant inventory and sales.
+func knownBranchLabels(tenant models.Tenant) []string {
+
+	seen := make(map[string]bool)
+
+	for _, item := range tenant.InventoryItems {
+		for _, label := range item.Labels {
+			seen[label] = true
+		}
+	}
+
+	for _, sales_per_day := range tenant.Sales {
+		for _, order := range sales_per_day.Orders {
+			for _, label := range order.Labels {
+				seen[label] = true
+			}
+		}
+	}
+
+	labels := make([]string, 0, len(seen))
+	for label := range seen {
+		if strings.HasPrefix(label, "branch:") {
+			labels = append(labels, label)
+		}
+	}
+
+	sort.Strings(labels)
+
+	return labels
+}
+
+// eventTenantID returns the tenant of the events carrying it, the trigger handlers listening to them share it.
+func eventTenantID(event interface{}) (tenant_id string, err error) {
+
+	switch e := event.(type) {
+	case []events.EventLowStockData:
+		if len(e) == 0 {
+			return "", nil
+		}
+		return e[0].TenantId, nil
+	case events.EventOrderIngestedData:
+		if len(e.Orders) == 0 {
+			return "", nil
+		}
+		return e.TenantId, nil
+	case events.EventRefundIngestedData:
+		if len(e.Refunds) == 0 {
+			return "", nil
+		}
+		return e.TenantId, nil
+	}
+
+	return "", fmt.Errorf("unexpected event %T", event)
+}
+
+// lowStockTriggerHandler fires on the low stock events of the monitored items.
+type lowStockTriggerHandler struct{}
+
+func (lowStockTriggerHandler) Describe() models.WorkflowCatalogEntry {
+	return models.WorkflowCatalogEntry{
+		Type:        models.WorkflowTriggerTypeLowStockLabel,
+		Label:       "Low stock",
+		Description: "Fires when inventory items fall below their threshold.",
+		Schema: jsonSchemaObject(models.WorkflowTriggerTypeLowStockLabel, []string{"monitor_type"}, map[string]interface{}{
+			"monitor_type":     jsonSchemaProperty("string", "Monitor every item or only the listed ones", models.TriggerLowStockMonitorTypeAny, models.TriggerLowStockMonitorTypeSpecific),
+			"product_ids":      jsonSchemaArray(jsonSchemaProperty("string", "Inventory item id"), "Items monitored by specific_items"),
+			"cooldown_minutes": jsonSchemaProperty("integer", "Minutes an item that fired is suppressed for, 0 disables the cooldown"),
+			"dedup_key":        jsonSchemaProperty("string", "Template telling the events apart for the cooldown and the digest, defaults to {{ item_id }}"),
+			"digest_minutes":   jsonSchemaProperty("integer", "Collect the items and run once every this many minutes, 0 runs on every event"),
+		}),
+	}
+}
+
+func (lowStockTriggerHandler) Decode(raw interface{}, config config.Config) (interface{}, error) {
+
+	var trigger models.WorkflowLowStockTrigger
+	err := mapstructure.Decode(raw, &trigger)
+	if err != nil {
+		return nil, err
+	}
+
+	switch trigger.MonitorType {
+	case models.TriggerLowStockMonitorTypeAny, models.TriggerLowStockMonitorTypeSpecific:
+	default:
+		return nil, fmt.Errorf("unsupported monitor_type %s", trigger.MonitorType)
+	}
+
+	if trigger.CooldownMinutes < 0 {
+		return nil, fmt.Errorf("cooldown_minutes can't be negative")
+	}
+
+	if trigger.DigestMinutes < 0 || trigger.DigestMinutes > 24*60 {
+		return nil, fmt.Errorf("digest_minutes must be between 0 and 1440")
+	}
+
+	_, err = common.ParseTemplate(trigger.DedupKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid dedup_key template: %v", err)
+	}
+
+	return trigger, nil
+}
+
+func (lowStockTriggerHandler) SampleOutput() interface{} {
+	return models.WorkflowLowStockTriggerOutput{
+		Items: []models.WorkflowLowStockTriggerOutputItem{
+			{
+				TenantId: "1",
+				Labels:   []string{"branch:main"},
+				ItemID:   "sample_item",
+				ItemName: "Sample item",
+				Quantity: 1,
+				Unit:     "kg",
+			},
+		},
+	}
+}
+
+func (lowStockTriggerHandler) EventID() string {
+	return events.EventLowStockId
+}
+
+func (lowStockTriggerHandler) EventTenantID(event interface{}) (string, error) {
+	return eventTenantID(event)
+}
+
+func (lowStockTriggerHandler) Match(raw_trigger bson.Raw, event interface{}) (interface{}, bool, error) {
+
+	low_stock_events, ok := event.([]events.EventLowStockData)
+	if !ok {
+		return nil, false, fmt.Errorf("unexpected event %T", event)
+	}
+
+	var trigger models.WorkflowLowStockTrigger
+	err := decodeTrigger(raw_trigger, &trigger)
+	if err != nil {
+		return nil, false, err
+	}
+
+	output := models.WorkflowLowStockTriggerOutput{
+		Items: make([]models.WorkflowLowStockTriggerOutputItem, 0),
+	}
+
+	for _, event := range low_stock_events {
+
+		monitored := trigger.MonitorType == models.TriggerLowStockMonitorTypeAny
+		for _, product_id := range trigger.ProductIDs {
+			if event.ItemID == product_id {
+				monitored = true
+			}
+		}
+
+		if monitored {
+			output.Items = append(output.Items, models.WorkflowLowStockTriggerOutputItem{
+				TenantId: event.TenantId,
+				ItemID:   event.ItemID,
+				ItemName: event.ItemName,
+				Quantity: event.Current,
+			})
+		}
+	}
+
+	return output, len(output.Items) > 0, nil
+}
+
+// Gate suppresses the items whose dedup key is in cooldown and collects the others into the digest of the workflow
+// when it has one, so the workflow runs with the remaining items right away or when the digest is due.
+func (lowStockTriggerHandler) Gate(service workflows.Service, tenant_id string, workflow_id string, raw_trigger bson.Raw, output interface{}) (interface{}, bool, []models.WorkflowRunLog, error) {
+
+	ws, err := workflowsService(service)
+	if err != nil {
+		return nil, false, nil, err
+	}
+
+	low_stock_output, ok := output.(models.WorkflowLowStockTriggerOutput)
+	if !ok {
+		return nil, false, nil, fmt.Errorf("unexpected output %T", output)
+	}
+
+	var trigger models.WorkflowLowStockTrigger
+	err = decodeTrigger(raw_trigger, &trigger)
+	if err != nil {
+		return nil, false, nil, err
+	}
+
+	if trigger.CooldownMinutes == 0 && trigger.DigestMinutes == 0 && trigger.DedupKey == "" {
+		return output, true, nil, nil
+	}
+
+	now := time.Now()
+	seen := make(map[string]bool)
+	entries := make([]models.WorkflowTriggerDigestEntry, 0, len(low_stock_output.Items))
+
+	for _, item := range low_stock_output.Items {
+
+		key, err := lowStockDedupKey(trigger.DedupKey, item)
+		if err != nil {
+			return nil, false, nil, err
+		}
+
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		if trigger.CooldownMinutes > 0 {
+			claimed, err := ws.claimTriggerCooldown(tenant_id, workflow_id, key, time.Duration(trigger.CooldownMinutes)*time.Minute, now)
+			if err != nil {
+				return nil, false, nil, err
+			}
+
+			if !claimed {
+				ws.Logger.Info(fmt.Sprintf("suppressed the low stock event of item %s for workflow %s, its dedup key %s is in cooldown", item.ItemID, workflow_id, key))
+
+				err = ws.suppressTriggerEvent(tenant_id, workflow_id, models.WorkflowSuppressedEvent{
+					Key:         key,
+					Description: fmt.Sprintf("low stock event of %s (%s) at quantity %v", item.ItemName, item.ItemID, item.Quantity),
+					At:          now,
+				})
+				if err != nil {
+					return nil, false, nil, err
+				}
+				continue
+			}
+		}
+
+		entries = append(entries, models.WorkflowTriggerDigestEntry{Key: key, Item: item, At: now})
+	}
+
+	if len(entries) == 0 {
+		return nil, false, nil, nil
+	}
+
+	if trigger.DigestMinutes > 0 {
+		return nil, false, nil, ws.addToTriggerDigest(tenant_id, workflow_id, time.Duration(trigger.DigestMinutes)*time.Minute, entries, now)
+	}
+
+	low_stock_output.Items = make([]models.WorkflowLowStockTriggerOutputItem, len(entries))
+	for i, entry := range entries {
+		low_stock_output.Items[i] = entry.Item
+	}
+
+	logs, err := ws.takeSuppressedEventsLogs(tenant_id, workflow_id)
+	if err != nil {
+		ws.Logger.Error(err.Error())
+	}
+
+	return low_stock_output, true, logs, nil
+}
+
+// lowStockDedupKey renders the dedup key template of the trigger against the item, the item id is the default key.
+func lowStockDedupKey(template string, item models.WorkflowLowStockTriggerOutputItem) (string, error) {
+
+	if template == "" {
+		return item.ItemID, nil
+	}
+
+	data, err := toJSONValue(item)
+	if err != nil {
+		return "", err
+	}
+
+	values, _ := data.(map[string]interface{})
+
+	key, err := common.RenderTemplate(template, values, true)
+	if err != nil {
+		return "", fmt.Errorf("couldn't interpret dedup_key: %v", err)
+	}
+
+	return key, nil
+}
+
+// scheduleTriggerHandler fires on its cron schedule.
+type scheduleTriggerHandler struct{}
+
+func (scheduleTriggerHandler) Describe() models.WorkflowCatalogEntry {
+	return models.WorkflowCatalogEntry{
+		Type:        models.WorkflowTriggerTypeScheduleLabel,
+		Label:       "Schedule",
+		Description: "Fires on a cron schedule.",
+		Schema:      jsonSchemaObject(models.WorkflowTriggerTypeScheduleLabel, []string{"cron"}, scheduleSchemaProperties()),
+	}
+}
+
+func (scheduleTriggerHandler) Decode(raw interface{}, config config.Config) (interface{}, error) {
+
+	var trigger models.WorkflowScheduleTrigger
+	err := mapstructure.Decode(raw, &trigger)
+	if err != nil {
+		return nil, err
+	}
+
+	_, _, err = ParseScheduleTrigger(trigger.WorkflowTriggerSchedule, config.TimeZone)
+	if err != nil {
+		return nil, err
+	}
+
+	return trigger, nil
+}
+
+func (scheduleTriggerHandler) SampleOutput() interface{} {
+	now := time.Now()
+	return models.WorkflowScheduleTriggerOutput{
+		ScheduledAt: now.Truncate(time.Minute),
+		FiredAt:     now,
+		TimeZone:    "UTC",
+	}
+}
+
+func (scheduleTriggerHandler) Evaluate(service workflows.Service, tenant_id string, raw_trigger bson.Raw, scheduled_at time.Time, fired_at time.Time) (interface{}, bool, error) {
+	return models.WorkflowScheduleTriggerOutput{
+		ScheduledAt: scheduled_at,
+		FiredAt:     fired_at,
+		TimeZone:    scheduled_at.Location().String(),
+	}, true, nil
+}
+
+// scheduleSchemaProperties returns the JSON schema properties of models.WorkflowTriggerSchedule.
+func scheduleSchemaProperties() map[string]interface{} {
+	return map[string]interface{}{
+		"cron":     jsonSchemaProperty("string", "Standard 5 fields cron expression, descriptors such as @daily are accepted"),
+		"timezone": jsonSchemaProperty("string", "IANA timezone the schedule is evaluated in, defaults to the hub timezone"),
+	}
+}
+
+// orderIngestedTriggerHandler fires on the orders ingested from the POS logs of the matching branches.
+type orderIngestedTriggerHandler struct{}
+
+func (orderIngestedTriggerHandler) Describe() models.WorkflowCatalogEntry {
+	return models.WorkflowCatalogEntry{
+		Type:        models.WorkflowTriggerTypeOrderIngestedLabel,
+		Label:       "Order ingested",
+		Description: "Fires when orders are ingested from the POS logs.",
+		Schema: jsonSchemaObject(models.WorkflowTriggerTypeOrderIngestedLabel, nil, map[string]interface{}{
+			"labels": jsonSchemaArray(jsonSchemaProperty("string", "Branch label such as branch:main"), "Branches to listen to, every branch when empty"),
+		}),
+	}
+}
+
+func (orderIngestedTriggerHandler) Decode(raw interface{}, config config.Config) (interface{}, error) {
+
+	var trigger models.WorkflowOrderIngestedTrigger
+	err := mapstructure.Decode(raw, &trigger)
+	if err != nil {
+		return nil, err
+	}
+
+	return trigger, nil
+}
+
+func (orderIngestedTriggerHandler) SampleOutput() interface{} {
+	now := time.Now()
+	return models.WorkflowOrderIngestedTriggerOutput{
+		Label: "branch:main",
+		Orders: []models.SalesPerDayOrder{
+			{
+				SalesPerDayOrder: core_models.SalesPerDayOrder{
+					Id: "sample_order",
+					Order: core_models.Order{
+						Id:          "sample_order",
+						DisplayId:   "1",
+						SubmittedAt: now,
+						State:       "finished",
+						Cost:        40,
+						SalePrice:   100,
+					},
+				},
+				Labels: []string{"branch:main"},
+			},
+		},
+	}
+}
+
+func (orderIngestedTriggerHandler) EventID() string {
+	return events.EventOrderIngestedId
+}
+
+func (orderIngestedTriggerHandler) EventTenantID(event interface{}) (string, error) {
+	return eventTenantID(event)
+}
+
+func (orderIngestedTriggerHandler) Match(raw_trigger bson.Raw, event interface{}) (interface{}, bool, error) {
+
+	order_ingested, ok := event.(events.EventOrderIngestedData)
+	if !ok {
+		return nil, false, fmt.Errorf("unexpected event %T", event)
+	}
+
+	var trigger models.WorkflowOrderIngestedTrigger
+	err := decodeTrigger(raw_trigger, &trigger)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if !matchesLabels(trigger.Labels, order_ingested.Label) {
+		return nil, false, nil
+	}
+
+	return models.WorkflowOrderIngestedTriggerOutput{
+		Label:  order_ingested.Label,
+		Orders: order_ingested.Orders,
+	}, true, nil
+}
+
+// refundIngestedTriggerHandler fires on the refunds ingested from the POS logs of the matching branches,
+// only the refunds reaching the minimum refund value of the trigger are passed to the workflow.
+type refundIngestedTriggerHandler struct{}
+
+func (refundIngestedTriggerHandler) Describe() models.WorkflowCatalogEntry {
+	return models.WorkflowCatalogEntry{
+		Type:        models.WorkflowTriggerTypeRefundIngestedLabel,
+		Label:       "Refund ingested",
+		Description: "Fires when refunds are ingested from the POS logs.",
+		Schema: jsonSchemaObject(models.WorkflowTriggerTypeRefundIngestedLabel, nil, map[string]interface{}{
+			"labels":           jsonSchemaArray(jsonSchemaProperty("string", "Branch label such as branch:main"), "Branches to listen to, every branch when empty"),
+			"min_refund_value": jsonSchemaProperty("number", "Refunds below this amount are ignored"),
+		}),
+	}
+}
+
+func (refundIngestedTriggerHandler) Decode(raw interface{}, config config.Config) (interface{}, error) {
+
+	var trigger models.WorkflowRefundIngestedTrigger
+	err := mapstructure.Decode(raw, &trigger)
+	if err != nil {
+		return nil, err
+	}
+
+	if trigger.MinRefundValue < 0 {
+		return nil, fmt.Errorf("min_refund_value can't be negative")
+	}
+
+	return trigger, nil
+}
+
+func (refundIngestedTriggerHandler) SampleOutput() interface{} {
+	return models.WorkflowRefundIngestedTriggerOutput{
+		Label: "branch:main",
+		Refunds: []models.LogOrderItemRefund{
+			{
+				LogOrderItemRefund: core_models.LogOrderItemRefund{
+					Id:        "sample_refund",
+					OrderId:   "sample_order",
+					ItemId:    "sample_order_item",
+					ProductId: "sample_product",
+					Reason:    "Sample refund",
+					Amount:    25,
+				},
+				Labels: []string{"branch:main"},
+			},
+		},
+	}
+}
+
+func (refundIngestedTriggerHandler) EventID() string {
+	return events.EventRefundIngestedId
+}
+
+func (refundIngestedTriggerHandler) EventTenantID(event interface{}) (string, error) {
+	return eventTenantID(event)
+}
+
+func (refundIngestedTriggerHandler) Match(raw_trigger bson.Raw, event interface{}) (interface{}, bool, error) {
+
+	refund_ingested, ok := event.(events.EventRefundIngestedData)
+	if !ok {
+		return nil, false, fmt.Errorf("unexpected event %T", event)
+	}
+
+	var trigger models.WorkflowRefundIngestedTrigger
+	err := decodeTrigger(raw_trigger, &trigger)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if !matchesLabels(trigger.Labels, refund_ingested.Label) {
+		return nil, false, nil
+	}
+
+	refunds := make([]models.LogOrderItemRefund, 0)
+	for _, refund := range refund_ingested.Refunds {
+		if refund.Amount >= trigger.MinRefundValue {
+			refunds = append(refunds, refund)
+		}
+	}
+
+	return models.WorkflowRefundIngestedTriggerOutput{
+		Label:   refund_ingested.Label,
+		Refunds: refunds,
+	}, len(refunds) > 0, nil
+}
+
+// dailySalesBelowTargetTriggerHandler is evaluated on its schedule and fires when the sales of
+// one or more branches for the evaluated day are below the target.
+type dailySalesBelowTargetTriggerHandler struct{}
+
+func (dailySalesBelowTargetTriggerHandler) Describe() models.WorkflowCatalogEntry {
+
+	properties := scheduleSchemaProperties()
+	properties["target"] = jsonSchemaProperty("number", "Sales target of each branch for the evaluated day")
+	properties["labels"] = jsonSchemaArray(jsonSchemaProperty("string", "Branch label such as branch:main"), "Branches to evaluate, every known branch when empty")
+	properties["evaluate_day"] = jsonSchemaProperty("string", "Day evaluated relative to the scheduled time, defaults to today", models.TriggerDailySalesEvaluateToday, models.TriggerDailySalesEvaluateYesterday)
+
+	return models.WorkflowCatalogEntry{
+		Type:        models.WorkflowTriggerTypeDailySalesBelowLabel,
+		Label:       "Daily sales below target",
+		Description: "Evaluated on a cron schedule, fires when the sales of a branch for the day are below the target.",
+		Schema:      jsonSchemaObject(models.WorkflowTriggerTypeDailySalesBelowLabel, []string{"cron", "target"}, properties),
+	}
+}
+
+func (dailySalesBelowTargetTriggerHandler) Decode(raw interface{}, config config.Config) (interface{}, error) {
+
+	var trigger models.WorkflowDailySalesBelowTargetTrigger
+	err := mapstructure.Decode(raw, &trigger)
+	if err != nil {
+		return nil, err
+	}
+
+	_, _, err = ParseScheduleTrigger(trigger.WorkflowTriggerSchedule, config.TimeZone)
+	if err != nil {
+		return nil, err
+	}
+
+	if trigger.Target <= 0 {
+		return nil, fmt.Errorf("target must be greater than zero")
+	}
+
+	switch trigger.EvaluateDay {
+	case "":
+		trigger.EvaluateDay = models.TriggerDailySalesEvaluateToday
+	case models.TriggerDailySalesEvaluateToday, models.TriggerDailySalesEvaluateYesterday:
+	default:
+		return nil, fmt.Errorf("unsupported evaluate_day %s", trigger.EvaluateDay)
+	}
+
+	return trigger, nil
+}
+
+func (dailySalesBelowTargetTriggerHandler) SampleOutput() interface{} {
+	return models.WorkflowDailySalesBelowTargetTriggerOutput{
+		Date:   time.Now().Format("2006-01-02"),
+		Target: 1000,
+		Branches: []models.WorkflowDailySalesBelowTargetOutputBranch{
+			{
+				Label:      "branch:main",
+				TotalSales: 650,
+				OrderCount: 12,
+			},
+		},
+	}
+}
+
+func (dailySalesBelowTargetTriggerHandler) Evaluate(service workflows.Service, tenant_id string, raw_trigger bson.Raw, scheduled_at time.Time, fired_at time.Time) (interface{}, bool, error) {
+
+	var trigger models.WorkflowDailySalesBelowTargetTrigger
+	err := decodeTrigger(raw_trigger, &trigger)
+	if err != nil {
+		return nil, false, err
+	}
+
+	ws, err := workflowsService(service)
+	if err != nil {
+		return nil, false, err
+	}
+
+	output, err := ws.EvaluateDailySalesBelowTarget(tenant_id, trigger, scheduled_at)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return output, len(output.Branches) > 0, nil
+}
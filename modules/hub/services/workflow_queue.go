@@ -0,0 +1,368 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nutrixpos/hub/common/config"
+	"github.com/nutrixpos/hub/modules/hub/models"
+	"github.com/nutrixpos/pos/common/logger"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const (
+	DefaultWorkflowWorkers           = 8
+	DefaultWorkflowTenantConcurrency = 2
+	DefaultWorkflowQueueSize         = 1000
+	DefaultWorkflowTenantQueueSize   = 200
+)
+
+// ErrWorkflowQueueFull is returned when a run is queued while the queue, or the tenant share of it, is full.
+var ErrWorkflowQueueFull = errors.New("workflow queue is full")
+
+// WorkflowQueue executes the runs of the hub, it is set up with the background workers.
+// Runs are executed inline while it isn't, such as from the command line.
+var WorkflowQueue *WorkflowExecutionQueue
+
+// workflowJob is a run waiting in the queue.
+type workflowJob struct {
+	TenantID   string
+	WorkflowID string
+	QueuedAt   time.Time
+	Run        func() error
+}
+
+// workflowQueueCounters counts the runs that went through the queue, of the hub or of a tenant.
+type workflowQueueCounters struct {
+	enqueued  uint64
+	completed uint64
+	failed    uint64
+	rejected  uint64
+}
+
+// tenantWorkflowJobs holds the waiting and running runs of a tenant.
+type tenantWorkflowJobs struct {
+	jobs    []workflowJob
+	running int
+}
+
+// WorkflowExecutionQueue runs the workflows on a bounded pool of workers. Tenants take turns (round robin)
+// and a tenant never runs more than its concurrency at once, so a tenant with slow actions only delays itself.
+type WorkflowExecutionQueue struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	logger logger.ILogger
+
+	workers            int
+	tenant_concurrency int
+	size               int
+	tenant_size        int
+
+	tenants map[string]*tenantWorkflowJobs
+	// turns lists the tenants with waiting runs in the order they get a worker, next is whose turn it is
+	turns []string
+	next  int
+
+	queued   int
+	running  int
+	counters workflowQueueCounters
+	// tenant_counters outlive the tenants entries, which are removed once they have no runs
+	tenant_counters map[string]*workflowQueueCounters
+}
+
+// NewWorkflowExecutionQueue creates a queue sized by the config, zero values use the defaults.
+func NewWorkflowExecutionQueue(config config.WorkflowsConfig, logger logger.ILogger) *WorkflowExecutionQueue {
+
+	q := &WorkflowExecutionQueue{
+		logger:             logger,
+		workers:            config.Workers,
+		tenant_concurrency: config.TenantConcurrency,
+		size:               config.QueueSize,
+		tenant_size:        config.TenantQueueSize,
+		tenants:            make(map[string]*tenantWorkflowJobs),
+		tenant_counters:    make(map[string]*workflowQueueCounters),
+	}
+	q.cond = sync.NewCond(&q.mu)
+
+	if q.workers <= 0 {
+		q.workers = DefaultWorkflowWorkers
+	}
+	if q.tenant_concurrency <= 0 {
+		q.tenant_concurrency = DefaultWorkflowTenantConcurrency
+	}
+	if q.size <= 0 {
+		q.size = DefaultWorkflowQueueSize
+	}
+	if q.tenant_size <= 0 {
+		q.tenant_size = DefaultWorkflowTenantQueueSize
+	}
+
+	return q
+}
+
+// Workers returns the number of workers the queue is meant to be worked by.
+func (q *WorkflowExecutionQueue) Workers() int {
+	return q.workers
+}
+
+// Enqueue adds a run to the queue of its tenant, ErrWorkflowQueueFull is returned when there is no room for it.
+func (q *WorkflowExecutionQueue) Enqueue(job workflowJob) error {
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	tenant, ok := q.tenants[job.TenantID]
+	if !ok {
+		tenant = &tenantWorkflowJobs{}
+	}
+
+	counters := q.tenantCounters(job.TenantID)
+
+	if q.queued >= q.size || len(tenant.jobs) >= q.tenant_size {
+		q.counters.rejected++
+		counters.rejected++
+		return ErrWorkflowQueueFull
+	}
+
+	q.tenants[job.TenantID] = tenant
+
+	if len(tenant.jobs) == 0 {
+		q.turns = append(q.turns, job.TenantID)
+	}
+
+	job.QueuedAt = time.Now()
+	tenant.jobs = append(tenant.jobs, job)
+	q.queued++
+	q.counters.enqueued++
+	counters.enqueued++
+
+	q.cond.Signal()
+
+	return nil
+}
+
+// Work executes the queued runs, it is the task of each worker of the pool and never returns.
+func (q *WorkflowExecutionQueue) Work() {
+	for {
+		job := q.take()
+
+		err := job.Run()
+		if err != nil {
+			q.logger.Error(fmt.Sprintf("run of workflow %s of tenant %s failed: %v", job.WorkflowID, job.TenantID, err))
+		}
+
+		q.done(job.TenantID, err)
+	}
+}
+
+// take waits for the next tenant whose turn it is and that is below its concurrency, and returns its oldest run.
+func (q *WorkflowExecutionQueue) take() workflowJob {
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for {
+		for i := 0; i < len(q.turns); i++ {
+
+			position := (q.next + i) % len(q.turns)
+			tenant_id := q.turns[position]
+			tenant := q.tenants[tenant_id]
+
+			if tenant.running >= q.tenant_concurrency {
+				continue
+			}
+
+			job := tenant.jobs[0]
+			tenant.jobs = tenant.jobs[1:]
+			tenant.running++
+			q.queued--
+			q.running++
+
+			if len(tenant.jobs) == 0 {
+				// the tenant leaves the turns until it queues again, the next tenant takes its position
+				q.turns = append(q.turns[:position], q.turns[position+1:]...)
+				q.next = position
+			} else {
+				q.next = position + 1
+			}
+
+			if len(q.turns) > 0 {
+				q.next %= len(q.turns)
+			} else {
+				q.next = 0
+			}
+
+			return job
+		}
+
+		q.cond.Wait()
+	}
+}
+
+// done releases the slot of a finished run and wakes up the workers waiting for one.
+func (q *WorkflowExecutionQueue) done(tenant_id string, err error) {
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	tenant := q.tenants[tenant_id]
+	tenant.running--
+	q.running--
+
+	counters := q.tenantCounters(tenant_id)
+	if err != nil {
+		q.counters.failed++
+		counters.failed++
+	} else {
+		q.counters.completed++
+		counters.completed++
+	}
+
+	if tenant.running == 0 && len(tenant.jobs) == 0 {
+		delete(q.tenants, tenant_id)
+	}
+
+	// a run of this tenant may have been waiting on its concurrency
+	q.cond.Broadcast()
+}
+
+// tenantCounters returns the counters of the tenant, the queue lock must be held.
+func (q *WorkflowExecutionQueue) tenantCounters(tenant_id string) *workflowQueueCounters {
+
+	counters, ok := q.tenant_counters[tenant_id]
+	if !ok {
+		counters = &workflowQueueCounters{}
+		q.tenant_counters[tenant_id] = counters
+	}
+
+	return counters
+}
+
+// Stats returns the depth of the queue and its counters as seen by the tenant: the runs, waits and counters
+// are the tenant ones and the capacity is its share of the queue. Every tenant is covered when tenant_id is empty.
+func (q *WorkflowExecutionQueue) Stats(tenant_id string) models.WorkflowQueueStats {
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+
+	counters := q.counters
+	capacity := q.size
+	if tenant_id != "" {
+		counters = workflowQueueCounters{}
+		if tenant_counters, ok := q.tenant_counters[tenant_id]; ok {
+			counters = *tenant_counters
+		}
+		capacity = q.tenant_size
+	}
+
+	stats := models.WorkflowQueueStats{
+		Workers:           q.workers,
+		TenantConcurrency: q.tenant_concurrency,
+		Capacity:          capacity,
+		Enqueued:          counters.enqueued,
+		Completed:         counters.completed,
+		Failed:            counters.failed,
+		Rejected:          counters.rejected,
+		Tenants:           make([]models.WorkflowQueueTenantStats, 0),
+	}
+
+	for id, tenant := range q.tenants {
+
+		if tenant_id != "" && id != tenant_id {
+			continue
+		}
+
+		var oldest_wait float64
+		if len(tenant.jobs) > 0 {
+			oldest_wait = now.Sub(tenant.jobs[0].QueuedAt).Seconds()
+		}
+
+		stats.Queued += len(tenant.jobs)
+		stats.Running += tenant.running
+		stats.OldestWait = max(stats.OldestWait, oldest_wait)
+
+		stats.Tenants = append(stats.Tenants, models.WorkflowQueueTenantStats{
+			TenantID:   id,
+			Queued:     len(tenant.jobs),
+			Running:    tenant.running,
+			OldestWait: oldest_wait,
+		})
+	}
+
+	sort.Slice(stats.Tenants, func(i, j int) bool {
+		return stats.Tenants[i].TenantID < stats.Tenants[j].TenantID
+	})
+
+	return stats
+}
+
+// QueueWorkflow queues a run of the workflow on the hub queue, see RunWorkflow.
+// The run is executed right away when the queue isn't set up. A run the queue has no room for
+// is recorded as failed, so the trigger that fired isn't lost silently.
+func (ws *WorkflowsService) QueueWorkflow(tenant_id string, workflow models.Workflow, actions []bson.Raw, trigger_output interface{}, trigger_logs ...models.WorkflowRunLog) (err error) {
+
+	if WorkflowQueue == nil {
+		return ws.RunWorkflow(tenant_id, workflow, actions, trigger_output, trigger_logs...)
+	}
+
+	err = WorkflowQueue.Enqueue(workflowJob{
+		TenantID:   tenant_id,
+		WorkflowID: workflow.ID,
+		Run: func() error {
+			return ws.RunWorkflow(tenant_id, workflow, actions, trigger_output, trigger_logs...)
+		},
+	})
+	if err != nil {
+		err = fmt.Errorf("couldn't queue a run of workflow %s of tenant %s: %w", workflow.ID, tenant_id, err)
+		ws.recordRejectedWorkflowRun(tenant_id, workflow, err, trigger_logs...)
+		return err
+	}
+
+	return nil
+}
+
+// recordRejectedWorkflowRun records a failed run of the workflow for a run the queue rejected, none of its steps ran.
+func (ws *WorkflowsService) recordRejectedWorkflowRun(tenant_id string, workflow models.Workflow, reason error, trigger_logs ...models.WorkflowRunLog) {
+
+	run_id, err := ws.StartWorkflowRun(tenant_id, workflow)
+	if err != nil {
+		ws.Logger.Error(fmt.Sprintf("failed to record the rejected run of workflow %s: %v", workflow.ID, err))
+		return
+	}
+
+	for _, log := range trigger_logs {
+		ws.AddLogsToWorkflowRun(workflow.Trigger.Type, tenant_id, workflow.ID, run_id, log)
+	}
+
+	ws.SkipPendingWorkflowRunSteps(tenant_id, workflow.ID, run_id)
+	ws.FailWorkflow(tenant_id, workflow.ID, run_id, reason.Error())
+}
+
+// queueWorkflowRun queues the execution of a run that was already started, such as a redriven one.
+// The run is executed right away when the queue isn't set up, its failure is recorded on the run.
+func (ws *WorkflowsService) queueWorkflowRun(tenant_id string, workflow_id string, run func() error) (err error) {
+
+	if WorkflowQueue == nil {
+		err = run()
+		if err != nil {
+			ws.Logger.Error(err.Error())
+		}
+		return nil
+	}
+
+	err = WorkflowQueue.Enqueue(workflowJob{
+		TenantID:   tenant_id,
+		WorkflowID: workflow_id,
+		Run:        run,
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't queue run of workflow %s of tenant %s: %w", workflow_id, tenant_id, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,285 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/nutrixpos/hub/common/config"
+)
+
+// queueTestJob is a job of the tenant, its workflow id names it in the expected orders.
+func queueTestJob(tenant_id string, name string) workflowJob {
+	return workflowJob{
+		TenantID:   tenant_id,
+		WorkflowID: name,
+		Run:        func() error { return nil },
+	}
+}
+
+func TestWorkflowQueueRoundRobin(t *testing.T) {
+
+	type step struct {
+		// enqueue queues a job of the tenant when set, otherwise the next job is taken
+		enqueue string
+		name    string
+	}
+
+	enqueue := func(tenant_id string, name string) step { return step{enqueue: tenant_id, name: name} }
+	take := step{}
+
+	tests := []struct {
+		name     string
+		steps    []step
+		expected []string
+	}{
+		{
+			name:     "single tenant keeps its order",
+			steps:    []step{enqueue("a", "a1"), enqueue("a", "a2"), enqueue("a", "a3"), take, take, take},
+			expected: []string{"a1", "a2", "a3"},
+		},
+		{
+			name: "tenants take turns",
+			steps: []step{
+				enqueue("a", "a1"), enqueue("a", "a2"), enqueue("a", "a3"),
+				enqueue("b", "b1"),
+				enqueue("c", "c1"), enqueue("c", "c2"),
+				take, take, take, take, take, take,
+			},
+			expected: []string{"a1", "b1", "c1", "a2", "c2", "a3"},
+		},
+		{
+			name: "a tenant queueing later joins the rotation",
+			steps: []step{
+				enqueue("a", "a1"), enqueue("a", "a2"), enqueue("a", "a3"), enqueue("a", "a4"),
+				take,
+				enqueue("b", "b1"),
+				take, take, take, take,
+			},
+			expected: []string{"a1", "a2", "b1", "a3", "a4"},
+		},
+		{
+			name: "a tenant queueing again waits for its next turn",
+			steps: []step{
+				enqueue("a", "a1"), enqueue("b", "b1"), enqueue("b", "b2"),
+				take, take,
+				enqueue("a", "a2"),
+				take, take,
+			},
+			expected: []string{"a1", "b1", "b2", "a2"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			q := NewWorkflowExecutionQueue(config.WorkflowsConfig{TenantConcurrency: 100}, nil)
+
+			taken := make([]string, 0)
+			for _, step := range test.steps {
+				if step.enqueue != "" {
+					if err := q.Enqueue(queueTestJob(step.enqueue, step.name)); err != nil {
+						t.Fatalf("unexpected error: %v", err)
+					}
+					continue
+				}
+				taken = append(taken, q.take().WorkflowID)
+			}
+
+			if !reflect.DeepEqual(taken, test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, taken)
+			}
+		})
+	}
+}
+
+func TestWorkflowQueueTenantConcurrency(t *testing.T) {
+
+	tests := []struct {
+		name        string
+		concurrency int
+		jobs        []workflowJob
+		// expected are the jobs taken before every tenant with waiting jobs is at its concurrency
+		expected []string
+	}{
+		{
+			name:        "one at a time",
+			concurrency: 1,
+			jobs:        []workflowJob{queueTestJob("a", "a1"), queueTestJob("a", "a2"), queueTestJob("b", "b1")},
+			expected:    []string{"a1", "b1"},
+		},
+		{
+			name:        "two at a time",
+			concurrency: 2,
+			jobs:        []workflowJob{queueTestJob("a", "a1"), queueTestJob("a", "a2"), queueTestJob("a", "a3"), queueTestJob("b", "b1")},
+			expected:    []string{"a1", "b1", "a2"},
+		},
+		{
+			name:        "capped tenant skipped",
+			concurrency: 1,
+			jobs:        []workflowJob{queueTestJob("a", "a1"), queueTestJob("a", "a2"), queueTestJob("b", "b1"), queueTestJob("b", "b2"), queueTestJob("c", "c1")},
+			expected:    []string{"a1", "b1", "c1"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			q := NewWorkflowExecutionQueue(config.WorkflowsConfig{TenantConcurrency: test.concurrency}, nil)
+
+			for _, job := range test.jobs {
+				if err := q.Enqueue(job); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			}
+
+			taken := make([]workflowJob, 0)
+			for range test.expected {
+				taken = append(taken, q.take())
+			}
+
+			names := make([]string, 0, len(taken))
+			for _, job := range taken {
+				names = append(names, job.WorkflowID)
+			}
+			if !reflect.DeepEqual(names, test.expected) {
+				t.Fatalf("expected %v, got %v", test.expected, names)
+			}
+
+			// every tenant with waiting jobs is at its concurrency, the next take waits for a run to finish
+			next := make(chan workflowJob, 1)
+			go func() { next <- q.take() }()
+
+			select {
+			case job := <-next:
+				t.Fatalf("took %s of tenant %s above its concurrency", job.WorkflowID, job.TenantID)
+			case <-time.After(50 * time.Millisecond):
+			}
+
+			finished := taken[0]
+			q.done(finished.TenantID, nil)
+
+			select {
+			case job := <-next:
+				if job.TenantID != finished.TenantID {
+					t.Errorf("expected a job of tenant %s once its run finished, got one of %s", finished.TenantID, job.TenantID)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("no job was taken once a run of tenant %s finished", finished.TenantID)
+			}
+		})
+	}
+}
+
+func TestWorkflowQueueFull(t *testing.T) {
+
+	tests := []struct {
+		name        string
+		size        int
+		tenant_size int
+		tenants     []string
+		// rejected lists whether each job is rejected
+		rejected []bool
+	}{
+		{
+			name:        "tenant share full",
+			size:        10,
+			tenant_size: 2,
+			tenants:     []string{"a", "a", "a", "b"},
+			rejected:    []bool{false, false, true, false},
+		},
+		{
+			name:        "queue full",
+			size:        3,
+			tenant_size: 2,
+			tenants:     []string{"a", "b", "c", "d", "a"},
+			rejected:    []bool{false, false, false, true, true},
+		},
+		{
+			name:        "both full",
+			size:        2,
+			tenant_size: 2,
+			tenants:     []string{"a", "a", "a", "b"},
+			rejected:    []bool{false, false, true, true},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			q := NewWorkflowExecutionQueue(config.WorkflowsConfig{QueueSize: test.size, TenantQueueSize: test.tenant_size}, nil)
+
+			rejected_count := make(map[string]uint64)
+			for i, tenant_id := range test.tenants {
+				err := q.Enqueue(queueTestJob(tenant_id, fmt.Sprint(i)))
+				if test.rejected[i] {
+					if !errors.Is(err, ErrWorkflowQueueFull) {
+						t.Errorf("job %d: expected %v, got %v", i, ErrWorkflowQueueFull, err)
+					}
+					rejected_count[tenant_id]++
+					continue
+				}
+				if err != nil {
+					t.Errorf("job %d: unexpected error: %v", i, err)
+				}
+			}
+
+			total := uint64(0)
+			for tenant_id, count := range rejected_count {
+				total += count
+				if stats := q.Stats(tenant_id); stats.Rejected != count {
+					t.Errorf("expected %d rejected runs of tenant %s, got %d", count, tenant_id, stats.Rejected)
+				}
+			}
+			if stats := q.Stats(""); stats.Rejected != total {
+				t.Errorf("expected %d rejected runs, got %d", total, stats.Rejected)
+			}
+
+			// taking a job makes room for another one
+			job := q.take()
+			if err := q.Enqueue(queueTestJob(job.TenantID, "again")); err != nil {
+				t.Errorf("unexpected error once a job was taken: %v", err)
+			}
+		})
+	}
+}
+
+func TestWorkflowQueueStats(t *testing.T) {
+
+	q := NewWorkflowExecutionQueue(config.WorkflowsConfig{TenantConcurrency: 1, QueueSize: 10, TenantQueueSize: 4}, nil)
+
+	for _, job := range []workflowJob{queueTestJob("a", "a1"), queueTestJob("a", "a2"), queueTestJob("b", "b1")} {
+		if err := q.Enqueue(job); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	job := q.take()
+	q.done(job.TenantID, errors.New("failed"))
+
+	tests := []struct {
+		tenant_id string
+		capacity  int
+		queued    int
+		enqueued  uint64
+		failed    uint64
+		tenants   int
+	}{
+		{tenant_id: "", capacity: 10, queued: 2, enqueued: 3, failed: 1, tenants: 2},
+		{tenant_id: "a", capacity: 4, queued: 1, enqueued: 2, failed: 1, tenants: 1},
+		{tenant_id: "b", capacity: 4, queued: 1, enqueued: 1, failed: 0, tenants: 1},
+		{tenant_id: "c", capacity: 4, queued: 0, enqueued: 0, failed: 0, tenants: 0},
+	}
+
+	for _, test := range tests {
+		t.Run("tenant "+test.tenant_id, func(t *testing.T) {
+			stats := q.Stats(test.tenant_id)
+			if stats.Capacity != test.capacity || stats.Queued != test.queued || stats.Enqueued != test.enqueued ||
+				stats.Failed != test.failed || len(stats.Tenants) != test.tenants {
+				t.Errorf("unexpected stats %+v", stats)
+			}
+		})
+	}
+}
@@ -0,0 +1,489 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/nutrixpos/hub/modules/hub/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// DefaultWorkflowRunsRetentionDays is used when the config doesn't set the runs retention.
+const DefaultWorkflowRunsRetentionDays = 30
+
+// WorkflowRunsFilter narrows the listed runs, zero values don't filter.
+type WorkflowRunsFilter struct {
+	Status string
+	From   time.Time
+	To     time.Time
+}
+
+// getRunsCollection returns the collection of the workflow runs.
+// The caller is responsible for disconnecting the returned client.
+func (ws *WorkflowsService) getRunsCollection(ctx context.Context) (client *mongo.Client, collection *mongo.Collection, err error) {
+	return ws.getDocumentsCollection(ctx, "workflow_runs")
+}
+
+// EnsureWorkflowRunsIndexes creates the indexes used to look up and list the runs.
+func (ws *WorkflowsService) EnsureWorkflowRunsIndexes() (err error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), ws.dbDeadline())
+	defer cancel()
+
+	client, collection, err := ws.getRunsCollection(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect(ctx)
+
+	_, err = collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "id", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys: bson.D{{Key: "tenant_id", Value: 1}, {Key: "workflow_id", Value: 1}, {Key: "start_time", Value: -1}},
+		},
+		{
+			Keys: bson.D{{Key: "tenant_id", Value: 1}, {Key: "workflow_id", Value: 1}, {Key: "status", Value: 1}, {Key: "start_time", Value: -1}},
+		},
+		{
+			Keys: bson.D{{Key: "tenant_id", Value: 1}, {Key: "start_time", Value: -1}},
+		},
+		{
+			Keys: bson.D{{Key: "start_time", Value: 1}},
+		},
+		{
+			Keys: bson.D{{Key: "status", Value: 1}, {Key: "delay.until", Value: 1}},
+		},
+		{
+			Keys: bson.D{{Key: "status", Value: 1}, {Key: "resume.lease_until", Value: 1}},
+		},
+	})
+
+	return err
+}
+
+// embeddedRunsMigrationDeadline bounds the migration of the embedded runs of a tenant, its document may be close to 16MB.
+const embeddedRunsMigrationDeadline = 2 * time.Minute
+
+// MigrateEmbeddedWorkflowRuns moves the runs still embedded in the workflows of the tenants documents
+// into the runs collection, it is safe to run again as already moved runs are left untouched. Tenants are
+// migrated one at a time, a tenant that fails is logged and left embedded for the next start.
+// migrated counts the runs moved by this call.
+func (ws *WorkflowsService) MigrateEmbeddedWorkflowRuns() (migrated int, err error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), ws.dbDeadline())
+	defer cancel()
+
+	client, tenants_collection, err := ws.getTenantsCollection(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer client.Disconnect(context.Background())
+
+	cursor, err := tenants_collection.Find(ctx, bson.M{
+		"workflows.runs.0": bson.M{"$exists": true},
+	}, options.Find().SetProjection(bson.M{"tenant_id": 1}))
+	if err != nil {
+		return 0, err
+	}
+
+	tenant_ids := make([]string, 0)
+	for cursor.Next(ctx) {
+		tenant_id, ok := cursor.Current.Lookup("tenant_id").StringValueOK()
+		if ok {
+			tenant_ids = append(tenant_ids, tenant_id)
+		}
+	}
+
+	err = cursor.Err()
+	cursor.Close(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	runs_collection := tenants_collection.Database().Collection(ws.collectionName("workflow_runs"), options.Collection().SetBSONOptions(&options.BSONOptions{
+		DefaultDocumentM: true,
+	}))
+
+	for _, tenant_id := range tenant_ids {
+
+		tenant_migrated, err := ws.migrateTenantEmbeddedRuns(tenants_collection, runs_collection, tenant_id)
+		migrated += tenant_migrated
+		if err != nil {
+			ws.Logger.Error(fmt.Sprintf("failed to move the embedded workflow runs of tenant %s, they are retried on the next start: %v", tenant_id, err))
+		}
+	}
+
+	return migrated, nil
+}
+
+// migrateTenantEmbeddedRuns upserts the embedded runs of the tenant in one bulk write and removes them
+// from its document once they are all stored.
+func (ws *WorkflowsService) migrateTenantEmbeddedRuns(tenants_collection *mongo.Collection, runs_collection *mongo.Collection, tenant_id string) (migrated int, err error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), embeddedRunsMigrationDeadline)
+	defer cancel()
+
+	var tenant struct {
+		Workflows []struct {
+			ID   string               `bson:"id"`
+			Runs []models.WorkflowRun `bson:"runs"`
+		} `bson:"workflows"`
+	}
+
+	err = tenants_collection.FindOne(ctx, bson.M{"tenant_id": tenant_id}, options.FindOne().SetProjection(bson.M{
+		"workflows.id":   1,
+		"workflows.runs": 1,
+	})).Decode(&tenant)
+	if err != nil {
+		return 0, err
+	}
+
+	writes := make([]mongo.WriteModel, 0)
+	for _, workflow := range tenant.Workflows {
+		for _, run := range workflow.Runs {
+
+			run.TenantID = tenant_id
+			run.WorkflowID = workflow.ID
+
+			writes = append(writes, mongo.NewUpdateOneModel().
+				SetFilter(bson.M{"id": run.ID}).
+				SetUpdate(bson.M{"$setOnInsert": run}).
+				SetUpsert(true))
+		}
+	}
+
+	if len(writes) > 0 {
+		result, err := runs_collection.BulkWrite(ctx, writes, options.BulkWrite().SetOrdered(false))
+		if result != nil {
+			migrated = int(result.UpsertedCount)
+		}
+		if err != nil {
+			return migrated, err
+		}
+	}
+
+	_, err = tenants_collection.UpdateOne(ctx, bson.M{"tenant_id": tenant_id}, bson.M{
+		"$unset": bson.M{"workflows.$[].runs": ""},
+	})
+
+	return migrated, err
+}
+
+// PurgeExpiredWorkflowRuns deletes the runs started before the retention period of the config.
+func (ws *WorkflowsService) PurgeExpiredWorkflowRuns(now time.Time) (deleted int64, err error) {
+
+	retention_days := ws.Config.Workflows.RunsRetentionDays
+	if retention_days <= 0 {
+		retention_days = DefaultWorkflowRunsRetentionDays
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), ws.dbDeadline())
+	defer cancel()
+
+	client, collection, err := ws.getRunsCollection(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer client.Disconnect(ctx)
+
+	result, err := collection.DeleteMany(ctx, bson.M{
+		"start_time": bson.M{"$lt": now.AddDate(0, 0, -retention_days)},
+		"status":     bson.M{"$nin": []string{models.WorkflowRunStatusRunning, models.WorkflowRunStatusWaiting, models.WorkflowRunStatusDelayed}},
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return result.DeletedCount, nil
+}
+
+// GetWorkflowRuns returns a page of the runs of the workflow, newest first.
+func (ws *WorkflowsService) GetWorkflowRuns(tenant_id string, workflow_id string, runs_filter WorkflowRunsFilter, page_number int, page_size int) (runs []models.WorkflowRun, total_records int, err error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), ws.dbDeadline())
+	defer cancel()
+
+	client, collection, err := ws.getRunsCollection(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer client.Disconnect(ctx)
+
+	filter := bson.M{
+		"tenant_id":   tenant_id,
+		"workflow_id": workflow_id,
+	}
+
+	if runs_filter.Status != "" {
+		filter["status"] = runs_filter.Status
+	}
+
+	start_time := bson.M{}
+	if !runs_filter.From.IsZero() {
+		start_time["$gte"] = runs_filter.From
+	}
+	if !runs_filter.To.IsZero() {
+		start_time["$lt"] = runs_filter.To
+	}
+	if len(start_time) > 0 {
+		filter["start_time"] = start_time
+	}
+
+	count, err := collection.CountDocuments(ctx, filter)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	skip := (page_number - 1) * page_size
+
+	cursor, err := collection.Find(ctx, filter, options.Find().
+		SetSort(bson.D{{Key: "start_time", Value: -1}}).
+		SetSkip(int64(skip)).
+		SetLimit(int64(page_size)))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	runs = make([]models.WorkflowRun, 0)
+	err = cursor.All(ctx, &runs)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return runs, int(count), nil
+}
+
+// GetLatestWorkflowRuns returns the latest runs of each of the given workflows, without their steps.
+func (ws *WorkflowsService) GetLatestWorkflowRuns(tenant_id string, workflow_ids []string, limit int) (runs map[string][]models.WorkflowRun, err error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), ws.dbDeadline())
+	defer cancel()
+
+	client, collection, err := ws.getRunsCollection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Disconnect(ctx)
+
+	runs = make(map[string][]models.WorkflowRun)
+
+	for _, workflow_id := range workflow_ids {
+
+		cursor, err := collection.Find(ctx, bson.M{
+			"tenant_id":   tenant_id,
+			"workflow_id": workflow_id,
+		}, options.Find().
+			SetSort(bson.D{{Key: "start_time", Value: -1}}).
+			SetLimit(int64(limit)).
+			SetProjection(bson.M{"steps": 0}))
+		if err != nil {
+			return nil, err
+		}
+
+		workflow_runs := make([]models.WorkflowRun, 0)
+		err = cursor.All(ctx, &workflow_runs)
+		if err != nil {
+			return nil, err
+		}
+
+		runs[workflow_id] = workflow_runs
+	}
+
+	return runs, nil
+}
+
+// GetWorkflowRun returns a run of the workflow, mongo.ErrNoDocuments is returned when it doesn't exist.
+func (ws *WorkflowsService) GetWorkflowRun(tenant_id string, workflow_id string, run_id string) (run models.WorkflowRun, err error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), ws.dbDeadline())
+	defer cancel()
+
+	client, collection, err := ws.getRunsCollection(ctx)
+	if err != nil {
+		return run, err
+	}
+	defer client.Disconnect(ctx)
+
+	err = collection.FindOne(ctx, bson.M{
+		"tenant_id":   tenant_id,
+		"workflow_id": workflow_id,
+		"id":          run_id,
+	}).Decode(&run)
+
+	return run, err
+}
+
+// updateWorkflowRun applies the update to the run, array_filters target its steps.
+func (ws *WorkflowsService) updateWorkflowRun(tenant_id string, workflow_id string, run_id string, update bson.M, array_filters ...interface{}) (err error) {
+	return ws.updateWorkflowRunWhere(tenant_id, workflow_id, run_id, nil, update, array_filters...)
+}
+
+// updateWorkflowRunWhere applies the update to the run when it also matches where,
+// mongo.ErrNoDocuments is returned when it doesn't.
+func (ws *WorkflowsService) updateWorkflowRunWhere(tenant_id string, workflow_id string, run_id string, where bson.M, update bson.M, array_filters ...interface{}) (err error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), ws.dbDeadline())
+	defer cancel()
+
+	client, collection, err := ws.getRunsCollection(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect(ctx)
+
+	filter := bson.M{
+		"tenant_id":   tenant_id,
+		"workflow_id": workflow_id,
+		"id":          run_id,
+	}
+
+	for key, value := range where {
+		filter[key] = value
+	}
+
+	opts := options.Update()
+	if len(array_filters) > 0 {
+		opts.SetArrayFilters(options.ArrayFilters{Filters: array_filters})
+	}
+
+	result, err := collection.UpdateOne(ctx, filter, update, opts)
+	if err != nil {
+		ws.Logger.Error(err.Error())
+		return err
+	}
+
+	if result.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+
+	notifyWorkflowRun(run_id)
+
+	return nil
+}
+
+// AddLogsToWorkflowRun appends a log entry to the run, source is the trigger or action the entry comes from.
+func (ws *WorkflowsService) AddLogsToWorkflowRun(source string, tenant_id string, workflow_id string, run_id string, log models.WorkflowRunLog) (err error) {
+	return ws.updateWorkflowRun(tenant_id, workflow_id, run_id, bson.M{
+		"$push": bson.M{"logs": log},
+	})
+}
+
+// AddLogsToWorkflowRunStep appends a log entry to the step of the run executing the action at step_index.
+func (ws *WorkflowsService) AddLogsToWorkflowRunStep(tenant_id string, workflow_id string, run_id string, step_index int, log models.WorkflowRunLog) (err error) {
+	return ws.updateWorkflowRun(tenant_id, workflow_id, run_id, bson.M{
+		"$push": bson.M{"steps.$[step].logs": log},
+	}, bson.M{"step.index": step_index})
+}
+
+// SetWorkflowRunStepStatus updates the status of a run step, the step start time is recorded
+// when it moves to running and its end time when it reaches a final status.
+func (ws *WorkflowsService) SetWorkflowRunStepStatus(tenant_id string, workflow_id string, run_id string, step_index int, status string) (err error) {
+
+	set := bson.M{
+		"steps.$[step].status": status,
+	}
+
+	switch status {
+	case models.WorkflowRunStepStatusRunning:
+		set["steps.$[step].start_time"] = time.Now()
+	case models.WorkflowRunStepStatusCompleted, models.WorkflowRunStepStatusFailed, models.WorkflowRunStepStatusSkipped, models.WorkflowRunStepStatusCancelled:
+		set["steps.$[step].end_time"] = time.Now()
+	}
+
+	return ws.updateWorkflowRun(tenant_id, workflow_id, run_id, bson.M{"$set": set}, bson.M{"step.index": step_index})
+}
+
+// SetWorkflowRunStepOutput stores the output of the action executed by a run step.
+func (ws *WorkflowsService) SetWorkflowRunStepOutput(tenant_id string, workflow_id string, run_id string, step_index int, output interface{}) (err error) {
+	return ws.updateWorkflowRun(tenant_id, workflow_id, run_id, bson.M{
+		"$set": bson.M{"steps.$[step].output": output},
+	}, bson.M{"step.index": step_index})
+}
+
+// AddWorkflowRunStep appends a step to the run, it is used for the steps created while the run executes.
+func (ws *WorkflowsService) AddWorkflowRunStep(tenant_id string, workflow_id string, run_id string, step models.WorkflowRunStep) (err error) {
+	return ws.updateWorkflowRun(tenant_id, workflow_id, run_id, bson.M{
+		"$push": bson.M{"steps": step},
+	})
+}
+
+// SkipPendingWorkflowRunSteps marks the steps of the run that didn't start as skipped.
+func (ws *WorkflowsService) SkipPendingWorkflowRunSteps(tenant_id string, workflow_id string, run_id string) (err error) {
+
+	return ws.updateWorkflowRun(tenant_id, workflow_id, run_id, bson.M{
+		"$set": bson.M{
+			"steps.$[step].status":   models.WorkflowRunStepStatusSkipped,
+			"steps.$[step].end_time": time.Now(),
+		},
+	}, bson.M{"step.status": models.WorkflowRunStepStatusPending})
+}
+
+// StartWorkflowRun creates a new running run of the workflow with a pending step for each of its actions.
+func (ws *WorkflowsService) StartWorkflowRun(tenant_id string, workflow models.Workflow) (run_id string, err error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), ws.dbDeadline())
+	defer cancel()
+
+	client, collection, err := ws.getRunsCollection(ctx)
+	if err != nil {
+		return run_id, err
+	}
+	defer client.Disconnect(ctx)
+
+	run_id = primitive.NewObjectID().Hex()
+
+	steps := make([]models.WorkflowRunStep, len(workflow.Actions))
+	for index, action := range workflow.Actions {
+		steps[index] = models.WorkflowRunStep{
+			Index:  index,
+			Path:   fmt.Sprint(index),
+			Type:   action.Type,
+			Status: models.WorkflowRunStepStatusPending,
+			Logs:   []models.WorkflowRunLog{},
+		}
+	}
+
+	newRun := models.WorkflowRun{
+		ID:              run_id,
+		TenantID:        tenant_id,
+		WorkflowID:      workflow.ID,
+		StartTime:       time.Now(),
+		WorkflowVersion: workflow.Version,
+		Status:          models.WorkflowRunStatusRunning,
+		Steps:           steps,
+		Logs: []models.WorkflowRunLog{
+			{
+				Level:     "INFO",
+				TimeStamp: time.Now(),
+				Message:   "Workflow execution started.",
+			},
+		},
+	}
+
+	_, err = collection.InsertOne(ctx, newRun)
+	if err != nil {
+		ws.Logger.Error(err.Error())
+		return run_id, err
+	}
+
+	return run_id, nil
+}
+
+// FinishWorkflowRun records the final status and output of the run, a run already
+// finished (such as a cancelled one) is left as it is and mongo.ErrNoDocuments is returned.
+func (ws *WorkflowsService) FinishWorkflowRun(tenant_id string, workflow_id string, run_id string, status string, output interface{}) (err error) {
+	return ws.updateWorkflowRunWhere(tenant_id, workflow_id, run_id, bson.M{"status": models.WorkflowRunStatusRunning}, bson.M{
+		"$set": bson.M{
+			"end_time": time.Now(),
+			"status":   status,
+			"output":   output,
+		},
+	})
+}
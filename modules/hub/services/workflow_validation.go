@@ -0,0 +1,400 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/nutrixpos/hub/common"
+	"github.com/nutrixpos/hub/common/workflows"
+	"github.com/nutrixpos/hub/modules/hub/models"
+)
+
+// WorkflowValidationError lists what is wrong with the trigger and actions of a workflow being saved,
+// each error is located by the path of its field, such as trigger.product_ids[0] or actions[1].then[0].url.
+type WorkflowValidationError struct {
+	Errors []common.JSONSchemaError
+}
+
+func (e *WorkflowValidationError) Error() string {
+
+	messages := make([]string, 0, len(e.Errors))
+	for _, field_err := range e.Errors {
+		messages = append(messages, field_err.Error())
+	}
+
+	return "invalid workflow: " + strings.Join(messages, "; ")
+}
+
+// DecodeWorkflowDefinition validates the trigger and actions of a workflow being saved and decodes them into what
+// gets stored. They are checked against the JSON schema of their type, then by the handler of their type, and the
+// inventory items and env vars they reference must exist. A *WorkflowValidationError is returned when they are invalid.
+func (ws *WorkflowsService) DecodeWorkflowDefinition(tenant_id string, definition map[string]interface{}) (trigger interface{}, actions []interface{}, err error) {
+
+	tenant_svc := TenantService{
+		Config: ws.Config,
+		Logger: ws.Logger,
+	}
+
+	tenant, err := tenant_svc.GetTenantById(tenant_id)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return ws.decodeWorkflowDefinition(tenant, definition)
+}
+
+// decodeWorkflowDefinition is DecodeWorkflowDefinition against the inventory items and env vars of the given tenant.
+func (ws *WorkflowsService) decodeWorkflowDefinition(tenant models.Tenant, definition map[string]interface{}) (trigger interface{}, actions []interface{}, err error) {
+
+	// the editor sends unset fields as null, they are left out as mapstructure does
+	raw_trigger := withoutNulls(definition["trigger"])
+
+	field_errors := make([]common.JSONSchemaError, 0)
+	validateWorkflowTriggerSchema(raw_trigger, &field_errors)
+	raw_actions := validateWorkflowActionsSchema(withoutNulls(definition["actions"]), "actions", &field_errors)
+
+	if len(field_errors) > 0 {
+		return nil, nil, &WorkflowValidationError{Errors: field_errors}
+	}
+
+	trigger, err = workflows.Types.DecodeTrigger(raw_trigger, ws.Config)
+	if err != nil {
+		return nil, nil, &WorkflowValidationError{Errors: []common.JSONSchemaError{{Path: "trigger", Message: err.Error()}}}
+	}
+
+	actions, err = workflows.Types.DecodeActions(raw_actions, "")
+	var decode_err *workflows.ActionDecodeError
+	if errors.As(err, &decode_err) {
+		return nil, nil, &WorkflowValidationError{Errors: []common.JSONSchemaError{{Path: "actions" + actionFieldPath(decode_err.Path), Message: decode_err.Message}}}
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	field_errors = workflowReferenceErrors(tenant, raw_trigger, raw_actions)
+	if len(field_errors) > 0 {
+		return nil, nil, &WorkflowValidationError{Errors: field_errors}
+	}
+
+	return trigger, actions, nil
+}
+
+// validateWorkflowTriggerSchema validates the trigger against the JSON schema of its type,
+// a workflow may be saved without a trigger yet.
+func validateWorkflowTriggerSchema(raw interface{}, field_errors *[]common.JSONSchemaError) {
+
+	if raw == nil {
+		return
+	}
+
+	trigger_map, ok := raw.(map[string]interface{})
+	if !ok {
+		*field_errors = append(*field_errors, common.JSONSchemaError{Path: "trigger", Message: "must be an object"})
+		return
+	}
+
+	trigger_type, ok := trigger_map["type"].(string)
+	if !ok && trigger_map["type"] != nil {
+		*field_errors = append(*field_errors, common.JSONSchemaError{Path: "trigger.type", Message: "must be of type string"})
+		return
+	}
+
+	if trigger_type == "" {
+		return
+	}
+
+	handler, ok := workflows.Types.Trigger(trigger_type)
+	if !ok {
+		*field_errors = append(*field_errors, common.JSONSchemaError{Path: "trigger.type", Message: fmt.Sprintf("unsupported trigger type %s", trigger_type)})
+		return
+	}
+
+	appendFieldErrors(field_errors, "trigger", common.ValidateJSONSchema(handler.Describe().Schema, trigger_map))
+}
+
+// validateWorkflowActionsSchema validates the actions at path against the JSON schemas of their types, condition
+// branches included, and returns them as a list.
+func validateWorkflowActionsSchema(raw interface{}, path string, field_errors *[]common.JSONSchemaError) []interface{} {
+
+	if raw == nil {
+		return nil
+	}
+
+	list, ok := raw.([]interface{})
+	if !ok {
+		*field_errors = append(*field_errors, common.JSONSchemaError{Path: path, Message: "must be an array"})
+		return nil
+	}
+
+	for index, raw_action := range list {
+
+		action_path := fmt.Sprintf("%s[%d]", path, index)
+
+		action_map, ok := raw_action.(map[string]interface{})
+		if !ok {
+			*field_errors = append(*field_errors, common.JSONSchemaError{Path: action_path, Message: "must be an object"})
+			continue
+		}
+
+		action_type, _ := action_map["type"].(string)
+		if action_type == "" {
+			*field_errors = append(*field_errors, common.JSONSchemaError{Path: action_path + ".type", Message: "is required"})
+			continue
+		}
+
+		handler, ok := workflows.Types.Action(action_type)
+		if !ok {
+			*field_errors = append(*field_errors, common.JSONSchemaError{Path: action_path + ".type", Message: fmt.Sprintf("unsupported action type %s", action_type)})
+			continue
+		}
+
+		appendFieldErrors(field_errors, action_path, common.ValidateJSONSchema(handler.Describe().Schema, action_map))
+
+		if action_type == models.WorkflowActionTypeConditionLabel {
+			for _, branch := range []string{"then", "else"} {
+				validateWorkflowActionsSchema(action_map[branch], action_path+"."+branch, field_errors)
+			}
+		}
+	}
+
+	return list
+}
+
+// workflowReferenceErrors checks the inventory items and env vars referenced by the trigger and actions exist in the tenant,
+// the templates of the actions in lenient missing values mode may reference missing env vars.
+func workflowReferenceErrors(tenant models.Tenant, raw_trigger interface{}, raw_actions []interface{}) []common.JSONSchemaError {
+	return collectWorkflowReferences(tenant, raw_trigger, raw_actions).errors
+}
+
+// collectWorkflowReferences walks the inventory items and env vars referenced by the trigger and actions.
+func collectWorkflowReferences(tenant models.Tenant, raw_trigger interface{}, raw_actions []interface{}) *workflowReferences {
+
+	references := &workflowReferences{
+		env_vars:                   make(map[string]bool),
+		inventory_items:            make(map[string]bool),
+		referenced_env_vars:        make(map[string]bool),
+		referenced_inventory_items: make(map[string]bool),
+		errors:                     make([]common.JSONSchemaError, 0),
+	}
+
+	for _, env_var := range tenant.EnvVars {
+		references.env_vars[env_var.Name] = true
+	}
+
+	for _, item := range tenant.InventoryItems {
+		references.inventory_items[item.ID] = true
+	}
+
+	if trigger_map, ok := raw_trigger.(map[string]interface{}); ok {
+		switch trigger_map["type"] {
+		case models.WorkflowTriggerTypeLowStockLabel:
+			if trigger_map["monitor_type"] == models.TriggerLowStockMonitorTypeSpecific {
+				product_ids, _ := trigger_map["product_ids"].([]interface{})
+				for index, product_id := range product_ids {
+					references.checkInventoryItem(fmt.Sprintf("trigger.product_ids[%d]", index), product_id)
+				}
+			}
+		case models.WorkflowTriggerTypeInboundWebhookLabel:
+			if signature, ok := trigger_map["signature"].(map[string]interface{}); ok {
+				references.checkEnvVars("trigger.signature.secret", signature["secret"], true)
+			}
+		}
+	}
+
+	references.checkActions(raw_actions, "actions")
+
+	return references
+}
+
+// workflowReferences collects the env vars and inventory items a workflow references, and the references
+// to what the tenant doesn't have as errors.
+type workflowReferences struct {
+	env_vars                   map[string]bool
+	inventory_items            map[string]bool
+	referenced_env_vars        map[string]bool
+	referenced_inventory_items map[string]bool
+	errors                     []common.JSONSchemaError
+}
+
+func (r *workflowReferences) checkActions(raw_actions []interface{}, path string) {
+
+	for index, raw_action := range raw_actions {
+
+		action_map, ok := raw_action.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		action_path := fmt.Sprintf("%s[%d]", path, index)
+		action_type, _ := action_map["type"].(string)
+
+		keys := make([]string, 0, len(action_map))
+		for key := range action_map {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			if action_type == models.WorkflowActionTypeConditionLabel && (key == "then" || key == "else") {
+				branch, _ := action_map[key].([]interface{})
+				r.checkActions(branch, action_path+"."+key)
+				continue
+			}
+
+			r.checkEnvVars(action_path+"."+key, action_map[key], action_map["missing_values"] != models.TemplateMissingValuesLenient)
+		}
+
+		if action_type == models.WorkflowActionTypeAdjustInventoryLabel {
+			adjustments, _ := action_map["adjustments"].([]interface{})
+			for adjustment_index, adjustment := range adjustments {
+				adjustment_map, _ := adjustment.(map[string]interface{})
+				item_id, _ := adjustment_map["item_id"].(string)
+				// templated ids are only known when the action runs
+				if !strings.Contains(item_id, "{{") {
+					r.checkInventoryItem(fmt.Sprintf("%s.adjustments[%d].item_id", action_path, adjustment_index), item_id)
+				}
+			}
+		}
+	}
+}
+
+// checkEnvVars checks the env vars read by the templates found in value, objects and arrays are walked.
+// Missing env vars are only errors when required.
+func (r *workflowReferences) checkEnvVars(path string, value interface{}, required bool) {
+
+	switch v := value.(type) {
+	case string:
+		if !strings.Contains(v, "{{") {
+			return
+		}
+
+		template, err := common.ParseTemplate(v)
+		if err != nil {
+			return
+		}
+
+		for _, template_path := range template.Paths() {
+			name := envVarReference(template_path)
+			if name == "" {
+				continue
+			}
+
+			r.referenced_env_vars[name] = true
+			if required && !r.env_vars[name] {
+				r.errors = append(r.errors, common.JSONSchemaError{Path: path, Message: fmt.Sprintf("env var %s doesn't exist", name)})
+			}
+		}
+
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			r.checkEnvVars(path+"."+key, v[key], required)
+		}
+
+	case []interface{}:
+		for index, element := range v {
+			r.checkEnvVars(fmt.Sprintf("%s[%d]", path, index), element, required)
+		}
+	}
+}
+
+func (r *workflowReferences) checkInventoryItem(path string, item_id interface{}) {
+
+	id, _ := item_id.(string)
+	if id == "" {
+		return
+	}
+
+	r.referenced_inventory_items[id] = true
+	if r.inventory_items[id] {
+		return
+	}
+
+	r.errors = append(r.errors, common.JSONSchemaError{Path: path, Message: fmt.Sprintf("inventory item %s doesn't exist", id)})
+}
+
+// envVarReference returns the env var a template path reads, {{ NAME }} and {{ env.NAME }} read env vars
+// while {{ input.x }} reads the action input. It is empty when the path doesn't read an env var.
+func envVarReference(path string) string {
+
+	segments := strings.Split(path, ".")
+	for i, segment := range segments {
+		if bracket := strings.Index(segment, "["); bracket >= 0 {
+			segments[i] = segment[:bracket]
+		}
+	}
+
+	switch segments[0] {
+	case "input":
+		return ""
+	case "env":
+		if len(segments) < 2 {
+			return ""
+		}
+		return segments[1]
+	}
+
+	return segments[0]
+}
+
+// actionFieldPath converts the path of an action (e.g. 1.then.0) into the path of its field (e.g. [1].then[0]).
+func actionFieldPath(action_path string) string {
+
+	var path strings.Builder
+	for _, segment := range strings.Split(action_path, ".") {
+		if _, err := strconv.Atoi(segment); err == nil {
+			path.WriteString("[" + segment + "]")
+		} else {
+			path.WriteString("." + segment)
+		}
+	}
+
+	return path.String()
+}
+
+// appendFieldErrors adds the JSON schema errors of the value at prefix.
+func appendFieldErrors(field_errors *[]common.JSONSchemaError, prefix string, schema_errors []common.JSONSchemaError) {
+
+	for _, schema_err := range schema_errors {
+		switch {
+		case schema_err.Path == "":
+			schema_err.Path = prefix
+		case strings.HasPrefix(schema_err.Path, "["):
+			schema_err.Path = prefix + schema_err.Path
+		default:
+			schema_err.Path = prefix + "." + schema_err.Path
+		}
+		*field_errors = append(*field_errors, schema_err)
+	}
+}
+
+// withoutNulls returns the value with the null properties of its objects left out.
+func withoutNulls(value interface{}) interface{} {
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		cleaned := make(map[string]interface{}, len(v))
+		for key, element := range v {
+			if element != nil {
+				cleaned[key] = withoutNulls(element)
+			}
+		}
+		return cleaned
+	case []interface{}:
+		cleaned := make([]interface{}, len(v))
+		for index, element := range v {
+			cleaned[index] = withoutNulls(element)
+		}
+		return cleaned
+	}
+
+	return value
+}
@@ -0,0 +1,459 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/nutrixpos/hub/modules/hub/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// getVersionsCollection returns the collection of the workflow versions.
+// The caller is responsible for disconnecting the returned client.
+func (ws *WorkflowsService) getVersionsCollection(ctx context.Context) (client *mongo.Client, collection *mongo.Collection, err error) {
+	return ws.getDocumentsCollection(ctx, "workflow_versions")
+}
+
+// EnsureWorkflowVersions creates the versions indexes and records a first version
+// for the workflows saved before they were versioned.
+func (ws *WorkflowsService) EnsureWorkflowVersions() (err error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), ws.dbDeadline())
+	defer cancel()
+
+	client, collection, err := ws.getVersionsCollection(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect(ctx)
+
+	_, err = collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "tenant_id", Value: 1}, {Key: "workflow_id", Value: 1}, {Key: "version", Value: -1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return err
+	}
+
+	tenants_collection := collection.Database().Collection(ws.collectionName("sales"), options.Collection().SetBSONOptions(&options.BSONOptions{
+		DefaultDocumentM: true,
+	}))
+
+	cursor, err := tenants_collection.Find(ctx, bson.M{
+		"workflows": bson.M{"$elemMatch": bson.M{"version": bson.M{"$in": bson.A{nil, 0}}}},
+	}, options.Find().SetProjection(bson.M{
+		"tenant_id": 1,
+		"workflows": 1,
+	}))
+	if err != nil {
+		return err
+	}
+
+	var tenants []struct {
+		TenantID  string   `bson:"tenant_id"`
+		Workflows []bson.M `bson:"workflows"`
+	}
+
+	err = cursor.All(ctx, &tenants)
+	if err != nil {
+		return err
+	}
+
+	for _, tenant := range tenants {
+		for _, workflow := range tenant.Workflows {
+
+			switch version := workflow["version"].(type) {
+			case int32:
+				if version > 0 {
+					continue
+				}
+			case int64:
+				if version > 0 {
+					continue
+				}
+			}
+
+			workflow_id, _ := workflow["id"].(string)
+
+			version, err := ws.RecordWorkflowVersion(tenant.TenantID, workflow_id, workflow, "Version of the workflow saved before versioning")
+			if err != nil {
+				return err
+			}
+
+			_, err = tenants_collection.UpdateOne(ctx, bson.M{
+				"tenant_id":    tenant.TenantID,
+				"workflows.id": workflow_id,
+			}, bson.M{
+				"$set": bson.M{"workflows.$.version": version},
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// RecordWorkflowVersion stores the definition as the next version of the workflow and sets that version on it,
+// the definition is expected to be the workflow document as saved in the tenant.
+func (ws *WorkflowsService) RecordWorkflowVersion(tenant_id string, workflow_id string, definition map[string]interface{}, comment string) (version int, err error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), ws.dbDeadline())
+	defer cancel()
+
+	client, collection, err := ws.getVersionsCollection(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer client.Disconnect(ctx)
+
+	snapshot := make(map[string]interface{}, len(definition))
+	for key, value := range definition {
+		if key == "runs" {
+			continue
+		}
+		snapshot[key] = value
+	}
+
+	// concurrent saves race for the same version number, the unique index lets only one of them through
+	for attempt := 0; attempt < 3; attempt++ {
+
+		var latest models.WorkflowVersion
+		err = collection.FindOne(ctx, bson.M{
+			"tenant_id":   tenant_id,
+			"workflow_id": workflow_id,
+		}, options.FindOne().SetSort(bson.D{{Key: "version", Value: -1}})).Decode(&latest)
+		if err != nil && err != mongo.ErrNoDocuments {
+			return 0, err
+		}
+
+		version = latest.Version + 1
+		snapshot["version"] = version
+
+		_, err = collection.InsertOne(ctx, models.WorkflowVersion{
+			TenantID:   tenant_id,
+			WorkflowID: workflow_id,
+			Version:    version,
+			Definition: snapshot,
+			Comment:    comment,
+			CreatedAt:  time.Now(),
+		})
+		if mongo.IsDuplicateKeyError(err) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		definition["version"] = version
+		return version, nil
+	}
+
+	return 0, fmt.Errorf("couldn't record a new version of workflow %s, it is being saved concurrently", workflow_id)
+}
+
+// DiscardWorkflowVersion removes a version that was recorded for a save that didn't go through.
+func (ws *WorkflowsService) DiscardWorkflowVersion(tenant_id string, workflow_id string, version int) (err error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), ws.dbDeadline())
+	defer cancel()
+
+	client, collection, err := ws.getVersionsCollection(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect(ctx)
+
+	_, err = collection.DeleteOne(ctx, bson.M{
+		"tenant_id":   tenant_id,
+		"workflow_id": workflow_id,
+		"version":     version,
+	})
+	return err
+}
+
+// GetWorkflowVersions returns a page of the versions of the workflow, newest first.
+func (ws *WorkflowsService) GetWorkflowVersions(tenant_id string, workflow_id string, page_number int, page_size int) (versions []models.WorkflowVersion, total_records int, err error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), ws.dbDeadline())
+	defer cancel()
+
+	client, collection, err := ws.getVersionsCollection(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer client.Disconnect(ctx)
+
+	filter := bson.M{
+		"tenant_id":   tenant_id,
+		"workflow_id": workflow_id,
+	}
+
+	count, err := collection.CountDocuments(ctx, filter)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	skip := (page_number - 1) * page_size
+
+	cursor, err := collection.Find(ctx, filter, options.Find().
+		SetSort(bson.D{{Key: "version", Value: -1}}).
+		SetSkip(int64(skip)).
+		SetLimit(int64(page_size)))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	versions = make([]models.WorkflowVersion, 0)
+	err = cursor.All(ctx, &versions)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return versions, int(count), nil
+}
+
+// GetWorkflowVersion returns a version of the workflow, mongo.ErrNoDocuments is returned when it doesn't exist.
+func (ws *WorkflowsService) GetWorkflowVersion(tenant_id string, workflow_id string, version int) (workflow_version models.WorkflowVersion, err error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), ws.dbDeadline())
+	defer cancel()
+
+	client, collection, err := ws.getVersionsCollection(ctx)
+	if err != nil {
+		return workflow_version, err
+	}
+	defer client.Disconnect(ctx)
+
+	err = collection.FindOne(ctx, bson.M{
+		"tenant_id":   tenant_id,
+		"workflow_id": workflow_id,
+		"version":     version,
+	}).Decode(&workflow_version)
+
+	return workflow_version, err
+}
+
+// DiffWorkflowVersions returns the fields that changed from one version of the workflow to another, sorted by path.
+func (ws *WorkflowsService) DiffWorkflowVersions(tenant_id string, workflow_id string, from int, to int) (changes []models.WorkflowVersionChange, err error) {
+
+	from_version, err := ws.GetWorkflowVersion(tenant_id, workflow_id, from)
+	if err != nil {
+		return nil, err
+	}
+
+	to_version, err := ws.GetWorkflowVersion(tenant_id, workflow_id, to)
+	if err != nil {
+		return nil, err
+	}
+
+	return DiffWorkflowDefinitions(from_version.Definition, to_version.Definition)
+}
+
+// DiffWorkflowDefinitions compares two workflow definitions field by field, the version field itself is ignored.
+func DiffWorkflowDefinitions(from interface{}, to interface{}) (changes []models.WorkflowVersionChange, err error) {
+
+	from_value, err := toJSONValue(from)
+	if err != nil {
+		return nil, err
+	}
+
+	to_value, err := toJSONValue(to)
+	if err != nil {
+		return nil, err
+	}
+
+	from_fields := make(map[string]interface{})
+	flattenDefinition("", from_value, from_fields)
+
+	to_fields := make(map[string]interface{})
+	flattenDefinition("", to_value, to_fields)
+
+	changes = make([]models.WorkflowVersionChange, 0)
+
+	for path, from_field := range from_fields {
+		to_field, ok := to_fields[path]
+		switch {
+		case !ok:
+			changes = append(changes, models.WorkflowVersionChange{Path: path, Change: models.WorkflowVersionChangeRemoved, From: from_field})
+		case !reflect.DeepEqual(from_field, to_field):
+			changes = append(changes, models.WorkflowVersionChange{Path: path, Change: models.WorkflowVersionChangeChanged, From: from_field, To: to_field})
+		}
+	}
+
+	for path, to_field := range to_fields {
+		if _, ok := from_fields[path]; !ok {
+			changes = append(changes, models.WorkflowVersionChange{Path: path, Change: models.WorkflowVersionChangeAdded, To: to_field})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+
+	return changes, nil
+}
+
+// flattenDefinition adds every scalar (and empty container) of value to fields keyed by its dotted path.
+func flattenDefinition(prefix string, value interface{}, fields map[string]interface{}) {
+
+	join := func(key string) string {
+		if prefix == "" {
+			return key
+		}
+		return prefix + "." + key
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if len(v) == 0 && prefix != "" {
+			fields[prefix] = v
+		}
+		for key, child := range v {
+			if prefix == "" && key == "version" {
+				continue
+			}
+			flattenDefinition(join(key), child, fields)
+		}
+	case []interface{}:
+		if len(v) == 0 {
+			fields[prefix] = v
+		}
+		for index, child := range v {
+			flattenDefinition(join(fmt.Sprint(index)), child, fields)
+		}
+	default:
+		fields[strings.TrimPrefix(prefix, ".")] = v
+	}
+}
+
+// RollbackWorkflow restores the definition of a previous version as the current workflow,
+// the history stays immutable as the restored definition is saved as a new version.
+// The definition is validated like an edit, a *WorkflowValidationError is returned when it no longer is valid,
+// such as when an env var it reads was deleted since.
+func (ws *WorkflowsService) RollbackWorkflow(tenant_id string, workflow_id string, version int) (new_version int, err error) {
+
+	workflow_version, err := ws.GetWorkflowVersion(tenant_id, workflow_id, version)
+	if err != nil {
+		return 0, err
+	}
+
+	value, err := toJSONValue(workflow_version.Definition)
+	if err != nil {
+		return 0, err
+	}
+
+	definition, ok := value.(map[string]interface{})
+	if !ok {
+		return 0, fmt.Errorf("version %d of workflow %s has an invalid definition", version, workflow_id)
+	}
+
+	tenant_svc := TenantService{
+		Config: ws.Config,
+		Logger: ws.Logger,
+	}
+
+	tenant, err := tenant_svc.GetTenantById(tenant_id)
+	if err != nil {
+		return 0, err
+	}
+
+	restoreWorkflowTrigger(definition, tenant, workflow_id)
+
+	trigger, actions, err := ws.decodeWorkflowDefinition(tenant, definition)
+	if err != nil {
+		return 0, err
+	}
+
+	db_workflow := make(map[string]interface{}, len(definition))
+	for key, value := range definition {
+		db_workflow[key] = value
+	}
+	db_workflow["id"] = workflow_id
+	db_workflow["actions"] = actions
+	delete(db_workflow, "trigger")
+	if trigger != nil {
+		db_workflow["trigger"] = trigger
+	}
+
+	new_version, err = ws.RecordWorkflowVersion(tenant_id, workflow_id, db_workflow, fmt.Sprintf("Rolled back to version %d", version))
+	if err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), ws.dbDeadline())
+	defer cancel()
+
+	client, collection, err := ws.getTenantsCollection(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer client.Disconnect(ctx)
+
+	result, err := collection.UpdateOne(ctx, bson.M{
+		"tenant_id":    tenant_id,
+		"workflows.id": workflow_id,
+	}, bson.M{
+		"$set": bson.M{"workflows.$": db_workflow},
+	})
+	if err == nil && result.MatchedCount == 0 {
+		err = mongo.ErrNoDocuments
+	}
+	if err != nil {
+		ws.DiscardWorkflowVersion(tenant_id, workflow_id, new_version)
+		return 0, err
+	}
+
+	return new_version, nil
+}
+
+// restoreWorkflowTrigger prepares the trigger of a restored definition, like an edit the restored schedule
+// starts counting from now instead of firing what it missed, and an inbound webhook keeps its current token
+// as the one of the version may have been rotated since.
+func restoreWorkflowTrigger(definition map[string]interface{}, tenant models.Tenant, workflow_id string) {
+
+	trigger, ok := definition["trigger"].(map[string]interface{})
+	if !ok {
+		return
+	}
+
+	delete(trigger, "last_scheduled_at")
+
+	if trigger["type"] == models.WorkflowTriggerTypeInboundWebhookLabel {
+		trigger["token"] = currentInboundWebhookToken(tenant, workflow_id)
+	}
+}
+
+// currentInboundWebhookToken returns the token of the inbound webhook trigger of the workflow,
+// empty when it has none so that a new one is generated.
+func currentInboundWebhookToken(tenant models.Tenant, workflow_id string) string {
+
+	for _, raw_workflow := range tenant.Workflows {
+
+		workflow, _, err := DecodeWorkflow(raw_workflow)
+		if err != nil || workflow.ID != workflow_id || workflow.Trigger.Type != models.WorkflowTriggerTypeInboundWebhookLabel {
+			continue
+		}
+
+		raw_trigger, err := rawWorkflowTrigger(raw_workflow)
+		if err != nil {
+			return ""
+		}
+
+		var trigger models.WorkflowInboundWebhookTrigger
+		if decodeTrigger(raw_trigger, &trigger) != nil {
+			return ""
+		}
+
+		return trigger.Token
+	}
+
+	return ""
+}
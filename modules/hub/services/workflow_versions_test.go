@@ -0,0 +1,258 @@
+package services
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/nutrixpos/hub/modules/hub/models"
+)
+
+func TestDiffWorkflowDefinitions(t *testing.T) {
+
+	definition := func(actions ...interface{}) map[string]interface{} {
+		return map[string]interface{}{
+			"name":    "Notify",
+			"version": 1,
+			"trigger": map[string]interface{}{"type": models.WorkflowTriggerTypeLowStockLabel},
+			"actions": append([]interface{}{}, actions...),
+		}
+	}
+
+	request := func(url string) map[string]interface{} {
+		return map[string]interface{}{"type": models.WorkflowActionTypeHttpRequestLabel, "url": url}
+	}
+
+	condition := func(then ...interface{}) map[string]interface{} {
+		return map[string]interface{}{"type": models.WorkflowActionTypeConditionLabel, "expression": "qty < 5", "then": then}
+	}
+
+	tests := []struct {
+		name     string
+		from     interface{}
+		to       interface{}
+		expected []models.WorkflowVersionChange
+	}{
+		{
+			name:     "same definition",
+			from:     definition(request("https://a.example")),
+			to:       definition(request("https://a.example")),
+			expected: []models.WorkflowVersionChange{},
+		},
+		{
+			name: "version ignored",
+			from: definition(request("https://a.example")),
+			to: func() interface{} {
+				d := definition(request("https://a.example"))
+				d["version"] = 2
+				return d
+			}(),
+			expected: []models.WorkflowVersionChange{},
+		},
+		{
+			name: "changed field",
+			from: definition(request("https://a.example")),
+			to:   definition(request("https://b.example")),
+			expected: []models.WorkflowVersionChange{
+				{Path: "actions.0.url", Change: models.WorkflowVersionChangeChanged, From: "https://a.example", To: "https://b.example"},
+			},
+		},
+		{
+			name: "added and removed fields",
+			from: definition(map[string]interface{}{"type": models.WorkflowActionTypeHttpRequestLabel, "url": "https://a.example", "body": "{}"}),
+			to:   definition(map[string]interface{}{"type": models.WorkflowActionTypeHttpRequestLabel, "url": "https://a.example", "method": "POST"}),
+			expected: []models.WorkflowVersionChange{
+				{Path: "actions.0.body", Change: models.WorkflowVersionChangeRemoved, From: "{}"},
+				{Path: "actions.0.method", Change: models.WorkflowVersionChangeAdded, To: "POST"},
+			},
+		},
+		{
+			name: "appended action",
+			from: definition(request("https://a.example")),
+			to:   definition(request("https://a.example"), request("https://b.example")),
+			expected: []models.WorkflowVersionChange{
+				{Path: "actions.1.type", Change: models.WorkflowVersionChangeAdded, To: models.WorkflowActionTypeHttpRequestLabel},
+				{Path: "actions.1.url", Change: models.WorkflowVersionChangeAdded, To: "https://b.example"},
+			},
+		},
+		{
+			name: "emptied actions",
+			from: definition(request("https://a.example")),
+			to:   definition(),
+			expected: []models.WorkflowVersionChange{
+				{Path: "actions", Change: models.WorkflowVersionChangeAdded, To: []interface{}{}},
+				{Path: "actions.0.type", Change: models.WorkflowVersionChangeRemoved, From: models.WorkflowActionTypeHttpRequestLabel},
+				{Path: "actions.0.url", Change: models.WorkflowVersionChangeRemoved, From: "https://a.example"},
+			},
+		},
+		{
+			name: "nested action changed",
+			from: definition(condition(request("https://a.example"), request("https://b.example"))),
+			to:   definition(condition(request("https://a.example"), request("https://c.example"))),
+			expected: []models.WorkflowVersionChange{
+				{Path: "actions.0.then.1.url", Change: models.WorkflowVersionChangeChanged, From: "https://b.example", To: "https://c.example"},
+			},
+		},
+		{
+			name: "nested action added",
+			from: definition(condition(request("https://a.example"))),
+			to:   definition(condition(request("https://a.example"), request("https://b.example"))),
+			expected: []models.WorkflowVersionChange{
+				{Path: "actions.0.then.1.type", Change: models.WorkflowVersionChangeAdded, To: models.WorkflowActionTypeHttpRequestLabel},
+				{Path: "actions.0.then.1.url", Change: models.WorkflowVersionChangeAdded, To: "https://b.example"},
+			},
+		},
+		{
+			name: "action replaced by a condition",
+			from: definition(request("https://a.example")),
+			to:   definition(condition(request("https://a.example"))),
+			expected: []models.WorkflowVersionChange{
+				{Path: "actions.0.expression", Change: models.WorkflowVersionChangeAdded, To: "qty < 5"},
+				{Path: "actions.0.then.0.type", Change: models.WorkflowVersionChangeAdded, To: models.WorkflowActionTypeHttpRequestLabel},
+				{Path: "actions.0.then.0.url", Change: models.WorkflowVersionChangeAdded, To: "https://a.example"},
+				{Path: "actions.0.type", Change: models.WorkflowVersionChangeChanged, From: models.WorkflowActionTypeHttpRequestLabel, To: models.WorkflowActionTypeConditionLabel},
+				{Path: "actions.0.url", Change: models.WorkflowVersionChangeRemoved, From: "https://a.example"},
+			},
+		},
+		{
+			name:     "numbers compared by value",
+			from:     map[string]interface{}{"trigger": map[string]interface{}{"threshold": 5}},
+			to:       map[string]interface{}{"trigger": map[string]interface{}{"threshold": 5.0}},
+			expected: []models.WorkflowVersionChange{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			changes, err := DiffWorkflowDefinitions(test.from, test.to)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(changes, test.expected) {
+				t.Errorf("expected %+v, got %+v", test.expected, changes)
+			}
+		})
+	}
+}
+
+func TestCurrentInboundWebhookToken(t *testing.T) {
+
+	webhook := func(id string, token string) map[string]interface{} {
+		return map[string]interface{}{
+			"id":      id,
+			"trigger": map[string]interface{}{"type": models.WorkflowTriggerTypeInboundWebhookLabel, "token": token},
+			"actions": []interface{}{},
+		}
+	}
+
+	low_stock := map[string]interface{}{
+		"id":      "low-stock",
+		"trigger": map[string]interface{}{"type": models.WorkflowTriggerTypeLowStockLabel, "token": "not-a-webhook"},
+		"actions": []interface{}{},
+	}
+
+	tests := []struct {
+		name        string
+		workflows   []interface{}
+		workflow_id string
+		expected    string
+	}{
+		{
+			name:        "current token kept",
+			workflows:   []interface{}{webhook("orders", "rotated-token")},
+			workflow_id: "orders",
+			expected:    "rotated-token",
+		},
+		{
+			name:        "token of the workflow",
+			workflows:   []interface{}{webhook("refunds", "refunds-token"), webhook("orders", "orders-token")},
+			workflow_id: "orders",
+			expected:    "orders-token",
+		},
+		{
+			name:        "no longer a webhook",
+			workflows:   []interface{}{low_stock},
+			workflow_id: "low-stock",
+			expected:    "",
+		},
+		{
+			name:        "unknown workflow",
+			workflows:   []interface{}{webhook("orders", "orders-token")},
+			workflow_id: "refunds",
+			expected:    "",
+		},
+		{
+			name:        "no workflows",
+			workflows:   nil,
+			workflow_id: "orders",
+			expected:    "",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tenant := models.Tenant{Workflows: test.workflows}
+			if token := currentInboundWebhookToken(tenant, test.workflow_id); token != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, token)
+			}
+		})
+	}
+}
+
+func TestRestoreWorkflowTrigger(t *testing.T) {
+
+	tenant := models.Tenant{Workflows: []interface{}{
+		map[string]interface{}{
+			"id":      "orders",
+			"trigger": map[string]interface{}{"type": models.WorkflowTriggerTypeInboundWebhookLabel, "token": "rotated-token"},
+			"actions": []interface{}{},
+		},
+		map[string]interface{}{
+			"id":      "report",
+			"trigger": map[string]interface{}{"type": models.WorkflowTriggerTypeScheduleLabel, "cron": "0 9 * * *"},
+			"actions": []interface{}{},
+		},
+	}}
+
+	tests := []struct {
+		name        string
+		workflow_id string
+		trigger     map[string]interface{}
+		expected    map[string]interface{}
+	}{
+		{
+			name:        "webhook keeps the current token",
+			workflow_id: "orders",
+			trigger:     map[string]interface{}{"type": models.WorkflowTriggerTypeInboundWebhookLabel, "token": "version-token", "schema": "{}"},
+			expected:    map[string]interface{}{"type": models.WorkflowTriggerTypeInboundWebhookLabel, "token": "rotated-token", "schema": "{}"},
+		},
+		{
+			name:        "webhook restored over another trigger gets a new token",
+			workflow_id: "report",
+			trigger:     map[string]interface{}{"type": models.WorkflowTriggerTypeInboundWebhookLabel, "token": "version-token"},
+			expected:    map[string]interface{}{"type": models.WorkflowTriggerTypeInboundWebhookLabel, "token": ""},
+		},
+		{
+			name:        "schedule starts counting from now",
+			workflow_id: "report",
+			trigger:     map[string]interface{}{"type": models.WorkflowTriggerTypeScheduleLabel, "cron": "0 9 * * *", "last_scheduled_at": "2024-01-01T09:00:00Z"},
+			expected:    map[string]interface{}{"type": models.WorkflowTriggerTypeScheduleLabel, "cron": "0 9 * * *"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			definition := map[string]interface{}{"trigger": test.trigger}
+			restoreWorkflowTrigger(definition, tenant, test.workflow_id)
+			if !reflect.DeepEqual(definition["trigger"], test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, definition["trigger"])
+			}
+		})
+	}
+
+	// a definition without a trigger is left as is
+	definition := map[string]interface{}{"name": "Notify"}
+	restoreWorkflowTrigger(definition, tenant, "orders")
+	if len(definition) != 1 {
+		t.Errorf("expected the definition to be left as is, got %v", definition)
+	}
+}
@@ -4,18 +4,20 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
-	"regexp"
+	"net/url"
+	"strings"
 	"time"
 
 	"github.com/nutrixpos/hub/common"
 	"github.com/nutrixpos/hub/common/config"
-	"github.com/nutrixpos/hub/modules/hub/events"
+	"github.com/nutrixpos/hub/common/workflows"
 	"github.com/nutrixpos/hub/modules/hub/models"
 	"github.com/nutrixpos/pos/common/logger"
 	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
@@ -26,21 +28,20 @@ type WorkflowsService struct {
 	Settings models.Settings
 }
 
-func (ws *WorkflowsService) AddLogsToWorkflowRun(source string, tenant_id string, workflow_id string, run_id string, log models.WorkflowRunLog) (err error) {
-
-	clientOptions := options.Client().ApplyURI(fmt.Sprintf("mongodb://%s:%v", ws.Config.Databases[0].Host, ws.Config.Databases[0].Port))
+// getTenantsCollection connects to the database and returns the collection holding the tenants documents,
+// the caller is responsible for disconnecting the returned client.
+func (ws *WorkflowsService) getTenantsCollection(ctx context.Context) (client *mongo.Client, collection *mongo.Collection, err error) {
+	return ws.getCollection(ctx, "sales")
+}
 
-	db_connection_deadline := 5 * time.Second
-	if ws.Config.Env == "dev" {
-		db_connection_deadline = 1000 * time.Second
-	}
+// getCollection connects to the database and returns the collection configured for table.
+// The caller is responsible for disconnecting the returned client.
+func (ws *WorkflowsService) getCollection(ctx context.Context, table string) (client *mongo.Client, collection *mongo.Collection, err error) {
 
-	// Create a context with a timeout (optional)
-	ctx, cancel := context.WithTimeout(context.Background(), db_connection_deadline)
-	defer cancel()
+	clientOptions := options.Client().ApplyURI(fmt.Sprintf("mongodb://%s:%v", ws.Config.Databases[0].Host, ws.Config.Databases[0].Port))
 
 	// Connect to MongoDB
-	client, err := mongo.Connect(ctx, clientOptions)
+	client, err = mongo.Connect(ctx, clientOptions)
 	if err != nil {
 		return
 	}
@@ -48,647 +49,972 @@ func (ws *WorkflowsService) AddLogsToWorkflowRun(source string, tenant_id string
 	// Ping the database to check connectivity
 	err = client.Ping(ctx, nil)
 	if err != nil {
+		client.Disconnect(ctx)
 		return
 	}
 
 	// Connected successfully
 
-	collection := client.Database(ws.Config.Databases[0].Database).Collection(ws.Config.Databases[0].Tables["sales"])
+	collection = client.Database(ws.Config.Databases[0].Database).Collection(ws.collectionName(table))
+	return
+}
+
+// collectionName returns the collection configured for table, tables missing from the config use their key as the collection name.
+func (ws *WorkflowsService) collectionName(table string) string {
 
-	filter := bson.M{
-		"tenant_id":         tenant_id,
-		"workflows.id":      workflow_id,
-		"workflows.runs.id": run_id,
+	name, ok := ws.Config.Databases[0].Tables[table]
+	if !ok || name == "" {
+		return table
 	}
 
-	// Create the update to push log to the specific run
-	// We need to use array filters to target the correct nested elements
-	update := bson.M{
-		"$push": bson.M{
-			"workflows.$[workflow].runs.$[run].logs": log,
-		},
+	return name
+}
+
+// getDocumentsCollection returns the collection configured for table with embedded documents decoded as maps,
+// so that the free form documents it stores (e.g. action inputs and outputs) read back as they were written.
+// The caller is responsible for disconnecting the returned client.
+func (ws *WorkflowsService) getDocumentsCollection(ctx context.Context, table string) (client *mongo.Client, collection *mongo.Collection, err error) {
+
+	client, collection, err = ws.getCollection(ctx, table)
+	if err != nil {
+		return
 	}
 
-	arrayFilters := options.ArrayFilters{
-		Filters: []interface{}{
-			bson.M{"workflow.id": workflow_id},
-			bson.M{"run.id": run_id},
-		},
+	collection = collection.Database().Collection(collection.Name(), options.Collection().SetBSONOptions(&options.BSONOptions{
+		DefaultDocumentM: true,
+	}))
+	return
+}
+
+// dbDeadline returns the timeout used for the database operations of the service.
+func (ws *WorkflowsService) dbDeadline() time.Duration {
+	if ws.Config.Env == "dev" {
+		return 1000 * time.Second
 	}
+	return 5 * time.Second
+}
+
+// DecodeWorkflow decodes a workflow as stored in the tenant document, it returns the
+// workflow definition alongside the raw documents of its actions so that each action
+// can be decoded into its concrete type.
+func DecodeWorkflow(raw interface{}) (workflow models.Workflow, actions []bson.Raw, err error) {
 
-	opts := options.Update().SetArrayFilters(arrayFilters)
+	b, err := bson.Marshal(raw)
+	if err != nil {
+		return workflow, actions, err
+	}
 
-	// Execute the update
-	result, err := collection.UpdateOne(context.Background(), filter, update, opts)
+	err = bson.Unmarshal(b, &workflow)
+	if err != nil {
+		return workflow, actions, err
+	}
+
+	raw_actions := struct {
+		Actions []bson.Raw `bson:"actions"`
+	}{}
+
+	err = bson.Unmarshal(b, &raw_actions)
+	if err != nil {
+		return workflow, actions, err
+	}
+
+	return workflow, raw_actions.Actions, nil
+}
+
+// RunWorkflow starts a new run of the workflow whose trigger produced the given output and executes its actions,
+// trigger_logs are what the trigger has to say about the run, such as the events it suppressed.
+func (ws *WorkflowsService) RunWorkflow(tenant_id string, workflow models.Workflow, actions []bson.Raw, trigger_output interface{}, trigger_logs ...models.WorkflowRunLog) (err error) {
+
+	run_id, err := ws.StartWorkflowRun(tenant_id, workflow)
 	if err != nil {
-		ws.Logger.Error(err.Error())
 		return err
 	}
 
-	if result.MatchedCount == 0 {
-		return mongo.ErrNoDocuments
+	for _, log := range trigger_logs {
+		ws.AddLogsToWorkflowRun(workflow.Trigger.Type, tenant_id, workflow.ID, run_id, log)
 	}
 
-	return nil
+	ws.AddLogsToWorkflowRun(workflow.Trigger.Type, tenant_id, workflow.ID, run_id, models.WorkflowRunLog{
+		Level:     "INFO",
+		Message:   fmt.Sprintf("Finished evaluating the %s trigger, running actions...", workflow.Trigger.Type),
+		TimeStamp: time.Now(),
+	})
+
+	return ws.RunWorkflowActions(tenant_id, workflow.ID, run_id, actions, trigger_output)
 }
 
-func (ws *WorkflowsService) RunLowStockTriggeredWorkflows(events []events.EventLowStockData) (err error) {
+// workflowExecution holds the state of a run while its actions are executed.
+type workflowExecution struct {
+	TenantID   string
+	WorkflowID string
+	RunID      string
+	// Context is cancelled when the run is, see CancelWorkflowRun
+	Context context.Context
+	// NextStepIndex is the index given to the next step created for a branch action
+	NextStepIndex int
+	// ResumeIndex and ResumeInput track the top level action being executed and its input,
+	// a dead letter redrives the run from there
+	ResumeIndex int
+	ResumeInput interface{}
+}
 
-	run_id := primitive.NewObjectID().Hex()
+// errWorkflowRunPaused is returned by the executor when the run paused on an approval or a delay step,
+// it is resumed from there later, see resumeWorkflowRun.
+var errWorkflowRunPaused = errors.New("workflow run is paused")
 
-	clientOptions := options.Client().ApplyURI(fmt.Sprintf("mongodb://%s:%v", ws.Config.Databases[0].Host, ws.Config.Databases[0].Port))
+// RunWorkflowActions executes the actions of a workflow run in order, the output of each
+// action is passed as the input of the next one, starting with the trigger output.
+// Execution stops at the first failing action, marking the run as failed and the remaining steps as skipped,
+// when a filter drops everything, completing the run, or when the run is cancelled.
+func (ws *WorkflowsService) RunWorkflowActions(tenant_id string, workflow_id string, run_id string, actions []bson.Raw, input interface{}) (err error) {
+	return ws.runWorkflowActionsFrom(tenant_id, workflow_id, run_id, actions, input, 0, len(actions))
+}
 
-	db_connection_deadline := 5 * time.Second
-	if ws.Config.Env == "dev" {
-		db_connection_deadline = 1000 * time.Second
+// runWorkflowActionsFrom executes the top level actions of the run starting at first, input being the input of that action.
+// next_step_index is the index of the first step created for a branch action, see nextWorkflowRunStepIndex.
+func (ws *WorkflowsService) runWorkflowActionsFrom(tenant_id string, workflow_id string, run_id string, actions []bson.Raw, input interface{}, first int, next_step_index int) (err error) {
+
+	if len(actions) == 0 {
+		ws.FailWorkflow(tenant_id, workflow_id, run_id, "Workflow has no actions to run")
+		return fmt.Errorf("no actions found")
 	}
 
-	// Create a context with a timeout (optional)
-	ctx, cancel := context.WithTimeout(context.Background(), db_connection_deadline)
-	defer cancel()
+	ctx, release := watchWorkflowRunCancellation(run_id)
+	defer release()
 
-	// Connect to MongoDB
-	client, err := mongo.Connect(ctx, clientOptions)
-	if err != nil {
-		return
+	execution := &workflowExecution{
+		TenantID:      tenant_id,
+		WorkflowID:    workflow_id,
+		RunID:         run_id,
+		Context:       ctx,
+		NextStepIndex: next_step_index,
 	}
 
-	// Ping the database to check connectivity
-	err = client.Ping(ctx, nil)
+	output, halted, err := ws.runActions(execution, actions, input, "", first)
+	if errors.Is(err, ErrWorkflowRunCancelled) {
+		// the run was already marked as cancelled by CancelWorkflowRun
+		ws.AddLogsToWorkflowRun("", tenant_id, workflow_id, run_id, models.WorkflowRunLog{
+			Level:     "WARNING",
+			Message:   "Stopped running the actions, the run was cancelled",
+			TimeStamp: time.Now(),
+		})
+		return nil
+	}
+	if errors.Is(err, errWorkflowRunPaused) {
+		ws.AddLogsToWorkflowRun("", tenant_id, workflow_id, run_id, models.WorkflowRunLog{
+			Level:     "INFO",
+			Message:   "Paused running the actions until the run is resumed",
+			TimeStamp: time.Now(),
+		})
+		return nil
+	}
 	if err != nil {
-		return
+		ws.SkipPendingWorkflowRunSteps(tenant_id, workflow_id, run_id)
+		ws.FailWorkflow(tenant_id, workflow_id, run_id, err.Error())
+		return err
 	}
 
-	// Connected successfully
-
-	collection := client.Database(ws.Config.Databases[0].Database).Collection(ws.Config.Databases[0].Tables["sales"])
-
-	// Filter for specific tenant
-	filter := bson.M{
-		"tenant_id":              events[0].TenantId,
-		"workflows.trigger.type": models.WorkflowTriggerTypeLowStockLabel,
+	if halted {
+		ws.SkipPendingWorkflowRunSteps(tenant_id, workflow_id, run_id)
 	}
 
-	// Projection to select only workflows field
-	opts := options.FindOne().SetProjection(bson.M{
-		"workflows.$": 1,
-	})
+	return ws.CompleteWorkflow(tenant_id, workflow_id, run_id, output)
+}
 
-	// Using bson.M for dynamic structure
-	var result bson.M
-	err = collection.FindOne(context.Background(), filter, opts).Decode(&result)
+// resumeWorkflowRun completes the step the run paused on, passing its input on, and queues the execution of the
+// remaining actions from resume_index. The run must already be back to running with its resume leased to this hub,
+// the lease is renewed until the actions stop executing.
+func (ws *WorkflowsService) resumeWorkflowRun(tenant_id string, workflow_id string, run_id string, version int, step_index int, resume_index int, input interface{}) (err error) {
 
-	if err == mongo.ErrNoDocuments {
-		return mongo.ErrNoDocuments
-	}
+	ws.SetWorkflowRunStepOutput(tenant_id, workflow_id, run_id, step_index, input)
+	ws.SetWorkflowRunStepStatus(tenant_id, workflow_id, run_id, step_index, models.WorkflowRunStepStatusCompleted)
 
+	_, actions, err := ws.workflowVersionActions(tenant_id, workflow_id, version)
 	if err != nil {
-		ws.Logger.Error(err.Error())
+		ws.FailWorkflow(tenant_id, workflow_id, run_id, fmt.Sprintf("couldn't resume the run: %v", err))
 		return err
 	}
 
-	// 1. Assert to primitive.A (which is []interface{})
-	rawWorkflows, ok := result["workflows"].(primitive.A)
-	if !ok {
-		return fmt.Errorf("result['workflows'] is not an array or is missing")
+	// the branch steps that ran before the pause keep their indexes
+	run, err := ws.GetWorkflowRun(tenant_id, workflow_id, run_id)
+	if err != nil {
+		ws.FailWorkflow(tenant_id, workflow_id, run_id, fmt.Sprintf("couldn't resume the run: %v", err))
+		return err
 	}
+	next_step_index := nextWorkflowRunStepIndex(run.Steps, len(actions))
+
+	renewing := ws.renewWorkflowRunResumeLease(tenant_id, workflow_id, run_id)
 
-	// 2. Check length safely
-	if len(rawWorkflows) == 0 {
-		return fmt.Errorf("no workflows found")
+	err = ws.queueWorkflowRun(tenant_id, workflow_id, func() error {
+		defer close(renewing)
+		return ws.runWorkflowActionsFrom(tenant_id, workflow_id, run_id, actions, input, resume_index, next_step_index)
+	})
+	if err != nil {
+		close(renewing)
+		ws.SkipPendingWorkflowRunSteps(tenant_id, workflow_id, run_id)
+		ws.FailWorkflow(tenant_id, workflow_id, run_id, fmt.Sprintf("couldn't resume the run: %v", err))
+		return err
 	}
 
-	// 3. Convert to []bson.M manually
-	workflows := make([]bson.M, len(rawWorkflows))
-	for i, v := range rawWorkflows {
-		workflows[i] = v.(bson.M) // Assert individual elements
+	return nil
+}
+
+// nextWorkflowRunStepIndex returns the index of the next step created for a branch action of a run having steps,
+// the top level actions hold the first actions_count indexes and the branch steps the ones after.
+func nextWorkflowRunStepIndex(steps []models.WorkflowRunStep, actions_count int) int {
+
+	next := actions_count
+	for _, step := range steps {
+		if step.Index >= next {
+			next = step.Index + 1
+		}
 	}
 
-	output := models.WorkflowLowStockTriggerOutput{
-		Items: make([]models.WorkflowLowStockTriggerOutputItem, 0),
+	return next
+}
+
+// workflowVersionActions returns the workflow and its actions as of the version, a run resumes with the
+// definition it started with. Runs started before versions were recorded resume with the current definition.
+func (ws *WorkflowsService) workflowVersionActions(tenant_id string, workflow_id string, version int) (workflow models.Workflow, actions []bson.Raw, err error) {
+
+	workflow_version, err := ws.GetWorkflowVersion(tenant_id, workflow_id, version)
+	if err == mongo.ErrNoDocuments {
+		return ws.GetWorkflow(tenant_id, workflow_id)
+	}
+	if err != nil {
+		return workflow, nil, err
 	}
 
-	for _, w := range workflows {
-		var workflow models.Workflow
-		if b, err := bson.Marshal(w); err == nil {
-			_ = bson.Unmarshal(b, &workflow)
+	workflow, actions, err = DecodeWorkflow(workflow_version.Definition)
+	workflow.Version = version
+	return workflow, actions, err
+}
+
+// runActions executes a list of actions, either the top level actions of the workflow (empty path_prefix)
+// or the actions of a condition branch, starting at first. halted reports that a filter stopped the run.
+func (ws *WorkflowsService) runActions(execution *workflowExecution, actions []bson.Raw, input interface{}, path_prefix string, first int) (output interface{}, halted bool, err error) {
+
+	output = input
+
+	for position := first; position < len(actions); position++ {
+
+		raw_action := actions[position]
+
+		if ws.workflowRunCancelled(execution) {
+			ws.stopCancelledWorkflowRun(execution, -1)
+			return nil, false, ErrWorkflowRunCancelled
 		}
 
-		if workflow.Trigger.Type == models.WorkflowTriggerTypeLowStockLabel {
-			var trigger models.WorkflowLowStockTrigger
-			if b, err := bson.Marshal(w["trigger"]); err == nil {
-				_ = bson.Unmarshal(b, &trigger)
-			}
+		if path_prefix == "" {
+			execution.ResumeIndex = position
+			execution.ResumeInput = output
+		}
+
+		var action models.WorkflowActionBase
+		decode_err := bson.Unmarshal(raw_action, &action)
+
+		step_index := position
+		path := fmt.Sprint(position)
 
-			if trigger.MonitorType == models.TriggerLowStockMonitorTypeAny {
-
-				newRun := models.WorkflowRun{
-					ID:        run_id,
-					StartTime: time.Now(),
-					Status:    "running",
-					Logs: []models.WorkflowRunLog{
-						{
-							Level:     "INFO",
-							TimeStamp: time.Now(),
-							Message:   "Workflow execution started.",
-						},
-					},
-				}
-
-				_, err = collection.UpdateOne(ctx, bson.M{
-					"tenant_id":    events[0].TenantId,
-					"workflows.id": workflow.ID,
-				}, bson.M{
-					"$push": bson.M{
-						"workflows.$.runs": newRun,
-					},
-				})
-				if err != nil {
-					ws.Logger.Error(err.Error())
-				}
-
-				for _, event := range events {
-					output.Items = append(output.Items, models.WorkflowLowStockTriggerOutputItem{
-						ItemID:   event.ItemID,
-						ItemName: event.ItemName,
-						Quantity: event.Current,
-					})
-				}
-
-			} else {
-				for _, event := range events {
-
-					for _, product_id := range trigger.ProductIDs {
-						if event.ItemID == product_id {
-							output.Items = append(output.Items, models.WorkflowLowStockTriggerOutputItem{
-								ItemID:   event.ItemID,
-								ItemName: event.ItemName,
-								Quantity: event.Current,
-							})
-						}
-					}
-				}
+		if path_prefix != "" {
+			path = fmt.Sprintf("%s.%d", path_prefix, position)
+			step_index = execution.NextStepIndex
+			execution.NextStepIndex++
+
+			err = ws.AddWorkflowRunStep(execution.TenantID, execution.WorkflowID, execution.RunID, models.WorkflowRunStep{
+				Index:  step_index,
+				Path:   path,
+				Type:   action.Type,
+				Status: models.WorkflowRunStepStatusPending,
+				Logs:   []models.WorkflowRunLog{},
+			})
+			if err != nil {
+				return nil, false, err
 			}
 		}
 
-		ws.AddLogsToWorkflowRun(models.WorkflowTriggerTypeLowStockLabel, events[0].TenantId, workflow.ID, run_id, models.WorkflowRunLog{
+		if decode_err != nil {
+			return nil, false, ws.failStep(execution, step_index, path, fmt.Errorf("failed to decode action: %v", decode_err))
+		}
+
+		ws.SetWorkflowRunStepStatus(execution.TenantID, execution.WorkflowID, execution.RunID, step_index, models.WorkflowRunStepStatusRunning)
+		ws.AddLogsToWorkflowRunStep(execution.TenantID, execution.WorkflowID, execution.RunID, step_index, models.WorkflowRunLog{
 			Level:     "INFO",
-			Message:   fmt.Sprintf("Finished evaluating the %s trigger, running actions...", models.WorkflowTriggerTypeLowStockLabel),
+			Message:   fmt.Sprintf("Running step %s (%s)...", path, action.Type),
 			TimeStamp: time.Now(),
 		})
 
-		rawActions, ok := w["actions"].(primitive.A)
-		if !ok {
-			return fmt.Errorf("result['actions'] is not an array or is missing")
-		}
+		switch action.Type {
+		case models.WorkflowActionTypeConditionLabel:
+			var condition models.WorkflowConditionAction
+			err = bson.Unmarshal(raw_action, &condition)
+			if err != nil {
+				return nil, false, ws.failStep(execution, step_index, path, err)
+			}
 
-		// 2. Check length safely
-		if len(rawActions) == 0 {
-			return fmt.Errorf("no actions found")
-		}
+			branch, branch_actions, err := ws.evaluateCondition(execution, step_index, raw_action, condition, output)
+			if err != nil {
+				return nil, false, ws.failStep(execution, step_index, path, err)
+			}
 
-		// 3. Convert to []bson.M manually
-		actions_bson := make([]bson.M, len(rawActions))
-		for i, v := range rawActions {
-			actions_bson[i] = v.(bson.M) // Assert individual elements
-		}
+			ws.SetWorkflowRunStepStatus(execution.TenantID, execution.WorkflowID, execution.RunID, step_index, models.WorkflowRunStepStatusCompleted)
+
+			output, halted, err = ws.runActions(execution, branch_actions, output, path+"."+branch, 0)
+			if err != nil || halted {
+				return output, halted, err
+			}
+
+			continue
 
-		actions_base := make([]models.WorkflowActionBase, 0)
+		case models.WorkflowActionTypeFilterLabel:
+			var filter models.WorkflowFilterAction
+			err = bson.Unmarshal(raw_action, &filter)
+			if err != nil {
+				return nil, false, ws.failStep(execution, step_index, path, err)
+			}
 
-		for _, a := range actions_bson {
-			var action models.WorkflowActionBase
-			if b, err := bson.Marshal(a); err == nil {
-				_ = bson.Unmarshal(b, &action)
+			filtered, keep, err := ws.evaluateFilter(execution, step_index, filter, output)
+			if err != nil {
+				return nil, false, ws.failStep(execution, step_index, path, err)
 			}
 
-			actions_base = append(actions_base, action)
-		}
+			ws.SetWorkflowRunStepOutput(execution.TenantID, execution.WorkflowID, execution.RunID, step_index, filtered)
+			ws.SetWorkflowRunStepStatus(execution.TenantID, execution.WorkflowID, execution.RunID, step_index, models.WorkflowRunStepStatusCompleted)
+
+			if !keep {
+				return filtered, true, nil
+			}
 
-		if actions_base[0].Type == models.WorkflowActionTypeN8nWebhookLabel {
+			output = filtered
+			continue
 
-			var next_action models.WorkflowN8nWebhookAction
-			if b, err := bson.Marshal(actions_bson[0]); err == nil {
-				_ = bson.Unmarshal(b, &next_action)
+		case models.WorkflowActionTypeWaitForApprovalLabel:
+			if path_prefix != "" {
+				return nil, false, ws.failStep(execution, step_index, path, fmt.Errorf("%s can only be a top level action", action.Type))
 			}
 
-			err = ws.RunN8nAction(output, next_action, actions_bson[1:], events[0].TenantId, workflow.ID, run_id)
+			err = ws.requestApproval(execution, step_index, raw_action, output)
+			if errors.Is(err, ErrWorkflowRunCancelled) {
+				ws.stopCancelledWorkflowRun(execution, step_index)
+				return nil, false, err
+			}
 			if err != nil {
-				ws.Logger.Error(err.Error())
-
-				ws.AddLogsToWorkflowRun(
-					models.WorkflowActionTypeN8nWebhookLabel,
-					events[0].TenantId,
-					workflow.ID,
-					run_id,
-					models.WorkflowRunLog{
-						Level:     "ERROR",
-						Message:   err.Error(),
-						TimeStamp: time.Now(),
-					},
-				)
-
-				filter := bson.M{
-					"tenant_id":         events[0].TenantId,
-					"workflows.id":      workflow.ID,
-					"workflows.runs.id": run_id,
-				}
-
-				// Create the update to push log to the specific run
-				// We need to use array filters to target the correct nested elements
-				update := bson.M{
-					"$set": bson.M{
-						"workflows.$[workflow].runs.$[run].end_time": time.Now(),
-						"workflows.$[workflow].runs.$[run].status":   "failed",
-					},
-				}
-
-				arrayFilters := options.ArrayFilters{
-					Filters: []interface{}{
-						bson.M{"workflow.id": workflow.ID},
-						bson.M{"run.id": run_id},
-					},
-				}
-
-				opts := options.Update().SetArrayFilters(arrayFilters)
-
-				// Execute the update
-				result, err := collection.UpdateOne(context.Background(), filter, update, opts)
-				if err != nil {
-					ws.Logger.Error(err.Error())
-					return err
-				}
-
-				if result.MatchedCount == 0 {
-					return mongo.ErrNoDocuments
-				}
+				return nil, false, ws.failStep(execution, step_index, path, err)
+			}
+
+			// the run resumes from the approval, see DecideWorkflowApproval
+			return nil, false, errWorkflowRunPaused
+
+		case models.WorkflowActionTypeDelayLabel:
+			if path_prefix != "" {
+				return nil, false, ws.failStep(execution, step_index, path, fmt.Errorf("%s can only be a top level action", action.Type))
+			}
+
+			delayed, err := ws.delayWorkflowRun(execution, step_index, raw_action, output)
+			if errors.Is(err, ErrWorkflowRunCancelled) {
+				ws.stopCancelledWorkflowRun(execution, step_index)
+				return nil, false, err
 			}
+			if err != nil {
+				return nil, false, ws.failStep(execution, step_index, path, err)
+			}
+
+			if delayed {
+				// the run resumes once the delay is over, see ResumeDelayedWorkflowRuns
+				return nil, false, errWorkflowRunPaused
+			}
+
+			ws.SetWorkflowRunStepOutput(execution.TenantID, execution.WorkflowID, execution.RunID, step_index, output)
+			ws.SetWorkflowRunStepStatus(execution.TenantID, execution.WorkflowID, execution.RunID, step_index, models.WorkflowRunStepStatusCompleted)
+			continue
+		}
+
+		action_output, attempts, err := ws.runActionWithRetry(execution, step_index, action.Type, raw_action, output)
+		if execution.Context.Err() != nil {
+			// whatever the action returned, it was interrupted or finished after the run was cancelled
+			ws.stopCancelledWorkflowRun(execution, step_index)
+			return nil, false, ErrWorkflowRunCancelled
+		}
+		if err != nil {
+			ws.deadLetterStep(execution, step_index, path, action.Type, attempts, output, err)
+			return nil, false, ws.failStep(execution, step_index, path, err)
 		}
 
+		ws.SetWorkflowRunStepOutput(execution.TenantID, execution.WorkflowID, execution.RunID, step_index, action_output)
+		ws.SetWorkflowRunStepStatus(execution.TenantID, execution.WorkflowID, execution.RunID, step_index, models.WorkflowRunStepStatusCompleted)
+
+		output = action_output
 	}
 
-	return err
+	return output, false, nil
 }
 
-func (ws *WorkflowsService) RunN8nAction(input interface{}, action models.WorkflowN8nWebhookAction, next_actions []bson.M, tenant_id string, workflow_id string, run_id string) error {
+// evaluateCondition evaluates the condition over the input and returns the chosen branch
+// with its actions, the decision is recorded in the step and run logs.
+func (ws *WorkflowsService) evaluateCondition(execution *workflowExecution, step_index int, raw_action bson.Raw, condition models.WorkflowConditionAction, input interface{}) (branch string, actions []bson.Raw, err error) {
 
-	ws.AddLogsToWorkflowRun(models.WorkflowActionTypeN8nWebhookLabel, tenant_id, workflow_id, run_id, models.WorkflowRunLog{
+	expression, err := common.ParseExpression(condition.Expression)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid expression %s: %v", condition.Expression, err)
+	}
+
+	holds, err := expression.Evaluate(input)
+	if err != nil {
+		return "", nil, err
+	}
+
+	branches := struct {
+		Then []bson.Raw `bson:"then"`
+		Else []bson.Raw `bson:"else"`
+	}{}
+	err = bson.Unmarshal(raw_action, &branches)
+	if err != nil {
+		return "", nil, err
+	}
+
+	branch, actions = "then", branches.Then
+	if !holds {
+		branch, actions = "else", branches.Else
+	}
+
+	decision := fmt.Sprintf("Condition %s evaluated to %t, running the %s branch (%d actions)", condition.Expression, holds, branch, len(actions))
+
+	ws.AddLogsToWorkflowRunStep(execution.TenantID, execution.WorkflowID, execution.RunID, step_index, models.WorkflowRunLog{
 		Level:     "INFO",
-		Message:   "Running N8n action...",
+		Message:   decision,
+		TimeStamp: time.Now(),
+	})
+	ws.AddLogsToWorkflowRun(models.WorkflowActionTypeConditionLabel, execution.TenantID, execution.WorkflowID, execution.RunID, models.WorkflowRunLog{
+		Level:     "INFO",
+		Message:   decision,
 		TimeStamp: time.Now(),
 	})
 
-	if len(next_actions) == 0 {
+	return branch, actions, nil
+}
 
-		clientOptions := options.Client().ApplyURI(fmt.Sprintf("mongodb://%s:%v", ws.Config.Databases[0].Host, ws.Config.Databases[0].Port))
+// evaluateFilter applies the filter over the input, keep is false when nothing is left to pass
+// to the next actions, the decision is recorded in the step and run logs.
+func (ws *WorkflowsService) evaluateFilter(execution *workflowExecution, step_index int, filter models.WorkflowFilterAction, input interface{}) (output interface{}, keep bool, err error) {
 
-		db_connection_deadline := 5 * time.Second
-		if ws.Config.Env == "dev" {
-			db_connection_deadline = 1000 * time.Second
-		}
+	expression, err := common.ParseExpression(filter.Expression)
+	if err != nil {
+		return nil, false, fmt.Errorf("invalid expression %s: %v", filter.Expression, err)
+	}
 
-		// Create a context with a timeout (optional)
-		ctx, cancel := context.WithTimeout(context.Background(), db_connection_deadline)
-		defer cancel()
+	var decision string
 
-		// Connect to MongoDB
-		client, err := mongo.Connect(ctx, clientOptions)
+	if expression.IterablePath() != "" {
+		filtered, total, kept, err := expression.Filter(input)
 		if err != nil {
-			return err
+			return nil, false, err
 		}
 
-		// Ping the database to check connectivity
-		err = client.Ping(ctx, nil)
+		output, keep = filtered, kept > 0
+		decision = fmt.Sprintf("Filter %s kept %d of %d %s", filter.Expression, kept, total, expression.IterablePath())
+	} else {
+		holds, err := expression.Evaluate(input)
 		if err != nil {
-			return err
+			return nil, false, err
 		}
 
-		// Connected successfully
-		collection := client.Database(ws.Config.Databases[0].Database).Collection(ws.Config.Databases[0].Tables["sales"])
+		output, keep = input, holds
+		decision = fmt.Sprintf("Filter %s evaluated to %t", filter.Expression, holds)
+	}
 
-		filter := bson.M{
-			"tenant_id": tenant_id,
-		}
+	if !keep {
+		decision += ", nothing left to process, stopping the run"
+	}
 
-		// Get the tenant from the database
-		var tenant models.Tenant
-		err = collection.FindOne(ctx, filter).Decode(&tenant)
-		if err != nil {
-			return err
-		}
+	ws.AddLogsToWorkflowRunStep(execution.TenantID, execution.WorkflowID, execution.RunID, step_index, models.WorkflowRunLog{
+		Level:     "INFO",
+		Message:   decision,
+		TimeStamp: time.Now(),
+	})
+	ws.AddLogsToWorkflowRun(models.WorkflowActionTypeFilterLabel, execution.TenantID, execution.WorkflowID, execution.RunID, models.WorkflowRunLog{
+		Level:     "INFO",
+		Message:   decision,
+		TimeStamp: time.Now(),
+	})
 
-		webhook_url_preprocessed := action.WebhookURL
+	return output, keep, nil
+}
 
-		secrets_map := make(map[string]interface{})
-		for _, env_var := range tenant.EnvVars {
-			if env_var.IsSecret {
-				secrets_map[env_var.Name] = env_var.Value
-			}
-		}
-		secrets_values := make([]string, 0)
-		for _, env_var := range secrets_map {
-			secrets_values = append(secrets_values, fmt.Sprintf("%s", env_var))
-		}
+// runAction executes the action with the handler of its type, returning its output.
+func (ws *WorkflowsService) runAction(ctx context.Context, tenant_id string, workflow_id string, run_id string, step_index int, action_type string, raw_action bson.Raw, input interface{}) (output interface{}, err error) {
 
-		webhook_url_processed, err := common.InterpretVars(webhook_url_preprocessed, secrets_map)
-		if err != nil {
-			return fmt.Errorf("Couldn't interpret env vars")
-		}
+	handler, ok := workflows.Types.Action(action_type)
+	if !ok {
+		return nil, fmt.Errorf("unsupported action type: %s", action_type)
+	}
 
-		filter = bson.M{
-			"tenant_id":         tenant_id,
-			"workflows.id":      workflow_id,
-			"workflows.runs.id": run_id,
-		}
+	return handler.Execute(workflows.ActionContext{
+		Context:    ctx,
+		Service:    ws,
+		TenantID:   tenant_id,
+		WorkflowID: workflow_id,
+		RunID:      run_id,
+		StepIndex:  step_index,
+	}, raw_action, input)
+}
 
-		jsonData, err := json.Marshal(input)
-		if err != nil {
-			fmt.Println("Error marshaling JSON:", err)
-			return err
-		}
+// failStep records the error on the failing step and marks it as failed, it returns
+// the error prefixed with the step path to be recorded on the run.
+func (ws *WorkflowsService) failStep(execution *workflowExecution, step_index int, path string, step_err error) error {
 
-		// Create HTTP request
-		url := webhook_url_processed
-		http_req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
-		if err != nil {
-			fmt.Println("Error creating request: %s", common.MaskString(err.Error(), secrets_values))
-			return err
-		}
+	ws.AddLogsToWorkflowRunStep(execution.TenantID, execution.WorkflowID, execution.RunID, step_index, models.WorkflowRunLog{
+		Level:     "ERROR",
+		Message:   step_err.Error(),
+		TimeStamp: time.Now(),
+	})
+	ws.SetWorkflowRunStepStatus(execution.TenantID, execution.WorkflowID, execution.RunID, step_index, models.WorkflowRunStepStatusFailed)
 
-		// Set headers
-		http_req.Header.Set("Content-Type", "application/json")
-		http_req.Header.Set("User-Agent", "Go-HTTP-Client")
+	return fmt.Errorf("step %s failed: %s", path, step_err.Error())
+}
 
-		for key, value := range action.Headers {
+func (ws *WorkflowsService) RunN8nAction(ctx context.Context, input interface{}, action models.WorkflowN8nWebhookAction, tenant_id string, workflow_id string, run_id string, step_index int) (output interface{}, err error) {
 
-			k, err := common.InterpretVars(key, secrets_map)
-			if err != nil {
-				return fmt.Errorf("Couldn't interpret env var %s", common.MaskString(key, secrets_values))
-			}
-			v, err := common.InterpretVars(value, secrets_map)
-			if err != nil {
-				return fmt.Errorf("Couldn't interpret env var %s", common.MaskString(value, secrets_values))
-			}
+	ws.AddLogsToWorkflowRunStep(tenant_id, workflow_id, run_id, step_index, models.WorkflowRunLog{
+		Level:     "INFO",
+		Message:   "Running N8n action...",
+		TimeStamp: time.Now(),
+	})
 
-			http_req.Header.Set(k, v)
-		}
+	http_req, secrets_values, err := ws.prepareN8nRequest(input, action, tenant_id, false)
+	if err != nil {
+		return nil, err
+	}
 
-		// Create HTTP client with timeout
-		timeout := 10
-		if action.Timeout > 0 {
-			timeout = action.Timeout
+	if http_req.Header.Get(WorkflowSignatureHeader) == "" {
+		ws.warnUnsignedRequest(tenant_id, workflow_id, run_id)
+	}
+
+	// Create HTTP client with timeout
+	timeout := 10
+	if action.Timeout > 0 {
+		timeout = action.Timeout
+	}
+	http_client := &http.Client{
+		Timeout: time.Duration(timeout) * time.Second,
+	}
+
+	// Send request, it is aborted when the run is cancelled
+	http_resp, err := http_client.Do(http_req.WithContext(ctx))
+	if err != nil {
+		return nil, &ActionRequestError{Message: fmt.Sprintf("error sending request: %s", common.MaskString(err.Error(), secrets_values))}
+	}
+	defer http_resp.Body.Close()
+
+	// Read response
+	body, err := io.ReadAll(http_resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if http_resp.StatusCode != http.StatusOK {
+		return nil, &ActionRequestError{
+			StatusCode: http_resp.StatusCode,
+			Message:    fmt.Sprintf("failed to call N8n webhook, status code: %s, response: %s", http_resp.Status, common.MaskString(string(body), secrets_values)),
 		}
-		http_client := &http.Client{
-			Timeout: time.Duration(timeout) * time.Second,
+	}
+
+	// the webhook response becomes the output of the action, falling back to
+	// the raw body when it isn't valid json
+	var http_result interface{}
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &http_result); err != nil {
+			http_result = string(body)
 		}
+	}
+
+	ws.AddLogsToWorkflowRunStep(
+		tenant_id,
+		workflow_id,
+		run_id,
+		step_index,
+		models.WorkflowRunLog{
+			Level:     "INFO",
+			Message:   "Successfully called N8n webhook, response: " + common.MaskString(fmt.Sprintf("%v", http_result), secrets_values),
+			TimeStamp: time.Now(),
+		},
+	)
 
-		// Send request
-		http_resp, err := http_client.Do(http_req)
+	return http_result, nil
+}
+
+// prepareN8nRequest builds the request of the n8n webhook action without sending it, the values
+// of the secret env vars are returned to be masked in logs and errors.
+func (ws *WorkflowsService) prepareN8nRequest(input interface{}, action models.WorkflowN8nWebhookAction, tenant_id string, dry_run bool) (http_req *http.Request, secrets_values []string, err error) {
+
+	tenant_svc := TenantService{
+		Config: ws.Config,
+		Logger: ws.Logger,
+	}
+
+	// Get the tenant from the database
+	tenant, err := tenant_svc.GetTenantById(tenant_id)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	env_vars, err := ws.DecryptEnvVars(tenant)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	vars_basket, secrets_values, err := BuildVarsBasket(env_vars, input)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	interpret := func(field string, plain string) (string, error) {
+		return renderActionTemplate(field, plain, vars_basket, secrets_values, action.MissingValues)
+	}
+
+	webhook_url_processed, err := interpret("webhook url", action.WebhookURL)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	jsonData, err := json.Marshal(input)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Create HTTP request
+	url := webhook_url_processed
+	http_req, err = http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, nil, fmt.Errorf("error creating request: %s", common.MaskString(err.Error(), secrets_values))
+	}
+
+	// Set headers
+	http_req.Header.Set("Content-Type", "application/json")
+	http_req.Header.Set("User-Agent", "Go-HTTP-Client")
+
+	for key, value := range action.Headers {
+		k, err := interpret("header name", key)
 		if err != nil {
-			fmt.Println("Error sending request: %s", common.MaskString(err.Error(), secrets_values))
-			return fmt.Errorf("Error sending request: %s", common.MaskString(err.Error(), secrets_values))
+			return nil, nil, err
 		}
-		defer http_resp.Body.Close()
-
-		// Read response
-		var http_result map[string]interface{}
-		json.NewDecoder(http_resp.Body).Decode(&http_result)
-
-		if http_resp.StatusCode == 200 {
-			ws.AddLogsToWorkflowRun(
-				models.WorkflowActionTypeN8nWebhookLabel,
-				tenant_id,
-				workflow_id,
-				run_id,
-				models.WorkflowRunLog{
-					Level:     "INFO",
-					Message:   "Successfully called N8n webhook, response: " + fmt.Sprintf("%v\n", http_result),
-					TimeStamp: time.Now(),
-				},
-			)
-		} else {
-			var responseBody map[string]interface{}
-			err = json.NewDecoder(http_resp.Body).Decode(&responseBody)
-			if err != nil && err.Error() != "EOF" {
-				return fmt.Errorf(fmt.Sprintf("Failed to call N8n webhook, status code: %s", http_resp.Status))
-			}
-			ws.FailWorkflow(tenant_id, workflow_id, run_id, fmt.Sprintf("Failed to call N8n webhook, status code: %s", http_resp.Status))
-			return fmt.Errorf(fmt.Sprintf("Failed to call N8n webhook, status code: %s, response: %v", http_resp.Status, responseBody))
+		v, err := interpret("header "+k, value)
+		if err != nil {
+			return nil, nil, err
 		}
+		http_req.Header.Set(k, v)
+	}
 
-		// POST request finished
-		// We need to use array filters to target the correct nested elements
-		update := bson.M{
-			"$set": bson.M{
-				"workflows.$[workflow].runs.$[run].end_time": time.Now(),
-				"workflows.$[workflow].runs.$[run].status":   "completed",
-			},
-		}
+	// signed last so the signature headers can't be overridden by the action headers
+	err = ws.signOutboundRequest(tenant, http_req, jsonData, dry_run)
+	if err != nil {
+		return nil, nil, fmt.Errorf("couldn't sign the request: %w", err)
+	}
 
-		arrayFilters := options.ArrayFilters{
-			Filters: []interface{}{
-				bson.M{"workflow.id": workflow_id},
-				bson.M{"run.id": run_id},
-			},
-		}
+	return http_req, secrets_values, nil
+}
 
-		opts := options.Update().SetArrayFilters(arrayFilters)
+// RunHttpRequestAction sends the request described by the action, the url, query params, headers and body
+// templates are interpreted against the tenant env vars and the flattened action input.
+// The captured response is returned as the output of the action.
+func (ws *WorkflowsService) RunHttpRequestAction(ctx context.Context, input interface{}, action models.WorkflowHttpRequestAction, tenant_id string, workflow_id string, run_id string, step_index int) (output interface{}, err error) {
 
-		// Execute the update
-		result, err := collection.UpdateOne(context.Background(), filter, update, opts)
-		if err != nil {
-			ws.Logger.Error(err.Error())
-			return err
-		}
+	ws.AddLogsToWorkflowRunStep(tenant_id, workflow_id, run_id, step_index, models.WorkflowRunLog{
+		Level:     "INFO",
+		Message:   fmt.Sprintf("Running HTTP request action (%s)...", action.Method),
+		TimeStamp: time.Now(),
+	})
 
-		if result.MatchedCount == 0 {
-			return mongo.ErrNoDocuments
-		}
+	http_req, secrets_values, err := ws.prepareHttpRequest(input, action, tenant_id, false)
+	if err != nil {
+		return nil, err
+	}
 
-		// Send a POST request to the webhook URL with the input
+	if http_req.Header.Get(WorkflowSignatureHeader) == "" {
+		ws.warnUnsignedRequest(tenant_id, workflow_id, run_id)
+	}
 
-		ws.AddLogsToWorkflowRun(
-			models.WorkflowActionTypeN8nWebhookLabel,
-			tenant_id,
-			workflow_id,
-			run_id,
-			models.WorkflowRunLog{
-				Level:     "INFO",
-				Message:   "Successfully finished running the workflow",
-				TimeStamp: time.Now(),
-			},
-		)
+	timeout := 10
+	if action.Timeout > 0 {
+		timeout = action.Timeout
+	}
+	http_client := &http.Client{
+		Timeout: time.Duration(timeout) * time.Second,
 	}
 
-	return nil
-}
+	http_resp, err := http_client.Do(http_req.WithContext(ctx))
+	if err != nil {
+		return nil, &ActionRequestError{Message: fmt.Sprintf("error sending request: %s", common.MaskString(err.Error(), secrets_values))}
+	}
+	defer http_resp.Body.Close()
 
-func (ws *WorkflowsService) ReplaceEnvVars(plain string, tenant_id string) (interpreted string, err error) {
+	response_body, err := io.ReadAll(http_resp.Body)
+	if err != nil {
+		return nil, err
+	}
 
-	re := regexp.MustCompile(`\{\{\s*(.*?)\s*\}\}`)
-	matches := re.FindAllStringSubmatch(plain, -1)
+	response := models.WorkflowHttpRequestActionOutput{
+		StatusCode: http_resp.StatusCode,
+		Headers:    make(map[string]string),
+	}
+
+	for key := range http_resp.Header {
+		response.Headers[key] = http_resp.Header.Get(key)
+	}
 
-	var env_var_names []string
-	for _, match := range matches {
-		if len(match) > 1 {
-			env_var_names = append(env_var_names, match[1])
+	if len(response_body) > 0 {
+		var json_body interface{}
+		if err := json.Unmarshal(response_body, &json_body); err == nil {
+			response.Body = json_body
+		} else {
+			response.Body = string(response_body)
 		}
 	}
 
-	clientOptions := options.Client().ApplyURI(fmt.Sprintf("mongodb://%s:%v", ws.Config.Databases[0].Host, ws.Config.Databases[0].Port))
+	if http_resp.StatusCode < 200 || http_resp.StatusCode > 299 {
+		return nil, &ActionRequestError{
+			StatusCode: http_resp.StatusCode,
+			Message:    fmt.Sprintf("HTTP request failed, status code: %s, response: %s", http_resp.Status, common.MaskString(string(response_body), secrets_values)),
+		}
+	}
 
-	db_connection_deadline := 5 * time.Second
-	if ws.Config.Env == "dev" {
-		db_connection_deadline = 1000 * time.Second
+	ws.AddLogsToWorkflowRunStep(tenant_id, workflow_id, run_id, step_index, models.WorkflowRunLog{
+		Level:     "INFO",
+		Message:   fmt.Sprintf("HTTP request succeeded, status code: %s", http_resp.Status),
+		TimeStamp: time.Now(),
+	})
+
+	return response, nil
+}
+
+// prepareHttpRequest builds the request of the http request action without sending it, the url, query params,
+// headers and body templates are interpreted against the tenant env vars and the flattened action input.
+// The values of the secrets are returned to be masked in logs and errors.
+func (ws *WorkflowsService) prepareHttpRequest(input interface{}, action models.WorkflowHttpRequestAction, tenant_id string, dry_run bool) (http_req *http.Request, secrets_values []string, err error) {
+
+	tenant_svc := TenantService{
+		Config: ws.Config,
+		Logger: ws.Logger,
 	}
 
-	// Create a context with a timeout (optional)
-	ctx, cancel := context.WithTimeout(context.Background(), db_connection_deadline)
-	defer cancel()
+	tenant, err := tenant_svc.GetTenantById(tenant_id)
+	if err != nil {
+		return nil, nil, err
+	}
 
-	// Connect to MongoDB
-	client, err := mongo.Connect(ctx, clientOptions)
+	env_vars, err := ws.DecryptEnvVars(tenant)
 	if err != nil {
-		return interpreted, err
+		return nil, nil, err
 	}
 
-	// Ping the database to check connectivity
-	err = client.Ping(ctx, nil)
+	vars_basket, secrets_values, err := BuildVarsBasket(env_vars, input)
 	if err != nil {
-		return interpreted, err
+		return nil, nil, err
 	}
 
-	// Connected successfully
+	interpret := func(field string, plain string) (string, error) {
+		return renderActionTemplate(field, plain, vars_basket, secrets_values, action.MissingValues)
+	}
 
-	collection := client.Database(ws.Config.Databases[0].Database).Collection(ws.Config.Databases[0].Tables["sales"])
+	request_url, err := interpret("url", action.URL)
+	if err != nil {
+		return nil, nil, err
+	}
 
-	filter := bson.M{
-		"tenant_id": tenant_id,
+	parsed_url, err := url.Parse(request_url)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid url: %s", common.MaskString(err.Error(), secrets_values))
 	}
 
-	env_var_values := make([]string, 0)
+	query := parsed_url.Query()
+	for key, value := range action.QueryParams {
+		v, err := interpret("query param "+key, value)
+		if err != nil {
+			return nil, nil, err
+		}
+		query.Set(key, v)
+	}
+	parsed_url.RawQuery = query.Encode()
 
-	// Get the tenant from the database
-	var tenant models.Tenant
-	err = collection.FindOne(ctx, filter).Decode(&tenant)
-	if err != nil {
-		return interpreted, err
+	method := strings.ToUpper(action.Method)
+	if method == "" {
+		method = http.MethodPost
 	}
 
-	for _, name := range env_var_names {
+	var body io.Reader
+	var body_bytes []byte
+	if action.Body != "" {
+		interpreted_body, err := interpret("body", action.Body)
+		if err != nil {
+			return nil, nil, err
+		}
+		body_bytes = []byte(interpreted_body)
+		body = bytes.NewReader(body_bytes)
+	} else if method != http.MethodGet && method != http.MethodHead {
+		body_bytes, err = json.Marshal(input)
+		if err != nil {
+			return nil, nil, err
+		}
+		body = bytes.NewReader(body_bytes)
+	}
 
-		found := false
+	http_req, err = http.NewRequest(method, parsed_url.String(), body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error creating request: %s", common.MaskString(err.Error(), secrets_values))
+	}
 
-		for _, env_var := range tenant.EnvVars {
+	http_req.Header.Set("Content-Type", "application/json")
+	http_req.Header.Set("User-Agent", "Go-HTTP-Client")
 
-			if env_var.Name == name {
-				env_var_values = append(env_var_values, env_var.Value)
-				found = true
-				break
-			}
+	for key, value := range action.Headers {
+		k, err := interpret("header name", key)
+		if err != nil {
+			return nil, nil, err
+		}
+		v, err := interpret("header "+k, value)
+		if err != nil {
+			return nil, nil, err
 		}
+		http_req.Header.Set(k, v)
+	}
 
-		if !found {
-			return interpreted, fmt.Errorf("environment variable %s not found for tenant %s", name, tenant_id)
+	switch action.Auth.Type {
+	case models.HttpRequestAuthTypeBasic:
+		username, err := interpret("auth username", action.Auth.Username)
+		if err != nil {
+			return nil, nil, err
+		}
+		password, err := interpret("auth password", action.Auth.Password)
+		if err != nil {
+			return nil, nil, err
+		}
+		secrets_values = append(secrets_values, password)
+		http_req.SetBasicAuth(username, password)
+	case models.HttpRequestAuthTypeBearer:
+		token, err := interpret("auth token", action.Auth.Token)
+		if err != nil {
+			return nil, nil, err
 		}
+		secrets_values = append(secrets_values, token)
+		http_req.Header.Set("Authorization", "Bearer "+token)
 	}
 
-	interpreted = plain
-	for _, value := range env_var_values {
+	err = ws.signOutboundRequest(tenant, http_req, body_bytes, dry_run)
+	if err != nil {
+		return nil, nil, fmt.Errorf("couldn't sign the request: %w", err)
+	}
 
-		re := regexp.MustCompile(`\{\{\s*(.*?)\s*\}\}`)
+	return http_req, secrets_values, nil
+}
 
-		// Find the first match and its submatch
-		loc := re.FindStringSubmatchIndex(interpreted)
+// BuildVarsBasket builds the data action templates are rendered against, it contains the tenant env vars
+// by name and under "env", and the action input under "input" (e.g. {{ input.items.0.item_name }}).
+// The values of the secret env vars are returned to be masked in logs and errors.
+func BuildVarsBasket(env_vars []models.WorkflowEnvVar, input interface{}) (vars_basket map[string]interface{}, secrets_values []string, err error) {
 
-		if loc == nil {
-			break
+	vars_basket = make(map[string]interface{})
+	secrets_values = make([]string, 0)
+	env := make(map[string]interface{})
+
+	for _, env_var := range env_vars {
+		vars_basket[env_var.Name] = env_var.Value
+		env[env_var.Name] = env_var.Value
+		if env_var.IsSecret && env_var.Value != "" {
+			secrets_values = append(secrets_values, env_var.Value)
 		}
+	}
+
+	generic_input, err := toJSONValue(input)
+	if err != nil {
+		return vars_basket, secrets_values, err
+	}
 
-		// loc[0], loc[1] = start/end of full match
-		// loc[2], loc[3] = start/end of first submatch (content inside {{}})
+	vars_basket["env"] = env
+	vars_basket["input"] = generic_input
 
-		start, end := loc[0], loc[1]
-		interpreted = interpreted[:start] + value + interpreted[end:]
+	return vars_basket, secrets_values, nil
+}
+
+// renderActionTemplate renders a template field of an action, missing_values is the action
+// missing values mode. The secrets are masked in the returned error.
+func renderActionTemplate(field string, plain string, vars_basket map[string]interface{}, secrets_values []string, missing_values string) (string, error) {
+
+	interpreted, err := common.RenderTemplate(plain, vars_basket, missing_values != models.TemplateMissingValuesLenient)
+	if err != nil {
+		return "", fmt.Errorf("couldn't interpret %s: %s", field, common.MaskString(err.Error(), secrets_values))
 	}
 
 	return interpreted, nil
 }
 
-func (ws *WorkflowsService) FailWorkflow(tenant_id string, workflow_id string, run_id string, message string) (err error) {
+// renderActionHTMLTemplate renders an html template of an action like renderActionTemplate, the values it
+// outputs are html escaped unless piped through raw.
+func renderActionHTMLTemplate(field string, plain string, vars_basket map[string]interface{}, secrets_values []string, missing_values string) (string, error) {
 
-	clientOptions := options.Client().ApplyURI(fmt.Sprintf("mongodb://%s:%v", ws.Config.Databases[0].Host, ws.Config.Databases[0].Port))
+	interpreted, err := common.RenderHTMLTemplate(plain, vars_basket, missing_values != models.TemplateMissingValuesLenient)
+	if err != nil {
+		return "", fmt.Errorf("couldn't interpret %s: %s", field, common.MaskString(err.Error(), secrets_values))
+	}
 
-	db_connection_deadline := 5 * time.Second
-	if ws.Config.Env == "dev" {
-		db_connection_deadline = 1000 * time.Second
+	return interpreted, nil
+}
+
+// ReplaceEnvVars renders the template against the tenant env vars, a missing env var is an error.
+func (ws *WorkflowsService) ReplaceEnvVars(plain string, tenant_id string) (interpreted string, err error) {
+
+	tenant_svc := TenantService{
+		Config: ws.Config,
+		Logger: ws.Logger,
 	}
 
-	// Create a context with a timeout (optional)
-	ctx, cancel := context.WithTimeout(context.Background(), db_connection_deadline)
-	defer cancel()
+	tenant, err := tenant_svc.GetTenantById(tenant_id)
+	if err != nil {
+		return interpreted, err
+	}
 
-	// Connect to MongoDB
-	client, err := mongo.Connect(ctx, clientOptions)
+	env_vars, err := ws.DecryptEnvVars(tenant)
 	if err != nil {
-		return err
+		return interpreted, err
 	}
 
-	// Ping the database to check connectivity
-	err = client.Ping(ctx, nil)
+	vars_basket, _, err := BuildVarsBasket(env_vars, nil)
 	if err != nil {
-		return err
+		return interpreted, err
 	}
 
-	// Connected successfully
+	return common.RenderTemplate(plain, vars_basket, true)
+}
 
-	collection := client.Database(ws.Config.Databases[0].Database).Collection(ws.Config.Databases[0].Tables["sales"])
+// CompleteWorkflow marks the run as completed, output is the output of the last action of the run.
+func (ws *WorkflowsService) CompleteWorkflow(tenant_id string, workflow_id string, run_id string, output interface{}) (err error) {
 
 	ws.AddLogsToWorkflowRun(
-		models.WorkflowActionTypeN8nWebhookLabel,
+		"",
 		tenant_id,
 		workflow_id,
 		run_id,
 		models.WorkflowRunLog{
-			Level:     "ERROR",
-			Message:   message,
+			Level:     "INFO",
+			Message:   "Successfully finished running the workflow",
 			TimeStamp: time.Now(),
 		},
 	)
 
-	filter := bson.M{
-		"tenant_id":         tenant_id,
-		"workflows.id":      workflow_id,
-		"workflows.runs.id": run_id,
-	}
+	return ws.FinishWorkflowRun(tenant_id, workflow_id, run_id, models.WorkflowRunStatusCompleted, output)
+}
 
-	// Create the update to push log to the specific run
-	// We need to use array filters to target the correct nested elements
-	update := bson.M{
-		"$set": bson.M{
-			"workflows.$[workflow].runs.$[run].end_time": time.Now(),
-			"workflows.$[workflow].runs.$[run].status":   "failed",
-		},
-	}
+func (ws *WorkflowsService) FailWorkflow(tenant_id string, workflow_id string, run_id string, message string) (err error) {
 
-	arrayFilters := options.ArrayFilters{
-		Filters: []interface{}{
-			bson.M{"workflow.id": workflow_id},
-			bson.M{"run.id": run_id},
+	ws.AddLogsToWorkflowRun(
+		"",
+		tenant_id,
+		workflow_id,
+		run_id,
+		models.WorkflowRunLog{
+			Level:     "ERROR",
+			Message:   message,
+			TimeStamp: time.Now(),
 		},
-	}
-
-	opts := options.Update().SetArrayFilters(arrayFilters)
-
-	// Execute the update
-	result, err := collection.UpdateOne(context.Background(), filter, update, opts)
-	if err != nil {
-		ws.Logger.Error(err.Error())
-		return err
-	}
-
-	if result.MatchedCount == 0 {
-		return mongo.ErrNoDocuments
-	}
+	)
 
-	return nil
+	return ws.FinishWorkflowRun(tenant_id, workflow_id, run_id, models.WorkflowRunStatusFailed, nil)
 }
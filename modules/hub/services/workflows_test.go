@@ -0,0 +1,97 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/nutrixpos/hub/modules/hub/models"
+)
+
+func TestNextWorkflowRunStepIndex(t *testing.T) {
+
+	top_level := func(types ...string) []models.WorkflowRunStep {
+		steps := make([]models.WorkflowRunStep, 0, len(types))
+		for index, action_type := range types {
+			steps = append(steps, models.WorkflowRunStep{Index: index, Type: action_type})
+		}
+		return steps
+	}
+
+	branch := func(index int) models.WorkflowRunStep {
+		return models.WorkflowRunStep{Index: index, Type: models.WorkflowActionTypeHttpRequestLabel}
+	}
+
+	condition := models.WorkflowActionTypeConditionLabel
+	approval := models.WorkflowActionTypeWaitForApprovalLabel
+	delay := models.WorkflowActionTypeDelayLabel
+
+	tests := []struct {
+		name          string
+		steps         []models.WorkflowRunStep
+		actions_count int
+		expected      int
+	}{
+		{
+			name:          "new run",
+			steps:         top_level(condition, approval, condition),
+			actions_count: 3,
+			expected:      3,
+		},
+		{
+			name:          "approval after a condition branch",
+			steps:         append(top_level(condition, approval, condition), branch(3), branch(4)),
+			actions_count: 3,
+			expected:      5,
+		},
+		{
+			name:          "second approval after the branch run on the first resume",
+			steps:         append(top_level(condition, approval, condition, approval, condition), branch(5), branch(6), branch(7)),
+			actions_count: 5,
+			expected:      8,
+		},
+		{
+			name:          "delay after a condition branch",
+			steps:         append(top_level(condition, delay, condition), branch(3), branch(4)),
+			actions_count: 3,
+			expected:      5,
+		},
+		{
+			name:          "delay after the branch run on an approval resume",
+			steps:         append(top_level(condition, approval, condition, delay, condition), branch(5), branch(6), branch(7)),
+			actions_count: 5,
+			expected:      8,
+		},
+		{
+			name:          "steps out of order",
+			steps:         append(top_level(condition, approval), branch(4), branch(2), branch(3)),
+			actions_count: 2,
+			expected:      5,
+		},
+		{
+			name:          "no steps stored",
+			steps:         nil,
+			actions_count: 4,
+			expected:      4,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			next := nextWorkflowRunStepIndex(test.steps, test.actions_count)
+			if next != test.expected {
+				t.Fatalf("expected %d, got %d", test.expected, next)
+			}
+
+			// the branch run after resuming gets indexes no step holds yet
+			used := make(map[int]bool)
+			for _, step := range test.steps {
+				used[step.Index] = true
+			}
+			for index := next; index < next+3; index++ {
+				if used[index] {
+					t.Errorf("index %d of a new branch step is already used", index)
+				}
+			}
+		})
+	}
+}
@@ -6,6 +6,7 @@ package modules
 import (
 	"github.com/gorilla/mux"
 	"github.com/nutrixpos/hub/common"
+	"github.com/nutrixpos/hub/common/workflows"
 )
 
 // saved_module_builders is a map of module builders that have been saved.
@@ -55,3 +56,9 @@ type ISeederModule interface {
 	Seed(entities []string, is_new_only bool) error
 	GetSeedables() (entities []string, err error)
 }
+
+// IWorkflowTypesModule is an interface that modules can implement to contribute workflow trigger and action types.
+// RegisterWorkflowTypes is called by the app manager before any module is started.
+type IWorkflowTypesModule interface {
+	RegisterWorkflowTypes(registry *workflows.TypesRegistry) error
+}